@@ -0,0 +1,216 @@
+;;; compile-test.el --- unit tests for compile.el  -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Unit tests for compile.el.
+
+;;; Code:
+
+(require 'elisp/compile)
+
+(require 'cl-lib)
+(require 'ert)
+(require 'json)
+
+(defun elisp/compile-test--compile (contents)
+  "Write CONTENTS to a temporary Emacs Lisp file and byte-compile it.
+Return non-nil if compilation succeeded."
+  (let* ((dir (make-temp-file "compile-test-" :dir-flag))
+         (src (expand-file-name "warning.el" dir))
+         (out (expand-file-name "warning.elc" dir)))
+    (unwind-protect
+        (progn
+          (with-temp-file src
+            (insert contents))
+          (and (elisp/compile--file src out)
+               (file-exists-p out)))
+      (delete-directory dir :recursive))))
+
+(defconst elisp/compile-test--obsolete
+  ";;; warning.el --- test file  -*- lexical-binding: t; -*-
+\(eval-and-compile
+  (defun elisp/compile-test--old () nil)
+  (make-obsolete 'elisp/compile-test--old nil \"1.0\"))
+\(defun elisp/compile-test--new () (elisp/compile-test--old))
+"
+  "Contents of an Emacs Lisp file that generates an obsolescence warning.")
+
+(ert-deftest elisp/compile/warnings ()
+  (let ((elisp/fatal--warnings nil)
+        (elisp/allowed--warnings ()))
+    (should (elisp/compile-test--compile elisp/compile-test--obsolete))))
+
+(ert-deftest elisp/compile/fatal-warnings ()
+  (let ((elisp/fatal--warnings t)
+        (elisp/allowed--warnings ()))
+    (should-not (elisp/compile-test--compile elisp/compile-test--obsolete))))
+
+(ert-deftest elisp/compile/allowed-warnings ()
+  (let ((elisp/fatal--warnings t)
+        (elisp/allowed--warnings '(obsolete)))
+    (should (elisp/compile-test--compile elisp/compile-test--obsolete))))
+
+(ert-deftest elisp/compile/warnings-file ()
+  (let* ((elisp/fatal--warnings nil)
+         (elisp/allowed--warnings ())
+         (file (make-temp-file "warnings-" nil ".json"))
+         (process-environment (cons (concat "TEST_WARNINGS_OUTPUT_FILE=" file)
+                                    process-environment)))
+    (unwind-protect
+        (progn
+          (should (elisp/compile-test--compile elisp/compile-test--obsolete))
+          (let ((records (with-temp-buffer
+                           (insert-file-contents file)
+                           (cl-loop until (eobp)
+                                    collect (json-read)
+                                    do (forward-line)))))
+            (should (eql (length records) 1))
+            (let ((record (car records)))
+              (should (string-suffix-p "warning.el"
+                                       (alist-get 'file record)))
+              ;; The obsolete function is called in the last line.
+              (should (eql (alist-get 'line record) 5))
+              (should (equal (alist-get 'category record) "bytecomp"))
+              (should (string-match-p (rx "obsolete")
+                                      (alist-get 'message record))))))
+      (delete-file file))))
+
+(ert-deftest elisp/compile/require-lexical-binding ()
+  (let ((elisp/fatal--warnings t)
+        (elisp/allowed--warnings ())
+        (elisp/require--lexical-binding t))
+    (should (elisp/compile-test--compile
+             ";;; lexical.el --- test file  -*- lexical-binding: t; -*-\n"))
+    (should-not (elisp/compile-test--compile
+                 ";;; dynamic.el --- test file\n"))))
+
+(ert-deftest elisp/compile/check-lexical-binding ()
+  (let ((file (make-temp-file "dynamic-" nil ".el" ";;; dynamic.el\n")))
+    (unwind-protect
+        (let ((message (elisp/compile--check-lexical-binding file)))
+          (should (stringp message))
+          ;; The message should name the offending file and line.
+          (should (string-prefix-p (concat file ":1: ") message))
+          (should (string-match-p (rx "lexical-binding") message)))
+      (delete-file file))))
+
+;; ‘elisp/compile-test--compile’ writes the source to warning.el.
+(ert-deftest elisp/compile/check-declared-features ()
+  (let ((elisp/fatal--warnings t)
+        (elisp/allowed--warnings ())
+        (elisp/check--declared-features t))
+    (should (elisp/compile-test--compile
+             ";;; warning.el --- test file  -*- lexical-binding: t; -*-
+\(provide 'warning)
+"))
+    (should-not (elisp/compile-test--compile
+                 ";;; warning.el --- test file  -*- lexical-binding: t; -*-
+\(provide 'other)
+"))))
+
+(ert-deftest elisp/compile/check-declared-features-message ()
+  (let ((dir (make-temp-file "compile-test-" :dir-flag)))
+    (unwind-protect
+        (let ((file (expand-file-name "foo/bar.el" dir)))
+          (make-directory (file-name-directory file))
+          (write-region ";;; bar.el
+;; (provide 'commented)
+\(provide 'bar)
+\(provide 'foo/bar)
+\(provide 'baz)
+" nil file)
+          (let ((message (elisp/compile--check-declared-features file)))
+            (should (stringp message))
+            ;; The message should name the offending file, line, and feature.
+            (should (string-prefix-p (concat file ":5: ") message))
+            (should (string-match-p (rx "‘baz’") message))
+            (should (string-match-p (rx "expected ‘bar’") message))))
+      (delete-directory dir :recursive))))
+
+(ert-deftest elisp/compile/deterministic ()
+  (let ((elisp/fatal--warnings t)
+        (elisp/allowed--warnings ())
+        (dir (make-temp-file "compile-test-" :dir-flag)))
+    (unwind-protect
+        (let ((src (expand-file-name "deterministic.el" dir))
+              (outputs ()))
+          (with-temp-file src
+            ;; The macro generates a fresh uninterned symbol that ends up in
+            ;; the compiled output.
+            (insert ";;; deterministic.el --- test  -*- lexical-binding: t; -*-
+\(defmacro elisp/compile-test--symbol () `',(gensym))
+\(defun elisp/compile-test--function () (elisp/compile-test--symbol))
+"))
+          (dolist (name '("first.elc" "second.elc"))
+            (let ((out (expand-file-name name dir)))
+              (should (elisp/compile--file src out))
+              (with-temp-buffer
+                (set-buffer-multibyte nil)
+                (insert-file-contents-literally out)
+                (push (buffer-string) outputs))))
+          (should (equal (car outputs) (cadr outputs))))
+      (delete-directory dir :recursive))))
+
+(ert-deftest elisp/compile/cache ()
+  (let* ((elisp/fatal--warnings t)
+         (elisp/allowed--warnings ())
+         (dir (make-temp-file "compile-test-" :dir-flag))
+         (elisp/cache--directory (expand-file-name "cache" dir))
+         (src (expand-file-name "cached.el" dir))
+         (unrelated (expand-file-name "unrelated.el" dir))
+         ;; Bazel sets this variable for tests, but the cache isn’t used when
+         ;; recording warnings.
+         (process-environment (cons "TEST_WARNINGS_OUTPUT_FILE"
+                                    process-environment))
+         (compilations 0))
+    (cl-flet ((compile-to (name)
+                          (let ((out (expand-file-name name dir)))
+                            (should (elisp/compile--file src out))
+                            (with-temp-buffer
+                              (set-buffer-multibyte nil)
+                              (insert-file-contents-literally out)
+                              (buffer-string))))
+              (count-compilation (&rest _) (cl-incf compilations)))
+      (advice-add #'byte-compile-file :before #'count-compilation)
+      (unwind-protect
+          (progn
+            (write-region ";;; cached.el --- test  -*- lexical-binding: t; -*-
+\(defun elisp/compile-test--cached () 1)
+" nil src)
+            (write-region ";;; unrelated.el\n" nil unrelated)
+            (let ((first (compile-to "first.elc")))
+              (should (eql compilations 1))
+              (should (eql (length (directory-files elisp/cache--directory
+                                                    nil (rx ".elc" eos)))
+                           1))
+              ;; Touching a file that the source doesn’t require shouldn’t
+              ;; invalidate the cache.
+              (set-file-times unrelated)
+              (write-region ";;; unrelated.el\n;; changed\n" nil unrelated)
+              (should (equal (compile-to "second.elc") first))
+              (should (eql compilations 1)))
+            ;; Changing the source file should.
+            (write-region ";;; cached.el --- test  -*- lexical-binding: t; -*-
+\(defun elisp/compile-test--cached () 2)
+" nil src)
+            (compile-to "third.elc")
+            (should (eql compilations 2)))
+        (advice-remove #'byte-compile-file #'count-compilation)
+        (delete-directory dir :recursive)))))
+
+;;; compile-test.el ends here
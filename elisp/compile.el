@@ -20,29 +20,103 @@
 ;;
 ;; Usage:
 ;;
-;;   emacs --quick --batch --load=compile.el SOURCE DEST
+;;   emacs --quick --batch --load=compile.el [--fatal-warnings]
+;;       [--allow-warning CATEGORY]... [--require-lexical-binding]
+;;       [--check-declared-features] [--native-compile DIR]
+;;       [--cache-directory DIR] SOURCE DEST
 ;;
 ;; Compiles the Emacs Lisp file SOURCE and stores the compiled output in the
-;; file DEST.  Exits with a zero status only if compilation succeeds.
+;; file DEST.  If --fatal-warnings is given, treat byte-compile warnings as
+;; errors.  Each --allow-warning option disables the byte-compile warnings of
+;; the given CATEGORY, see ‘byte-compile-warnings’.  If
+;; --require-lexical-binding is given, fail if the first line of SOURCE doesn’t
+;; enable ‘lexical-binding’.  If --check-declared-features is given, fail if
+;; SOURCE provides a feature that doesn’t match its filename.  If
+;; --native-compile is given, also compile SOURCE to native code and store the
+;; result in the directory DIR, using the same layout as
+;; ‘native-comp-eln-load-path’.  If --cache-directory is given, reuse a
+;; compiled file from DIR if SOURCE, the libraries it requires, and the
+;; compilation options haven’t changed, and store newly compiled files there.
+;; Exits with a zero status only if compilation succeeds.
+;;
+;; If the environment variable TEST_WARNINGS_OUTPUT_FILE is set, also append
+;; each byte-compile warning to the named file as a line containing a JSON
+;; object with the fields ‘file’, ‘line’, ‘category’, and ‘message’.
 
 ;;; Code:
 
 (require 'bytecomp)
+(require 'cl-lib)
+(require 'json)
 
 (add-to-list 'command-switch-alist
              (cons "--fatal-warnings" #'elisp/fatal-warnings))
 
+(add-to-list 'command-switch-alist
+             (cons "--allow-warning" #'elisp/allow-warning))
+
+(add-to-list 'command-switch-alist
+             (cons "--require-lexical-binding"
+                   #'elisp/require-lexical-binding))
+
+(add-to-list 'command-switch-alist
+             (cons "--check-declared-features"
+                   #'elisp/check-declared-features))
+
+(add-to-list 'command-switch-alist
+             (cons "--native-compile" #'elisp/native-compile))
+
+(add-to-list 'command-switch-alist
+             (cons "--cache-directory" #'elisp/cache-directory))
+
 (defvar elisp/fatal--warnings nil
   "Whether byte-compile warnings should be treated as errors.
 The --fatal-warnings option sets this variable.")
 
+(defvar elisp/allowed--warnings ()
+  "List of byte-compile warning categories to disable.
+Each element is a symbol from ‘byte-compile-warning-types’.  The
+--allow-warning option adds elements to this list.")
+
+(defvar elisp/require--lexical-binding nil
+  "Whether source files must enable ‘lexical-binding’.
+The --require-lexical-binding option sets this variable.")
+
+(defvar elisp/check--declared-features nil
+  "Whether source files must provide features that match their names.
+The --check-declared-features option sets this variable.")
+
+(defvar elisp/native--output nil
+  "Output directory for the natively-compiled file, or nil.
+The --native-compile option sets this variable.")
+
+(defvar elisp/cache--directory nil
+  "Directory containing previously compiled files, or nil.
+The --cache-directory option sets this variable.")
+
+(defvar cl--gensym-counter)
+
+(declare-function native-compile "comp" (function-or-file &optional output))
+(declare-function comp-el-to-eln-filename "comp.c"
+                  (filename &optional base-dir))
+
 (defun elisp/compile-batch-and-exit ()
   "Byte-compiles a single Emacs Lisp file and exits Emacs.
 There must be exactly two remaining arguments on the command
 line.  These are interpreted as source and output file,
 respectively.  If compilation fails, exit with a nonzero exit
 code.  If the command line option --fatal-warnings is given,
-treat warnings as errors."
+treat warnings as errors.  The command line option
+--allow-warning disables the warnings of a single category.  If
+the command line option --require-lexical-binding is given, fail
+unless the source file enables ‘lexical-binding’.  If the command
+line option --check-declared-features is given, fail if the
+source file provides a feature that doesn’t match its name.  If
+the command line option --native-compile is given, also compile
+the source file to native code.  If the command line option
+--cache-directory is given, reuse compiled files from that
+directory.  If the environment variable TEST_WARNINGS_OUTPUT_FILE
+is set, append the warnings to that file."
   (unless noninteractive
     (error "This function works only in batch mode"))
   (let* ((src (pop command-line-args-left))
@@ -50,7 +124,33 @@ treat warnings as errors."
          ;; Leaving these enabled leads to undefined behavior and doesn’t make
          ;; sense in batch mode.
          (attempt-stack-overflow-recovery nil)
-         (attempt-orderly-shutdown-on-fatal-signal nil)
+         (attempt-orderly-shutdown-on-fatal-signal nil))
+    (kill-emacs (if (elisp/compile--file src out) 0 1))))
+
+(defun elisp/compile--file (src out)
+  "Byte-compile the Emacs Lisp file SRC and write the result to OUT.
+Return non-nil if compilation succeeded.  Treat warnings as
+errors if ‘elisp/fatal--warnings’ is non-nil, but disable the
+warning categories in ‘elisp/allowed--warnings’.  If
+‘elisp/require--lexical-binding’ is non-nil, fail before
+compilation unless SRC enables ‘lexical-binding’.  If
+‘elisp/check--declared-features’ is non-nil, fail before
+compilation if SRC provides a feature that doesn’t match its
+name.  If ‘elisp/native--output’ is non-nil, also compile SRC to
+native code and write the result to that directory.  If
+‘elisp/cache--directory’ is non-nil, copy the compiled file from
+there instead of compiling SRC if possible, see
+‘elisp/compile--cache-key’.  If the environment variable
+TEST_WARNINGS_OUTPUT_FILE is set, append the byte-compile
+warnings to that file, see ‘elisp/compile--write-warnings’."
+  (cl-check-type src string)
+  (cl-check-type out string)
+  (let* ((warnings-file (getenv "TEST_WARNINGS_OUTPUT_FILE"))
+         ;; The byte compiler appends its warnings to the log buffer, so
+         ;; remember where the warnings of this file start.
+         (log-start (with-current-buffer
+                        (get-buffer-create byte-compile-log-buffer)
+                      (point-max)))
          ;; Ensure filenames in the output are relative to the current
          ;; directory.
          (byte-compile-root-dir default-directory)
@@ -58,14 +158,234 @@ treat warnings as errors."
          (temp (make-temp-file "compile-" nil ".elc"))
          (byte-compile-dest-file-function (lambda (_) temp))
          (byte-compile-error-on-warn elisp/fatal--warnings)
-         (success (byte-compile-file src)))
-    (when success (copy-file temp out :overwrite))
+         (byte-compile-warnings (if elisp/allowed--warnings
+                                    (cons 'not elisp/allowed--warnings)
+                                  t))
+         ;; Make the names of uninterned symbols generated by macros
+         ;; deterministic, so that the compiled output only depends on the
+         ;; source file.  This is important for remote caching.
+         (gensym-counter 0)
+         (cl--gensym-counter 0)
+         (problem (or (and elisp/require--lexical-binding
+                           (elisp/compile--check-lexical-binding src))
+                      (and elisp/check--declared-features
+                           (elisp/compile--check-declared-features src))))
+         ;; The cache only contains byte-compiled files, and reusing them
+         ;; wouldn’t reproduce the warnings.
+         (cached (and (not problem) elisp/cache--directory
+                      (not elisp/native--output)
+                      (member warnings-file '(nil ""))
+                      (expand-file-name
+                       (concat (elisp/compile--cache-key src) ".elc")
+                       elisp/cache--directory)))
+         (hit (and cached (file-readable-p cached)))
+         (success (and (not problem)
+                       (or hit (byte-compile-file src)))))
+    (when problem (message "%s" problem))
+    (unless (member warnings-file '(nil ""))
+      (elisp/compile--write-warnings warnings-file log-start))
+    (cond (hit
+           (message "Reusing cached compiled file %s" cached)
+           (copy-file cached out :overwrite))
+          (success
+           (copy-file temp out :overwrite)
+           (when cached (elisp/compile--store temp cached))))
     (delete-file temp)
-    (kill-emacs (if success 0 1))))
+    (when (and success elisp/native--output)
+      ;; Emacs looks up natively-compiled files in the directories of
+      ;; ‘native-comp-eln-load-path’ by a hash of the source file, so put the
+      ;; file where Emacs will find it when loading the byte-compiled file.
+      ;; Same as above, write to a temporary file first.
+      (let ((temp (make-temp-file "compile-" nil ".eln"))
+            (eln (comp-el-to-eln-filename src elisp/native--output)))
+        (setq success (native-compile src temp))
+        (when success
+          (make-directory (file-name-directory eln) :parents)
+          (copy-file temp eln :overwrite))
+        (delete-file temp)))
+    success))
+
+(defun elisp/compile--cache-key (src)
+  "Return a cache key for compiling the Emacs Lisp file SRC.
+The key is a SHA-256 hash of the Emacs version, the compilation
+options, the contents of SRC, and the names and contents of the
+libraries that SRC requires at top level, as found in
+‘load-path’.  Compiling SRC should produce the same output as
+long as the key doesn’t change."
+  (cl-check-type src string)
+  (cl-flet ((file-hash (file)
+                       (with-temp-buffer
+                         (set-buffer-multibyte nil)
+                         (insert-file-contents-literally file)
+                         (secure-hash 'sha256 (current-buffer)))))
+    (secure-hash
+     'sha256
+     (prin1-to-string
+      (list emacs-version system-configuration
+            elisp/fatal--warnings (sort (mapcar #'symbol-name
+                                                elisp/allowed--warnings)
+                                        #'string-lessp)
+            (file-hash src)
+            (cl-loop for feature in (elisp/compile--required-features src)
+                     for file = (locate-file (symbol-name feature) load-path
+                                             (get-load-suffixes))
+                     collect (list feature (and file (file-hash file)))))))))
+
+(defun elisp/compile--required-features (src)
+  "Return the features that the Emacs Lisp file SRC requires at top level.
+Consider ‘require’ forms at top level and within top-level
+‘eval-when-compile’ and ‘eval-and-compile’ forms.  Return a
+sorted list of feature symbols without duplicates."
+  (cl-check-type src string)
+  (let ((features ()))
+    (cl-labels ((walk (form)
+                      (pcase form
+                        (`(require (quote ,(and (pred symbolp) feature)) . ,_)
+                         (cl-pushnew feature features))
+                        (`(,(or 'eval-when-compile 'eval-and-compile 'progn)
+                           . ,body)
+                         (mapc #'walk body)))))
+      (with-temp-buffer
+        (insert-file-contents src)
+        (with-syntax-table emacs-lisp-mode-syntax-table
+          (cl-loop
+           ;; Leave reporting syntax errors to the byte compiler.
+           for form = (condition-case nil
+                          (read (current-buffer))
+                        ((end-of-file invalid-read-syntax) (cl-return)))
+           do (walk form)))))
+    (sort features #'string-lessp)))
+
+(defun elisp/compile--store (file cached)
+  "Copy the compiled FILE to the cache file CACHED.
+Write a temporary file first and rename it, so that parallel
+compilation actions never see a partially written file.  Only
+log errors, since the cache is an optimization."
+  (cl-check-type file string)
+  (cl-check-type cached string)
+  (condition-case err
+      (let ((directory (file-name-directory cached)))
+        (make-directory directory :parents)
+        (let ((temp (make-temp-file (expand-file-name "cache-" directory)
+                                    nil ".elc")))
+          (copy-file file temp :overwrite)
+          (rename-file temp cached :overwrite)))
+    (file-error
+     (message "Can’t store compiled file in cache: %s"
+              (error-message-string err)))))
+
+(defun elisp/compile--check-lexical-binding (src)
+  "Check that the Emacs Lisp file SRC enables ‘lexical-binding’.
+Return nil if the first line of SRC sets ‘lexical-binding’ to a
+non-nil value.  Otherwise, return an error message that names
+the file and line."
+  (cl-check-type src string)
+  (with-temp-buffer
+    (insert-file-contents src)
+    (unless (cdr (assq 'lexical-binding (hack-local-variables-prop-line)))
+      (format-message
+       "%s:1: error: first line doesn’t set ‘lexical-binding’ to t"
+       src))))
+
+(defun elisp/compile--check-declared-features (src)
+  "Check that the features provided by the Emacs Lisp file SRC match its name.
+Return nil if each top-level ‘provide’ form in SRC provides a
+feature whose name is the filename of SRC without extension,
+optionally preceded by some of its parent directories.  For
+example, the file “foo/bar.el” may provide ‘bar’ or ‘foo/bar’.
+Otherwise, return an error message that names the file and line."
+  (cl-check-type src string)
+  (let ((name (file-name-sans-extension
+               (if (string-suffix-p ".gz" src) (substring src 0 -3) src))))
+    (with-temp-buffer
+      (insert-file-contents src)
+      (with-syntax-table emacs-lisp-mode-syntax-table
+        (cl-loop
+         with start = nil
+         ;; Leave reporting syntax errors to the byte compiler.
+         for form = (progn
+                      (forward-comment (buffer-size))
+                      (setq start (point))
+                      (condition-case nil
+                          (read (current-buffer))
+                        ((end-of-file invalid-read-syntax) (cl-return nil))))
+         do (pcase form
+              (`(provide (quote ,(and (pred symbolp) feature)) . ,_)
+               (let ((feature-name (symbol-name feature)))
+                 (unless (or (equal feature-name name)
+                             (string-suffix-p (concat "/" feature-name) name))
+                   (cl-return
+                    (format-message
+                     "%s:%d: error: feature ‘%s’ doesn’t match filename; %s"
+                     src (line-number-at-pos start) feature
+                     (format-message "expected ‘%s’"
+                                     (file-name-nondirectory name)))))))))))))
+
+(defun elisp/compile--write-warnings (file start)
+  "Append the byte-compile warnings in the log buffer to FILE.
+Only consider warnings after position START in
+‘byte-compile-log-buffer’.  Write each warning as a line
+containing a JSON object with the fields ‘file’, ‘line’,
+‘category’, and ‘message’.  The category is always “bytecomp”,
+the type that the byte compiler passes to ‘display-warning’."
+  (cl-check-type file string)
+  (cl-check-type start natnum)
+  (let ((records ()))
+    (with-current-buffer (get-buffer-create byte-compile-log-buffer)
+      (save-excursion
+        (goto-char (min start (point-max)))
+        (while (re-search-forward
+                (rx bol (group (+? nonl)) ?: (group (+ digit)) ?: (+ digit) ?:
+                    (? ?\s) "Warning: " (group (* nonl)) eol)
+                nil t)
+          (let ((source (match-string-no-properties 1))
+                (line (string-to-number (match-string-no-properties 2)))
+                (message (match-string-no-properties 3)))
+            ;; Long warnings continue on indented lines.
+            (forward-line)
+            (while (looking-at (rx (+ blank) (group (+ nonl)) eol))
+              (setq message (concat message " "
+                                    (match-string-no-properties 1)))
+              (forward-line))
+            (push `((file . ,source) (line . ,line) (category . "bytecomp")
+                    (message . ,message))
+                  records)))))
+    (when records
+      (with-temp-buffer
+        (dolist (record (nreverse records))
+          (insert (json-encode record) ?\n))
+        ;; Write all lines at once so that lines from parallel processes
+        ;; don’t get mixed up.
+        (let ((coding-system-for-write 'utf-8-unix)
+              (write-region-inhibit-fsync t))
+          (write-region nil nil file :append :nomessage))))))
 
 (defun elisp/fatal-warnings (_arg)
   "Process the --fatal-warnings command-line option."
   (setq elisp/fatal--warnings t))
 
+(defun elisp/allow-warning (_arg)
+  "Process the --allow-warning command-line option."
+  (let ((category (intern (pop command-line-args-left))))
+    (unless (memq category byte-compile-warning-types)
+      (error "Unknown byte-compile warning category %s" category))
+    (push category elisp/allowed--warnings)))
+
+(defun elisp/require-lexical-binding (_arg)
+  "Process the --require-lexical-binding command-line option."
+  (setq elisp/require--lexical-binding t))
+
+(defun elisp/check-declared-features (_arg)
+  "Process the --check-declared-features command-line option."
+  (setq elisp/check--declared-features t))
+
+(defun elisp/native-compile (_arg)
+  "Process the --native-compile command-line option."
+  (setq elisp/native--output (pop command-line-args-left)))
+
+(defun elisp/cache-directory (_arg)
+  "Process the --cache-directory command-line option."
+  (setq elisp/cache--directory (pop command-line-args-left)))
+
 (provide 'elisp/compile)
 ;;; compile.el ends here
@@ -67,6 +67,8 @@ def _elisp_toolchain_impl(ctx):
         emacs = ctx.attr.emacs,
         use_default_shell_env = ctx.attr.use_default_shell_env,
         execution_requirements = ctx.attr.execution_requirements,
+        native_compilation = ctx.attr.native_compilation,
+        compile_cache = ctx.attr.compile_cache,
         wrap = ctx.attr.wrap,
     )]
 
@@ -123,21 +125,46 @@ def _elisp_test_impl(ctx):
     """Rule implementation for the “elisp_test” rule."""
     toolchain = _toolchain(ctx)
 
+    # Files with the extension “.erts” contain data-driven tests, which the
+    # test runner reads at runtime.  Only the other files need compilation.
+    erts_files = [file for file in ctx.files.srcs if file.extension == "erts"]
     executable, runfiles = _binary(
         ctx,
-        srcs = ctx.files.srcs,
+        srcs = [file for file in ctx.files.srcs if file.extension != "erts"],
         # “local = 1” is equivalent to adding a “local” tag,
         # cf. https://docs.bazel.build/versions/3.1.0/be/common-definitions.html#test.local.
         tags = ["local"] if ctx.attr.local else [],
         substitutions = {
             "[[skip_tests]]": cpp_strings(ctx.attr.skip_tests),
             "[[skip_tags]]": cpp_strings(ctx.attr.skip_tags),
+            "[[module_assertions]]": (
+                "true" if ctx.attr.module_assertions else "false"
+            ),
+            "[[isolate_srcs]]": "true" if ctx.attr.isolate_srcs else "false",
+            "[[terminal]]": "true" if ctx.attr.terminal else "false",
+            "[[site_init]]": "true" if ctx.attr.site_init else "false",
+            "[[pre_test_load]]": cpp_strings([
+                runfile_location(ctx, file)
+                for file in ctx.files.pre_test_load
+            ]),
+            "[[pre_test_eval]]": cpp_strings(ctx.attr.pre_test_eval),
+            "[[erts_files]]": cpp_strings([
+                runfile_location(ctx, file)
+                for file in erts_files
+            ]),
+            "[[test_args]]": cpp_strings([
+                _expand_test_arg(ctx, arg)
+                for arg in ctx.attr.test_args
+            ]),
+            "[[required_env]]": cpp_strings(ctx.attr.required_env),
         },
     )
 
     # We include the original source files in the runfiles so that error
     # messages in tests can link back to them.
-    runfiles = runfiles.merge(ctx.runfiles(files = ctx.files.srcs))
+    runfiles = runfiles.merge(
+        ctx.runfiles(files = ctx.files.srcs + ctx.files.pre_test_load),
+    )
 
     test_env = {}
     if ctx.configuration.coverage_enabled:
@@ -192,6 +219,24 @@ See the rule documentation for details.""",
         "execution_requirements": attr.string_dict(
             doc = "Execution requirements for compilation and test actions.",
         ),
+        "native_compilation": attr.bool(
+            doc = """Whether the Emacs binary supports native compilation.
+Set this to `True` only for Emacs 28 and later if Emacs was built with
+`--with-native-compilation`.  Otherwise, libraries are only byte-compiled,
+even if their `native_compile` attribute is `True`.""",
+            default = False,
+        ),
+        "compile_cache": attr.string(
+            doc = """Absolute name of a local directory for caching compiled files.
+If set, compilation actions look for a previously byte-compiled file in this
+directory whose key matches the content hash of the source file, the libraries
+that it requires, and the compilation options.  If such a file exists, they
+copy it instead of compiling the source file again.  This saves time if Bazel
+reruns compilation actions due to irrelevant input changes.  The directory
+must be writable from within compilation actions, e.g. using
+`--sandbox_writable_path`.  Native compilation and actions that record
+warnings don’t use the cache.""",
+        ),
         "wrap": attr.bool(
             doc = """Whether the binary given in the `emacs` attribute is a
 wrapper around Emacs proper.
@@ -234,13 +279,40 @@ Otherwise, file names are relative to the runfiles root.  File names in
 `inputFiles` or `outputFiles` can also be absolute; in this case they specify
 temporary files that are deleted after the action completes, or files passed on
 the command line interpreted according to the `input_args` and `output_args`
-attributes of the `elisp_binary` rule.""",
+attributes of the `elisp_binary` rule.
+
+Independent of the `wrap` attribute, `elisp_binary` and `elisp_test` programs
+set the environmental variable `ELISP_MANIFEST` to the filename of the manifest
+at runtime.  Emacs Lisp code can use the function
+`elisp/runfiles/check-declared` to verify that a file is a declared input file
+before accessing it.""",
     provides = [platform_common.ToolchainInfo],
 )
 
 # Compilation-related attributes shared between elisp_library, elisp_binary,
 # and elisp_test.
 _COMPILE_ATTRS = {
+    "allowed_warnings": attr.string_list(
+        doc = """List of byte-compile warning categories to disable, for
+example `["obsolete"]`.  See the documentation of the variable
+`byte-compile-warnings` for the available categories.  Warnings in these
+categories are neither shown nor treated as errors, even if `fatal_warnings`
+is `True`.  Prefer fixing warnings over disabling them.""",
+    ),
+    "check_declared_features": attr.bool(
+        doc = """If `True`, fail the build if an Emacs Lisp source file
+provides a feature that doesn’t match its filename.  The feature name must be
+the filename without extension, optionally preceded by some of its parent
+directories; for example, `foo/bar.el` may provide `bar` or `foo/bar`.  Source
+files listed in `mismatched_feature_srcs` are exempt from this check.""",
+        default = False,
+    ),
+    "dynamic_binding_srcs": attr.label_list(
+        doc = """List of source files that are exempt from the
+`require_lexical_binding` check.  Use this only for legacy files that haven’t
+been ported to lexical binding yet.""",
+        allow_files = [".el", ".el.gz"],
+    ),
     "fatal_warnings": attr.bool(
         doc = """If `True` (the default), then byte compile warnings should be
 treated as errors.  If `False`, they still show up in the output, but don’t
@@ -250,6 +322,29 @@ attribute to `False` only for integrating third-party libraries that don’t
 compile cleanly and that you don’t control.""",
         default = True,
     ),
+    "mismatched_feature_srcs": attr.label_list(
+        doc = """List of source files that are exempt from the
+`check_declared_features` check.  Use this only for files that intentionally
+provide a feature with a different name.""",
+        allow_files = [".el", ".el.gz"],
+    ),
+    "native_compile": attr.bool(
+        doc = """If `True`, also compile the Emacs Lisp source files to native
+code.  At runtime, Emacs then loads the natively-compiled files instead of the
+byte-compiled `.elc` files.  It finds them only if the source files resolve to
+the same absolute filenames at build time and at runtime, as is usually the
+case for local execution; otherwise it falls back to the byte-compiled files.
+This requires a toolchain that supports native compilation, see the
+`native_compilation` attribute of `elisp_toolchain`.  On other toolchains, this
+attribute has no effect.""",
+        default = False,
+    ),
+    "require_lexical_binding": attr.bool(
+        doc = """If `True`, fail the build if the first line of an Emacs Lisp
+source file doesn’t set `lexical-binding` to `t`.  Source files listed in
+`dynamic_binding_srcs` are exempt from this check.""",
+        default = False,
+    ),
     "_compile": attr.label(
         default = "//elisp:compile.el",
         allow_single_file = [".el"],
@@ -262,8 +357,10 @@ elisp_library = rule(
         srcs = attr.label_list(
             allow_empty = False,
             doc = """List of source files.  These must either be Emacs Lisp
-files ending in `.el`, or module objects ending in `.so` or `.dylib`.""",
-            allow_files = [".el", ".so", ".dylib"],
+files ending in `.el`, gzip-compressed Emacs Lisp files ending in `.el.gz`,
+byte-compiled files ending in `.elc`, or module objects ending in `.so` or
+`.dylib`.""",
+            allow_files = [".el", ".el.gz", ".elc", ".so", ".dylib"],
             mandatory = True,
             # Undocumented flag to make these rules work with
             # “bazel build --compile_one_dependency”.  See
@@ -295,6 +392,13 @@ By default, libraries need to be loaded using a filename relative to the
 workspace root, i.e., <var>package</var>/<var>file</var>.  If you want to add
 further elements to the load path, use the `load_path` attribute.
 
+If the load path of an `elisp_binary` or `elisp_test` rule contains
+directories from more than one repository, a `require` form without explicit
+filename first looks for the feature in the load path directories of the
+repository that contains the requiring file.  That way, libraries in different
+repositories can provide features of the same name without loading each
+other’s files by accident.
+
 If there are multiple source files specified in `srcs`, these source files can
 also load each other.  However, it’s often preferable to only have one
 `elisp_library` target per source file to make dependencies more obvious and
@@ -302,7 +406,13 @@ ensure that files get only loaded in their byte-compiled form.
 
 The source files in `srcs` can also list shared objects.  The rule treats them
 as Emacs modules and doesn’t try to byte-compile them.  You can use
-e.g. `cc_binary` with `linkshared = True` to create shared objects.""",
+e.g. `cc_binary` with `linkshared = True` to create shared objects.
+
+Likewise, `srcs` can list byte-compiled files, e.g. for vendored libraries that
+only ship compiled files without their sources.  The rule uses them as they
+are.  Dependent libraries and binaries find them on the load path like any
+other compiled file.  Such files must be in the same package as the
+`elisp_library` rule.""",
     provides = [EmacsLispInfo],
     toolchains = [_TOOLCHAIN_TYPE],
     incompatible_use_toolchain_transition = True,
@@ -368,10 +478,57 @@ command line, the corresponding arguments are treated as filenames for output
 files and added to the `outputFiles` field of the manifest.  This only has an
 effect for toolchains that specify `wrap = True`.""",
         ),
+        preload = attr.string_list(
+            doc = """List of features to `require` before loading the binary’s source file.
+The features are required in order, so they have to be provided by
+dependencies of the binary.  If one of the features can’t be loaded, the
+binary fails with an error message that names the feature.""",
+        ),
     ),
     doc = """Binary rule that loads a single Emacs Lisp file.
 The source file is byte-compiled.  At runtime, the compiled version is loaded
-in batch mode.""",
+in batch mode.
+
+Command-line arguments passed to the binary are available in the variable
+`command-line-args-left`.  If the arguments contain a `--` separator, the
+arguments before it are instead passed to Emacs as additional startup options,
+and only the arguments after it end up in `command-line-args-left`.
+
+To run Emacs under a debugger or profiler, set the environmental variable
+`ELISP_WRAPPER` to the wrapper program, optionally followed by
+whitespace-separated arguments, e.g. `ELISP_WRAPPER="gdb --args"`.  The binary
+splits the value only at whitespace and doesn’t interpret quotes or
+backslashes, so neither the program name nor the arguments can contain
+whitespace; use a wrapper script for more complex cases.  The wrapper receives
+the filename of the Emacs binary and its command-line arguments after its own
+arguments.  This also works for `elisp_test` rules.
+
+To run the binary with a different Emacs than the one from the toolchain, for
+example to compare the behavior of two Emacs versions, set the environmental
+variable `ELISP_EMACS` to the filename of the other Emacs binary.  If that
+file doesn’t exist or isn’t executable, the binary prints a warning and falls
+back to the Emacs from the toolchain.  This also works for `elisp_test`
+rules.
+
+If the Emacs from the toolchain uses portable dump files, you can speed up
+startup by setting the environmental variable `ELISP_DUMP_FILE` to a dump
+file with additional preloaded libraries, created with
+`dump-emacs-portable`.  The binary checks that the dump file was created by
+the same Emacs binary; otherwise, it prints a warning and uses the default
+dump file.  This also works for `elisp_test` rules.
+
+If the Emacs from the toolchain supports native compilation, it writes
+natively-compiled files to a cache directory that normally lives in a temporary
+location and doesn’t survive the run.  To reuse natively-compiled files across
+runs, set the environmental variable `ELISP_ELN_CACHE` to a writable directory
+outside of the sandbox, e.g. using `--test_env`.  If Bazel sandboxes the run,
+also pass the directory to `--sandbox_writable_path`.  The binary adds that
+directory to the front of `native-comp-eln-load-path`, so that Emacs writes new
+natively-compiled files there and prefers them over older ones.
+Emacs keys the cached files on the absolute filename of the source file, so
+they are only reused if that filename stays the same.  If the variable doesn’t
+name a writable directory, the binary prints a warning and ignores it.  This
+also works for `elisp_test` rules.""",
     executable = True,
     fragments = ["cpp"],
     toolchains = [
@@ -387,8 +544,15 @@ elisp_test = rule(
         _COMPILE_ATTRS,
         srcs = attr.label_list(
             allow_empty = False,
-            doc = "List of source files to load.",
-            allow_files = [".el"],
+            doc = """List of source files to load.
+Besides Emacs Lisp files, this can contain data-driven test files with the
+extension `.erts`, as described in [the ERT
+manual](https://www.gnu.org/software/emacs/manual/html_node/ert/erts-files.html).
+The test binary defines an ERT test named `erts/FILE/NAME` for each test case
+`NAME` in such a file, where `FILE` is the workspace-relative filename without
+extension, and runs it using `ert-test-erts-file`.  This requires Emacs 29 or
+later; on earlier versions, the test cases are skipped.""",
+            allow_files = [".el", ".erts"],
             mandatory = True,
             # Undocumented flag to make these rules work with
             # “bazel build --compile_one_dependency”.  See
@@ -431,6 +595,65 @@ elisp_test = rule(
             doc = "List of `elisp_library` dependencies.",
             providers = [EmacsLispInfo],
         ),
+        isolate_srcs = attr.bool(
+            doc = """Whether to load each source file in a separate Emacs process.
+By default, the test binary loads all source files into the same Emacs
+process, so that e.g. two source files that define the same variable interfere
+with each other.  If this attribute is `True`, the test binary instead runs
+the tests of each source file in a fresh subordinate Emacs process and merges
+their reports and coverage data.  This is slower, so only set it if the source
+files can’t coexist in one process.""",
+            default = False,
+        ),
+        module_assertions = attr.bool(
+            doc = """Whether to run Emacs with the `--module-assertions` option.
+Module assertions detect misuse of the module API in dynamic modules, such as
+using values or environments that are no longer live.  If a module assertion
+fails, Emacs prints a message starting with “Emacs module assertion” and
+aborts.  Module assertions slow down module function calls, so you can set
+this attribute to `False` for performance-sensitive tests that don’t exercise
+dynamic modules.""",
+            default = True,
+        ),
+        pre_test_eval = attr.string_list(
+            doc = """List of Emacs Lisp forms to evaluate before loading the test source files.
+Each element is a string containing a single form.  The test binary evaluates
+the forms after loading the files in `pre_test_load` and before requiring the
+features in `preload`, so the forms can apply global configuration such as
+customizing variables.  If evaluating a form signals an error, the test fails
+with an error message that names the form.""",
+        ),
+        pre_test_load = attr.label_list(
+            doc = """List of Emacs Lisp files to load before loading the test source files.
+The test binary loads these files in order before evaluating the forms in
+`pre_test_eval`.  Unlike `preload`, this can run arbitrary setup code that
+doesn’t belong to a library.  If loading a file signals an error, the test
+fails with an error message that names the file.""",
+            allow_files = [".el"],
+        ),
+        preload = attr.string_list(
+            doc = """List of features to `require` before loading the test source files.
+The features are required in order, so they have to be provided by
+dependencies of the test.  Tests can then use the features without requiring
+them.  If one of the features can’t be loaded, the test fails with an error
+message that names the feature.""",
+        ),
+        required_env = attr.string_list(
+            doc = """List of environment variables that the tests need.
+Before starting Emacs, the test binary checks that all of these variables are
+set, possibly to an empty value.  If some of them aren’t set, the test fails
+right away with an error message that lists the missing variables.  Use
+`bazel test --test_env` to pass the variables to the test.""",
+        ),
+        site_init = attr.bool(
+            doc = """Whether to load site-wide initialization files.
+By default, the test binary starts Emacs with the `--quick` option, so that
+neither `site-start.el` nor the `site-lisp` directories of the local Emacs
+installation can affect the tests.  Set this attribute to `True` for tests
+that legitimately rely on site-wide initialization.  The test binary never
+loads a user init file.""",
+            default = False,
+        ),
         skip_tests = attr.string_list(
             doc = """List of tests to skip.  This attribute contains a list of
 ERT test symbols; when running the test rule, these tests are skipped.
@@ -447,24 +670,499 @@ skipped.  This can be useful to e.g. skip tests that are flaky or only work in
 interactive mode.  Use the `:tags` keyword argument to `ert-deftest` to tag
 tests.""",
         ),
+        terminal = attr.bool(
+            doc = """Whether to run the tests in an interactive Emacs on a terminal.
+By default, the test binary runs Emacs in batch mode, where `noninteractive` is
+non-nil and there is no terminal frame.  If this attribute is `True`, the test
+binary instead runs Emacs with the `--no-window-system` option on a fresh
+pseudo-terminal with terminal type `xterm`, so that tests can exercise code
+paths that only work interactively, such as terminal frames and keymaps.  The
+test binary discards the terminal output, but still writes messages to the
+test log and the XML report.  This mode requires an operating system whose
+`posix_spawn` supports starting a new session.""",
+            default = False,
+        ),
+        test_args = attr.string_list(
+            doc = """List of arguments to pass to the tests.
+Tests can retrieve the arguments using the function `elisp/ert/test-args`.
+The arguments are subject to `$(location)` and “Make” variable substitution.
+`$(location)`, `$(locations)`, `$(rootpath)`, and `$(rootpaths)` references
+must refer to targets in the `srcs` or `data` attributes and expand to absolute
+filenames at runtime.  Use `$$` for a literal dollar sign.  This attribute
+isn’t called `args` because Bazel reserves that name for its own attribute,
+which passes command-line arguments to the test binary instead.""",
+        ),
     ),
     doc = """Runs ERT tests that are defined in the source files.
 The given source files should contain ERT tests defined with `ert-deftest`.
 See the [ERT
 manual](https://www.gnu.org/software/emacs/manual/html_node/ert/How-to-Write-Tests.html)
 for details.  The generated test binary loads all source files and executes all
-tests like `ert-run-tests-batch-and-exit`.
+tests like `ert-run-tests-batch-and-exit`.  It loads the source files in the
+order given, but skips files that an earlier source file has already loaded,
+e.g. using `require`, so that no file is loaded twice.
+
+A test file can define suite setup and teardown functions that the test binary
+calls once before and after running the tests of that file.  The names of these
+functions are derived from the file name: for a test file `foo-test.el`, they
+are `foo-test--setup-suite` and `foo-test--teardown-suite`.  Both functions
+are optional and take no arguments.  If the setup function signals an error,
+the test binary reports it as a suite error named `setup-suite` and skips the
+tests of the file.  Likewise, it reports an error in the teardown function as a
+suite error named `teardown-suite`.  If tests run in parallel, each process
+calls the suite functions of the files whose tests it runs.
 
 You can restrict the tests to be run using the `--test_filter` option.  If set,
 the value of `--test_filter` must be a Lisp expression usable as an [ERT test
 selector](https://www.gnu.org/software/emacs/manual/html_node/ert/Test-Selectors.html).
+In particular, a string selector matches test names as a regular expression,
+e.g. `--test_filter='"^foo-"'`.  If the selector doesn’t match any test, the
+test binary writes an empty report and succeeds.
 You can also restrict the tests to be run using the `skip_tests` and
 `skip_tags` rule attributes.  These restrictions are additive, i.e., a test
 only runs if it’s not suppressed by either facility.
 
+To select tests by tag, set the environment variable `ELISP_TEST_TAGS` to a
+whitespace-separated list of tags, e.g. using
+`bazel test --test_env=ELISP_TEST_TAGS="+integration -slow"`.  Tags prefixed
+with `-` exclude tests with that tag.  Other tags, optionally prefixed with
+`+`, select tests that have any of these tags.  This selection is combined with
+the test filter, i.e., a test only runs if it matches both.
+
+For more complex selections, set the environment variable `ELISP_TEST_SELECTOR`
+to a Lisp form.  Unlike `--test_filter`, the test binary evaluates this form.
+The result should be an ERT selector or a predicate function that receives each
+`ert-test` object and returns non-nil for the tests to run, e.g.
+`(lambda (test) (string-match-p "MARKER" (or (ert-test-documentation test)
+"")))`.  The test binary signals an error if the form can’t be read or
+evaluated, or if it doesn’t evaluate to a valid selector.  Like tags, this
+selection is combined with the test filter.
+
 In coverage mode (i.e., when run under `bazel coverage`), all tests tagged with
 the `:nocover` tag are also skipped.  You can use this tag to skip tests that
-normally pass, but don’t work under coverage for some reason.""",
+normally pass, but don’t work under coverage for some reason.
+
+By default, coverage mode only collects line coverage.  To also collect branch
+coverage, set the environment variable `ELISP_TEST_BRANCH_COVERAGE` to `1`,
+e.g. using `bazel coverage --test_env=ELISP_TEST_BRANCH_COVERAGE=1`.  Branch
+coverage requires additional bookkeeping for each branching form, which makes
+instrumented code noticeably slower.
+
+The coverage report contains a function record for each definition that Edebug
+instruments, including nested definitions such as local functions.  To get one
+function record per top-level definition instead, set the environment variable
+`ELISP_TEST_FUNCTION_COVERAGE` to `1`.  The test binary then folds nested
+definitions into the top-level definitions that contain them, so the `FN` and
+`FNDA` records show which top-level definitions have run and how often.  The
+line and branch coverage data stays the same.
+
+To omit some source files from the coverage report, e.g. generated or vendored
+code, set the environment variable `ELISP_TEST_COVERAGE_EXCLUDE` to a
+space-separated list of glob patterns such as `*-pb.el third_party/*`.  The
+patterns match workspace-relative filenames, and `*` also matches slashes.  The
+test binary still instruments matching files, so excluding them only changes
+the report, not the behavior of the tests.
+
+Some coverage dashboards only understand Cobertura XML.  To get such a report
+as well, set the environment variable `ELISP_TEST_COVERAGE_FORMAT` to
+`cobertura` when running in coverage mode.  The test binary then converts the
+LCOV data to Cobertura and writes it to the file named by the environment
+variable `ELISP_TEST_COBERTURA_FILE`, or to `coverage.xml` among the
+undeclared test outputs.  It still writes the LCOV report, because Bazel only
+merges coverage files in that format.  The default value `lcov` writes only
+the LCOV report.
+
+For test impact analysis, set the environment variable
+`ELISP_TEST_COVERAGE_PER_TEST_FILE` to a filename when running in coverage
+mode.  The test binary then records the instrumented source files whose forms
+each test has executed in a `coverage-files` property of the `<testcase>`
+element, as a space-separated list of workspace-relative filenames.  It also
+writes a JSON object to the given file that maps each test name to an array of
+these filenames.
+
+To run only the tests affected by a change, set the environment variable
+`ELISP_TEST_CHANGED_FILES` to a file that lists the changed workspace-relative
+filenames, one per line, and `ELISP_TEST_COVERAGE_MAP` to the JSON file that
+`ELISP_TEST_COVERAGE_PER_TEST_FILE` has written in a previous run.  The test
+binary then only runs the selected tests that touched one of the changed files
+or are defined in one of them.  To be on the safe side, it also runs the tests
+that the coverage map doesn’t mention.
+
+The test binary runs the selected tests in random order to detect unwanted
+dependencies between tests.  It logs the seed for the random order; to
+reproduce a specific order, set the environment variable
+`TEST_RANDOMIZE_ORDERING_SEED` to that seed, e.g. using
+`bazel test --test_env=TEST_RANDOMIZE_ORDERING_SEED=…`.  If some tests fail,
+the test binary also prints the corresponding command line.  The XML report
+records the seed in the `ordering-seed` property and always lists the tests
+sorted by name.  To allow grouping the tests by source file, the `classname`
+attribute of each test case is the workspace-relative filename of the file
+that defines the test, without extension and with dots instead of slashes,
+e.g. `tests.test` for a test defined in `tests/test.el`.
+
+To find out why tests are slow, set the environment variable
+`ELISP_TEST_PROFILE` to `cpu` or `mem` to run the Emacs CPU or memory profiler
+while loading and running the tests.  The test binary writes the profile to the
+file given by the environment variable `ELISP_TEST_PROFILE_FILE`, or to
+`emacs.profile` in the directory for undeclared test outputs.  You can load it
+with `profiler-find-profile`.  The test binary also writes a human-readable
+report to the same filename with `.txt` appended.  Note that profiling slows
+down the tests, so the test times in the report include the overhead of the
+profiler.  With `ELISP_TEST_JOBS`, only tests that run in the main Emacs
+process are profiled.
+
+To record environment variables in the XML report, set the environment variable
+`ELISP_TEST_REPORT_ENV` to a space-separated list of glob patterns such as
+`CI_* LANG`.  The report then contains a property `env:NAME` for each matching
+environment variable `NAME`.  To avoid leaking secrets, the property values are
+redacted unless you also set the environment variable
+`ELISP_TEST_REPORT_ENV_VALUES` to `1`, and variables whose names contain words
+such as `TOKEN`, `SECRET`, `PASSWORD`, or `KEY` are never included, even as
+part of a longer word such as in `APIKEY` or `GITHUBTOKEN`.  A few harmless
+words such as `MONKEY` and `TOKENIZER` don’t count, so e.g. `TOKENIZER_DIR` can
+be included.
+
+To post-process the report before the test binary writes it, e.g. to add CI
+metadata, set the environment variable `ELISP_TEST_REPORT_HOOK` to the name of
+an Emacs Lisp file.  That file should add functions to the hook
+`elisp/ert/report-functions`.  The test binary loads the file after running
+the tests and calls each function with the report as a `testsuite` XML node
+in the format of `xml-parse-region`.  Each function returns the new report,
+e.g. with additional properties.  If loading the file or calling a function
+fails, the test binary keeps the original report, adds the error as a test case
+named `report-hook` with an error of type `report-hook-error`, and fails.
+
+The time of each test case in the XML report only covers running the test
+itself, summed over all attempts, and the time of the test suite is the sum of
+the test case times.  The time it takes to load the test files is recorded
+separately in the `setup-time` property.  If the test binary can find the
+definition of a test, the test case also has `file` and `line` attributes
+with the workspace-relative source filename and line number of its
+`ert-deftest` form.
+
+To ensure that a hanging test doesn’t prevent the test binary from writing a
+report, each test runs with a timeout.  By default, the test binary distributes
+the time remaining until the Bazel test timeout evenly among the remaining
+tests.  To specify an explicit per-test timeout, set the environment variable
+`ELISP_TEST_TIMEOUT` to the desired number of seconds.  Tests that time out
+are reported as errors of type `timeout`.  Note that Emacs can only interrupt
+tests that wait, e.g. in `sleep-for` or `accept-process-output`.  If Bazel
+terminates the test binary with `SIGTERM`, e.g. because the Bazel test timeout
+has expired, the test binary still writes a partial report.  It reports the
+test that was running as error of type `timeout` and the tests that haven’t
+run as skipped.
+
+The test binary exits with status 1 if some tests failed.  If Emacs is killed
+by a signal instead, e.g. because it crashed or ran out of memory, the test
+binary exits with status 128 plus the signal number, and adds a suite-level
+`<error>` element of type `signal` to the XML report, incrementing the error
+count of the suite.  If Emacs didn’t get a chance to write a report, the test
+binary writes a report that only contains this error, using the same suite
+name as the test runner would.  This makes it possible to distinguish
+infrastructure failures from test failures.
+
+To prevent a runaway test from exhausting the memory of the machine, set the
+environment variable `ELISP_TEST_MEMORY_LIMIT` to the maximum size of the
+address space of Emacs in bytes.  A test that fails to allocate memory is
+reported as an error of type `memory`.  If Emacs crashes instead, the
+suite-level error described above has the type `memory` instead of
+`signal`.
+
+To catch memory regressions, set the environment variable
+`ELISP_TEST_MEMORY_USAGE` to 1.  Each `<testcase>` element then gets a
+`memory` attribute with the approximate number of bytes that Emacs allocated
+while running the test, based on `memory-use-counts`.  The value doesn’t
+depend on garbage collection, so it’s stable across runs of the same code.
+
+The `gc-count` and `gc-time` properties of the test suite contain the number
+of garbage collections and the total time in seconds that Emacs spent in them
+while running the tests, based on `gcs-done` and `gc-elapsed`.  To get these
+numbers for each test, set the environment variable `ELISP_TEST_GC_PER_TEST`
+to 1.  Each `<testcase>` element then gets `gc-count` and `gc-time`
+properties that cover the last attempt of the test.  If tests run in parallel,
+the suite properties only count garbage collections in the main process.
+
+To run the same tests against several Emacs versions in one invocation, set
+the environment variable `ELISP_TEST_EMACS_MATRIX` to a colon-separated list
+of Emacs binaries.  The test binary then runs the tests once with each of them,
+even if some runs fail, and appends the Emacs version to the name of each
+run’s test suite, e.g. `//pkg:test (Emacs 29.1)`.  The XML report then
+contains a `testsuites` element with one `testsuite` element per run.  The
+test fails if any of the runs fails.
+
+The test binary runs Emacs with the environment variable `HOME` pointing to a
+fresh temporary directory, which it removes afterwards.  Therefore
+`user-emacs-directory` and files such as `custom-file` don’t refer to the
+real user profile, even if the test runs outside of a sandbox.  To use a
+different home directory, set the environment variable `ELISP_TEST_HOME` to
+its name.
+
+If a test file fails to load, the test binary still runs the tests that the
+file has defined before the error, and reports the error as a test case named
+`load` with an error of type `load-error`, so that missing tests don’t go
+unnoticed.  If the error is due to a `require` form whose feature can’t be
+found, e.g. because of a missing dependency, the error has the type
+`missing-feature` instead, and its message names the feature, the file that
+requires it, the filenames that Emacs tried, and the load path.  Likewise,
+selected tests that don’t produce a result for some other reason are reported
+as errors of type `missing`.
+
+If two files define a test with the same name, ERT silently keeps only the
+definition that it loaded last.  The test binary detects such collisions while
+loading the test files and reports each of them as a test case named
+`duplicate` with an error of type `duplicate-test` that names both files.
+
+By contrast, errors in setup actions or while preloading features are fatal by
+default, because the test files usually rely on them.  To run the remaining
+tests anyway, set the environment variable `ELISP_TEST_KEEP_GOING` to `1`.  The
+test binary then reports each such error as a test case named `setup` with an
+error of type `setup-error` and continues.  The test still fails in this case.
+
+The `<testsuite>` element of the generated XML report is named after the label
+of the test target, taken from the environment variable `TEST_TARGET` that
+Bazel sets, or `ERT` if that variable isn’t set.  To use a different name, set
+the environment variable `ELISP_TEST_SUITE_NAME`.
+
+The generated XML report contains the standard output and the messages of each
+test in `<system-out>` and `<system-err>` elements, respectively.  Each of
+them is truncated to 64 KiB.  To change this limit, set the environment
+variable `ELISP_TEST_OUTPUT_LIMIT` to the desired number of bytes, e.g. using
+`bazel test --test_env=ELISP_TEST_OUTPUT_LIMIT=…`.
+
+Failure messages print backtraces and conditions with `print-level` bound
+to 8 and `print-length` bound to 50, so that huge values don’t blow up the
+report.  To change these limits, set the environment variables
+`ELISP_TEST_PRINT_LEVEL` and `ELISP_TEST_PRINT_LENGTH`, respectively.  A
+value of `0` means no limit.
+
+The `assertions` attribute of each `<testcase>` element counts the `should`,
+`should-not`, `should-error`, and `skip-unless` forms that the test has
+evaluated, including those in helper functions.  A test without assertions
+might not check anything.
+
+To detect tests that leave behind modified global state, set the environment
+variable `ELISP_TEST_CHECK_GLOBALS` to `warn` or `strict`.  The test binary
+then compares the values of `load-path`, `features`, and `default-directory`
+as well as the number of live buffers before and after each test.  To check
+additional variables, set the environment variable `ELISP_TEST_GLOBALS` to a
+space-separated list of variable names.  In `warn` mode, the messages of a test
+that modifies any of these mention the modification.  In `strict` mode, such a
+test additionally fails with an error of type `elisp/ert/global-state`.
+
+To fail tests that only log a warning, set the environment variable
+`ELISP_TEST_FAIL_ON_MESSAGE` to an Emacs regular expression.  A test that
+would otherwise pass then fails with an error of type
+`elisp/ert/matching-message` if any line of its messages or standard output
+matches the regular expression.  The failure message contains the first
+matching line.
+
+To tighten `should-error` assertions, set the environment variable
+`ELISP_TEST_STRICT_SHOULD_ERROR` to 1.  A `should-error` form then fails
+unless its `:type` lists the error symbol of the condition that it caught,
+as if it specified `:exclude-subtypes`.  A form without `:type` expects the
+type `error` and therefore only accepts plain `error` signals.  The failure
+condition contains the expected and the actual condition type.
+
+Tests that call `advice-add` without a matching `advice-remove` change the
+behavior of later tests.  To prevent this, set the environment variable
+`ELISP_TEST_CLEAN_ADVICE` to 1.  The test binary then records the advice on
+all named functions before each test and removes any advice that the test has
+added afterwards.  It reports each removed piece of advice as a warning of the
+test, like `elisp/ert/should-warn`, but the test doesn’t fail.  Unlike
+`ELISP_TEST_CHECK_GLOBALS`, this undoes the leaked change.
+
+To follow the progress of a long test run, set the environment variable
+`ELISP_TEST_PROGRESS_FD` to the number of an open file descriptor, e.g. a pipe
+inherited from the process that runs the test binary.  The test binary then
+writes one JSON object per line to that file descriptor: a `test-start` event
+when a test starts, and a `test-end` event with the `status` (`passed`,
+`failed`, `error`, or `skipped`) and `duration` in seconds when it has
+finished.  Each event names the test in its `test` field.  Tests that run in
+subordinate processes only produce `test-end` events once their process has
+finished.
+
+Tools such as editor integrations that want to show results while the tests
+are still running can set the environment variable `ELISP_TEST_STREAM_FILE` to
+a filename.  The test binary then rewrites that file after each finished test
+with a JUnit XML report that contains the test cases that have finished so far.
+It replaces the file atomically, so readers always see a complete XML
+document.  Once all tests have finished, the file contains the same report as
+the final XML report.
+
+If Bazel provides a warnings file in the environment variable
+`TEST_WARNINGS_OUTPUT_FILE`, the test binary appends a line to that file for
+each warning that the tests emit using `display-warning` or functions such as
+`warn`.  Each line is a JSON object with the fields `file` and `line`, which
+point to the definition of the test that emitted the warning, `category`,
+which is the warning type, and `message`.  The byte compiler used by the rules
+writes its warnings to that file in the same format if the variable is set
+when it runs.
+
+To find the tests that take the longest, set the environment variable
+`ELISP_TEST_SLOW_THRESHOLD` to a number of seconds.  After running the tests,
+the test binary then prints the slowest tests that took longer than that,
+slowest first, and lists them in the report property `slow-tests` as
+space-separated `NAME=SECONDS` entries.  By default, it lists at most ten
+tests; set the environment variable `ELISP_TEST_SLOW_COUNT` to change that
+limit.
+
+To benchmark tests tagged `:benchmark`, set the environment variable
+`ELISP_TEST_BENCHMARK_ITERATIONS` to a positive number of iterations.  After
+such a test has passed once, the test binary runs it again, first a number of
+times given by the environment variable `ELISP_TEST_BENCHMARK_WARMUP` (one by
+default) without measuring, and then the given number of iterations.  It
+records the number of iterations and warmup runs as well as the minimum,
+median, mean, and sample standard deviation of the measured durations in
+seconds as `<property>` elements named `benchmark-iterations`,
+`benchmark-warmup`, `benchmark-min`, `benchmark-median`, `benchmark-mean`, and
+`benchmark-stddev` within the `<testcase>` element.  If any iteration fails,
+the test fails with the result of that iteration.  To also write the results
+to a JSON file, set the environment variable `ELISP_TEST_BENCHMARK_FILE` to its
+name.  The file then contains an object whose `benchmarks` member is an array
+with one object per benchmark test, containing the test `name` and the
+statistics under the same names without the `benchmark-` prefix.
+
+To see how much the duration of each test varies, set the environment variable
+`ELISP_TEST_DURATION_SAMPLES` to a positive number of samples.  The test
+binary then runs each test that passes repeatedly until it has measured that
+many durations, and records them in seconds as a space-separated
+`duration-samples` property of the `<testcase>` element.  The `time`
+attribute remains the duration of the first run.  If any run fails, the test
+fails with the result of that run.  The JSON summary from
+`ELISP_TEST_SUMMARY_FILE` then contains a `samples` member, an array with one
+object per test containing the test `name` and its `durations`.
+
+To retry tests that fail unexpectedly, set the environment variable
+`ELISP_TEST_RETRIES` to the maximum number of retries.  Each attempt gets its
+own timeout as described above.  If a test passes on a retry, the test binary
+reports it as passed and marks it in the XML report with the attributes
+`flaky="true"` and `attempts`.  Tests that fail on every attempt are reported
+with the result of the last attempt.
+
+To stop after the first test with an unexpected result, set the environment
+variable `ELISP_TEST_FAIL_FAST` to `1`.  If retries are enabled, the test binary
+only stops once all attempts have failed.  The XML report lists the tests that
+didn’t run as skipped.  To stop after a given number of unexpected results
+instead, set the environment variable `ELISP_TEST_MAX_FAILURES` to that number.
+With sharding, each shard counts its own unexpected results.
+
+To run tests in parallel, set the environment variable `ELISP_TEST_JOBS` to the
+number of subordinate Emacs processes to use.  The test binary distributes the
+tests among these processes and merges their reports and coverage data.  Tests
+tagged with `:serial` always run in the main Emacs process, after the other
+tests have finished.  Use this tag for tests that can’t run concurrently with
+other tests.
+
+The `timestamp` attribute of the XML report contains the local start time of
+the test run without timezone, as required by the JUnit XML schema.  To add an
+explicit timezone offset as specified by RFC 3339, set the environment variable
+`ELISP_TEST_TIMESTAMP_FORMAT` to `rfc3339`; the default value `legacy` selects
+the format without timezone.
+
+By default, the test binary writes a JUnit XML report.  To write a report in
+the Test Anything Protocol (TAP) version 13 format instead, set the environment
+variable `ELISP_TEST_REPORT_FORMAT` to `tap`.  The TAP report goes to standard
+output after the output of the tests, unless you set the environment variable
+`ELISP_TEST_REPORT_FILE` to the desired filename.  `ELISP_TEST_REPORT_FILE` also
+overrides the filename of the JUnit report.  To also write the JUnit report to
+standard output, e.g. for CI systems that capture standard output instead of
+files, set the environment variable `ELISP_TEST_REPORT_STDOUT` to 1.  The test
+binary then prints the report after all tests have finished, so it doesn’t
+interleave with the output of the tests.  The printed report is identical to
+the one in the report file.
+
+Tests can write artifacts such as generated buffer contents to the directory
+given by the variable `elisp/ert/output-directory`.  The test binary sets this
+variable to the directory for undeclared test outputs that Bazel provides in
+the environment variable `TEST_UNDECLARED_OUTPUTS_DIR`.  If that isn’t set, it
+uses the value of the environment variable `ELISP_TEST_OUTPUT_DIR` instead.  If
+neither is set, `elisp/ert/output-directory` is nil.  When a test fails, the
+XML report lists the files that the test has created in that directory.
+
+Each test runs with `temporary-file-directory` and the environment variable
+`TMPDIR` set to a fresh directory `ert/NAME/` within the Bazel test temporary
+directory, where `NAME` is the test name with special characters
+percent-encoded.  That way, temporary files of different tests can’t collide.
+The test binary removes the directory after the test has finished.  To keep
+the directories of failed tests for debugging, set the environment variable
+`ELISP_TEST_KEEP_TEMP_DIRS` to `1`.
+
+Tests can use the function `elisp/ert/data-file` to find files listed in the
+`data` attribute.  It takes a filename relative to the workspace of the test,
+for example `"tests/data.txt"`, and returns its local filename.  If the file
+isn’t a declared data file, it signals an error of type
+`elisp/runfiles/undeclared`.
+
+To compare output against a golden file listed in the `data` attribute, use
+the function `elisp/ert/assert-golden`.  It takes a string or buffer and a
+filename as for `elisp/ert/data-file`.  If the contents differ, the test fails
+with an error of type `elisp/ert/golden-mismatch`, and the failure message
+contains a unified diff.  To update golden files, pass
+`--test_arg=--update-goldens` to `bazel test`.  In that mode, the test binary
+writes the new contents to the subdirectory `goldens` of the undeclared test
+outputs directory instead of failing the test; copy them back into the source
+tree from there.
+
+To compare numbers with a tolerance, use the function
+`elisp/ert/assert-approx`.  It takes the expected and actual numbers and the
+keyword arguments `:margin` for an absolute tolerance and `:fraction` for a
+tolerance relative to the smaller absolute value, like `cmpopts.EquateApprox`
+in Go.  If the numbers differ by more than the tolerance, the test fails with
+an error of type `elisp/ert/approx-mismatch`, and the failure message shows
+the expected and actual values and the tolerance.
+
+For advisory checks that shouldn’t fail the test, use the function
+`elisp/ert/should-warn` instead of `should`.  It takes a value and an
+optional message.  If the value is nil, the test still passes, but the test
+binary adds a `<property>` element named `warning` with the message to the
+`<testcase>` element and counts it in the `warnings` attribute of the
+`<testsuite>` element.  The attribute is only present if there are warnings.
+
+Tests that need an external program such as `git` can call the function
+`elisp/ert/skip-unless-program` with the program name.  If `executable-find`
+doesn’t find the program, the test is skipped with a reason that names the
+program; otherwise, the function returns the absolute filename of the program.
+
+To check examples in function docstrings, set the environment variable
+`ELISP_TEST_DOCTESTS` to `1`.  An example is a Lisp form followed by `⇒` and
+the printed representation of its value on the rest of the line.  The test
+binary then defines an additional test named `doctest/FUNCTION/N` for the
+`N`th example of each function that the test source files and their
+dependencies define, except for functions that come with Emacs.  Such a test
+evaluates the form and compares the printed representation of its value with
+the expected one.  If they differ, the test fails with an error of type
+`elisp/ert/doctest-mismatch`, and the failure message shows the location of
+the function definition and both values.
+
+The test binary always runs Emacs in batch mode, so tests that are guarded by
+`(skip-unless (display-graphic-p))` or `(skip-unless (tty-type))` are reliably
+reported as skipped.  Tests that need network access should use
+`(skip-unless (featurep 'elisp/ert/network))`; the test binary only
+provides the feature `elisp/ert/network` if you set the environment variable
+`ELISP_TEST_NETWORK` to `1`, so such tests are skipped by default.
+
+To additionally write a compact JSON summary, set the environment variable
+`ELISP_TEST_SUMMARY_FILE` to the desired filename.  The summary is a JSON
+object with the keys `tests`, `errors`, `failures`, `skipped`, and `time`,
+containing the same values as the corresponding attributes of the JUnit
+report, and `failed`, an array of objects with `name`, `type`, `message`, and
+`time` keys for each failed test.  The `message` is the first line of the
+failure message.
+
+To list the tests that the test binary would run without actually running
+them, set the environment variable `ELISP_TEST_LIST` to `names` or `json`.  The
+test binary then prints the names of the selected tests to standard output,
+either one per line or as a JSON array of objects with `name` and `tags`
+properties, and exits successfully without writing an XML report.  The listing
+takes the test filter and sharding into account.
+
+To get a report with the same shape as a real one without running any tests,
+e.g. to set up dashboards, set the environment variable
+`ELISP_TEST_DRY_RUN_REPORT` to 1.  The test binary then writes an XML report
+that contains a `<testcase>` element with zero time for each selected test.
+Each element is marked as skipped with the message “Test not run in dry-run
+mode”.  Load errors still show up in the report and make the test binary
+fail.""",
     fragments = ["cpp"],
     test = True,
     toolchains = [
@@ -481,15 +1179,18 @@ def _compile(ctx, srcs, deps, load_path):
     Args:
       ctx (ctx): rule context
       srcs (list of Files): Emacs Lisp sources files to compile; can also
-          include module objects
+          include byte-compiled files and module objects
       deps (list of targets): Emacs Lisp libraries that the sources depend on
       load_path (list of strings): additional load path directories, relative
           to the current package
 
     Returns:
       A structure with the following fields:
-        outs: a list of File objects containing the byte-compiled files and
-            module objects
+        outs: a list of File objects containing the byte-compiled files,
+            directories with natively-compiled files and the source files next
+            to the byte-compiled files, precompiled files, and module objects
+        load_files: a list of File objects to load at runtime: the
+            byte-compiled files, precompiled files, and module objects
         load_path: the load path required to load the compiled files
         runfiles: a runfiles object for the set of input files
         transitive_load_path: the load path required to load the compiled files
@@ -501,14 +1202,24 @@ def _compile(ctx, srcs, deps, load_path):
     """
 
     # Only byte-compile Lisp source files.  Use module objects directly as
-    # outputs.
-    lisp = [src for src in srcs if src.short_path.endswith(".el")]
+    # outputs.  Emacs decompresses gzip-compressed source files transparently
+    # during compilation, see Info node ‘(emacs) Compressed Files’.
+    lisp = [
+        src
+        for src in srcs
+        if src.short_path.endswith(".el") or src.short_path.endswith(".el.gz")
+    ]
     mods = [
         src
         for src in srcs
         if src.short_path.endswith(".so") or src.short_path.endswith(".dylib")
     ]
-    outs = mods
+
+    # Byte-compiled files without sources are used as they are, like module
+    # objects.
+    precompiled = [src for src in srcs if src.short_path.endswith(".elc")]
+    outs = mods + precompiled
+    load_files = mods + precompiled
 
     # If any file comes for a different package, we can’t place the compiled
     # files adjacent to the source files.  See
@@ -526,6 +1237,20 @@ def _compile(ctx, srcs, deps, load_path):
         if mod.root != ctx.bin_dir or relocate_output:
             fail("module object {} in unsupported location".format(mod.path))
 
+    # Precompiled files can be source files, but they have to be in the
+    # current package so that the load path below covers them.
+    for elc in precompiled:
+        if (elc.owner.workspace_name != ctx.label.workspace_name or
+            elc.owner.package != ctx.label.package or relocate_output):
+            fail("byte-compiled file {} in unsupported location".format(
+                elc.path,
+            ))
+
+    # Build actions find the compiled files of this rule in the bin directory,
+    # but precompiled source files are only in the source tree.  The runfiles
+    # tree contains both kinds of files in the same place.
+    precompiled_sources = any([elc.is_source for elc in precompiled])
+
     # Directory relative to the workspace root where outputs should be stored.
     # We prefer storing them adjacent to source files to reduce the number of
     # load path entries, but if necessary, we generate a subdirectory in the
@@ -580,6 +1305,13 @@ def _compile(ctx, srcs, deps, load_path):
             ),
         )
         resolved_load_path.append(resolved)
+        if precompiled_sources:
+            resolved_load_path.append(struct(
+                for_actions = check_relative_filename(
+                    paths.join(ctx.label.workspace_root, dir),
+                ),
+                for_runfiles = resolved.for_runfiles,
+            ))
 
     indirect_srcs = [
         dep[EmacsLispInfo].transitive_source_files
@@ -614,6 +1346,10 @@ def _compile(ctx, srcs, deps, load_path):
     toolchain = _toolchain(ctx)
     emacs = toolchain.emacs
 
+    # Native compilation silently degrades to byte compilation if the
+    # toolchain doesn’t support it.
+    native_compile = ctx.attr.native_compile and toolchain.native_compilation
+
     # Expand load path only if needed.  It’s important that the expanded load
     # path is equivalent to the --directory arguments below.
     flat_load_path = [
@@ -628,17 +1364,15 @@ def _compile(ctx, srcs, deps, load_path):
     # but since compilation can execute arbitrary code, it ensures that
     # compilation actions don’t interfere with each other.
     for src in lisp:
-        out = (
-            ctx.actions.declare_file(
-                paths.join(
-                    _OUTPUT_DIR,
-                    paths.replace_extension(src.short_path, ".elc"),
-                ),
-            ) if relocate_output else ctx.actions.declare_file(
-                paths.replace_extension(src.basename, ".elc"),
-                sibling = src,
-            )
-        )
+        out = _compiled_file(ctx, src, ".elc", relocate_output)
+        native_out = _compiled_file(
+            ctx,
+            src,
+            ".eln.d",
+            relocate_output,
+            directory = True,
+        ) if native_compile else None
+        outputs = [out] + ([native_out] if native_out else [])
         args = []
         inputs = depset(
             # Add all source files as input files so they can load each other
@@ -657,7 +1391,7 @@ def _compile(ctx, srcs, deps, load_path):
                     root = "EXECUTION_ROOT",
                     loadPath = flat_load_path,
                     inputFiles = [f.path for f in inputs.to_list()],
-                    outputFiles = [out.path],
+                    outputFiles = [f.path for f in outputs],
                     tags = ctx.attr.tags,
                 ).to_json(),
             )
@@ -682,13 +1416,32 @@ def _compile(ctx, srcs, deps, load_path):
                 expand_directories = False,
             ).add_all(
                 ["--fatal-warnings"] if ctx.attr.fatal_warnings else [],
+            ).add_all(
+                ctx.attr.allowed_warnings,
+                before_each = "--allow-warning",
+            ).add_all(
+                ["--require-lexical-binding"] if (
+                    ctx.attr.require_lexical_binding and
+                    src not in ctx.files.dynamic_binding_srcs
+                ) else [],
+            ).add_all(
+                ["--check-declared-features"] if (
+                    ctx.attr.check_declared_features and
+                    src not in ctx.files.mismatched_feature_srcs
+                ) else [],
+            ).add_all(
+                ["--native-compile", native_out] if native_out else [],
+            ).add_all(
+                ["--cache-directory", toolchain.compile_cache] if (
+                    toolchain.compile_cache
+                ) else [],
             ),
             "--funcall=elisp/compile-batch-and-exit",
             src.path,
             out.path,
         ]
         ctx.actions.run(
-            outputs = [out],
+            outputs = outputs,
             inputs = inputs,
             executable = emacs.files_to_run,
             arguments = args,
@@ -699,10 +1452,24 @@ def _compile(ctx, srcs, deps, load_path):
             use_default_shell_env = toolchain.use_default_shell_env,
             execution_requirements = toolchain.execution_requirements,
         )
-        outs.append(out)
+        outs += outputs
+        load_files.append(out)
+        if native_out:
+            # When loading a byte-compiled file, Emacs only looks for the
+            # natively-compiled file if the source file is next to it.  The
+            # launcher adds the output directory to native-comp-eln-load-path.
+            if relocate_output:
+                link = ctx.actions.declare_file(
+                    paths.join(_OUTPUT_DIR, src.short_path),
+                )
+                ctx.actions.symlink(output = link, target_file = src)
+                outs.append(link)
+            else:
+                outs.append(src)
 
     return struct(
         outs = outs,
+        load_files = load_files,
         load_path = resolved_load_path,
         runfiles = ctx.runfiles(transitive_files = transitive_data),
         transitive_load_path = transitive_load_path,
@@ -730,10 +1497,10 @@ def _binary(ctx, srcs, tags, substitutions):
     toolchain = _toolchain(ctx)
     emacs = toolchain.emacs
 
-    # Only pass in data files when needed.
-    data_files_for_manifest = (
-        result.runfiles.files.to_list() if toolchain.wrap else []
-    )
+    # Always pass in data files, because Emacs Lisp code can check the
+    # manifest for declared input files even if the toolchain doesn’t wrap
+    # Emacs.
+    data_files_for_manifest = result.runfiles.files.to_list()
 
     # If we’re supposed to generate coverage information, use source files in
     # addition to compiled files because we can’t instrument compiled files for
@@ -788,21 +1555,32 @@ def _binary(ctx, srcs, tags, substitutions):
         template = ctx.file._template,
         output = driver,
         substitutions = dicts.add({
-            "[[directory]]": cpp_strings([
+            # Load path entries can differ only in their directory for build
+            # actions, see _compile.
+            "[[directory]]": cpp_strings(collections.uniq([
                 check_relative_filename(dir.for_runfiles)
                 for dir in result.transitive_load_path.to_list()
+            ])),
+            "[[eln_directory]]": cpp_strings([
+                runfile_location(ctx, file)
+                for file in result.transitive_outs.to_list()
+                if file.is_directory and file.basename.endswith(".eln.d")
             ]),
             "[[emacs]]": cpp_string(
                 runfile_location(ctx, emacs.files_to_run.executable),
             ),
             "[[load]]": cpp_strings(
-                [runfile_location(ctx, src) for src in result.outs],
+                [runfile_location(ctx, src) for src in result.load_files],
             ),
             "[[data]]": cpp_strings([
                 runfile_location(ctx, file)
                 for file in data_files_for_manifest
             ] + links.keys()),
             "[[mode]]": "kWrap" if toolchain.wrap else "kDirect",
+            "[[native_compile]]": (
+                "true" if toolchain.native_compilation else "false"
+            ),
+            "[[preload]]": cpp_strings(ctx.attr.preload),
             "[[tags]]": cpp_strings(collections.uniq(ctx.attr.tags + tags)),
         }, substitutions),
     )
@@ -846,4 +1624,116 @@ def _load_directory_for_actions(directory):
 # Directory relative to the current package where to store compiled files.
 # This equivalent to _objs for C++ rules.  See
 # https://docs.bazel.build/versions/3.1.0/output_directories.html#layout-diagram.
+def _compiled_file(ctx, src, extension, relocate_output, directory = False):
+    """Declares an output file for a compiled Emacs Lisp source file.
+
+    Args:
+      ctx: rule context
+      src: File object denoting the Emacs Lisp source file
+      extension: file extension of the output file, e.g., “.elc”
+      relocate_output: whether to put the output file into a separate
+          directory instead of next to the source file
+      directory: whether to declare an output directory instead of a file
+
+    Returns:
+      a File object for the output file
+    """
+
+    # Compressed source files still result in uncompressed output files.
+    short_path = _strip_suffix(src.short_path, ".gz")
+    if directory:
+        declare = ctx.actions.declare_directory
+    else:
+        declare = ctx.actions.declare_file
+    if relocate_output:
+        return declare(
+            paths.join(
+                _OUTPUT_DIR,
+                paths.replace_extension(short_path, extension),
+            ),
+        )
+    return declare(
+        paths.replace_extension(paths.basename(short_path), extension),
+        sibling = src,
+    )
+
+def _expand_test_arg(ctx, arg):
+    """Expands location references and “Make” variables in a test argument.
+
+    Location references expand to `$(rlocation …)` placeholders, which the
+    test binary resolves at runtime using the runfiles library.  Literal
+    dollar signs stay escaped as `$$` so that the test binary can tell them
+    apart from placeholders.
+
+    Args:
+      ctx (ctx): rule context
+      arg (string): an element of the `test_args` attribute
+
+    Returns:
+      the expanded argument
+    """
+    result = ""
+    rest = arg
+
+    # Starlark has no “while” loop, but each iteration consumes at least one
+    # character.
+    for _ in range(len(arg)):
+        index = rest.find("$")
+        if index < 0:
+            break
+        result += rest[:index]
+        rest = rest[index:]
+        if rest.startswith("$$"):
+            result += "$$"
+            rest = rest[2:]
+            continue
+        if not rest.startswith("$("):
+            fail("invalid dollar sign in test argument {}".format(arg))
+        end = rest.find(")")
+        if end < 0:
+            fail("unterminated reference in test argument {}".format(arg))
+        reference = rest[2:end]
+        rest = rest[end + 1:]
+        words = reference.split(" ")
+        if len(words) == 2 and words[0] in _LOCATION_FUNCTIONS:
+            targets = ctx.attr.srcs + ctx.attr.data
+            files = ctx.expand_location(
+                "$(rootpaths {})".format(words[1]),
+                targets,
+            ).split(" ")
+            if not words[0].endswith("s") and len(files) != 1:
+                fail("$({}) in test argument {} expands to {} files".format(
+                    reference,
+                    arg,
+                    len(files),
+                ))
+            result += " ".join([
+                "$(rlocation {})".format(check_relative_filename(
+                    paths.join(ctx.workspace_name, path),
+                ))
+                for path in files
+            ])
+        elif len(words) == 1 and words[0] in ctx.var:
+            result += ctx.var[words[0]].replace("$", "$$")
+        else:
+            fail("unknown reference $({}) in test argument {}".format(
+                reference,
+                arg,
+            ))
+    return result + rest
+
+_LOCATION_FUNCTIONS = ["location", "locations", "rootpath", "rootpaths"]
+
+def _strip_suffix(string, suffix):
+    """Removes a suffix from a string if present.
+
+    Args:
+      string: the string to remove the suffix from
+      suffix: the suffix to remove
+
+    Returns:
+      the string without the suffix
+    """
+    return string[:-len(suffix)] if string.endswith(suffix) else string
+
 _OUTPUT_DIR = "_elisp"
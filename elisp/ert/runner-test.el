@@ -0,0 +1,269 @@
+;;; runner-test.el --- unit test for runner.el  -*- lexical-binding: t; -*-
+
+;; Copyright 2021 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+;;; Commentary:
+
+;; Unit tests for runner.el.  The integration tests in //tests:ert_test
+;; cover complete test runs.
+
+;;; Code:
+
+(require 'elisp/ert/runner)
+
+(require 'ert)
+
+(defun elisp/ert/runner-test--config (&rest variables)
+  "Return the test configuration for the environment VARIABLES.
+Each element of VARIABLES is of the form NAME=VALUE.  Only the
+required variables and VARIABLES are set."
+  (let ((process-environment
+         `("TEST_SRCDIR=/src" "TEST_TMPDIR=/tmp" ,@variables)))
+    (elisp/ert/read--config)))
+
+(ert-deftest elisp/ert/read--config/defaults ()
+  (let ((config (elisp/ert/runner-test--config)))
+    (should (elisp/ert/run--config-p config))
+    (should (equal (elisp/ert/config--temp-dir config) "/tmp"))
+    (should (equal (elisp/ert/config--suite-name config) "ERT"))
+    (should (eq (elisp/ert/config--report-writer config)
+                #'elisp/ert/write--junit-report))
+    (should-not (elisp/ert/config--report-file config))
+    (should (equal (elisp/ert/config--timestamp-format config) "%FT%T"))
+    (should (eql (elisp/ert/config--shard-count config) 1))
+    (should (eql (elisp/ert/config--shard-index config) 0))
+    (should (eql (elisp/ert/config--jobs config) 1))
+    (should (eql (elisp/ert/config--retries config) 0))
+    (should (eql (elisp/ert/config--output-limit config) 65536))
+    (should (equal (elisp/ert/config--random-seed config) ""))
+    (should (elisp/ert/config--ordering-seed config))
+    (should-not (elisp/ert/config--check-globals config))
+    (should (memq 'load-path (elisp/ert/config--globals config)))
+    (should-not (elisp/ert/config--keep-going config))
+    (should-not (elisp/ert/config--coverage-enabled config))
+    (should-not (elisp/ert/config--cobertura-file config))
+    (should-not (elisp/ert/config--profile config))))
+
+(ert-deftest elisp/ert/read--config/values ()
+  (let ((config (elisp/ert/runner-test--config
+                 "XML_OUTPUT_FILE=/out/test.xml"
+                 "ELISP_TEST_SUMMARY_FILE=/out/summary.json"
+                 "ELISP_TEST_TIMESTAMP_FORMAT=rfc3339"
+                 "ELISP_TEST_CHECK_GLOBALS=strict"
+                 "ELISP_TEST_GLOBALS=foo bar"
+                 "ELISP_TEST_KEEP_GOING=1"
+                 "ELISP_TEST_DOCTESTS=0"
+                 "ELISP_TEST_PROFILE=cpu"
+                 "TEST_UNDECLARED_OUTPUTS_DIR=/outputs"
+                 "ELISP_TEST_PROGRESS_FD=3"
+                 "TEST_RANDOMIZE_ORDERING_SEED=123")))
+    (should (equal (elisp/ert/config--report-file config) "/:/out/test.xml"))
+    (should (equal (elisp/ert/config--summary-file config)
+                   "/:/out/summary.json"))
+    (should (equal (elisp/ert/config--timestamp-format config) "%FT%T%:z"))
+    (should (eq (elisp/ert/config--check-globals config) 'strict))
+    (should (memq 'foo (elisp/ert/config--globals config)))
+    (should (memq 'bar (elisp/ert/config--globals config)))
+    (should (eq (elisp/ert/config--keep-going config) t))
+    (should-not (elisp/ert/config--doctests config))
+    (should (eq (elisp/ert/config--profile config) 'cpu))
+    (should (equal (elisp/ert/config--output-directory config) "/:/outputs/"))
+    (should (equal (elisp/ert/config--profile-file config)
+                   "/:/outputs/emacs.profile"))
+    (should (equal (elisp/ert/config--progress-file config) "/:/dev/fd/3"))
+    (should (equal (elisp/ert/config--ordering-seed config) "123"))))
+
+(ert-deftest elisp/ert/read--config/empty ()
+  ;; Setting a variable to the empty string is the same as not setting it.
+  (let ((config (elisp/ert/runner-test--config "ELISP_TEST_RETRIES="
+                                               "ELISP_TEST_REPORT_FORMAT=")))
+    (should (eql (elisp/ert/config--retries config) 0))
+    (should (eq (elisp/ert/config--report-writer config)
+                #'elisp/ert/write--junit-report))))
+
+(ert-deftest elisp/ert/read--config/tap ()
+  (let ((config (elisp/ert/runner-test--config
+                 "XML_OUTPUT_FILE=/out/test.xml"
+                 "ELISP_TEST_REPORT_FORMAT=tap")))
+    (should (eq (elisp/ert/config--report-writer config)
+                #'elisp/ert/write--tap-report))
+    ;; The TAP report goes to standard output by default.
+    (should-not (elisp/ert/config--report-file config)))
+  (let ((config (elisp/ert/runner-test--config
+                 "XML_OUTPUT_FILE=/out/test.xml" "ELISP_TEST_REPORT_FORMAT=tap"
+                 "ELISP_TEST_REPORT_FILE=/out/test.tap")))
+    (should (equal (elisp/ert/config--report-file config)
+                   "/:/out/test.tap"))))
+
+(ert-deftest elisp/ert/read--config/suite-name ()
+  (should (equal (elisp/ert/config--suite-name
+                  (elisp/ert/runner-test--config "TEST_TARGET=//pkg:test"))
+                 "//pkg:test"))
+  (should (equal (elisp/ert/config--suite-name
+                  (elisp/ert/runner-test--config
+                   "TEST_TARGET=//pkg:test" "ELISP_TEST_SUITE_NAME=suite"))
+                 "suite"))
+  (should (equal (elisp/ert/config--suite-name
+                  (elisp/ert/runner-test--config "ELISP_TEST_SUITE_NAME=suite"
+                                                 "ELISP_TEST_MATRIX=1"))
+                 (format "suite (Emacs %s)" emacs-version))))
+
+(ert-deftest elisp/ert/read--config/invalid ()
+  (dolist (variable '("TEST_SHARD_INDEX=1"
+                      "ELISP_TEST_TIMESTAMP_FORMAT=iso"
+                      "ELISP_TEST_LIST=xml"
+                      "ELISP_TEST_NETWORK=yes"
+                      "ELISP_TEST_DOCTESTS=2"
+                      "ELISP_TEST_KEEP_GOING=true"
+                      "ELISP_TEST_SUITE_NAME= suite"
+                      "ELISP_TEST_CHECK_GLOBALS=error"
+                      "ELISP_TEST_FAIL_ON_MESSAGE=\\("
+                      "ELISP_TEST_PROGRESS_FD=stderr"
+                      "ELISP_TEST_PROFILE=cpu"
+                      "ELISP_TEST_PROFILE=disk"
+                      "ELISP_TEST_COVERAGE_FORMAT=cobertura"
+                      "ELISP_TEST_COVERAGE_FORMAT=html"
+                      "ELISP_TEST_REPORT_FORMAT=html"
+                      "ELISP_TEST_CHANGED_FILES=/changed.txt"
+                      "ELISP_TEST_JOBS=0"
+                      "ELISP_TEST_RETRIES=-1"
+                      "COVERAGE=1"))
+    (ert-info (variable :prefix "Variable: ")
+      (should-error (elisp/ert/runner-test--config variable))))
+  (should-error (elisp/ert/runner-test--config "ELISP_TEST_REPORT_FORMAT=tap"
+                                               "ELISP_TEST_REPORT_STDOUT=1"))
+  (let ((process-environment '("TEST_TMPDIR=/tmp")))
+    (should-error (elisp/ert/read--config)))
+  (let ((process-environment '("TEST_SRCDIR=/src")))
+    (should-error (elisp/ert/read--config))))
+
+(ert-deftest elisp/ert/final--result/check-globals ()
+  (let ((result (make-ert-test-passed :messages "" :should-forms nil)))
+    (should (eq (elisp/ert/final--result
+                 (elisp/ert/runner-test--config
+                  "ELISP_TEST_CHECK_GLOBALS=warn")
+                 result '(load-path) "")
+                result))
+    (let ((final (elisp/ert/final--result
+                  (elisp/ert/runner-test--config
+                   "ELISP_TEST_CHECK_GLOBALS=strict")
+                  result '(load-path) "")))
+      (should (ert-test-failed-p final))
+      (should (equal (ert-test-result-with-condition-condition final)
+                     '(elisp/ert/global-state load-path))))))
+
+(ert-deftest elisp/ert/final--result/fail-on-message ()
+  (let ((config (elisp/ert/runner-test--config
+                 "ELISP_TEST_FAIL_ON_MESSAGE=^Warning:"))
+        (result (make-ert-test-passed :messages "Loading foo\n"
+                                      :should-forms nil)))
+    (should (eq (elisp/ert/final--result config result nil "Output\n")
+                result))
+    (let ((final (elisp/ert/final--result config result nil
+                                          "Warning: bad\n")))
+      (should (ert-test-failed-p final))
+      (should (equal (ert-test-result-with-condition-condition final)
+                     '(elisp/ert/matching-message "Warning: bad"))))))
+
+(ert-deftest elisp/ert/add--test-report ()
+  (let ((results (elisp/ert/make--run-results)))
+    (should-not (elisp/ert/add--test-report
+                 results '(testcase ((name . "pass") (time . "1.5")))))
+    (should-not (elisp/ert/add--test-report
+                 results '(testcase ((name . "skip") (time . "0"))
+                                    (skipped ((message . "skipped"))))))
+    (should (elisp/ert/add--test-report
+             results '(testcase ((name . "fail") (time . "0.5"))
+                                (failure ((message . "failed"))))))
+    (should (elisp/ert/add--test-report
+             results '(testcase ((name . "error") (time . "0"))
+                                (properties
+                                 ()
+                                 (property ((name . "warning")
+                                            (value . "careful"))))
+                                (error ((message . "error"))))))
+    (should (equal (mapcar (lambda (report) (alist-get 'name (cadr report)))
+                           (elisp/ert/results--test-reports results))
+                   '("error" "fail" "skip" "pass")))
+    (should (eql (elisp/ert/results--errors results) 1))
+    (should (eql (elisp/ert/results--failures results) 1))
+    (should (eql (elisp/ert/results--skipped results) 1))
+    (should (eql (elisp/ert/results--unexpected results) 2))
+    (should (eql (elisp/ert/results--warnings results) 1))
+    (should (= (float-time (elisp/ert/results--suite-time results)) 2))))
+
+(ert-deftest elisp/ert/add--missing-tests ()
+  (let* ((passed (make-ert-test :name 'elisp/ert/runner-test--passed))
+         (not-run (make-ert-test :name 'elisp/ert/runner-test--not-run))
+         (missing (make-ert-test :name 'elisp/ert/runner-test--missing))
+         (results (elisp/ert/make--run-results
+                   :tests (list passed not-run missing)
+                   :not-run (list not-run)
+                   :not-run-message "Not run")))
+    (elisp/ert/add--test-report
+     results
+     '(testcase ((name . "elisp/ert/runner-test--passed") (time . "0"))))
+    (elisp/ert/add--missing-tests results)
+    (should-not (elisp/ert/results--not-run results))
+    (should (eql (length (elisp/ert/results--test-reports results)) 3))
+    (should (eql (elisp/ert/results--skipped results) 1))
+    (should (eql (elisp/ert/results--errors results) 1))
+    (should (eql (elisp/ert/results--unexpected results) 1))
+    (let ((reports (elisp/ert/results--test-reports results)))
+      (should (equal (alist-get 'name (cadr (nth 0 reports)))
+                     "elisp/ert/runner-test--missing"))
+      (should (equal (car (nth 2 (nth 0 reports))) 'error))
+      (should (equal (alist-get 'name (cadr (nth 1 reports)))
+                     "elisp/ert/runner-test--not-run"))
+      (should (equal (nth 2 (nth 1 reports))
+                     '(skipped ((message . "Not run"))))))))
+
+(ert-deftest elisp/ert/suite--report ()
+  (let ((config (elisp/ert/runner-test--config "ELISP_TEST_SUITE_NAME=suite"))
+        (results (elisp/ert/make--run-results :start-time 0)))
+    (elisp/ert/add--test-report
+     results '(testcase ((name . "b") (time . "1"))))
+    (elisp/ert/add--test-report
+     results '(testcase ((name . "a") (time . "2"))
+                        (failure ((message . "failed")))))
+    (let* ((report (elisp/ert/suite--report config results nil))
+           (attributes (cadr report)))
+      (should (eq (car report) 'testsuite))
+      (should (equal (alist-get 'name attributes) "suite"))
+      (should (equal (alist-get 'tests attributes) "2"))
+      (should (equal (alist-get 'errors attributes) "0"))
+      (should (equal (alist-get 'failures attributes) "1"))
+      (should (equal (alist-get 'skipped attributes) "0"))
+      (should-not (assq 'warnings attributes))
+      (should (equal (mapcar (lambda (node) (alist-get 'name (cadr node)))
+                             (xml-get-children report 'testcase))
+                     '("a" "b")))
+      ;; Building the report doesn’t modify the results.
+      (should (equal (mapcar (lambda (node) (alist-get 'name (cadr node)))
+                             (elisp/ert/results--test-reports results))
+                     '("a" "b"))))))
+
+(ert-deftest elisp/ert/sensitive--variable-p ()
+  (dolist (name '("API_TOKEN" "SSH_KEYS" "APIKEY" "GITHUBTOKEN" "MYPASSWORD"
+                  "DBPASSWD" "aws_secret_access_key" "SESSION_ID"
+                  "HTTP_COOKIES"))
+    (ert-info (name :prefix "Variable: ")
+      (should (elisp/ert/sensitive--variable-p name))))
+  (dolist (name '("PATH" "MONKEY_PATH" "TOKENIZER_DIR" "KEYBOARD_LAYOUT"
+                  "AUTHOR" "SESSIONIZE"))
+    (ert-info (name :prefix "Variable: ")
+      (should-not (elisp/ert/sensitive--variable-p name)))))
+
+;;; runner-test.el ends here
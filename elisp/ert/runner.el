@@ -29,34 +29,575 @@
 (require 'debug)
 (require 'edebug)
 (require 'ert)
+(require 'find-func)
 (require 'format)
+(require 'json)
 (require 'nadvice)
 (require 'pp)
+(require 'profiler)
 (require 'rx)
 (require 'subr-x)
 (require 'trampver)  ; load eagerly to work around Bug#11218
 (require 'xml)
 
+;; Don’t load the runfiles library eagerly, so that tests can still collect
+;; coverage information for it.
+(declare-function elisp/runfiles/check-declared "elisp/runfiles/runfiles"
+                  (filename &optional manifest))
+(declare-function elisp/runfiles/rlocation "elisp/runfiles/runfiles"
+                  (filename &optional runfiles))
+
 (add-to-list 'command-switch-alist
              (cons "--test-source" #'elisp/ert/test-source))
 (add-to-list 'command-switch-alist (cons "--skip-test" #'elisp/ert/skip-test))
 (add-to-list 'command-switch-alist (cons "--skip-tag" #'elisp/ert/skip-tag))
+(add-to-list 'command-switch-alist
+             (cons "--isolate-test-sources" #'elisp/ert/isolate-test-sources))
+(add-to-list 'command-switch-alist
+             (cons "--pre-test-load" #'elisp/ert/pre-test-load))
+(add-to-list 'command-switch-alist
+             (cons "--pre-test-eval" #'elisp/ert/pre-test-eval))
+(add-to-list 'command-switch-alist
+             (cons "--preload-feature" #'elisp/ert/preload-feature))
+(add-to-list 'command-switch-alist
+             (cons "--update-goldens" #'elisp/ert/update-goldens))
+(add-to-list 'command-switch-alist (cons "--test-arg" #'elisp/ert/test-arg))
+(add-to-list 'command-switch-alist (cons "--erts-file" #'elisp/ert/erts-file))
 
 (defvar elisp/ert/test--sources ()
   "Test source files to be loaded.
 This list is populated by --test-source command-line options.")
 
+(defvar elisp/ert/erts--files ()
+  "Data-driven test files in erts format.
+This list is populated by --erts-file command-line options.")
+
+(defvar elisp/ert/isolate--sources nil
+  "Whether to run the tests of each source file in a separate process.
+This is set by the --isolate-test-sources command-line option.")
+
+(defvar elisp/ert/pre-test--actions ()
+  "Setup actions to perform before loading the test source files.
+Each element is of the form (load . FILE) or (eval . FORM), where
+FORM is a string.  The list is in reverse order.  This list is
+populated by --pre-test-load and --pre-test-eval command-line
+options.")
+
+(defvar elisp/ert/preload--features ()
+  "Features to require before loading the test source files.
+This list is populated by --preload-feature command-line options.")
+
+(defvar elisp/ert/update--goldens nil
+  "Whether ‘elisp/ert/assert-golden’ should write new golden files.
+This is set by the --update-goldens command-line option.")
+
+(defvar elisp/ert/branch--coverage nil
+  "Whether to collect branch coverage information.
+This is bound to non-nil if the environment variable
+ELISP_TEST_BRANCH_COVERAGE is set to 1.")
+
+(defvar elisp/ert/function--coverage nil
+  "Whether to report function coverage per top-level definition.
+This is bound to non-nil if the environment variable
+ELISP_TEST_FUNCTION_COVERAGE is set to 1.")
+
+(defvar elisp/ert/print--level 8
+  "Value of ‘print-level’ for failure messages.
+This is bound to the value of the environment variable
+ELISP_TEST_PRINT_LEVEL if that is set.")
+
+(defvar elisp/ert/print--length 50
+  "Value of ‘print-length’ for failure messages.
+This is bound to the value of the environment variable
+ELISP_TEST_PRINT_LENGTH if that is set.")
+
+(defvar elisp/ert/test--warnings nil
+  "Warnings that ‘elisp/ert/should-warn’ recorded, in reverse order.
+The test runner binds this variable around each test.")
+
+(defvar elisp/ert/output-directory nil
+  "Directory for test artifacts, or nil if there is none.
+The test runner sets this variable to the value of the
+environment variable TEST_UNDECLARED_OUTPUTS_DIR, or
+ELISP_TEST_OUTPUT_DIR if the former isn’t set, and ensures that
+the directory exists.  Tests can write files to this directory to
+retrieve them after the test has finished.  If a test fails, the
+XML report lists the files that the test has created in this
+directory.")
+
 ;; Customizable Edebug behavior only appeared in Emacs 27.
 (defvar edebug-behavior-alist)
 (defvar edebug-after-instrumentation-function)
 (defvar edebug-new-definition-function)
 
+(defvar elisp/ert/terminal--mode nil
+  "Whether the tests run in an interactive Emacs on a terminal.
+‘elisp/ert/run-terminal-and-exit’ binds this variable.")
+
+(defun elisp/ert/run-terminal-and-exit ()
+  "Run ERT tests in an interactive Emacs on a terminal.
+This is like ‘elisp/ert/run-batch-and-exit’, but for the
+terminal mode of the ‘elisp_test’ rule.  As in batch mode,
+messages also go to standard error, and an uncaught error exits
+Emacs with status 255."
+  (when noninteractive
+    (error "This function works only in interactive mode"))
+  (advice-add #'message :after #'elisp/ert/message--to-stderr)
+  (let ((elisp/ert/terminal--mode t))
+    (condition-case err
+        (elisp/ert/run-batch-and-exit)
+      (error (elisp/ert/message--to-stderr
+              "%s" (error-message-string err))
+             (kill-emacs 255)))))
+
+(defun elisp/ert/message--to-stderr (format-string &rest args)
+  "Print a message to standard error like Emacs does in batch mode.
+This can be used as ‘:after’ advice for ‘message’.  FORMAT-STRING
+and ARGS are as for ‘message’."
+  (when format-string
+    (princ (concat (apply #'format-message format-string args) "\n")
+           #'external-debugging-output)))
+
+(cl-defstruct (elisp/ert/run--config
+               (:constructor elisp/ert/make--run-config)
+               (:conc-name elisp/ert/config--)
+               (:copier nil))
+  "Settings of a test run.
+‘elisp/ert/read--config’ reads them from the environment at the
+start of the run, so that the rest of the test runner doesn’t
+need to look at environment variables.  Unless noted otherwise,
+filenames are absolute and quoted using “/:”, and nil means that
+the corresponding file shouldn’t be written."
+  (temp-dir nil :type string :documentation "Value of TEST_TMPDIR.")
+  (report-file
+   nil
+   :type (or null string)
+   :documentation "File for the test report.  If nil, write the
+report to standard output.")
+  (report-writer
+   nil
+   :type function
+   :documentation "Function that writes the test report.  It
+receives the report file and the report as XML node.")
+  (report-stdout
+   nil
+   :type boolean
+   :documentation "Whether to also print the JUnit report to
+standard output.")
+  (report-hook nil :type (or null string)
+               :documentation "File that post-processes the report.")
+  (summary-file nil :type (or null string)
+                :documentation "File for the JSON summary.")
+  (stream-file nil :type (or null string)
+               :documentation "File for partial JUnit reports.")
+  (warnings-file nil :type (or null string)
+                 :documentation "File for warnings that tests generate.")
+  (progress-file nil :type (or null string)
+                 :documentation "File for progress events.")
+  (benchmark-file nil :type (or null string)
+                  :documentation "File for benchmark results.")
+  (suite-name nil :type string :documentation "Name of the test suite.")
+  (timestamp-format nil :type string
+                    :documentation "Format of the report timestamp.")
+  (environment-properties
+   nil
+   :type list
+   :documentation "Report properties for the environment
+variables, see ‘elisp/ert/environment--properties’.")
+  (random-seed nil :type string :documentation "Value of TEST_RANDOM_SEED.")
+  (ordering-seed nil :type string
+                 :documentation "Seed for shuffling the tests.")
+  (shard-count 1 :type natnum :documentation "Number of shards.")
+  (shard-index 0 :type natnum :documentation "Index of this shard.")
+  (shard-status-file nil :type (or null string)
+                     :documentation "Value of TEST_SHARD_STATUS_FILE.")
+  (selector nil :documentation "ERT selector for the tests to run.")
+  (changed-files
+   nil
+   :type list
+   :documentation "If non-nil, only run the tests affected by
+these files, see ‘elisp/ert/affected--tests’.")
+  (coverage-map nil :type list
+                :documentation "Files that each test has touched.")
+  (list-format
+   nil
+   :type (or null string)
+   :documentation "If non-nil, only list the selected tests in
+this format, see ‘elisp/ert/list--tests’.")
+  (dry-run-report nil :type boolean
+                  :documentation "Whether to write a dry-run report.")
+  (isolated-source
+   nil
+   :type (or null string)
+   :documentation "If non-nil, the only test source file that this
+process loads, see ‘elisp/ert/run--isolated’.")
+  (isolate
+   nil
+   :type boolean
+   :documentation "Whether to run the tests of each test source
+file in a separate subordinate process instead of loading them.")
+  (jobs 1 :type natnum :documentation "Number of parallel processes.")
+  (total-timeout nil :type (or null number)
+                 :documentation "Timeout of the whole test run.")
+  (test-timeout nil :type (or null number)
+                :documentation "Timeout of each test.")
+  (retries 0 :type natnum :documentation "Retries for failing tests.")
+  (fail-fast nil :type boolean
+             :documentation "Whether to stop after the first failure.")
+  (max-failures nil :type (or null natnum)
+                :documentation "Stop after that many unexpected results.")
+  (keep-going nil :type boolean
+              :documentation "Whether setup errors aren’t fatal.")
+  (doctests nil :type boolean
+            :documentation "Whether to run docstring examples.")
+  (network nil :type boolean
+           :documentation "Whether tests may access the network.")
+  (keep-temp-dirs nil :type boolean
+                  :documentation "Whether to keep directories of failed tests.")
+  (check-globals
+   nil
+   :type (member nil warn strict)
+   :documentation "Whether to check for modified global variables.
+If ‘strict’, tests that modify them fail.")
+  (globals nil :type list :documentation "Global variables to check.")
+  (fail-on-message
+   nil
+   :type (or null string)
+   :documentation "Regular expression for messages that make tests
+fail, see ‘elisp/ert/final--result’.")
+  (strict-should-error nil :type boolean
+                       :documentation "Whether ‘should-error’ is strict.")
+  (clean-advice nil :type boolean
+                :documentation "Whether to remove leaked advice.")
+  (memory-usage nil :type boolean
+                :documentation "Whether to measure allocated memory.")
+  (gc-per-test nil :type boolean
+               :documentation "Whether to count garbage collections.")
+  (output-directory nil :type (or null string)
+                    :documentation "Directory for test artifacts.")
+  (output-limit 65536 :type natnum
+                :documentation "Maximum length of test output.")
+  (print-level nil :type (or null natnum)
+               :documentation "Print level for failure messages.")
+  (print-length nil :type (or null natnum)
+                :documentation "Print length for failure messages.")
+  (slow-threshold nil :type (or null number)
+                  :documentation "Report tests slower than this.")
+  (slow-count 10 :type natnum
+              :documentation "Maximum number of slow tests to report.")
+  (benchmark-iterations nil :type (or null natnum)
+                        :documentation "Iterations of benchmark tests.")
+  (benchmark-warmup 1 :type natnum
+                    :documentation "Warmup runs of benchmark tests.")
+  (duration-samples nil :type (or null natnum)
+                    :documentation "Number of duration samples per test.")
+  (profile nil :type (member nil cpu mem) :documentation "Profiler mode.")
+  (profile-file nil :type (or null string)
+                :documentation "File for the profile.")
+  (coverage-enabled nil :type boolean
+                    :documentation "Whether coverage is enabled.")
+  (coverage-manifest nil :type (or null string)
+                     :documentation "Files to instrument.")
+  (coverage-file nil :type (or null string)
+                 :documentation "File for the LCOV coverage report.")
+  (coverage-exclude nil :type list
+                    :documentation "Patterns of files to omit from coverage.")
+  (coverage-per-test-file nil :type (or null string)
+                          :documentation "File for per-test coverage.")
+  (cobertura-file nil :type (or null string)
+                  :documentation "File for the Cobertura report.")
+  (branch-coverage nil :type boolean
+                   :documentation "Whether to report branch coverage.")
+  (function-coverage nil :type boolean
+                     :documentation "Whether to report function coverage."))
+
+(cl-defstruct (elisp/ert/run--results
+               (:constructor elisp/ert/make--run-results)
+               (:conc-name elisp/ert/results--)
+               (:copier nil))
+  "Results of a test run so far.
+‘elisp/ert/add--test-report’ adds test cases and updates the
+counts."
+  (tests nil :type list :documentation "Selected tests.")
+  (test-reports
+   nil
+   :type list
+   :documentation "‘testcase’ XML nodes of the tests that have
+finished, in reverse order.")
+  (not-run nil :type list :documentation "Tests that didn’t run.")
+  (not-run-message
+   "Test not run in fail-fast mode"
+   :type string
+   :documentation "Skip message for the tests in ‘not-run’.")
+  (current-test
+   nil
+   :type (or null ert-test)
+   :documentation "Test that is currently running in this
+process, if any.")
+  (errors 0 :type natnum :documentation "Number of errors.")
+  (failures 0 :type natnum :documentation "Number of failures.")
+  (skipped 0 :type natnum :documentation "Number of skipped tests.")
+  (warnings 0 :type natnum :documentation "Number of warnings.")
+  (unexpected 0 :type natnum :documentation "Number of unexpected results.")
+  (suite-time
+   0
+   :documentation "Sum of the test durations, so that it doesn’t
+include the overhead of the runner itself.")
+  (start-time nil :documentation "Time when the tests started.")
+  (setup-time 0 :documentation "Time it took to load the tests.")
+  (gcs-before
+   0
+   :type natnum
+   :documentation "Value of ‘gcs-done’ when the tests started.")
+  (gc-elapsed-before
+   0
+   :type number
+   :documentation "Value of ‘gc-elapsed’ when the tests started."))
+(defun elisp/ert/read--config ()
+  "Read the settings of a test run from the environment.
+Return an ‘elisp/ert/run--config’ object.  Signal an error if an
+environment variable has an invalid value, so that a
+misconfigured test fails before loading or running any tests."
+  (let* ((temp-dir (elisp/ert/env--string "TEST_TMPDIR"))
+         (coverage-enabled (equal (getenv "COVERAGE") "1"))
+         (coverage-manifest (elisp/ert/env--file "COVERAGE_MANIFEST"))
+         ;; Normally Bazel sets COVERAGE_DIR and merges the coverage files in
+         ;; that directory into COVERAGE_OUTPUT_FILE.  If only the latter is
+         ;; set, write the coverage report there directly.
+         (coverage-file (let ((dir (elisp/ert/env--file "COVERAGE_DIR")))
+                          (if dir (expand-file-name "emacs-lisp.dat" dir)
+                            (elisp/ert/env--file "COVERAGE_OUTPUT_FILE"))))
+         (shard-count (elisp/ert/env--number "TEST_TOTAL_SHARDS" 1))
+         (shard-index (elisp/ert/env--number "TEST_SHARD_INDEX" 0))
+         (list-format (elisp/ert/env--string "ELISP_TEST_LIST"))
+         (dry-run-report (equal (getenv "ELISP_TEST_DRY_RUN_REPORT") "1"))
+         (isolated-source (elisp/ert/env--string "ELISP_TEST_ISOLATED_SOURCE"))
+         (output-directory
+          (let ((dir (or (elisp/ert/env--string "TEST_UNDECLARED_OUTPUTS_DIR")
+                         (elisp/ert/env--string "ELISP_TEST_OUTPUT_DIR"))))
+            (and dir (file-name-as-directory
+                      (concat "/:" (expand-file-name dir))))))
+         (profile (elisp/ert/env--choice "ELISP_TEST_PROFILE"
+                                         '(("cpu" . cpu) ("mem" . mem))))
+         (report-file (elisp/ert/env--file "XML_OUTPUT_FILE"))
+         ;; Both report writers receive the report as XML node.  Unless
+         ;; overridden, the JUnit report goes to XML_OUTPUT_FILE, and the TAP
+         ;; report goes to standard output.
+         (report-writer
+          (elisp/ert/env--choice "ELISP_TEST_REPORT_FORMAT"
+                                 '(("junit" . elisp/ert/write--junit-report)
+                                   ("tap" . elisp/ert/write--tap-report))
+                                 #'elisp/ert/write--junit-report))
+         (report-stdout (equal (getenv "ELISP_TEST_REPORT_STDOUT") "1"))
+         (summary-file (elisp/ert/env--file "ELISP_TEST_SUMMARY_FILE"))
+         (coverage-per-test-file
+          (elisp/ert/env--file "ELISP_TEST_COVERAGE_PER_TEST_FILE"))
+         (changed-files (elisp/ert/env--file "ELISP_TEST_CHANGED_FILES"))
+         (coverage-map (elisp/ert/env--file "ELISP_TEST_COVERAGE_MAP"))
+         (suite-name (or (elisp/ert/env--string "ELISP_TEST_SUITE_NAME")
+                         ;; Default to the target label so that reports from
+                         ;; different targets are easy to tell apart.
+                         (elisp/ert/env--string "TEST_TARGET")
+                         "ERT"))
+         (fail-on-message (elisp/ert/env--string "ELISP_TEST_FAIL_ON_MESSAGE"))
+         (progress-fd (elisp/ert/env--string "ELISP_TEST_PROGRESS_FD")))
+    ;; TEST_SRCDIR and TEST_TMPDIR are required,
+    ;; cf. https://docs.bazel.build/versions/3.1.0/test-encyclopedia.html#initial-conditions.
+    (or (elisp/ert/env--string "TEST_SRCDIR") (error "TEST_SRCDIR not set"))
+    (or temp-dir (error "TEST_TMPDIR not set"))
+    (and coverage-enabled (null coverage-manifest)
+         (error "Coverage requested but COVERAGE_MANIFEST not set"))
+    (and coverage-enabled (null coverage-file)
+         (error "Coverage requested but neither COVERAGE_DIR nor %s set"
+                "COVERAGE_OUTPUT_FILE"))
+    (unless (< shard-index shard-count)
+      (error "Invalid SHARD_COUNT (%s) or SHARD_INDEX (%s)"
+             shard-count shard-index))
+    (unless (member list-format '(nil "names" "json"))
+      (error "Invalid ELISP_TEST_LIST (%s)" list-format))
+    ;; When the launcher runs the tests with several Emacs binaries, tag each
+    ;; suite with the Emacs version so that the combined report can tell the
+    ;; runs apart.
+    (when (equal (getenv "ELISP_TEST_MATRIX") "1")
+      (setq suite-name (format "%s (Emacs %s)" suite-name emacs-version)))
+    ;; The JUnit schema requires the suite name to be an XML token.
+    (when (string-match-p (rx (or (any "\t\n\r") (seq bos " ") (seq " " eos)
+                                  "  "))
+                          suite-name)
+      (error "Invalid ELISP_TEST_SUITE_NAME (%s)" suite-name))
+    (when fail-on-message
+      (condition-case nil
+          (string-match-p fail-on-message "")
+        (invalid-regexp
+         (error "Invalid ELISP_TEST_FAIL_ON_MESSAGE (%s)" fail-on-message))))
+    (when (and progress-fd (not (string-match-p (rx bos (+ digit) eos)
+                                                progress-fd)))
+      (error "Invalid ELISP_TEST_PROGRESS_FD (%s)" progress-fd))
+    (when (eq report-writer #'elisp/ert/write--tap-report)
+      (setq report-file nil))
+    (setq report-file (or (elisp/ert/env--file "ELISP_TEST_REPORT_FILE")
+                          report-file))
+    ;; The TAP report might already go to standard output.
+    (when (and report-stdout
+               (not (eq report-writer #'elisp/ert/write--junit-report)))
+      (error "ELISP_TEST_REPORT_STDOUT requires the JUnit report format"))
+    ;; Selecting the tests affected by changed files needs the files that
+    ;; each test touched in a previous run.
+    (when (and changed-files (null coverage-map))
+      (error "%s requires %s"
+             "ELISP_TEST_CHANGED_FILES" "ELISP_TEST_COVERAGE_MAP"))
+    (elisp/ert/make--run-config
+     :temp-dir temp-dir
+     :report-file report-file
+     :report-writer report-writer
+     :report-stdout report-stdout
+     :report-hook (elisp/ert/env--file "ELISP_TEST_REPORT_HOOK")
+     :summary-file summary-file
+     :stream-file (elisp/ert/env--file "ELISP_TEST_STREAM_FILE")
+     :warnings-file (elisp/ert/env--file "TEST_WARNINGS_OUTPUT_FILE")
+     ;; Emacs can’t write to file descriptors directly, but opening the
+     ;; corresponding device file refers to the same file.
+     :progress-file (and progress-fd (concat "/:/dev/fd/" progress-fd))
+     :benchmark-file (elisp/ert/env--file "ELISP_TEST_BENCHMARK_FILE")
+     :suite-name suite-name
+     :timestamp-format (elisp/ert/env--choice "ELISP_TEST_TIMESTAMP_FORMAT"
+                                              '(("legacy" . "%FT%T")
+                                                ("rfc3339" . "%FT%T%:z"))
+                                              "%FT%T")
+     ;; Record the environment before any test can change it.
+     :environment-properties
+     (elisp/ert/environment--properties
+      (split-string (or (getenv "ELISP_TEST_REPORT_ENV") ""))
+      (equal (getenv "ELISP_TEST_REPORT_ENV_VALUES") "1"))
+     :random-seed (or (getenv "TEST_RANDOM_SEED") "")
+     ;; Log the ordering seed so that the order can be reproduced.
+     :ordering-seed (or (elisp/ert/env--string "TEST_RANDOMIZE_ORDERING_SEED")
+                        (format-time-string "%s"))
+     :shard-count shard-count
+     :shard-index shard-index
+     :shard-status-file (elisp/ert/env--file "TEST_SHARD_STATUS_FILE")
+     :selector (elisp/ert/make--selector (and coverage-enabled '(:nocover)))
+     :changed-files (and changed-files
+                         (elisp/ert/read--changed-files changed-files))
+     :coverage-map (and changed-files
+                        (elisp/ert/read--coverage-map coverage-map))
+     :list-format list-format
+     :dry-run-report dry-run-report
+     :isolated-source isolated-source
+     ;; If ISOLATE is non-nil, this process doesn’t load any test source
+     ;; files, but runs the tests of each file in a separate subordinate
+     ;; process.  Listing tests doesn’t run them, so it doesn’t need
+     ;; isolation.  The same applies to dry-run reports.
+     :isolate (and elisp/ert/isolate--sources
+                   (null isolated-source)
+                   (null list-format)
+                   (not dry-run-report))
+     :jobs (elisp/ert/env--number "ELISP_TEST_JOBS" 1
+                                  #'elisp/ert/positive--integer-p)
+     :total-timeout (elisp/ert/env--number "TEST_TIMEOUT" nil #'numberp)
+     :test-timeout (elisp/ert/env--number "ELISP_TEST_TIMEOUT" nil #'cl-plusp)
+     :retries (elisp/ert/env--number "ELISP_TEST_RETRIES" 0)
+     :fail-fast (equal (getenv "ELISP_TEST_FAIL_FAST") "1")
+     :max-failures (elisp/ert/env--number "ELISP_TEST_MAX_FAILURES" nil
+                                          #'elisp/ert/positive--integer-p)
+     :keep-going (elisp/ert/env--choice "ELISP_TEST_KEEP_GOING"
+                                        '(("0" . nil) ("1" . t)))
+     :doctests (elisp/ert/env--choice "ELISP_TEST_DOCTESTS"
+                                      '(("0" . nil) ("1" . t)))
+     :network (elisp/ert/env--choice "ELISP_TEST_NETWORK"
+                                     '(("0" . nil) ("1" . t)))
+     :keep-temp-dirs (equal (getenv "ELISP_TEST_KEEP_TEMP_DIRS") "1")
+     :check-globals (elisp/ert/env--choice "ELISP_TEST_CHECK_GLOBALS"
+                                           '(("warn" . warn)
+                                             ("strict" . strict)))
+     :globals (delete-dups
+               (append elisp/ert/default--globals
+                       (mapcar #'intern
+                               (split-string
+                                (or (getenv "ELISP_TEST_GLOBALS") "")))))
+     :fail-on-message fail-on-message
+     :strict-should-error (equal (getenv "ELISP_TEST_STRICT_SHOULD_ERROR") "1")
+     :clean-advice (equal (getenv "ELISP_TEST_CLEAN_ADVICE") "1")
+     :memory-usage (equal (getenv "ELISP_TEST_MEMORY_USAGE") "1")
+     :gc-per-test (equal (getenv "ELISP_TEST_GC_PER_TEST") "1")
+     :output-directory output-directory
+     :output-limit (elisp/ert/env--number "ELISP_TEST_OUTPUT_LIMIT" 65536)
+     :print-level (elisp/ert/print--limit "ELISP_TEST_PRINT_LEVEL"
+                                          elisp/ert/print--level)
+     :print-length (elisp/ert/print--limit "ELISP_TEST_PRINT_LENGTH"
+                                           elisp/ert/print--length)
+     :slow-threshold (elisp/ert/env--number "ELISP_TEST_SLOW_THRESHOLD" nil
+                                            #'numberp)
+     :slow-count (elisp/ert/env--number "ELISP_TEST_SLOW_COUNT" 10
+                                        #'elisp/ert/positive--integer-p)
+     :benchmark-iterations
+     (elisp/ert/env--number "ELISP_TEST_BENCHMARK_ITERATIONS" nil
+                            #'elisp/ert/positive--integer-p)
+     :benchmark-warmup (elisp/ert/env--number "ELISP_TEST_BENCHMARK_WARMUP" 1)
+     :duration-samples (elisp/ert/env--number "ELISP_TEST_DURATION_SAMPLES" nil
+                                              #'elisp/ert/positive--integer-p)
+     :profile profile
+     :profile-file
+     (and profile
+          (or (elisp/ert/env--file "ELISP_TEST_PROFILE_FILE")
+              (and output-directory
+                   (expand-file-name "emacs.profile" output-directory))
+              (error "%s requires %s or %s"
+                     "ELISP_TEST_PROFILE" "ELISP_TEST_PROFILE_FILE"
+                     "TEST_UNDECLARED_OUTPUTS_DIR")))
+     :coverage-enabled coverage-enabled
+     :coverage-manifest coverage-manifest
+     :coverage-file coverage-file
+     :coverage-exclude (split-string
+                        (or (getenv "ELISP_TEST_COVERAGE_EXCLUDE") ""))
+     ;; Per-test coverage needs the instrumented buffers, so it only works in
+     ;; coverage mode.
+     :coverage-per-test-file (and coverage-enabled coverage-per-test-file)
+     ;; Bazel only merges LCOV coverage files, so the LCOV report is always
+     ;; written.  Other formats go to a separate file.
+     :cobertura-file
+     (and (elisp/ert/env--choice "ELISP_TEST_COVERAGE_FORMAT"
+                                 '(("lcov" . nil) ("cobertura" . t)))
+          (or (elisp/ert/env--file "ELISP_TEST_COBERTURA_FILE")
+              (and output-directory
+                   (expand-file-name "coverage.xml" output-directory))
+              (error "%s requires %s or %s"
+                     "ELISP_TEST_COVERAGE_FORMAT=cobertura"
+                     "ELISP_TEST_COBERTURA_FILE"
+                     "TEST_UNDECLARED_OUTPUTS_DIR")))
+     :branch-coverage (equal (getenv "ELISP_TEST_BRANCH_COVERAGE") "1")
+     :function-coverage (equal (getenv "ELISP_TEST_FUNCTION_COVERAGE") "1"))))
+
+(defun elisp/ert/check--output-files (config)
+  "Check the output files in CONFIG before running any tests.
+CONFIG is an ‘elisp/ert/run--config’ object.  This makes sure
+that a bad filename doesn’t waste a whole test run.  Listing
+tests doesn’t write any of the files, so don’t check anything in
+that case."
+  (cl-check-type config elisp/ert/run--config)
+  (unless (elisp/ert/config--list-format config)
+    (let ((coverage (elisp/ert/config--coverage-enabled config)))
+      (cl-loop for (description . file)
+               in `(("XML report" . ,(elisp/ert/config--report-file config))
+                    ("JSON summary" . ,(elisp/ert/config--summary-file config))
+                    ("coverage report"
+                     . ,(and coverage (elisp/ert/config--coverage-file config)))
+                    ("Cobertura report"
+                     . ,(and coverage
+                             (elisp/ert/config--cobertura-file config)))
+                    ("per-test coverage file"
+                     . ,(elisp/ert/config--coverage-per-test-file config)))
+               when file
+               do (elisp/ert/check--output-file description file)))))
+
 (defun elisp/ert/run-batch-and-exit ()
   "Run ERT tests in batch mode.
 This is similar to ‘ert-run-tests-batch-and-exit’, but uses the
 TESTBRIDGE_TEST_ONLY environmental variable as test selector."
-  (or noninteractive (error "This function works only in batch mode"))
-  (let* ((attempt-stack-overflow-recovery nil)
+  (or noninteractive elisp/ert/terminal--mode
+      (error "This function works only in batch mode"))
+  (let* ((config (elisp/ert/read--config))
+         (attempt-stack-overflow-recovery nil)
          (attempt-orderly-shutdown-on-fatal-signal nil)
          (edebug-initial-mode 'Go-nonstop)  ; ‘step’ doesn’t work in batch mode
          ;; If possible, we perform our own coverage instrumentation, but that’s
@@ -66,20 +607,20 @@ TESTBRIDGE_TEST_ONLY environmental variable as test selector."
                                         elisp/ert/edebug--before
                                         elisp/ert/edebug--after)
                                       (bound-and-true-p edebug-behavior-alist)))
-         (source-dir (getenv "TEST_SRCDIR"))
-         (temp-dir (getenv "TEST_TMPDIR"))
-         (temporary-file-directory (concat "/:" temp-dir))
-         (report-file (getenv "XML_OUTPUT_FILE"))
-         (random-seed (or (getenv "TEST_RANDOM_SEED") ""))
-         (shard-count (string-to-number (or (getenv "TEST_TOTAL_SHARDS") "1")))
-         (shard-index (string-to-number (or (getenv "TEST_SHARD_INDEX") "0")))
-         (shard-status-file (getenv "TEST_SHARD_STATUS_FILE"))
-         (coverage-enabled (equal (getenv "COVERAGE") "1"))
-         (coverage-manifest (getenv "COVERAGE_MANIFEST"))
-         (coverage-dir (getenv "COVERAGE_DIR"))
-         (selector (elisp/ert/make--selector
-                    (and coverage-enabled '(:nocover))))
-         (original-load-suffixes load-suffixes)
+         (temporary-file-directory
+          (concat "/:" (elisp/ert/config--temp-dir config)))
+         (elisp/ert/branch--coverage (elisp/ert/config--branch-coverage config))
+         (elisp/ert/function--coverage
+          (elisp/ert/config--function-coverage config))
+         (elisp/ert/print--level (elisp/ert/config--print-level config))
+         (elisp/ert/print--length (elisp/ert/config--print-length config))
+         (elisp/ert/output-directory
+          (elisp/ert/config--output-directory config))
+         (coverage-enabled (elisp/ert/config--coverage-enabled config))
+         (isolate (elisp/ert/config--isolate config))
+         (suite-name (elisp/ert/config--suite-name config))
+         (stream-file (elisp/ert/config--stream-file config))
+         (profile (elisp/ert/config--profile config))
          ;; If coverage is enabled, check for a file with a well-known
          ;; extension first.  The Bazel runfiles machinery is expected to
          ;; generate these files for source files that should be instrumented.
@@ -88,18 +629,9 @@ TESTBRIDGE_TEST_ONLY environmental variable as test selector."
                             (cons ".el.instrument" load-suffixes)
                           load-suffixes))
          (load-buffers ()))
-    ;; TEST_SRCDIR and TEST_TMPDIR are required,
-    ;; cf. https://docs.bazel.build/versions/3.1.0/test-encyclopedia.html#initial-conditions.
-    (and (member source-dir '(nil "")) (error "TEST_SRCDIR not set"))
-    (and (member temp-dir '(nil "")) (error "TEST_TMPDIR not set"))
-    (and coverage-enabled (member coverage-manifest '(nil ""))
-         (error "Coverage requested but COVERAGE_MANIFEST not set"))
-    (and coverage-enabled (member coverage-dir '(nil ""))
-         (error "Coverage requested but COVERAGE_DIR not set"))
-    (unless (and (natnump shard-count) (natnump shard-index)
-                 (< shard-index shard-count))
-      (error "Invalid SHARD_COUNT (%s) or SHARD_INDEX (%s)"
-             shard-count shard-index))
+    (when elisp/ert/output-directory
+      (make-directory elisp/ert/output-directory :parents))
+    (elisp/ert/check--output-files config)
     (when coverage-enabled
       (let ((format-alist nil)
             (after-insert-file-functions nil)
@@ -108,7 +640,7 @@ TESTBRIDGE_TEST_ONLY environmental variable as test selector."
             (coding-system-for-read 'iso-8859-1-unix)
             (instrumented-files ()))
         (with-temp-buffer
-          (insert-file-contents (concat "/:" coverage-manifest))
+          (insert-file-contents (elisp/ert/config--coverage-manifest config))
           (while (not (eobp))
             ;; The filenames in the coverage manifest are typically relative to
             ;; the current directory, so expand them here.
@@ -152,113 +684,1040 @@ TESTBRIDGE_TEST_ONLY environmental variable as test selector."
                                       [&optional ("interactive" interactive)]
                                       def-body)])
                  cl-declarations body)))))
-    (random random-seed)
-    (when shard-status-file
-      (write-region "" nil (concat "/:" shard-status-file) :append))
-    (mapc #'load (reverse elisp/ert/test--sources))
-    (let ((tests (ert-select-tests selector t))
-          (unexpected 0)
-          (errors 0)
-          (failures 0)
-          (skipped 0)
-          (test-reports ())
-          (start-time (current-time)))
-      (or tests (error "Selector %S doesn’t match any tests" selector))
+    (random (elisp/ert/config--random-seed config))
+    (when-let ((file (elisp/ert/config--shard-status-file config)))
+      (write-region "" nil file :append))
+    ;; Advertise optional capabilities of the test environment as features so
+    ;; that tests can check for them using ‘skip-unless’ without having to
+    ;; require this library.  Provide the features before loading the test
+    ;; files in case they check for them at load time.
+    (when (elisp/ert/config--network config)
+      (provide 'elisp/ert/network))
+    ;; Profile the entire test run, including loading the test files.
+    (when profile
+      (message "Starting %s profiler; test times include profiling overhead"
+               profile)
+      (profiler-start profile))
+    ;; Measure the time it takes to load the test files separately, so that
+    ;; slow libraries don’t inflate the reported test durations.
+    (let* ((load-start (current-time))
+           (load-reports (elisp/ert/load--tests config))
+           (setup-time (time-subtract nil load-start))
+           (selector (elisp/ert/config--selector config))
+           (tests (ert-select-tests selector t))
+           (changed-files (elisp/ert/config--changed-files config))
+           (shard-count (elisp/ert/config--shard-count config))
+           (shard-index (elisp/ert/config--shard-index config))
+           (list-format (elisp/ert/config--list-format config))
+           (ordering-seed (elisp/ert/config--ordering-seed config))
+           (results nil)
+           ;; WORKER-REPORTS are the reports of tests that ran in subordinate
+           ;; processes.
+           (worker-reports ())
+           ;; LOCAL-TESTS are the tests that run in this Emacs process.
+           (local-tests ())
+           ;; SUITE-FILES are the test files whose suite setup has succeeded,
+           ;; see ‘elisp/ert/suite--function’.
+           (suite-files ())
+           (finish nil)
+           (finished nil))
+      ;; Don’t fail if the selector doesn’t match anything, so that a
+      ;; --test_filter flag that’s meant for other targets doesn’t break this
+      ;; target.  We still write an (empty) report below.
+      (or tests isolate
+          (message "Selector %S doesn’t match any tests" selector))
+      (when changed-files
+        (let ((count (length tests)))
+          (setq tests (elisp/ert/affected--tests
+                       tests changed-files
+                       (elisp/ert/config--coverage-map config)))
+          (message "Selected %d of %d tests affected by changed files"
+                   (length tests) count)))
       (when (> shard-count 1)
         (setq tests (cl-loop for test in tests
-                             for i from 0
-                             when (eql (mod i shard-count) shard-index)
+                             when (eql (elisp/ert/test--shard test shard-count)
+                                       shard-index)
                              collect test))
-        (or tests (message "Empty shard with index %d" shard-index)))
-      (message "Running %d tests" (length tests))
-      (dolist (test tests)
-        (message "Running test %s" (ert-test-name test))
+        (or tests isolate (message "Empty shard with index %d" shard-index)))
+      (when list-format
+        ;; Only list the tests that we would run, without running them or
+        ;; writing a report.
+        (elisp/ert/list--tests tests list-format)
+        (kill-emacs (if load-reports 1 0)))
+      ;; Run the tests in random order to detect unwanted dependencies
+      ;; between them.
+      (message "Shuffling tests with TEST_RANDOMIZE_ORDERING_SEED=%s"
+               ordering-seed)
+      (random ordering-seed)
+      (setq tests (elisp/ert/shuffle--list tests))
+      ;; Reseed the random number generator so that the tests themselves
+      ;; don’t depend on the ordering seed.
+      (random (elisp/ert/config--random-seed config))
+      (setq results (elisp/ert/make--run-results
+                     :tests tests
+                     :setup-time setup-time
+                     :start-time (current-time)
+                     ;; Count the garbage collections while running the
+                     ;; tests, but not while loading them.
+                     :gcs-before gcs-done
+                     :gc-elapsed-before gc-elapsed))
+      (dolist (report load-reports)
+        (elisp/ert/add--test-report results report))
+      ;; FINISH writes the reports.  Normally that happens once all tests
+      ;; have run.  But if Bazel terminates the test binary, e.g. because of
+      ;; a timeout, Emacs runs ‘kill-emacs-hook’, so we write a partial report
+      ;; there.  FINISHED ensures that we only write the reports once.
+      (setq finish
+            (lambda ()
+              (setq finished t)
+              (elisp/ert/finish--run config results load-buffers)))
+      ;; A dry-run report contains all selected tests, but doesn’t run any of
+      ;; them.
+      (when (elisp/ert/config--dry-run-report config)
+        (message "Writing dry-run report for %d tests" (length tests))
+        (setf (elisp/ert/results--not-run results) tests
+              (elisp/ert/results--not-run-message results)
+              "Test not run in dry-run mode")
+        (kill-emacs (min (funcall finish) 1)))
+      (add-hook 'kill-emacs-hook
+                (lambda ()
+                  (unless finished
+                    (message "Test binary terminated, writing partial report")
+                    ;; Record the test that was running as timed out.
+                    (when-let ((test (elisp/ert/results--current-test results)))
+                      (elisp/ert/add--test-report
+                       results
+                       `(testcase
+                         ((name . ,(symbol-name (ert-test-name test)))
+                          (classname . ,(elisp/ert/test--class-name
+                                         (ert-test-name test)))
+                          (time . "0"))
+                         (error
+                          ((message . "Test binary terminated during test")
+                           (type . "timeout"))))))
+                    ;; Report all other tests that haven’t finished as
+                    ;; skipped.
+                    (setf (elisp/ert/results--not-run results)
+                          (elisp/ert/missing--tests
+                           tests (elisp/ert/results--test-reports results))
+                          (elisp/ert/results--not-run-message results)
+                          "Test not run because test binary was terminated")
+                    (funcall finish))))
+      ;; Record the warnings that tests generate, e.g. using ‘warn’.
+      ;; Subordinate processes inherit TEST_WARNINGS_OUTPUT_FILE and record
+      ;; their own warnings.
+      (when-let ((warnings-file (elisp/ert/config--warnings-file config)))
+        (advice-add #'display-warning :before
+                    (lambda (type message &rest _)
+                      (let ((test (elisp/ert/results--current-test results)))
+                        (elisp/ert/write--warning
+                         warnings-file
+                         (and test (elisp/ert/test--location
+                                    (ert-test-name test)))
+                         type message)))
+                    '((name . elisp/ert/write--warning))))
+      ;; Tighten ‘should-error’ forms if requested.  Subordinate processes
+      ;; inherit ELISP_TEST_STRICT_SHOULD_ERROR and install their own advice.
+      (when (elisp/ert/config--strict-should-error config)
+        (advice-add #'ert--should-error-handle-error :before
+                    #'elisp/ert/check--should-error))
+      (if isolate
+          (message "Running tests of %d source files in isolation"
+                   (length elisp/ert/test--sources))
+        (message "Running %d tests" (length tests)))
+      (setq local-tests tests)
+      (let ((total-timeout (elisp/ert/config--total-timeout config))
+            (coverage-file (and coverage-enabled
+                                (elisp/ert/config--coverage-file config)))
+            (jobs (elisp/ert/config--jobs config)))
+        (cond
+         (isolate
+          (setq worker-reports
+                (elisp/ert/run--isolated (reverse elisp/ert/test--sources)
+                                         total-timeout coverage-file)))
+         ((> jobs 1)
+          ;; Distribute the tests that don’t require serial execution among
+          ;; subordinate Emacs processes.  Run the others in this process.
+          (let ((parallel-tests ()))
+            (setq local-tests ())
+            (dolist (test tests)
+              (if (memq :serial (ert-test-tags test))
+                  (push test local-tests)
+                (push test parallel-tests)))
+            (cl-callf nreverse local-tests)
+            (setq worker-reports
+                  (elisp/ert/run--workers
+                   (nreverse parallel-tests) jobs
+                   (and total-timeout
+                        (- total-timeout
+                           (float-time (time-subtract nil before-init-time))))
+                   coverage-file))))))
+      ;; Subordinate processes don’t write progress events, because they
+      ;; might not inherit the file descriptor.  Write the events for their
+      ;; tests once they have finished instead.
+      (dolist (report worker-reports)
+        (elisp/ert/write--progress
+         (elisp/ert/config--progress-file config) "test-end"
+         (intern (alist-get 'name (cadr report)))
+         `((status . ,(cond ((assq 'error (cddr report)) "error")
+                            ((assq 'failure (cddr report)) "failed")
+                            ((assq 'skipped (cddr report)) "skipped")
+                            (t "passed")))
+           (duration . ,(string-to-number (alist-get 'time (cadr report))))))
+        (elisp/ert/add--test-report results report))
+      (when worker-reports
+        (elisp/ert/write--partial-report
+         stream-file suite-name (elisp/ert/results--test-reports results)))
+      ;; Call the suite setup functions once before running the tests of each
+      ;; file.  If the setup of a file fails, report a suite error and skip
+      ;; the tests of that file.
+      (dolist (file (delete-dups
+                     (cl-loop for test in local-tests
+                              for file = (symbol-file (ert-test-name test)
+                                                      'ert--test)
+                              when file collect file)))
+        (condition-case err
+            (let ((setup (elisp/ert/suite--function file 'setup)))
+              (when setup
+                (message "Running suite setup %s" setup)
+                (funcall setup))
+              (push file suite-files))
+          (error
+           (message "Suite setup for %s failed: %s"
+                    (file-name-unquote file) (error-message-string err))
+           (elisp/ert/add--test-report
+            results (elisp/ert/suite--error file 'setup err))
+           (dolist (test local-tests)
+             (when (equal (symbol-file (ert-test-name test) 'ert--test) file)
+               (elisp/ert/add--test-report
+                results
+                `(testcase ((name . ,(symbol-name (ert-test-name test)))
+                            (classname . ,(elisp/ert/test--class-name
+                                           (ert-test-name test)))
+                            (time . "0"))
+                           (skipped
+                            ((message
+                              . "Test not run because suite setup failed")))))))
+           (setq local-tests
+                 (cl-remove-if
+                  (lambda (test)
+                    (equal (symbol-file (ert-test-name test) 'ert--test)
+                           file))
+                  local-tests)))))
+      (cl-dolist (test local-tests)
+        (setf (elisp/ert/results--current-test results) test)
         (let* ((name (ert-test-name test))
-               (start-time (current-time))
-               (result (ert-run-test test))
-               (duration (time-subtract nil start-time))
-               (expected (ert-test-result-expected-p test result))
-               (failed
-                (and (not expected)
-                     ;; A test that passed unexpectedly should count as failed
-                     ;; for the XML report.
-                     (ert-test-result-type-p result '(or :passed :failed))))
-               (status (ert-string-for-test-result result expected))
-               (report nil))
-          (message "Test %s %s and took %d ms" name status
-                   (* (float-time duration) 1000))
-          (unless expected
-            (cl-incf unexpected)
-            ;; Print a nice error message that should point back to the source
-            ;; file in a compilation buffer.  We don’t want to find the
-            ;; “.el.instrument” files when printing the error message, so bind
-            ;; ‘load-suffixes’ temporarily to its original value.
-            (let ((load-suffixes original-load-suffixes))
-              (elisp/ert/log--error name
-                                    (format-message "Test %s %s" name status))))
-          (and failed (cl-incf failures))
-          (and (not expected) (not failed) (cl-incf errors))
-          (when (ert-test-skipped-p result)
-            (cl-incf skipped)
-            (setq report '((skipped))))
-          (and (not expected) (ert-test-passed-p result)
-               ;; Fake an error so that the test is marked as failed in the XML
-               ;; report.
-               (setq report '((failure ((message . "Test passed unexpectedly")
-                                        (type . "error"))))))
-          (when (ert-test-result-with-condition-p result)
-            (let ((message (elisp/ert/failure--message name result))
-                  (condition (ert-test-result-with-condition-condition result)))
-              (message "%s" message)
-              (unless (symbolp (car condition))
-                ;; This shouldn’t normally happen, but happens due to a bug in
-                ;; ERT for forms such as (should (integerp (ert-fail "Boo"))).
-                (push 'ert-test-failed condition))
-              (unless expected
-                (setq report `((,(if failed 'failure 'error)
-                                ((message . ,(error-message-string condition))
-                                 (type . ,(symbol-name (car condition))))
-                                ,message))))))
-          (push `(testcase ((name . ,(symbol-name name))
-                            ;; classname is required, but we don’t have test
-                            ;; classes, so fill in a dummy value.
-                            (classname . "ERT")
-                            (time . ,(format-time-string "%s.%N" duration)))
-                           ,@report)
-                test-reports)))
-      (message "Running %d tests finished, %d results unexpected"
-               (length tests) unexpected)
-      (unless (member report-file '(nil ""))
+               (unexpected
+                (elisp/ert/add--test-report
+                 results
+                 (elisp/ert/run--local-test config test
+                                            (length (memq test local-tests))
+                                            load-buffers)))
+               (max-failures (elisp/ert/config--max-failures config))
+               (count (elisp/ert/results--unexpected results)))
+          (elisp/ert/write--partial-report
+           stream-file suite-name (elisp/ert/results--test-reports results))
+          (setf (elisp/ert/results--current-test results) nil)
+          ;; In fail-fast mode, stop after the first unexpected result.  This
+          ;; only happens after all retries have failed.
+          (when (and (elisp/ert/config--fail-fast config) unexpected)
+            (message "Stopping after unexpected result of test %s" name)
+            (setf (elisp/ert/results--not-run results)
+                  (cdr (memq test local-tests)))
+            (cl-return))
+          ;; Likewise, stop once there are ELISP_TEST_MAX_FAILURES unexpected
+          ;; results.  With sharding, each shard has its own budget.
+          (when (and max-failures unexpected (>= count max-failures))
+            (message "Stopping after %d unexpected results" count)
+            (setf (elisp/ert/results--not-run results)
+                  (cdr (memq test local-tests))
+                  (elisp/ert/results--not-run-message results)
+                  (format "Test not run after %d unexpected results" count))
+            (cl-return))))
+      ;; Call the suite teardown functions for all files whose setup has
+      ;; succeeded, even if some tests didn’t run.
+      (dolist (file (reverse suite-files))
+        (when-let ((teardown (elisp/ert/suite--function file 'teardown)))
+          (message "Running suite teardown %s" teardown)
+          (condition-case err
+              (funcall teardown)
+            (error
+             (message "Suite teardown for %s failed: %s"
+                      (file-name-unquote file) (error-message-string err))
+             (elisp/ert/add--test-report
+              results (elisp/ert/suite--error file 'teardown err))))))
+      (kill-emacs (min (funcall finish) 1)))))
+
+(defun elisp/ert/load--tests (config)
+  "Load the test source files for the test run CONFIG.
+CONFIG is an ‘elisp/ert/run--config’ object.  Also run the setup
+actions, define the tests for erts files, and define the
+doctests if requested.  Return a list of ‘testcase’ XML nodes
+that report the files that failed to load and the tests that are
+defined more than once."
+  (cl-check-type config elisp/ert/run--config)
+  (let ((isolated-source (elisp/ert/config--isolated-source config))
+        (isolate (elisp/ert/config--isolate config))
+        (keep-going (elisp/ert/config--keep-going config))
+        (loaded-before (mapcar #'car load-history))
+        (test-files (make-hash-table :test #'eq))
+        (load-errors ())
+        ;; Elements of DUPLICATE-TESTS have the form (NAME PREVIOUS FILE),
+        ;; meaning that loading FILE redefined the test NAME from the file
+        ;; PREVIOUS.
+        (duplicate-tests ()))
+    ;; Explain missing features while loading the test files.  A fatal
+    ;; error kills Emacs anyway, so we don’t need ‘unwind-protect’ to
+    ;; remove the advice below.
+    (advice-add #'require :around #'elisp/ert/require--with-diagnostics)
+    ;; ERT silently replaces a test if another file defines a test with
+    ;; the same name, so that the first test never runs.  Record the file
+    ;; that defines each test to detect such collisions.
+    (advice-add #'ert-set-test :before
+                (lambda (name &rest _)
+                  (when load-file-name
+                    (let ((previous (gethash name test-files)))
+                      (when (and previous
+                                 (not (string-equal previous
+                                                    load-file-name)))
+                        (message "Test %s from %s is redefined in %s"
+                                 name (file-name-unquote previous)
+                                 (file-name-unquote load-file-name))
+                        (push (list name previous load-file-name)
+                              duplicate-tests)))
+                    (puthash name load-file-name test-files)))
+                '((name . elisp/ert/record--definition)))
+    ;; Setup actions and preloading are fatal if they fail, because the
+    ;; test files rely on them.  In keep-going mode, report such errors
+    ;; like load errors of test files instead, so that the report still
+    ;; covers the tests that don’t depend on the failed action.  The
+    ;; isolating process doesn’t load any test files, so it doesn’t need
+    ;; them either.
+    (unless isolate
+      (cl-flet ((setup (function argument)
+                  (if keep-going
+                      (condition-case err
+                          (funcall function argument)
+                        (error
+                         (message "%s" (error-message-string err))
+                         (push (cons nil err) load-errors)))
+                    (funcall function argument))))
+        (dolist (action (reverse elisp/ert/pre-test--actions))
+          (setup #'elisp/ert/pre-test--run action))
+        (dolist (feature (reverse elisp/ert/preload--features))
+          (setup #'elisp/ert/preload--feature feature))))
+    (dolist (file (cond (isolated-source (list isolated-source))
+                        (isolate ())
+                        (t (reverse elisp/ert/test--sources))))
+      ;; A test file might require another test file of the same target
+      ;; that comes later in the list.  Don’t load that file a second
+      ;; time, since that would redefine its functions and variables and
+      ;; rerun its top-level forms.
+      (if (elisp/ert/loaded--p file)
+          (message "Not loading %s again, since it has already been loaded"
+                   (file-name-unquote file))
+        ;; Don’t give up if a test file fails to load, but report the error
+        ;; as test failure below.  Any tests that the file would have
+        ;; defined after the error are missing.
+        (condition-case err
+            (load file)
+          (error
+           (message "Loading %s failed: %s"
+                    (file-name-unquote file) (error-message-string err))
+           (push (cons file err) load-errors)))))
+    (advice-remove #'require #'elisp/ert/require--with-diagnostics)
+    (advice-remove #'ert-set-test 'elisp/ert/record--definition)
+    ;; Define a test for each case in the erts files.  These files aren’t
+    ;; test source files, so isolated subordinate processes don’t define
+    ;; them; the isolating process runs them itself.
+    (when (null isolated-source)
+      (dolist (file (reverse elisp/ert/erts--files))
+        (condition-case err
+            (elisp/ert/define--erts-tests file)
+          (error
+           (message "Reading %s failed: %s"
+                    (file-name-unquote file) (error-message-string err))
+           (push (cons file err) load-errors)))))
+    ;; Define the doctests before selecting tests, so that the selector
+    ;; applies to them as well.
+    (when (elisp/ert/config--doctests config)
+      (elisp/ert/define--doctests
+       (cl-remove-if (lambda (entry) (member (car entry) loaded-before))
+                     load-history)))
+    (append
+     ;; FILE is nil for errors during setup in keep-going mode.
+     (cl-loop
+      for (file . err) in (reverse load-errors)
+      collect `(testcase ((name . ,(if file "load" "setup"))
+                          (classname . ,(elisp/ert/file--class-name file))
+                          (time . "0"))
+                         (error ((message . ,(error-message-string err))
+                                 (type . ,(cond ((null file) "setup-error")
+                                                ((eq (car err)
+                                                     'elisp/ert/missing-feature)
+                                                 "missing-feature")
+                                                (t "load-error"))))
+                                ,(if file
+                                     (format-message
+                                      "Loading test file %s failed, so some \
+of its tests might be missing from this report:\n\n%S\n"
+                                      (file-name-unquote file) err)
+                                   (format-message
+                                    "Setting up the tests failed, so tests \
+that rely on the setup might fail:\n\n%S\n"
+                                    err)))))
+     (cl-loop
+      for (name previous file) in (reverse duplicate-tests)
+      collect `(testcase ((name . "duplicate")
+                          (classname . ,(elisp/ert/file--class-name file))
+                          (time . "0"))
+                         (error ((message
+                                  . ,(format-message
+                                      "Test %s is defined in both %s and %s"
+                                      name (file-name-unquote previous)
+                                      (file-name-unquote file)))
+                                 (type . "duplicate-test"))
+                                ,(format-message
+                                  "Loading %s redefined test %s, so the \
+definition from %s doesn’t run\n"
+                                  (file-name-unquote file) name
+                                  (file-name-unquote previous))))))))
+
+(defun elisp/ert/run--local-test (config test remaining load-buffers)
+  "Run TEST in this Emacs process and return its ‘testcase’ XML node.
+CONFIG is an ‘elisp/ert/run--config’ object.  REMAINING is the
+number of tests that still have to run in this process, including
+TEST; without an explicit per-test timeout, TEST gets its share
+of the remaining time.  LOAD-BUFFERS are the buffers of the
+instrumented files for per-test coverage."
+  (cl-check-type config elisp/ert/run--config)
+  (cl-check-type test ert-test)
+  (cl-check-type remaining natnum)
+  (cl-check-type load-buffers list)
+  (message "Running test %s" (ert-test-name test))
+  (elisp/ert/write--progress (elisp/ert/config--progress-file config)
+                             "test-start" (ert-test-name test))
+  (let* ((name (ert-test-name test))
+         (check-globals (elisp/ert/config--check-globals config))
+         (globals (elisp/ert/config--globals config))
+         (clean-advice (elisp/ert/config--clean-advice config))
+         (coverage-per-test-file
+          (elisp/ert/config--coverage-per-test-file config))
+         (test-timeout (elisp/ert/config--test-timeout config))
+         (total-timeout (elisp/ert/config--total-timeout config))
+         (benchmark-iterations (elisp/ert/config--benchmark-iterations config))
+         (benchmark-warmup (elisp/ert/config--benchmark-warmup config))
+         (duration-samples (elisp/ert/config--duration-samples config))
+         (output-limit (elisp/ert/config--output-limit config))
+         ;; Take the snapshot before creating any buffers.
+         (globals-before (and check-globals
+                              (elisp/ert/globals--snapshot globals)))
+         (advice-before (and clean-advice (elisp/ert/advice--snapshot)))
+         (hits-before (and coverage-per-test-file
+                           (mapcar #'elisp/ert/coverage--hits load-buffers)))
+         (stdout (generate-new-buffer " *stdout*"))
+         (elisp/ert/test--warnings ())
+         (attempts 0)
+         ;; Only measure the time spent running the test itself, summed over
+         ;; all attempts.
+         (duration 0)
+         ;; Like the time, the memory only counts the last attempt.
+         (memory nil)
+         ;; Likewise, GC is a pair (COUNT . SECONDS) describing the garbage
+         ;; collections during the last attempt.
+         (gc nil)
+         (old-artifacts (elisp/ert/output--files))
+         (test-temp-dir (elisp/ert/test--temp-directory name))
+         ;; Capture standard output of the test so that we can attribute it
+         ;; to the test in the XML report.  ERT itself already records the
+         ;; messages logged during the test.  If the test fails unexpectedly,
+         ;; retry it up to ELISP_TEST_RETRIES times.  Only the output and
+         ;; result of the last attempt count.
+         (result
+          (let ((standard-output stdout))
+            (cl-loop
+             ;; Unless the user has specified an explicit per-test timeout,
+             ;; distribute the remaining time evenly among the remaining
+             ;; tests, so that a hanging test doesn’t prevent us from writing
+             ;; a report.  Recompute the timeout for each attempt so that
+             ;; retries don’t exceed the budget.
+             for timeout = (or test-timeout
+                               (and total-timeout
+                                    (max 1 (/ (- total-timeout
+                                                 (float-time
+                                                  (time-subtract
+                                                   nil before-init-time)))
+                                              remaining))))
+             for result = (let ((start (current-time))
+                                (counts (and (elisp/ert/config--memory-usage
+                                              config)
+                                             (memory-use-counts)))
+                                (gc-start (and (elisp/ert/config--gc-per-test
+                                                config)
+                                               (cons gcs-done gc-elapsed))))
+                            (with-current-buffer stdout (erase-buffer))
+                            (setq elisp/ert/test--warnings nil)
+                            (prog1 (elisp/ert/run--test
+                                    test timeout test-temp-dir)
+                              (when counts
+                                (setq memory (elisp/ert/allocated--bytes
+                                              counts (memory-use-counts))))
+                              (when gc-start
+                                (setq gc (cons (- gcs-done (car gc-start))
+                                               (- gc-elapsed (cdr gc-start)))))
+                              (cl-callf time-add duration
+                                (time-subtract nil start))
+                              ;; Remove leaked advice after each attempt, so
+                              ;; that retries start from a clean state.
+                              (when clean-advice
+                                (dolist (leak (elisp/ert/remove--advice
+                                               advice-before))
+                                  (message "Warning: %s" leak)
+                                  (push leak elisp/ert/test--warnings)))))
+             do (cl-incf attempts)
+             until (or (ert-test-result-expected-p test result)
+                       (> attempts (elisp/ert/config--retries config)))
+             do (message "Test %s failed, retrying" name)
+             finally return result)))
+         ;; Only keep the warnings of the last attempt, not those of the
+         ;; benchmark or sample runs below.
+         (test-warnings (reverse elisp/ert/test--warnings))
+         ;; In benchmark mode, run each passing test tagged ‘:benchmark’
+         ;; repeatedly.  The result is either a failed iteration, which
+         ;; replaces the original result, or the list of measured durations.
+         (benchmark
+          (and benchmark-iterations
+               (memq :benchmark (ert-test-tags test))
+               (ert-test-passed-p result)
+               (let ((standard-output stdout))
+                 (elisp/ert/benchmark--test
+                  test benchmark-warmup benchmark-iterations
+                  test-timeout test-temp-dir))))
+         (result (if (ert-test-result-p benchmark) benchmark result))
+         ;; With ELISP_TEST_DURATION_SAMPLES, run each passing test until
+         ;; there are that many duration samples.  The first sample is the
+         ;; duration of the run above, which is also the time in the report.
+         ;; As for benchmarks, a failing run replaces the original result.
+         (samples
+          (and duration-samples
+               (ert-test-passed-p result)
+               (let ((standard-output stdout)
+                     (more (elisp/ert/benchmark--test
+                            test 0 (1- duration-samples)
+                            test-timeout test-temp-dir)))
+                 (if (ert-test-result-p more) more
+                   (cons (float-time duration) more)))))
+         (result (if (ert-test-result-p samples) samples result))
+         ;; Benchmark and sample runs can leak advice, too.  Their warnings
+         ;; don’t count, see above.
+         (_ (and clean-advice (elisp/ert/remove--advice advice-before)))
+         (benchmark-statistics
+          (and (consp benchmark)
+               `((iterations . ,benchmark-iterations)
+                 (warmup . ,benchmark-warmup)
+                 ,@(elisp/ert/benchmark--statistics benchmark))))
+         ;; The files touched by a test are the instrumented files whose hit
+         ;; counts have increased while running the test.
+         (touched-files
+          (and coverage-per-test-file
+               (sort (cl-loop for buffer in load-buffers
+                              for before in hits-before
+                              when (> (elisp/ert/coverage--hits buffer) before)
+                              collect (file-relative-name
+                                       (buffer-file-name buffer)))
+                     #'string-lessp)))
+         (properties
+          `(,@(cl-loop for (key . value) in benchmark-statistics
+                       collect (cons (format "benchmark-%s" key) value))
+            ,@(cl-loop for warning in test-warnings
+                       collect (cons "warning" warning))
+            ,@(and (consp samples)
+                   `(("duration-samples"
+                      . ,(mapconcat #'number-to-string samples " "))))
+            ,@(and gc
+                   `(("gc-count" . ,(car gc))
+                     ("gc-time" . ,(format "%.6f" (cdr gc)))))
+            ,@(and coverage-per-test-file
+                   `(("coverage-files"
+                      . ,(mapconcat #'identity touched-files " "))))))
+         ;; The artifacts of a test are the files that it has created in the
+         ;; output directory.
+         (artifacts (sort (cl-set-difference (elisp/ert/output--files)
+                                             old-artifacts
+                                             :test #'string-equal)
+                          #'string-lessp))
+         (output (with-current-buffer stdout
+                   (prog1 (buffer-substring-no-properties
+                           (point-min) (point-max))
+                     (kill-buffer))))
+         (modified-globals
+          (and check-globals
+               (elisp/ert/modified--globals
+                globals-before (elisp/ert/globals--snapshot globals))))
+         (result (elisp/ert/final--result config result modified-globals
+                                          output))
+         (messages
+          (concat (ert-test-result-messages result)
+                  (when modified-globals
+                    (format-message "Test %s modified %s\n" name
+                                    (mapconcat #'symbol-name modified-globals
+                                               ", ")))))
+         ;; ERT records each evaluated ‘should’, ‘should-not’,
+         ;; ‘should-error’, and ‘skip-unless’ form, including forms in helper
+         ;; functions called from the test.
+         (assertions (length (ert-test-result-should-forms result)))
+         (expected (ert-test-result-expected-p test result))
+         (failed
+          (and (not expected)
+               ;; A test that passed unexpectedly should count as failed for
+               ;; the XML report.
+               (ert-test-result-type-p result '(or :passed :failed))))
+         (status (ert-string-for-test-result result expected))
+         ;; A test is flaky if it eventually passed after a retry.
+         (flaky (and expected (> attempts 1)))
+         (report nil))
+    ;; Still print the output of the test, but only after it has finished,
+    ;; so that it doesn’t get mixed up with other tests.
+    (princ output)
+    (message "Test %s %s and took %d ms" name status
+             (* (float-time duration) 1000))
+    (when (> attempts 1)
+      (message "Test %s was attempted %d times" name attempts))
+    (when benchmark-statistics
+      (message "Benchmark %s: %s" name
+               (mapconcat (lambda (entry)
+                            (format "%s %s" (car entry) (cdr entry)))
+                          benchmark-statistics ", ")))
+    ;; Remove the temporary directory so that the next test starts afresh.
+    ;; Optionally keep the directory of a failed test for debugging.
+    (if (and (elisp/ert/config--keep-temp-dirs config) (not expected))
+        (message "Keeping temporary directory %s of test %s"
+                 (file-name-unquote test-temp-dir) name)
+      (when (file-directory-p test-temp-dir)
+        (delete-directory test-temp-dir :recursive)))
+    (unless expected
+      ;; Print a nice error message that should point back to the source
+      ;; file in a compilation buffer.  We don’t want to find the
+      ;; “.el.instrument” files when printing the error message, so remove
+      ;; that suffix temporarily.
+      (let ((load-suffixes (remove ".el.instrument" load-suffixes)))
+        (elisp/ert/log--error name (format-message "Test %s %s" name status))))
+    (when (ert-test-skipped-p result)
+      ;; Record the reason passed to ‘ert-skip’ or ‘skip-unless’.
+      (let* ((condition (ert-test-result-with-condition-condition result))
+             (reason (elisp/ert/condition--summary condition)))
+        (setq report `((skipped ((message . ,reason)))))))
+    (and (not expected) (ert-test-passed-p result)
+         ;; Fake an error so that the test is marked as failed in the XML
+         ;; report.
+         (setq report '((failure ((message . "Test passed unexpectedly")
+                                  (type . "error"))))))
+    (when (ert-test-result-with-condition-p result)
+      (let ((message (elisp/ert/failure--message name result))
+            (condition (ert-test-result-with-condition-condition result)))
+        (message "%s" message)
+        (unless (symbolp (car condition))
+          ;; This shouldn’t normally happen, but happens due to a bug in ERT
+          ;; for forms such as (should (integerp (ert-fail "Boo"))).
+          (push 'ert-test-failed condition))
+        (unless expected
+          (setq report `((,(if failed 'failure 'error)
+                          ((message . ,(elisp/ert/condition--summary
+                                        condition))
+                           (type . ,(pcase (car condition)
+                                      ('elisp/ert/timeout "timeout")
+                                      ('elisp/ert/memory-exhausted "memory")
+                                      (other (symbol-name other)))))
+                          ,(concat
+                            message
+                            (when artifacts
+                              (format-message
+                               "\n  Test %s artifacts:\n\n%s" name
+                               (mapconcat (lambda (file)
+                                            (concat "    " file "\n"))
+                                          artifacts ""))))))))))
+    ;; A test that exited nonlocally has no condition, but still counts as
+    ;; error, see ‘elisp/ert/add--test-report’.
+    (and (not expected) (null report)
+         (setq report `((error ((message . ,(format "Test %s" status))
+                                (type . "aborted"))))))
+    (elisp/ert/write--progress
+     (elisp/ert/config--progress-file config) "test-end" name
+     `((status . ,(cond ((ert-test-skipped-p result) "skipped")
+                        (failed "failed")
+                        ((not expected) "error")
+                        (t "passed")))
+       (duration . ,(float-time duration))))
+    `(testcase ((name . ,(symbol-name name))
+                ;; classname is required, but we don’t have test classes, so
+                ;; group the tests by source file.
+                (classname . ,(elisp/ert/test--class-name name))
+                ,@(when-let ((location (elisp/ert/test--location name)))
+                    `((file . ,(car location))
+                      (line . ,(number-to-string (cdr location)))))
+                (time . ,(format-time-string "%s.%N" duration))
+                (assertions . ,(number-to-string assertions))
+                ,@(and flaky '((flaky . "true")))
+                ,@(and (> attempts 1)
+                       `((attempts . ,(number-to-string attempts))))
+                ,@(and memory `((memory . ,(number-to-string memory)))))
+               ,@(and properties
+                      `((properties
+                         ()
+                         ,@(cl-loop for (key . value) in properties
+                                    collect `(property
+                                              ((name . ,key)
+                                               (value . ,(format "%s"
+                                                                 value))))))))
+               ,@report
+               ,@(unless (string-empty-p output)
+                   `((system-out
+                      () ,(elisp/ert/truncate--output output output-limit))))
+               ,@(unless (string-empty-p messages)
+                   `((system-err
+                      () ,(elisp/ert/truncate--output messages
+                                                      output-limit)))))))
+
+(defun elisp/ert/add--test-report (results report)
+  "Add the test case REPORT to the test RESULTS.
+RESULTS is an ‘elisp/ert/run--results’ object, and REPORT is a
+‘testcase’ XML node.  Update the counts in RESULTS for the
+result that REPORT describes: an ‘error’ or ‘failure’ child
+makes it unexpected, and a ‘skipped’ child makes it skipped.
+Return whether the result is unexpected."
+  (cl-check-type results elisp/ert/run--results)
+  (cl-check-type report cons)
+  (push report (elisp/ert/results--test-reports results))
+  (cl-incf (elisp/ert/results--warnings results)
+           (elisp/ert/warning--count report))
+  (cl-callf time-add (elisp/ert/results--suite-time results)
+    (string-to-number (alist-get 'time (cadr report))))
+  (cond ((assq 'error (cddr report))
+         (cl-incf (elisp/ert/results--errors results))
+         (cl-incf (elisp/ert/results--unexpected results))
+         t)
+        ((assq 'failure (cddr report))
+         (cl-incf (elisp/ert/results--failures results))
+         (cl-incf (elisp/ert/results--unexpected results))
+         t)
+        ((assq 'skipped (cddr report))
+         (cl-incf (elisp/ert/results--skipped results))
+         nil)))
+
+(cl-defun elisp/ert/data-file
+    (filename &optional (workspace (getenv "TEST_WORKSPACE")))
+  "Return the local filename of the data file FILENAME.
+FILENAME is relative to WORKSPACE, which defaults to the
+workspace of the current test.  The test must list FILENAME in
+its ‘data’ attribute; otherwise, signal an error of type
+‘elisp/runfiles/undeclared’.  If the file doesn’t exist, signal
+an error of type ‘elisp/runfiles/not-found’."
+  (cl-check-type filename string)
+  (cl-check-type workspace string)
+  (require 'elisp/runfiles/runfiles)
+  (let* ((name (concat workspace "/" filename))
+         (file (progn (elisp/runfiles/check-declared name)
+                      (elisp/runfiles/rlocation name))))
+    (unless (file-exists-p file)
+      (signal 'elisp/runfiles/not-found (list name file)))
+    file))
+
+(defun elisp/ert/test-args ()
+  "Return the arguments from the ‘test_args’ attribute of the test rule.
+The return value is a list of strings.  The test binary has
+already replaced location references such as ‘$(location)’ with
+absolute filenames."
+  (reverse elisp/ert/test--args))
+
+(defun elisp/ert/skip-unless-program (program)
+  "Skip the current test unless PROGRAM is available.
+PROGRAM is the name of an executable program, which is searched
+in ‘exec-path’ using ‘executable-find’.  If it’s not found, skip
+the test with a reason that names PROGRAM.  Otherwise, return
+the absolute filename of PROGRAM."
+  (cl-check-type program string)
+  (or (executable-find program)
+      (ert-skip (format-message "Program ‘%s’ not found in exec-path"
+                                program))))
+
+(defun elisp/ert/should-warn (value &optional message)
+  "Record a warning for the current test unless VALUE is non-nil.
+This is an advisory variant of ‘should’: if VALUE is nil, the
+test doesn’t fail.  Instead, the test binary adds a ‘warning’
+property with MESSAGE to the test case in the report and counts
+it in the ‘warnings’ attribute of the test suite.  MESSAGE
+defaults to a generic message.  Return VALUE."
+  (cl-check-type message (or null string))
+  (unless value
+    (let ((message (or message "Advisory assertion failed")))
+      (message "Warning: %s" message)
+      (push message elisp/ert/test--warnings)))
+  value)
+
+(cl-defun elisp/ert/assert-golden
+    (actual filename &optional (workspace (getenv "TEST_WORKSPACE")))
+  "Assert that ACTUAL matches the contents of the golden file FILENAME.
+ACTUAL is a string or a buffer.  FILENAME and WORKSPACE are as
+for ‘elisp/ert/data-file’.  If the contents differ, signal an
+error of type ‘elisp/ert/golden-mismatch’, and add a unified
+diff to the failure message.  If the test binary runs with the
+--update-goldens option, instead write ACTUAL to the file
+goldens/FILENAME in the undeclared outputs directory, so that
+you can copy it back into the source tree."
+  (cl-check-type actual (or string buffer))
+  (cl-check-type filename string)
+  (cl-check-type workspace string)
+  (when (bufferp actual)
+    (setq actual (with-current-buffer actual
+                   (save-restriction
+                     (widen)
+                     (buffer-substring-no-properties (point-min)
+                                                     (point-max))))))
+  (let* ((file (elisp/ert/data-file filename workspace))
+         (expected (with-temp-buffer
+                     (let ((coding-system-for-read 'utf-8-unix))
+                       (insert-file-contents file))
+                     (buffer-string))))
+    (unless (equal actual expected)
+      (if elisp/ert/update--goldens
+          (let ((new-file (and elisp/ert/output-directory
+                               (expand-file-name
+                                (concat "goldens/" filename)
+                                elisp/ert/output-directory))))
+            (unless new-file
+              (error "Can’t update golden file %s without output directory"
+                     filename))
+            (make-directory (file-name-directory new-file) :parents)
+            (let ((coding-system-for-write 'utf-8-unix)
+                  (write-region-inhibit-fsync t))
+              (write-region actual nil new-file))
+            (message "Wrote new contents of golden file %s to %s"
+                     filename (file-name-unquote new-file)))
+        (ert-info ((elisp/ert/golden--diff file filename actual)
+                   :prefix "Differences from golden file:\n")
+          (signal 'elisp/ert/golden-mismatch (list filename)))))))
+
+(defun elisp/ert/golden--diff (file label actual)
+  "Return a unified diff between FILE and the string ACTUAL.
+LABEL is the name of FILE in the diff header.  Each line of the
+result is indented by four spaces."
+  (cl-check-type file string)
+  (cl-check-type label string)
+  (cl-check-type actual string)
+  (let ((actual-file (let ((coding-system-for-write 'utf-8-unix))
+                       (make-temp-file "golden-" nil nil actual))))
+    (unwind-protect
         (with-temp-buffer
-          ;; The expected format of the XML output file isn’t well-documented.
-          ;; https://docs.bazel.build/versions/3.0.0/test-encyclopedia.html#initial-conditions
-          ;; only states that the XML file is “ANT-like.”
-          ;; https://llg.cubic.org/docs/junit/ and
-          ;; https://help.catchsoftware.com/display/ET/JUnit+Format contain a
-          ;; bit of documentation.
-          (xml-print
-           (elisp/ert/sanitize--xml
-            `((testsuite
-               ((name . "ERT")  ; required
-                (hostname . "localhost")  ; required
-                (tests . ,(number-to-string (length tests)))
-                (errors . ,(number-to-string errors))
-                (failures . ,(number-to-string failures))
-                (skipped . ,(number-to-string skipped))
-                (time . ,(format-time-string "%s.%N"
-                                             (time-subtract nil start-time)))
-                ;; No timezone or fractional seconds allowed.
-                (timestamp . ,(format-time-string "%FT%T" start-time)))
-               (properties () (property ((name . "emacs-version")
-                                         (value . ,emacs-version))))
-               ,@(nreverse test-reports)
-               (system-out) (system-err)))))
-          (let ((coding-system-for-write 'utf-8-unix))
-            (write-region nil nil (concat "/:" report-file)))))
-      (when coverage-enabled
-        (elisp/ert/write--coverage-report (concat "/:" coverage-dir)
-                                          load-buffers))
-      (kill-emacs (min unexpected 1)))))
+          (let* ((coding-system-for-read 'utf-8-unix)
+                 (status (call-process "diff" nil t nil "-u"
+                                       "--label" label "--label" "actual"
+                                       "--" (file-name-unquote file)
+                                       (file-name-unquote actual-file))))
+            ;; diff exits with status 1 if the files differ.
+            (unless (eql status 1)
+              (error "Running diff failed with status %s: %s"
+                     status (buffer-string))))
+          (mapconcat (lambda (line) (concat "    " line))
+                     (split-string (buffer-string) "\n" :omit-nulls)
+                     "\n"))
+      (delete-file actual-file))))
+
+(define-error 'elisp/ert/golden-mismatch "Contents differ from golden file")
+
+(cl-defun elisp/ert/assert-approx (expected actual &key (margin 0) (fraction 0))
+  "Assert that the number ACTUAL is approximately equal to EXPECTED.
+The numbers are equal if their absolute difference is at most
+the absolute tolerance MARGIN or at most the relative tolerance
+FRACTION times the smaller of their absolute values, like
+‘cmpopts.EquateApprox’ in Go.  NaN isn’t equal to anything.  If
+the numbers aren’t equal, signal an error of type
+‘elisp/ert/approx-mismatch’, and add the expected and actual
+values and the tolerance to the failure message."
+  (cl-check-type expected number)
+  (cl-check-type actual number)
+  (cl-check-type margin (real 0 *))
+  (cl-check-type fraction (real 0 *))
+  (let ((tolerance (max margin (* fraction (min (abs expected)
+                                                (abs actual))))))
+    ;; Comparisons with NaN are always false, so this also catches NaN.
+    (unless (or (= expected actual)
+                (<= (abs (- expected actual)) tolerance))
+      (ert-info ((format "expected %S, actual %S, difference %S, tolerance %S"
+                         expected actual (- actual expected) tolerance)
+                 :prefix "Numbers differ: ")
+        (signal 'elisp/ert/approx-mismatch (list expected actual))))))
+
+(define-error 'elisp/ert/approx-mismatch "Numbers aren’t approximately equal")
+
+(defun elisp/ert/define--doctests (history)
+  "Define ERT tests for the examples in function docstrings.
+HISTORY is a list of ‘load-history’ entries.  Look at the
+docstrings of the functions that these entries define, except
+for the functions that come with Emacs itself.  For each example
+as described in ‘elisp/ert/doctest--examples’, define an ERT
+test named doctest/FUNCTION/N, where N counts the examples of
+FUNCTION starting at 1."
+  (cl-check-type history list)
+  (let ((emacs-lisp-dir (when-let ((subr (locate-library "subr")))
+                          (file-name-directory subr)))
+        (count 0))
+    (pcase-dolist (`(,file . ,definitions) history)
+      (when (and (stringp file)
+                 (not (and emacs-lisp-dir
+                           (file-in-directory-p file emacs-lisp-dir))))
+        (dolist (definition definitions)
+          (pcase definition
+            (`(defun . ,(and (pred symbolp) function))
+             (cl-loop
+              for (form . expected) in (elisp/ert/doctest--examples function)
+              for index from 1
+              for name = (intern (format "doctest/%s/%d" function index))
+              do (ert-set-test
+                  name
+                  (make-ert-test
+                   :name name
+                   :documentation (format-message "Example %d of ‘%s’."
+                                                  index function)
+                   :body (apply-partially #'elisp/ert/check--doctest
+                                          function form expected)))
+              (cl-incf count)))))))
+    (message "Defined %d doctests" count)))
+
+(defun elisp/ert/define--erts-tests (file)
+  "Define ERT tests for the cases in the erts FILE.
+For each case as described in ‘elisp/ert/erts--cases’, define an
+ERT test named erts/BASE/NAME, where BASE is the name of FILE
+relative to its workspace without extension."
+  (cl-check-type file string)
+  (let ((base (file-name-sans-extension
+               (or (elisp/ert/workspace--relative-name file)
+                   (file-name-nondirectory (file-name-unquote file)))))
+        (contents (with-temp-buffer
+                    (let ((coding-system-for-read 'utf-8-unix))
+                      (insert-file-contents file))
+                    (buffer-string)))
+        (count 0))
+    (pcase-dolist (`(,case-name . ,case-contents)
+                   (elisp/ert/erts--cases contents))
+      (let ((name (intern (format "erts/%s/%s" base case-name))))
+        (ert-set-test
+         name
+         (make-ert-test
+          :name name
+          :documentation (format-message "Test case ‘%s’ from %s."
+                                         case-name (file-name-unquote file))
+          :body (apply-partially #'elisp/ert/check--erts case-contents))))
+      (cl-incf count))
+    (message "Defined %d tests from %s" count (file-name-unquote file))))
+
+(defun elisp/ert/erts--cases (contents)
+  "Split CONTENTS of an erts file into separate test cases.
+Return a list of (NAME . CASE-CONTENTS) pairs, one for each case.
+NAME is the value of the “Name:” header of the case, or the
+one-based index of the case if it has no name.  CASE-CONTENTS is
+a valid erts file by itself.  It consists of the text before the
+first “Name:” header, which contains the headers that apply to all
+cases, and the text of the case."
+  (cl-check-type contents string)
+  (with-temp-buffer
+    (insert contents)
+    (goto-char (point-min))
+    (let ((case-fold-search nil)
+          (header nil)
+          (start (point-min))
+          (index 0)
+          (cases ()))
+      ;; The last case doesn’t need a terminating “=-=-=” line.
+      (while (or (re-search-forward (rx bol "=-=-=" eol) nil t)
+                 (and (save-excursion
+                        (re-search-forward (rx bol "=-=" eol) nil t))
+                      (goto-char (point-max))))
+        (forward-line)
+        (let ((text (buffer-substring-no-properties start (point))))
+          (cl-incf index)
+          (unless header
+            ;; The first case also contains the global headers.
+            (setq header (if (string-match (rx bol "Name:") text)
+                             (substring text 0 (match-beginning 0))
+                           "")
+                  text (substring text (length header))))
+          (push (cons (if (string-match (rx bol "Name:" (* blank)
+                                            (group (+ nonl)))
+                                        text)
+                          (string-trim (match-string 1 text))
+                        (number-to-string index))
+                      (concat header text))
+                cases)
+          (setq start (point))))
+      (nreverse cases))))
+
+(defun elisp/ert/check--erts (contents)
+  "Run the erts test case in CONTENTS using ‘ert-test-erts-file’.
+CONTENTS is an element of the list returned by
+‘elisp/ert/erts--cases’.  Skip the test if ‘ert-test-erts-file’
+isn’t available."
+  (cl-check-type contents string)
+  (unless (fboundp 'ert-test-erts-file)
+    (ert-skip "Running erts files requires Emacs 29 or later"))
+  (let ((file (let ((coding-system-for-write 'utf-8-unix))
+                (make-temp-file "test-" nil ".erts" contents))))
+    (unwind-protect
+        (funcall #'ert-test-erts-file file)
+      (delete-file file))))
+
+(defun elisp/ert/doctest--examples (function)
+  "Return the examples in the docstring of FUNCTION.
+An example is a Lisp form followed by “⇒” and the printed
+representation of its value on the rest of the line, e.g.
+
+  (+ 1 2)
+    ⇒ 3
+
+Return a list of elements (FORM . EXPECTED), where EXPECTED is
+the printed representation from the docstring."
+  (cl-check-type function symbol)
+  (let ((doc (ignore-errors (documentation function :raw)))
+        (examples ()))
+    (when (stringp doc)
+      (with-temp-buffer
+        (with-syntax-table emacs-lisp-mode-syntax-table
+          (insert doc)
+          (goto-char (point-min))
+          (while (search-forward "⇒" nil t)
+            (let ((expected (string-trim (buffer-substring-no-properties
+                                          (point) (line-end-position))))
+                  (form (save-excursion
+                          (goto-char (match-beginning 0))
+                          (ignore-errors
+                            (backward-sexp)
+                            (read (current-buffer))))))
+              ;; Only accept function calls and similar forms, so that
+              ;; arrows in ordinary text don’t lead to bogus examples.
+              (when (and (consp form) (not (string-empty-p expected)))
+                (push (cons form expected) examples)))))))
+    (nreverse examples)))
+
+(defun elisp/ert/check--doctest (function form expected)
+  "Check an example from the docstring of FUNCTION.
+Evaluate FORM and compare the printed representation of its value
+with the string EXPECTED.  If they differ, signal an error of
+type ‘elisp/ert/doctest-mismatch’, and add the location of
+FUNCTION and both values to the failure message."
+  (cl-check-type function symbol)
+  (cl-check-type expected string)
+  (let ((actual (prin1-to-string (eval form t))))
+    (unless (equal actual expected)
+      (ert-info ((let ((location (elisp/ert/definition--location function
+                                                                 nil)))
+                   (format "%s%S\n  expected: %s\n  actual:   %s"
+                           (if location
+                               (format "%s:%d: " (car location) (cdr location))
+                             "")
+                           form expected actual))
+                 :prefix "Doctest example failed: ")
+        (signal 'elisp/ert/doctest-mismatch (list function form))))))
+
+(define-error 'elisp/ert/doctest-mismatch "Doctest example failed")
 
 (defvar elisp/ert/skip--tests nil
   "Test symbols to be skipped.
@@ -268,12 +1727,87 @@ This list is populated by --skip-test command-line options.")
   "Test tags to be skipped.
 This list is populated by --skip-tag command-line options.")
 
+(defvar elisp/ert/test--args nil
+  "Arguments for the tests, in reverse order.
+This list is populated by --test-arg command-line options.")
+
 (defun elisp/ert/test-source (_arg)
   "Handle the --test-source command-line argument."
   (let ((file (pop command-line-args-left)))
     (or file (error "Missing value for --test-source option"))
     (push file elisp/ert/test--sources)))
 
+(defun elisp/ert/loaded--p (file)
+  "Return whether FILE has already been loaded.
+Look for FILE in ‘load-history’.  Compare the filenames with
+‘file-equal-p’, since FILE might refer to the same file as a
+‘load-history’ entry through a different path."
+  (cl-check-type file string)
+  (let ((file (file-name-unquote file)))
+    (cl-loop for (loaded . _) in load-history
+             thereis (and (stringp loaded)
+                          (or (string-equal loaded file)
+                              (file-equal-p loaded file))))))
+
+(defun elisp/ert/require--with-diagnostics
+    (require feature &optional filename noerror)
+  "Call REQUIRE with FEATURE, FILENAME, and NOERROR.
+REQUIRE is the original ‘require’ function.  If REQUIRE fails
+because it can’t find the file for FEATURE, signal an error of
+type ‘elisp/ert/missing-feature’ instead, whose message names
+FEATURE, the file that requires it, the filenames that Emacs has
+tried, and the load path."
+  (condition-case err
+      (funcall require feature filename noerror)
+    (file-missing
+     (let ((name (or filename (symbol-name feature))))
+       ;; Only the innermost ‘require’ should explain the error, and only
+       ;; if the missing file is the one for FEATURE.
+       (if (or (eq (car err) 'elisp/ert/missing-feature)
+               (not (equal (car (last err)) name)))
+           (signal (car err) (cdr err))
+         (signal 'elisp/ert/missing-feature
+                 (list (elisp/ert/missing--feature-message feature name))))))))
+
+(defun elisp/ert/missing--feature-message (feature name)
+  "Return an error message for the missing FEATURE.
+NAME is the filename that ‘require’ has looked for."
+  (cl-check-type feature symbol)
+  (cl-check-type name string)
+  (string-join
+   `(,(format-message
+       "Cannot find feature ‘%s’ required by %s" feature
+       (if load-file-name
+           (or (elisp/ert/workspace--relative-name load-file-name)
+               (file-name-unquote load-file-name))
+         "the test binary"))
+     ,(format "  Tried the filenames %s in these load path directories:"
+              (mapconcat (lambda (suffix) (concat name suffix))
+                         (get-load-suffixes) ", "))
+     ,@(mapcar (lambda (dir)
+                 (concat "    " (if dir (file-name-unquote dir) ".")))
+               load-path))
+   "\n"))
+
+(define-error 'elisp/ert/missing-feature
+  "Cannot find required feature" 'file-missing)
+
+(defun elisp/ert/update-goldens (_arg)
+  "Handle the --update-goldens command-line argument."
+  (setq elisp/ert/update--goldens t))
+
+(defun elisp/ert/test-arg (_arg)
+  "Handle the --test-arg command-line argument."
+  (let ((arg (pop command-line-args-left)))
+    (or arg (error "Missing value for --test-arg option"))
+    (push arg elisp/ert/test--args)))
+
+(defun elisp/ert/erts-file (_arg)
+  "Handle the --erts-file command-line argument."
+  (let ((file (pop command-line-args-left)))
+    (or file (error "Missing value for --erts-file option"))
+    (push file elisp/ert/erts--files)))
+
 (defun elisp/ert/skip-test (_arg)
   "Handle the --skip-test command-line argument."
   (let ((test (pop command-line-args-left)))
@@ -286,6 +1820,58 @@ This list is populated by --skip-tag command-line options.")
     (or tag (error "Missing value for --skip-tag option"))
     (push (intern tag) elisp/ert/skip--tags)))
 
+(defun elisp/ert/isolate-test-sources (_arg)
+  "Handle the --isolate-test-sources command-line argument."
+  (setq elisp/ert/isolate--sources t))
+
+(defun elisp/ert/pre-test-load (_arg)
+  "Handle the --pre-test-load command-line argument."
+  (let ((file (pop command-line-args-left)))
+    (or file (error "Missing value for --pre-test-load option"))
+    (push (cons 'load file) elisp/ert/pre-test--actions)))
+
+(defun elisp/ert/pre-test-eval (_arg)
+  "Handle the --pre-test-eval command-line argument."
+  (let ((form (pop command-line-args-left)))
+    (or form (error "Missing value for --pre-test-eval option"))
+    (push (cons 'eval form) elisp/ert/pre-test--actions)))
+
+(defun elisp/ert/pre-test--run (action)
+  "Perform the setup ACTION.
+ACTION is an element of ‘elisp/ert/pre-test--actions’.  Signal an
+error that names the file or form if ACTION fails."
+  (cl-check-type action cons)
+  (pcase action
+    (`(load . ,file)
+     (condition-case err
+         (load file nil :nomessage :nosuffix)
+       (error (error "Loading setup file %s failed: %s"
+                     (file-name-unquote file) (error-message-string err)))))
+    (`(eval . ,form)
+     (condition-case err
+         (pcase-let ((`(,sexp . ,end) (read-from-string form)))
+           (unless (string-blank-p (substring form end))
+             (error "Trailing garbage after form"))
+           (eval sexp :lexical))
+       (error (error "Evaluating setup form %s failed: %s"
+                     form (error-message-string err)))))
+    (_ (error "Invalid setup action %S" action))))
+
+(defun elisp/ert/preload--feature (feature)
+  "Require FEATURE for all test files.
+Signal an error that names FEATURE if it can’t be loaded."
+  (cl-check-type feature symbol)
+  (condition-case err
+      (require feature)
+    (error (error "Failed to preload feature %s: %s"
+                  feature (error-message-string err)))))
+
+(defun elisp/ert/preload-feature (_arg)
+  "Handle the --preload-feature command-line argument."
+  (let ((feature (pop command-line-args-left)))
+    (or feature (error "Missing value for --preload-feature option"))
+    (push (intern feature) elisp/ert/preload--features)))
+
 (defun elisp/ert/make--selector (skip-tags)
   "Build an ERT selector from environment and command line.
 SKIP-TAGS is a list of additional tags to skip."
@@ -299,13 +1885,673 @@ SKIP-TAGS is a list of additional tags to skip."
             (invert (sel) (if sel `(not ,sel) t)))
     (let* ((test-filter (getenv "TESTBRIDGE_TEST_ONLY"))
            (filter (if (member test-filter '(nil "")) t (read test-filter)))
+           (custom-selector (getenv "ELISP_TEST_SELECTOR"))
+           (custom-sel (if (member custom-selector '(nil "")) t
+                         (elisp/ert/eval--selector custom-selector)))
+           (tags (elisp/ert/parse--tags (or (getenv "ELISP_TEST_TAGS") "")))
+           (include-tags-sel
+            (combine 'or t (mapcar (lambda (tag) `(tag ,tag)) (car tags))))
+           (exclude-tags-sel
+            (invert
+             (combine 'or nil (mapcar (lambda (tag) `(tag ,tag)) (cdr tags)))))
            (skip-tags-sel
             (invert
              (combine 'or nil (nreverse (mapcar (lambda (tag) `(tag ,tag))
                                                 skip-tags)))))
            (skip-tests
             (invert (combine 'member nil (reverse elisp/ert/skip--tests)))))
-      (combine 'and t (delq t (list filter skip-tags-sel skip-tests))))))
+      (combine 'and t (delq t (list filter custom-sel include-tags-sel
+                                    exclude-tags-sel skip-tags-sel
+                                    skip-tests))))))
+
+(defun elisp/ert/eval--selector (string)
+  "Evaluate the Lisp form in STRING and return an ERT selector.
+STRING is the value of the environment variable
+ELISP_TEST_SELECTOR.  The form should evaluate to either an ERT
+selector or a predicate function; the latter is called with each
+‘ert-test’ object and should return non-nil for the tests to
+select.  Signal an error if STRING doesn’t contain exactly one
+form or the form doesn’t evaluate to a valid selector."
+  (cl-check-type string string)
+  (condition-case err
+      (pcase-let ((`(,form . ,end) (read-from-string string)))
+        (when (string-match-p (rx (not (any space))) string end)
+          (error "Trailing input after %S" form))
+        (let* ((value (eval form t))
+               (selector (if (and (functionp value) (not (symbolp value)))
+                             `(satisfies ,value)
+                           value)))
+          ;; Let ERT check the selector now.  The tests aren’t loaded yet,
+          ;; so select from an empty list.
+          (ert-select-tests selector ())
+          selector))
+    (error (error "Invalid ELISP_TEST_SELECTOR (%s): %s"
+                  string (error-message-string err)))))
+
+(defun elisp/ert/parse--tags (string)
+  "Parse the tag expression STRING.
+STRING is a whitespace-separated list of tags.  A tag prefixed
+with “-” excludes tests with that tag.  Other tags, optionally
+prefixed with “+”, include tests with that tag.  Return a cons
+(INCLUDE . EXCLUDE) of two lists of tag symbols."
+  (cl-check-type string string)
+  (let ((include ())
+        (exclude ()))
+    (dolist (word (split-string string nil t))
+      (let ((tag (string-remove-prefix "+" (string-remove-prefix "-" word))))
+        (when (string-empty-p tag)
+          (error "Invalid tag %S in ELISP_TEST_TAGS" word))
+        (if (string-prefix-p "-" word)
+            (push (intern tag) exclude)
+          (push (intern tag) include))))
+    (cons (nreverse include) (nreverse exclude))))
+
+(defun elisp/ert/run--test (test timeout &optional temp-dir)
+  "Run TEST like ‘ert-run-test’, but give up after TIMEOUT seconds.
+TIMEOUT is either nil, meaning no timeout, or a positive number.
+If TEST doesn’t finish in time, return an ‘ert-test-quit’ result
+whose condition is (elisp/ert/timeout TIMEOUT).  Like all
+timers, the timeout can only interrupt TEST while it’s waiting,
+e.g. in ‘sleep-for’ or ‘accept-process-output’.  If a signal escapes
+‘ert-run-test’, return an ‘ert-test-quit’ result whose condition is
+the signal, so that the remaining tests still run.  If TEMP-DIR is
+non-nil, it names a directory that replaces any existing directory of
+that name; TEST runs with ‘temporary-file-directory’ and the
+environment variable TMPDIR set to that directory."
+  (cl-check-type test ert-test)
+  (cl-check-type timeout (or null number))
+  (cl-check-type temp-dir (or null string))
+  (when temp-dir
+    (when (file-directory-p temp-dir)
+      (delete-directory temp-dir :recursive))
+    (make-directory temp-dir :parents))
+  (let ((temporary-file-directory (or temp-dir temporary-file-directory))
+        (process-environment
+         (if temp-dir
+             (cons (concat "TMPDIR=" (file-name-unquote temp-dir))
+                   process-environment)
+           process-environment)))
+    (condition-case condition
+        (if (null timeout)
+            (ert-run-test test)
+          (with-timeout (timeout
+                         (elisp/ert/aborted--result
+                          test `(elisp/ert/timeout ,timeout)))
+            (ert-run-test test)))
+      ;; ERT only records signals that reach its debugger.  Signals can escape
+      ;; if the test binds ‘debug-on-error’ or ‘inhibit-debugger’, or if ERT
+      ;; itself fails.
+      (t (elisp/ert/aborted--result test condition)))))
+
+(defun elisp/ert/aborted--result (test condition)
+  "Record an ‘ert-test-quit’ result with CONDITION for TEST.
+Return the new result.  The result contains the messages and
+assertions of the incomplete result that ‘ert-run-test’ has
+already stored."
+  (cl-check-type test ert-test)
+  (cl-check-type condition cons)
+  (let* ((partial (ert-test-most-recent-result test))
+         (result (make-ert-test-quit
+                  :messages (and partial (ert-test-result-messages partial))
+                  :should-forms (and partial
+                                     (ert-test-result-should-forms partial))
+                  :condition condition
+                  :backtrace nil
+                  :infos nil)))
+    (setf (ert-test-most-recent-result test) result)))
+
+(defun elisp/ert/test--temp-directory (name)
+  "Return the temporary directory for the test named NAME.
+The directory is a subdirectory of ‘temporary-file-directory’
+whose name only depends on NAME, so that it’s predictable and
+distinct for each test."
+  (cl-check-type name symbol)
+  (file-name-as-directory
+   (expand-file-name
+    ;; Percent-encode characters that might not be valid in filenames.
+    (replace-regexp-in-string
+     (rx (not (any "a-z" "A-Z" "0-9" ?- ?_)))
+     (lambda (char) (format "%%%02X" (string-to-char char)))
+     (encode-coding-string (symbol-name name) 'utf-8-unix) :fixedcase :literal)
+    (expand-file-name "ert" temporary-file-directory))))
+
+(define-error 'elisp/ert/timeout "Test timed out")
+
+(define-error 'elisp/ert/global-state "Test modified global state")
+
+(define-error 'elisp/ert/memory-exhausted "Test ran out of memory")
+
+(define-error 'elisp/ert/matching-message "Test logged a forbidden message")
+
+(defun elisp/ert/matching--line (regexp string)
+  "Return the first line in STRING that matches REGEXP.
+Return nil if no line matches."
+  (cl-check-type regexp string)
+  (cl-check-type string string)
+  (cl-loop for line in (split-string string "\n")
+           when (string-match-p regexp line) return line))
+
+(defun elisp/ert/check--should-error (form-description-fn condition type
+                                                          _exclude-subtypes)
+  "Fail the current test if a ‘should-error’ form is too broad.
+This is a ‘:before’ advice for ‘ert--should-error-handle-error’
+that ELISP_TEST_STRICT_SHOULD_ERROR installs.  FORM-DESCRIPTION-FN,
+CONDITION, and TYPE are as in that function.  Fail unless the
+error symbol of CONDITION is one of the symbols in TYPE; a
+‘should-error’ form without :type has the type ‘error’.  This
+behaves as if all ‘should-error’ forms specified :exclude-subtypes,
+but explains which condition the form should have specified."
+  (cl-check-type form-description-fn function)
+  (cl-check-type condition cons)
+  (cl-check-type type (or symbol list))
+  (let ((actual (car condition))
+        (expected (if (listp type) type (list type))))
+    (unless (memq actual expected)
+      (ert-fail
+       (append (funcall form-description-fn)
+               (list :condition condition
+                     :expected-type type
+                     :actual-type actual
+                     :fail-reason
+                     (format-message
+                      "‘should-error’ caught ‘%s’, but expected ‘%s’"
+                      actual type)))))))
+
+(defun elisp/ert/warning--count (test-case)
+  "Return the number of warnings recorded in TEST-CASE.
+TEST-CASE is a ‘testcase’ XML node.  Count its ‘warning’
+properties, see ‘elisp/ert/should-warn’."
+  (cl-check-type test-case cons)
+  (cl-count "warning"
+            (xml-get-children (car (xml-get-children test-case 'properties))
+                              'property)
+            :key (lambda (property) (xml-get-attribute property 'name))
+            :test #'equal))
+
+(defconst elisp/ert/default--globals
+  '(load-path features default-directory buffer-list)
+  "Global state that ELISP_TEST_CHECK_GLOBALS checks by default.
+Each element is a variable symbol, except for ‘buffer-list’,
+which stands for the number of live buffers.")
+
+(defun elisp/ert/globals--snapshot (globals)
+  "Return a snapshot of the global state GLOBALS.
+GLOBALS is a list of symbols as in ‘elisp/ert/default--globals’.
+Return an alist that maps each element of GLOBALS to nil if it’s
+an unbound variable, and to a list containing a copy of its
+current value otherwise."
+  (cl-check-type globals list)
+  (mapcar (lambda (symbol)
+            (cons symbol
+                  (cond ((eq symbol 'buffer-list)
+                         (list (length (buffer-list))))
+                        ((boundp symbol)
+                         (list (copy-tree (symbol-value symbol)))))))
+          globals))
+
+(defun elisp/ert/modified--globals (before after)
+  "Return the global state that differs between BEFORE and AFTER.
+BEFORE and AFTER are snapshots as returned by
+‘elisp/ert/globals--snapshot’.  Return a list of symbols."
+  (cl-check-type before list)
+  (cl-check-type after list)
+  (cl-loop for (symbol . value) in before
+           unless (equal value (alist-get symbol after))
+           collect symbol))
+
+(defconst elisp/ert/object--sizes '(16 16 8 48 1 56 32)
+  "Approximate sizes in bytes of the objects that Emacs allocates.
+The elements correspond to the elements of the list that
+‘memory-use-counts’ returns: conses, floats, vector cells,
+symbols, string characters, intervals, and strings.  The sizes
+are those of a typical 64-bit build.")
+
+(defun elisp/ert/allocated--bytes (before after)
+  "Return the number of bytes allocated between BEFORE and AFTER.
+BEFORE and AFTER are lists as returned by ‘memory-use-counts’.
+The result is an estimate based on ‘elisp/ert/object--sizes’.
+The object counts only depend on the code that runs, not on
+garbage collection, so the result is stable across runs."
+  (cl-check-type before list)
+  (cl-check-type after list)
+  (cl-loop for old in before
+           for new in after
+           for size in elisp/ert/object--sizes
+           sum (* (- new old) size)))
+
+(defun elisp/ert/advice--snapshot ()
+  "Return the advice currently added to named functions.
+Return an alist that maps each advised function symbol to the
+list of its advice functions, see ‘advice-add’."
+  (let ((snapshot ()))
+    (mapatoms
+     (lambda (symbol)
+       (when (fboundp symbol)
+         (let ((functions ()))
+           (advice-mapc (lambda (function _props) (push function functions))
+                        symbol)
+           (when functions (push (cons symbol functions) snapshot))))))
+    snapshot))
+
+(defun elisp/ert/remove--advice (before)
+  "Remove the advice that has been added since BEFORE.
+BEFORE is a snapshot as returned by ‘elisp/ert/advice--snapshot’.
+Remove all advice that isn’t part of BEFORE.  Return a list of
+messages that describe the removed advice."
+  (cl-check-type before list)
+  (let ((messages ()))
+    (pcase-dolist (`(,symbol . ,functions) (elisp/ert/advice--snapshot))
+      (dolist (function functions)
+        (unless (memq function (alist-get symbol before))
+          (advice-remove symbol function)
+          (push (if (symbolp function)
+                    (format-message "Test left advice ‘%s’ on function ‘%s’"
+                                    function symbol)
+                  (format-message "Test left anonymous advice on function ‘%s’"
+                                  symbol))
+                messages))))
+    (nreverse messages)))
+
+(defun elisp/ert/shuffle--list (list)
+  "Return a random permutation of LIST.
+The permutation depends only on the state of the random number
+generator, see ‘random’."
+  (cl-check-type list list)
+  (let ((vector (vconcat list)))
+    ;; Fisher–Yates shuffle, see
+    ;; https://en.wikipedia.org/wiki/Fisher%E2%80%93Yates_shuffle.
+    (cl-loop for i downfrom (1- (length vector)) above 0
+             for j = (random (1+ i))
+             do (cl-rotatef (aref vector i) (aref vector j)))
+    (append vector nil)))
+
+(defconst elisp/ert/worker--removed-variables
+  '("TEST_SHARD_STATUS_FILE" "ELISP_TEST_LIST" "ELISP_TEST_REPORT_FORMAT"
+    "ELISP_TEST_REPORT_FILE" "ELISP_TEST_SUMMARY_FILE" "ELISP_TEST_PROFILE"
+    "ELISP_TEST_PROGRESS_FD" "ELISP_TEST_SLOW_THRESHOLD"
+    "ELISP_TEST_STREAM_FILE" "ELISP_TEST_BENCHMARK_FILE"
+    "ELISP_TEST_REPORT_HOOK" "ELISP_TEST_REPORT_STDOUT"
+    "ELISP_TEST_COVERAGE_FORMAT" "ELISP_TEST_COBERTURA_FILE")
+  "Environment variables to remove for subordinate Emacs processes.
+Subordinate processes always write JUnit reports to a temporary
+file.  These variables would prevent that or make them write
+additional reports.")
+
+(defun elisp/ert/run--workers (tests jobs timeout coverage-file)
+  "Run TESTS in JOBS subordinate Emacs processes.
+TESTS is a list of ERT test objects.  Each subordinate Emacs
+process runs a subset of TESTS using the same command line as the
+current Emacs process and writes an XML report.  TIMEOUT is either
+nil or the number of seconds remaining for all tests.  If
+COVERAGE-FILE is non-nil, append the coverage reports of the
+subordinate processes to it.  Return a list of ‘testcase’ XML
+nodes for TESTS."
+  (cl-check-type tests list)
+  (cl-check-type jobs natnum)
+  (cl-check-type timeout (or null number))
+  (cl-check-type coverage-file (or null string))
+  (let ((partitions (make-vector (min jobs (length tests)) nil))
+        (workers ())
+        (reports ()))
+    (cl-loop for test in tests
+             for i from 0
+             do (push (ert-test-name test)
+                      (aref partitions (mod i (length partitions)))))
+    (cl-loop
+     for names across partitions
+     for index from 0
+     for report-file = (make-temp-file "elisp-test-worker-" nil ".xml")
+     for worker-coverage-file = (and coverage-file
+                                     (make-temp-file "elisp-test-worker-"
+                                                     nil ".dat"))
+     for environment
+     = `(,(format "TESTBRIDGE_TEST_ONLY=%S" `(member ,@(nreverse names)))
+         ,(concat "XML_OUTPUT_FILE=" (file-name-unquote report-file))
+         ,@(and timeout (list (format "TEST_TIMEOUT=%d" (max timeout 1))))
+         ,@(and worker-coverage-file
+                (list "COVERAGE_DIR"
+                      (concat "COVERAGE_OUTPUT_FILE="
+                              (file-name-unquote worker-coverage-file))))
+         "ELISP_TEST_JOBS=1"
+         ;; Subordinate processes always run all of their tests, so remove
+         ;; the sharding variables, too.
+         "TEST_TOTAL_SHARDS" "TEST_SHARD_INDEX"
+         ,@elisp/ert/worker--removed-variables
+         ,@process-environment)
+     do (push (list index
+                    (elisp/ert/start--worker index environment)
+                    report-file worker-coverage-file)
+              workers))
+    (message "Running %d tests in %d subordinate processes"
+             (length tests) (length workers))
+    (while (cl-some (lambda (worker) (process-live-p (cadr worker))) workers)
+      (accept-process-output nil 1))
+    (pcase-dolist (`(,index ,process ,report-file ,worker-coverage-file)
+                   (nreverse workers))
+      (dolist (test-case (elisp/ert/finish--worker index process report-file
+                                                   worker-coverage-file
+                                                   coverage-file))
+        ;; Ignore test cases for anything else than TESTS, e.g. load errors,
+        ;; which the current process already reports.
+        (when (cl-find (alist-get 'name (cadr test-case)) tests
+                       :key (lambda (test) (symbol-name (ert-test-name test)))
+                       :test #'string-equal)
+          (push test-case reports))))
+    (nreverse reports)))
+
+(defun elisp/ert/missing--tests (tests reports)
+  "Return the elements of TESTS that don’t have a report in REPORTS.
+TESTS is a list of ERT test objects.  REPORTS is a list of
+‘testcase’ XML nodes."
+  (cl-check-type tests list)
+  (cl-check-type reports list)
+  (cl-loop for test in tests
+           for name = (symbol-name (ert-test-name test))
+           unless (cl-find name reports
+                           :key (lambda (report)
+                                  (alist-get 'name (cadr report)))
+                           :test #'string-equal)
+           collect test))
+
+(defun elisp/ert/run--isolated (sources timeout coverage-file)
+  "Run the tests of each of SOURCES in a separate Emacs process.
+SOURCES is a list of test source files.  The subordinate Emacs
+processes run one after the other, each loading only one of
+SOURCES, using the same command line and test selector as the
+current Emacs process.  TIMEOUT is either nil or the Bazel test
+timeout in seconds.  If COVERAGE-FILE is non-nil, append the
+coverage reports of the subordinate processes to it.  Return a
+list of ‘testcase’ XML nodes."
+  (cl-check-type sources list)
+  (cl-check-type timeout (or null number))
+  (cl-check-type coverage-file (or null string))
+  (cl-loop
+   for source in sources
+   for index from 0
+   for report-file = (make-temp-file "elisp-test-worker-" nil ".xml")
+   for worker-coverage-file = (and coverage-file
+                                   (make-temp-file "elisp-test-worker-"
+                                                   nil ".dat"))
+   for remaining = (and timeout
+                        (- timeout
+                           (float-time (time-subtract nil before-init-time))))
+   for environment
+   = `(,(concat "ELISP_TEST_ISOLATED_SOURCE=" source)
+       ,(concat "XML_OUTPUT_FILE=" (file-name-unquote report-file))
+       ,@(and remaining (list (format "TEST_TIMEOUT=%d" (max remaining 1))))
+       ,@(and worker-coverage-file
+              (list "COVERAGE_DIR"
+                    (concat "COVERAGE_OUTPUT_FILE="
+                            (file-name-unquote worker-coverage-file))))
+       ;; Subordinate processes apply the test filter and sharding
+       ;; themselves.
+       ,@elisp/ert/worker--removed-variables
+       ,@process-environment)
+   do (message "Running tests of %s in subordinate process %d"
+               (file-name-unquote source) index)
+   append (let ((process (elisp/ert/start--worker index environment)))
+            (while (process-live-p process)
+              (accept-process-output process 1))
+            (elisp/ert/finish--worker index process report-file
+                                      worker-coverage-file coverage-file))))
+
+(defun elisp/ert/start--worker (index environment)
+  "Start the subordinate Emacs process number INDEX and return it.
+ENVIRONMENT is the value of ‘process-environment’ for the new
+process.  The process uses the same command line as the current
+Emacs process."
+  (cl-check-type index natnum)
+  (cl-check-type environment list)
+  (let ((process-environment environment))
+    (make-process
+     :name (format "worker %d" index)
+     :buffer (generate-new-buffer (format " *worker %d*" index))
+     :command (cons (expand-file-name invocation-name invocation-directory)
+                    (cdr command-line-args))
+     ;; In terminal mode, the subordinate processes need a terminal, too.
+     :connection-type (if noninteractive 'pipe 'pty)
+     :noquery t
+     :sentinel #'ignore)))
+
+(defun elisp/ert/finish--worker (index process report-file
+                                       worker-coverage-file coverage-file)
+  "Collect the results of the subordinate Emacs PROCESS.
+INDEX is the number of the process.  PROCESS must have finished
+and written a JUnit report to REPORT-FILE.  If COVERAGE-FILE is
+non-nil, append WORKER-COVERAGE-FILE to it.  Delete REPORT-FILE
+and WORKER-COVERAGE-FILE afterwards.  Return a list of ‘testcase’
+XML nodes from the report."
+  (cl-check-type index natnum)
+  (cl-check-type process process)
+  (cl-check-type report-file string)
+  (cl-check-type worker-coverage-file (or null string))
+  (cl-check-type coverage-file (or null string))
+  (let ((buffer (process-buffer process))
+        (reports ()))
+    ;; Pass on the output of the subordinate process.
+    (message "Output of subordinate process %d:\n%s" index
+             (with-current-buffer buffer (string-trim-right (buffer-string))))
+    (kill-buffer buffer)
+    ;; The exit status is 1 if some tests failed.  Anything else is a crash,
+    ;; in which case we can’t trust the report.
+    (unless (and (eq (process-status process) 'exit)
+                 (memql (process-exit-status process) '(0 1)))
+      (error "Subordinate process %d failed with status %s %s" index
+             (process-status process) (process-exit-status process)))
+    (let* ((coding-system-for-read 'utf-8-unix)
+           (report (car (xml-parse-file report-file))))
+      (dolist (test-case (xml-get-children report 'testcase))
+        ;; Remove whitespace between the child elements.
+        (push (cl-remove-if #'stringp test-case :start 2) reports)))
+    (delete-file report-file)
+    (when worker-coverage-file
+      (with-temp-buffer
+        (let ((coding-system-for-read 'utf-8-unix)
+              (coding-system-for-write 'utf-8-unix))
+          (insert-file-contents worker-coverage-file)
+          (write-region nil nil coverage-file :append)))
+      (delete-file worker-coverage-file))
+    (nreverse reports)))
+
+(defun elisp/ert/write--profile (file mode)
+  "Stop the profiler and write its profile to FILE.
+MODE is the profiler mode, either ‘cpu’ or ‘mem’.  FILE receives
+the raw profile, which ‘profiler-find-profile’ can read.  In
+addition, write a human-readable report to FILE with “.txt”
+appended."
+  (cl-check-type file string)
+  (cl-check-type mode (member cpu mem))
+  (let ((profile (pcase-exhaustive mode
+                   ('cpu (profiler-cpu-profile))
+                   ('mem (profiler-memory-profile)))))
+    (profiler-stop)
+    (unless profile (error "Profiler didn’t record a %s profile" mode))
+    (profiler-write-profile profile file)
+    (let ((buffer (profiler-report-setup-buffer profile))
+          (coding-system-for-write 'utf-8-unix))
+      (with-current-buffer buffer
+        (write-region nil nil (concat file ".txt")))
+      (kill-buffer buffer))
+    (message "Wrote %s profile to %s" mode (file-name-unquote file))))
+
+(defconst elisp/ert/sensitive--word
+  (rx (or "CREDENTIAL" "KEY" "PASSWD" "PASSWORD" "SECRET" "TOKEN"))
+  "Regular expression for words that indicate secrets.
+These words make an environment variable sensitive even if they
+are only part of a component of its name, e.g. in APIKEY or
+GITHUBTOKEN.  See ‘elisp/ert/sensitive--variable-p’.")
+
+(defconst elisp/ert/sensitive--component
+  (rx bos (or "AUTH" "COOKIE" "PRIVATE" "SESSION") (? ?S) eos)
+  "Regular expression for name components that indicate secrets.
+Unlike ‘elisp/ert/sensitive--word’, these words only make an
+environment variable sensitive if they are a complete component
+of its name.  See ‘elisp/ert/sensitive--variable-p’.")
+
+(defconst elisp/ert/harmless--components
+  '("KEYBOARD" "KEYMAP" "MONKEY" "TOKENIZER" "TOKENIZERS")
+  "Name components that contain a sensitive word, but aren’t secrets.
+See ‘elisp/ert/sensitive--variable-p’.")
+
+(defun elisp/ert/sensitive--variable-p (name)
+  "Return whether the environment variable NAME might contain a secret.
+The XML report never includes such variables.  Split NAME into
+components separated by underscores, ignoring case.  NAME is
+sensitive if one of the components contains a match for
+‘elisp/ert/sensitive--word’ or matches
+‘elisp/ert/sensitive--component’.  Components in
+‘elisp/ert/harmless--components’ don’t count, so that e.g.
+TOKENIZER_DIR isn’t sensitive, but API_TOKEN and APIKEY are."
+  (cl-check-type name string)
+  (let ((case-fold-search t))
+    (cl-some (lambda (component)
+               (and (not (member (upcase component)
+                                 elisp/ert/harmless--components))
+                    (or (string-match-p elisp/ert/sensitive--word component)
+                        (string-match-p elisp/ert/sensitive--component
+                                        component))))
+             (split-string name "_" :omit-nulls))))
+
+(defun elisp/ert/slow--tests (test-reports threshold count)
+  "Return the slowest tests in TEST-REPORTS.
+TEST-REPORTS is a list of ‘testcase’ XML nodes.  Return at most
+COUNT elements of the form (NAME . SECONDS) for the tests that
+took longer than THRESHOLD seconds, slowest first."
+  (cl-check-type test-reports list)
+  (cl-check-type threshold number)
+  (cl-check-type count natnum)
+  (let ((slow ()))
+    (dolist (node test-reports)
+      (let ((seconds (string-to-number (alist-get 'time (cadr node)))))
+        (when (> seconds threshold)
+          (push (cons (alist-get 'name (cadr node)) seconds) slow))))
+    ;; Break ties by name so that the order doesn’t depend on the execution
+    ;; order.
+    (setq slow (sort slow (lambda (a b)
+                            (or (> (cdr a) (cdr b))
+                                (and (= (cdr a) (cdr b))
+                                     (string-lessp (car a) (car b)))))))
+    (cl-subseq slow 0 (min count (length slow)))))
+
+(defun elisp/ert/benchmark--test (test warmup iterations timeout temp-dir)
+  "Run TEST repeatedly to measure its duration.
+First run TEST WARMUP times without measuring, then ITERATIONS
+times while measuring the duration of each run.  TIMEOUT and
+TEMP-DIR are as for ‘elisp/ert/run--test’.  If any run doesn’t
+pass, return its result immediately.  Otherwise, return the list
+of measured durations in seconds, in execution order."
+  (cl-check-type test ert-test)
+  (cl-check-type warmup natnum)
+  (cl-check-type iterations natnum)
+  (cl-check-type timeout (or null number))
+  (cl-check-type temp-dir (or null string))
+  (cl-loop
+   for iteration below (+ warmup iterations)
+   for start = (current-time)
+   for result = (progn
+                  (when (bufferp standard-output)
+                    (with-current-buffer standard-output (erase-buffer)))
+                  (elisp/ert/run--test test timeout temp-dir))
+   for seconds = (float-time (time-subtract nil start))
+   unless (ert-test-passed-p result) return result
+   when (>= iteration warmup) collect seconds))
+
+(defun elisp/ert/benchmark--statistics (durations)
+  "Return statistics about DURATIONS.
+DURATIONS is a nonempty list of durations in seconds.  Return an
+alist with the keys ‘min’, ‘median’, ‘mean’, and ‘stddev’, in
+that order.  The standard deviation is the sample standard
+deviation, or zero if there is only one duration."
+  (cl-check-type durations cons)
+  (let* ((count (length durations))
+         (sorted (sort (copy-sequence durations) #'<))
+         (middle (/ count 2))
+         (median (if (cl-oddp count)
+                     (nth middle sorted)
+                   (/ (+ (nth (1- middle) sorted) (nth middle sorted)) 2.0)))
+         (mean (/ (apply #'+ durations) (float count)))
+         (stddev (if (> count 1)
+                     (sqrt (/ (cl-loop for seconds in durations
+                                       sum (expt (- seconds mean) 2))
+                              (1- count)))
+                   0.0)))
+    `((min . ,(car sorted))
+      (median . ,median)
+      (mean . ,mean)
+      (stddev . ,stddev))))
+
+(defun elisp/ert/environment--properties (patterns values)
+  "Return report properties for environment variables.
+PATTERNS is a list of glob patterns for variable names, see
+‘wildcard-to-regexp’.  Return an alist of (NAME . VALUE) pairs
+for the environment variables that match one of PATTERNS, except
+for sensitive ones, see ‘elisp/ert/sensitive--variable-p’.  NAME
+is the name of the variable, prefixed with “env:”.  If VALUES is
+non-nil, VALUE is the value of the variable, otherwise it’s a
+placeholder."
+  (cl-check-type patterns list)
+  (let ((regexps (mapcar #'wildcard-to-regexp patterns))
+        (properties ()))
+    (dolist (entry process-environment)
+      (when (string-match (rx bos (group (+ (not (any ?=)))) ?=
+                              (group (* anything)) eos)
+                          entry)
+        (let ((name (match-string 1 entry))
+              (value (match-string 2 entry)))
+          (when (and (let ((case-fold-search nil))
+                       (cl-some (lambda (regexp) (string-match-p regexp name))
+                                regexps))
+                     (not (elisp/ert/sensitive--variable-p name))
+                     ;; Earlier entries in ‘process-environment’ take
+                     ;; precedence.
+                     (not (assoc (concat "env:" name) properties)))
+            (push (cons (concat "env:" name) (if values value "<redacted>"))
+                  properties)))))
+    (nreverse properties)))
+
+(defun elisp/ert/list--tests (tests format)
+  "Print the names of TESTS to standard output.
+TESTS is a list of ERT test objects.  FORMAT is either
+\"names\" to print one test name per line, or \"json\" to print a
+JSON array of objects with the test names and tags."
+  (cl-check-type tests list)
+  (cl-check-type format string)
+  (let ((tests (sort (copy-sequence tests)
+                     (lambda (a b) (string-lessp (ert-test-name a)
+                                                 (ert-test-name b))))))
+    (pcase-exhaustive format
+      ("names"
+       (dolist (test tests)
+         (princ (format "%s\n" (ert-test-name test)))))
+      ("json"
+       ;; Use vectors so that ‘json-encode’ always generates arrays, even
+       ;; for empty lists.
+       (princ (json-encode
+               (cl-loop for test in tests
+                        for name = (symbol-name (ert-test-name test))
+                        for tags = (mapcar #'symbol-name (ert-test-tags test))
+                        vconcat `[((name . ,name) (tags . ,(vconcat tags)))])))
+       (terpri)))))
+
+(defun elisp/ert/test--shard (test shard-count)
+  "Return the index of the shard that should run TEST.
+SHARD-COUNT is the total number of shards.  The shard index only
+depends on the name of TEST, so that adding or removing other
+tests doesn’t move TEST to a different shard."
+  (cl-check-type test ert-test)
+  (cl-check-type shard-count natnum)
+  (let ((hash (secure-hash 'md5 (symbol-name (ert-test-name test)))))
+    ;; Use only a prefix of the hash to stay within the fixnum range.
+    (mod (string-to-number (substring hash 0 7) 16) shard-count)))
+
+(defun elisp/ert/output--files ()
+  "Return the files in ‘elisp/ert/output-directory’.
+Return a list of filenames relative to the output directory, or
+nil if there is no output directory."
+  (when elisp/ert/output-directory
+    (mapcar (lambda (file)
+              (file-relative-name file elisp/ert/output-directory))
+            (directory-files-recursively elisp/ert/output-directory ""))))
 
 (defun elisp/ert/failure--message (name result)
   "Return a failure message for the RESULT of a failing test.
@@ -317,11 +2563,15 @@ NAME is the name of the test."
           (pp-escape-newlines t)
           (print-circle t)
           (print-gensym t)
-          (print-level 8)
-          (print-length 50)
+          (print-level elisp/ert/print--level)
+          (print-length elisp/ert/print--length)
           (backtrace (ert-test-result-with-condition-backtrace result))
           (infos (ert-test-result-with-condition-infos result)))
-      (cond ((fboundp 'backtrace-to-string)  ; Emacs 27
+      ;; The backtrace is empty for tests that have timed out, see
+      ;; ‘elisp/ert/run--test’.  Don’t print the current backtrace in that
+      ;; case.
+      (cond ((null backtrace))
+            ((fboundp 'backtrace-to-string)  ; Emacs 27
              (insert (backtrace-to-string backtrace)))
             ((fboundp 'debugger-insert-backtrace)  ; Emacs 26
              (debugger-insert-backtrace backtrace nil))
@@ -348,6 +2598,360 @@ NAME is the name of the test."
       (insert ?\n)
       (buffer-substring-no-properties (point-min) (point-max)))))
 
+(defun elisp/ert/finish--run (config results load-buffers)
+  "Finish a test run and write its reports.
+CONFIG is an ‘elisp/ert/run--config’ object, and RESULTS is an
+‘elisp/ert/run--results’ object for the tests that have run so
+far.  LOAD-BUFFERS are the buffers of the instrumented files for
+the coverage report.  Return the final number of unexpected
+results."
+  (cl-check-type config elisp/ert/run--config)
+  (cl-check-type results elisp/ert/run--results)
+  (cl-check-type load-buffers list)
+  (let ((slow-threshold (elisp/ert/config--slow-threshold config))
+        (slow-tests ()))
+    (when (elisp/ert/config--profile config)
+      (elisp/ert/write--profile (elisp/ert/config--profile-file config)
+                                (elisp/ert/config--profile config)))
+    (elisp/ert/add--missing-tests results)
+    (message "Running %d tests finished, %d results unexpected"
+             (length (elisp/ert/results--test-reports results))
+             (elisp/ert/results--unexpected results))
+    (when slow-threshold
+      (setq slow-tests (elisp/ert/slow--tests
+                        (elisp/ert/results--test-reports results)
+                        slow-threshold
+                        (elisp/ert/config--slow-count config)))
+      (when slow-tests
+        (message "Slowest tests taking more than %s seconds:"
+                 slow-threshold)
+        (cl-loop for (name . seconds) in slow-tests
+                 do (message "  %s (%.3f s)" name seconds))))
+    (unless (zerop (elisp/ert/results--unexpected results))
+      ;; The failures might depend on the test order, so tell the user how to
+      ;; reproduce this order.
+      (message "To reproduce: bazel test %s %s"
+               (concat "--test_env=TEST_RANDOMIZE_ORDERING_SEED="
+                       (elisp/ert/config--ordering-seed config))
+               (or (elisp/ert/env--string "TEST_TARGET") "TARGET")))
+    (elisp/ert/write--reports
+     config
+     (elisp/ert/apply--report-hook
+      config results (elisp/ert/suite--report config results slow-tests))
+     load-buffers)
+    (elisp/ert/results--unexpected results)))
+
+(defun elisp/ert/add--missing-tests (results)
+  "Add test cases for the selected tests in RESULTS that didn’t run.
+RESULTS is an ‘elisp/ert/run--results’ object.  Report the tests
+in its ‘not-run’ slot as skipped, so that the report still covers
+all selected tests.  Report any other selected test without a
+result as error."
+  (cl-check-type results elisp/ert/run--results)
+  (dolist (test (elisp/ert/results--not-run results))
+    (elisp/ert/add--test-report
+     results
+     `(testcase ((name . ,(symbol-name (ert-test-name test)))
+                 (classname . ,(elisp/ert/test--class-name
+                                (ert-test-name test)))
+                 (time . "0"))
+                (skipped
+                 ((message . ,(elisp/ert/results--not-run-message results)))))))
+  (setf (elisp/ert/results--not-run results) nil)
+  ;; Any other selected test without a result has been lost somehow, e.g.
+  ;; because it was redefined or removed while running other tests.  Don’t
+  ;; let that go unnoticed.
+  (dolist (test (elisp/ert/missing--tests
+                 (elisp/ert/results--tests results)
+                 (elisp/ert/results--test-reports results)))
+    (message "Test %s was selected, but didn’t run" (ert-test-name test))
+    (elisp/ert/add--test-report
+     results
+     `(testcase ((name . ,(symbol-name (ert-test-name test)))
+                 (classname . ,(elisp/ert/test--class-name
+                                (ert-test-name test)))
+                 (time . "0"))
+                (error
+                 ((message . "Test was selected, but didn’t run")
+                  (type . "missing")))))))
+
+(defun elisp/ert/suite--report (config results slow-tests)
+  "Return the ‘testsuite’ XML node for a test run.
+CONFIG is an ‘elisp/ert/run--config’ object, and RESULTS is an
+‘elisp/ert/run--results’ object.  SLOW-TESTS is the list of slow
+tests, see ‘elisp/ert/slow--tests’."
+  (cl-check-type config elisp/ert/run--config)
+  (cl-check-type results elisp/ert/run--results)
+  (cl-check-type slow-tests list)
+  (let ((test-reports (elisp/ert/results--test-reports results))
+        (warnings (elisp/ert/results--warnings results)))
+    (elisp/ert/sanitize--xml
+     `(testsuite
+       ((name . ,(elisp/ert/config--suite-name config))  ; required
+        (hostname . "localhost")  ; required
+        (tests . ,(number-to-string (length test-reports)))
+        (errors . ,(number-to-string (elisp/ert/results--errors results)))
+        (failures . ,(number-to-string (elisp/ert/results--failures results)))
+        (skipped . ,(number-to-string (elisp/ert/results--skipped results)))
+        ,@(and (> warnings 0) `((warnings . ,(number-to-string warnings))))
+        (time . ,(format-time-string "%s.%N"
+                                     (elisp/ert/results--suite-time results)))
+        ;; The JUnit schema doesn’t allow timezones or fractional seconds, so
+        ;; only add the timezone offset if requested.
+        (timestamp . ,(format-time-string
+                       (elisp/ert/config--timestamp-format config)
+                       (elisp/ert/results--start-time results))))
+       ;; Keep the properties sorted by name so that reports from different
+       ;; runs are easy to compare.
+       (properties
+        ()
+        ,@(cl-loop
+           for (name . value)
+           in (sort
+               `(("emacs-version" . ,emacs-version)
+                 ("gc-count"
+                  . ,(- gcs-done (elisp/ert/results--gcs-before results)))
+                 ("gc-time"
+                  . ,(format "%.6f"
+                             (- gc-elapsed
+                                (elisp/ert/results--gc-elapsed-before
+                                 results))))
+                 ("load-path-length" . ,(length load-path))
+                 ("ordering-seed" . ,(elisp/ert/config--ordering-seed config))
+                 ("setup-time"
+                  . ,(format-time-string
+                      "%s.%N" (elisp/ert/results--setup-time results)))
+                 ("system-configuration" . ,system-configuration)
+                 ("system-type" . ,system-type)
+                 ,@(and (elisp/ert/config--slow-threshold config)
+                        `(("slow-tests"
+                           . ,(mapconcat
+                               (lambda (test)
+                                 (format "%s=%.3f" (car test) (cdr test)))
+                               slow-tests " "))))
+                 ,@(copy-sequence
+                    (elisp/ert/config--environment-properties config)))
+               (lambda (a b) (string-lessp (car a) (car b))))
+           collect `(property ((name . ,name)
+                               (value . ,(format "%s" value))))))
+       ;; Sort the test cases by name so that the report doesn’t depend on the
+       ;; execution order.
+       ,@(sort (reverse test-reports)
+               (lambda (a b)
+                 (string-lessp (alist-get 'name (cadr a))
+                               (alist-get 'name (cadr b)))))
+       (system-out) (system-err)))))
+
+(defun elisp/ert/apply--report-hook (config results report)
+  "Return REPORT as modified by the report hook in CONFIG.
+CONFIG is an ‘elisp/ert/run--config’ object, and REPORT is a
+‘testsuite’ XML node.  The report hook can add information such
+as CI metadata.  If the hook fails, keep the original report, but
+add the error to it so that it doesn’t go unnoticed, and count it
+as unexpected result in the ‘elisp/ert/run--results’ object
+RESULTS.  Return REPORT unchanged if there’s no report hook."
+  (cl-check-type config elisp/ert/run--config)
+  (cl-check-type results elisp/ert/run--results)
+  (cl-check-type report cons)
+  (let ((hook (elisp/ert/config--report-hook config)))
+    (if (null hook)
+        report
+      (condition-case err
+          (elisp/ert/sanitize--xml (elisp/ert/run--report-hook hook report))
+        (error
+         (message "Report hook %s failed: %s"
+                  (file-name-unquote hook) (error-message-string err))
+         (cl-incf (elisp/ert/results--unexpected results))
+         (elisp/ert/add--error-case
+          report
+          `(testcase ((name . "report-hook")
+                      (classname . "ERT")
+                      (time . "0"))
+                     (error ((message . ,(error-message-string err))
+                             (type . "report-hook-error"))
+                            ,(format-message
+                              "Running the report hook %s failed:\n\n%S\n"
+                              (file-name-unquote hook) err)))))))))
+
+(defun elisp/ert/write--reports (config report load-buffers)
+  "Write the final REPORT of a test run to the files in CONFIG.
+CONFIG is an ‘elisp/ert/run--config’ object, and REPORT is a
+‘testsuite’ XML node.  LOAD-BUFFERS are the buffers of the
+instrumented files for the coverage report."
+  (cl-check-type config elisp/ert/run--config)
+  (cl-check-type report cons)
+  (cl-check-type load-buffers list)
+  (let ((summary-file (elisp/ert/config--summary-file config))
+        (benchmark-file (elisp/ert/config--benchmark-file config))
+        (coverage-per-test-file
+         (elisp/ert/config--coverage-per-test-file config))
+        (coverage-file (elisp/ert/config--coverage-file config))
+        (cobertura-file (elisp/ert/config--cobertura-file config)))
+    (funcall (elisp/ert/config--report-writer config)
+             (elisp/ert/config--report-file config) report)
+    ;; Print the same document to standard output if requested.  Tests have
+    ;; finished at this point, so their output can’t interleave with the
+    ;; report.
+    (when (elisp/ert/config--report-stdout config)
+      (elisp/ert/write--junit-report nil report :stdout))
+    ;; Replace the last partial report with the final one.
+    (elisp/ert/write--junit-report (elisp/ert/config--stream-file config)
+                                   report)
+    (when summary-file
+      (elisp/ert/write--json-summary summary-file report))
+    (when benchmark-file
+      (elisp/ert/write--benchmarks benchmark-file report))
+    ;; Subordinate processes also write this file, but only for their own
+    ;; tests.  They have all finished at this point, so the file now gets the
+    ;; merged data.
+    (when coverage-per-test-file
+      (elisp/ert/write--coverage-per-test coverage-per-test-file report))
+    (when (elisp/ert/config--coverage-enabled config)
+      (elisp/ert/write--coverage-report
+       coverage-file load-buffers (elisp/ert/config--coverage-exclude config))
+      ;; Convert the LCOV file, which now also contains the data of
+      ;; subordinate processes.
+      (when cobertura-file
+        (elisp/ert/write--cobertura-report cobertura-file coverage-file)))))
+
+(defun elisp/ert/final--result (config result modified-globals output)
+  "Return the result to report for a test whose result is RESULT.
+CONFIG is an ‘elisp/ert/run--config’ object.  If its
+‘check-globals’ slot is ‘strict’, tests that modify global state
+fail even if they would otherwise pass; MODIFIED-GLOBALS is the
+list of global variables that the test has modified.  Likewise,
+tests that log a message or print output matching the regular
+expression in its ‘fail-on-message’ slot fail even if they would
+otherwise pass; OUTPUT is the output that the test has printed.
+Report running out of memory as an error instead of an ordinary
+failure."
+  (cl-check-type config elisp/ert/run--config)
+  (cl-check-type result ert-test-result)
+  (cl-check-type modified-globals list)
+  (cl-check-type output string)
+  (let* ((fail-on-message (elisp/ert/config--fail-on-message config))
+         (condition
+          (and (ert-test-passed-p result)
+               (if (and modified-globals
+                        (eq (elisp/ert/config--check-globals config) 'strict))
+                   `(elisp/ert/global-state ,@modified-globals)
+                 (when-let ((line (and fail-on-message
+                                       (elisp/ert/matching--line
+                                        fail-on-message
+                                        (concat (ert-test-result-messages
+                                                 result)
+                                                output)))))
+                   `(elisp/ert/matching-message ,line))))))
+    (cond (condition
+           (make-ert-test-failed
+            :messages (ert-test-result-messages result)
+            :should-forms (ert-test-result-should-forms result)
+            :condition condition
+            :backtrace nil
+            :infos nil))
+          ;; Emacs signals ‘memory-signal-data’ if it runs out of memory,
+          ;; e.g. because of ELISP_TEST_MEMORY_LIMIT.
+          ((and (ert-test-result-with-condition-p result)
+                (equal (ert-test-result-with-condition-condition result)
+                       memory-signal-data))
+           (make-ert-test-quit
+            :messages (ert-test-result-messages result)
+            :should-forms (ert-test-result-should-forms result)
+            :condition '(elisp/ert/memory-exhausted)
+            :backtrace (ert-test-result-with-condition-backtrace result)
+            :infos (ert-test-result-with-condition-infos result)))
+          (t result))))
+
+(defun elisp/ert/env--string (variable)
+  "Return the value of the environment VARIABLE.
+Return nil if VARIABLE is unset or empty, so that setting a
+variable to the empty string is the same as not setting it."
+  (cl-check-type variable string)
+  (let ((value (getenv variable)))
+    (and value (not (string-empty-p value)) value)))
+
+(defun elisp/ert/env--file (variable)
+  "Return the filename in the environment VARIABLE.
+Return nil if VARIABLE is unset or empty.  Otherwise, return the
+absolute filename, quoted using “/:”."
+  (cl-check-type variable string)
+  (let ((value (elisp/ert/env--string variable)))
+    (and value (concat "/:" (expand-file-name value)))))
+
+(defun elisp/ert/env--choice (variable choices &optional default)
+  "Return the value of the environment VARIABLE from a fixed set.
+CHOICES is an alist that maps the allowed values of VARIABLE to
+the values to return.  If VARIABLE is unset or empty, return
+DEFAULT.  Otherwise, signal an error if its value isn’t one of
+the keys in CHOICES."
+  (cl-check-type variable string)
+  (cl-check-type choices list)
+  (let ((value (elisp/ert/env--string variable)))
+    (if (null value)
+        default
+      (let ((choice (assoc value choices)))
+        (unless choice (error "Invalid %s (%s)" variable value))
+        (cdr choice)))))
+
+(defun elisp/ert/env--number (variable default &optional predicate)
+  "Return the value of the environment VARIABLE as a number.
+If VARIABLE is unset or empty, return DEFAULT.  Otherwise its
+value has to be a nonnegative decimal number that satisfies
+PREDICATE, which defaults to ‘natnump’; signal an error if it
+isn’t."
+  (cl-check-type variable string)
+  (let ((value (elisp/ert/env--string variable)))
+    (if (null value)
+        default
+      (let ((number (and (string-match-p
+                          (rx bos (or (+ digit) (seq (* digit) ?. (+ digit)))
+                              eos)
+                          value)
+                         (string-to-number value))))
+        (unless (and number (funcall (or predicate #'natnump) number))
+          (error "Invalid %s (%s)" variable value))
+        number))))
+
+(defun elisp/ert/positive--integer-p (object)
+  "Return whether OBJECT is a positive integer."
+  (and (natnump object) (> object 0)))
+
+(defun elisp/ert/print--limit (variable default)
+  "Return the print limit from the environment VARIABLE.
+If VARIABLE is unset or empty, return DEFAULT.  If it’s zero,
+return nil, meaning no limit."
+  (cl-check-type variable string)
+  (cl-check-type default (or null natnum))
+  (let ((number (elisp/ert/env--number variable default)))
+    (and (not (eql number 0)) number)))
+
+(defun elisp/ert/condition--summary (condition)
+  "Return a one-line summary of the error CONDITION.
+This is like ‘error-message-string’, but replaces line breaks
+with spaces so that the result is suitable for the ‘message’
+attribute of XML report elements."
+  (cl-check-type condition cons)
+  (let ((case-fold-search nil))
+    (replace-regexp-in-string (rx (+ (any ?\r ?\n))) " "
+                              (error-message-string condition)
+                              :fixedcase :literal)))
+
+(defun elisp/ert/truncate--output (string limit)
+  "Return STRING truncated to at most LIMIT bytes.
+If STRING is longer, append a marker stating how many bytes have
+been omitted.  The number of bytes is determined from the UTF-8
+encoding of STRING."
+  (cl-check-type string string)
+  (cl-check-type limit natnum)
+  (let ((bytes (encode-coding-string string 'utf-8-unix :nocopy)))
+    (if (<= (length bytes) limit)
+        string
+      ;; The cut might split a multibyte sequence, but
+      ;; ‘elisp/ert/sanitize--xml’ takes care of the resulting raw bytes.
+      (concat (decode-coding-string (substring bytes 0 limit) 'utf-8-unix)
+              (format "\n[%d bytes truncated]\n"
+                      (- (length bytes) limit))))))
+
 (defun elisp/ert/load--instrument (fullname file)
   "Load and instrument the Emacs Lisp file FULLNAME.
 FILE is an abbreviated name as described in
@@ -487,9 +3091,12 @@ as the offset vector.  The vector is attached to the
        ;; entry, in which case we have to fall back to the “after” entry.
        (let ((data (aset vector index (elisp/ert/make--coverage-data))))
          (elisp/ert/instrument--form seen vector form)
-         ;; Determine whether this is a branching form.  If so, generate a
-         ;; branch frequency vector and attach it to DATA.
-         (when-let ((branches (elisp/ert/instrument--branches vector form)))
+         ;; If branch coverage is enabled, determine whether this is a
+         ;; branching form.  If so, generate a branch frequency vector and
+         ;; attach it to DATA.
+         (when-let ((branches (and elisp/ert/branch--coverage
+                                   (elisp/ert/instrument--branches
+                                    vector form))))
            (setf (elisp/ert/coverage--data-branches data) branches))))
       ((pred elisp/ert/proper--list-p)
        ;; Use ‘dolist’ where possible to avoid deep recursion.
@@ -698,19 +3305,498 @@ VALUE."
         (cl-incf (aref branches branch-index)))))
   value)
 
-(defun elisp/ert/write--coverage-report (coverage-dir buffers)
-  "Write a coverage report to a file in COVERAGE-DIR.
+(defun elisp/ert/write--progress (file event test &optional fields)
+  "Append a progress EVENT for TEST to FILE.
+EVENT is a string naming the event, and TEST is the name of an
+ERT test.  FIELDS is an alist of additional fields.  Write the
+event as a single line containing a JSON object.  If FILE is nil,
+don’t write anything."
+  (cl-check-type file (or null string))
+  (cl-check-type event string)
+  (cl-check-type test symbol)
+  (cl-check-type fields list)
+  (when file
+    (with-temp-buffer
+      (insert (json-encode `((event . ,event)
+                             (test . ,(symbol-name test))
+                             ,@fields))
+              ?\n)
+      ;; Write the line at once so that lines from parallel processes don’t
+      ;; get mixed up.
+      (let ((coding-system-for-write 'utf-8-unix)
+            ;; Pipes don’t support ‘fsync’.
+            (write-region-inhibit-fsync t))
+        (write-region nil nil file :append :nomessage)))))
+
+(defun elisp/ert/write--warning (file location type message)
+  "Append a warning record to FILE.
+LOCATION is nil or a pair (FILE . LINE) as returned by
+‘elisp/ert/test--location’.  TYPE and MESSAGE are the arguments
+of ‘display-warning’.  Write the record as a single line
+containing a JSON object with the fields ‘file’, ‘line’,
+‘category’, and ‘message’."
+  (cl-check-type file string)
+  (cl-check-type location list)
+  (cl-check-type type (or symbol cons))
+  (cl-check-type message string)
+  (with-temp-buffer
+    (insert (json-encode
+             `((file . ,(car location))
+               (line . ,(cdr location))
+               (category . ,(mapconcat (lambda (sym) (format "%s" sym))
+                                       (if (consp type) type (list type))
+                                       "/"))
+               (message . ,(substring-no-properties message))))
+            ?\n)
+    ;; Write the line at once so that lines from parallel processes don’t
+    ;; get mixed up.
+    (let ((coding-system-for-write 'utf-8-unix)
+          (write-region-inhibit-fsync t))
+      (write-region nil nil file :append :nomessage))))
+
+(defun elisp/ert/write--junit-report (file report &optional stdout)
+  "Write REPORT to FILE in JUnit XML format.
+REPORT is a ‘testsuite’ XML node.  If FILE is nil, don’t write
+a file.  If STDOUT is non-nil, also write REPORT to standard
+output."
+  (cl-check-type file (or null string))
+  (cl-check-type report cons)
+  (when (or file stdout)
+    (with-temp-buffer
+      ;; The expected format of the XML output file isn’t well-documented.
+      ;; https://docs.bazel.build/versions/3.0.0/test-encyclopedia.html#initial-conditions
+      ;; only states that the XML file is “ANT-like.”
+      ;; https://llg.cubic.org/docs/junit/ and
+      ;; https://help.catchsoftware.com/display/ET/JUnit+Format contain a bit
+      ;; of documentation.
+      (xml-print (list report))
+      (when file (elisp/ert/write--atomically file))
+      (when stdout
+        (princ (buffer-string))
+        (terpri)))))
+
+(defun elisp/ert/write--partial-report (file name test-reports)
+  "Write a partial JUnit XML report to FILE.
+NAME is the name of the test suite.  TEST-REPORTS is the list of
+‘testcase’ XML nodes of the tests that have finished so far, in
+reverse order.  Each call replaces FILE atomically, so readers
+always see a complete XML document.  If FILE is nil, don’t write
+anything."
+  (cl-check-type file (or null string))
+  (cl-check-type name string)
+  (cl-check-type test-reports list)
+  (when file
+    (cl-flet ((count (tag) (cl-count-if (lambda (test-case)
+                                          (assq tag (cddr test-case)))
+                                        test-reports)))
+      (elisp/ert/write--junit-report
+       file
+       (elisp/ert/sanitize--xml
+        `(testsuite
+          ((name . ,name)  ; required
+           (hostname . "localhost")  ; required
+           (tests . ,(number-to-string (length test-reports)))
+           (errors . ,(number-to-string (count 'error)))
+           (failures . ,(number-to-string (count 'failure)))
+           (skipped . ,(number-to-string (count 'skipped))))
+          ,@(reverse test-reports)))))))
+
+(defun elisp/ert/write--tap-report (file report)
+  "Write REPORT to FILE in TAP version 13 format.
+REPORT is a ‘testsuite’ XML node.  If FILE is nil, write to
+standard output instead."
+  (cl-check-type file (or null string))
+  (cl-check-type report cons)
+  ;; See https://testanything.org/tap-version-13-specification.html.
+  (with-temp-buffer
+    (let ((test-cases (xml-get-children report 'testcase)))
+      (insert "TAP version 13\n")
+      (insert (format "1..%d\n" (length test-cases)))
+      (cl-loop
+       for test-case in test-cases
+       for number from 1
+       ;; ‘#’ starts a directive, so we have to escape it in descriptions.
+       for name = (replace-regexp-in-string
+                   (rx "#") "\\#" (xml-get-attribute test-case 'name) nil t)
+       for skipped = (car (xml-get-children test-case 'skipped))
+       for problem = (or (car (xml-get-children test-case 'failure))
+                         (car (xml-get-children test-case 'error)))
+       do
+       (insert (format "%s %d - %s" (if problem "not ok" "ok") number name))
+       (when skipped
+         (insert (format " # SKIP %s" (xml-get-attribute skipped 'message))))
+       (insert ?\n)
+       (when problem
+         ;; Add a YAML diagnostic block with the failure details.
+         ;; JSON strings are also valid YAML strings.
+         (insert "  ---\n"
+                 (format "  message: %s\n"
+                         (json-encode-string
+                          (xml-get-attribute problem 'message)))
+                 (format "  type: %s\n"
+                         (json-encode-string
+                          (xml-get-attribute problem 'type))))
+         (let ((details (string-trim-right (string-join (xml-node-children
+                                                         problem)))))
+           (unless (string-empty-p details)
+             (insert "  backtrace: |\n")
+             (dolist (line (split-string details "\n"))
+               (insert "    " line ?\n))))
+         (insert "  ...\n"))))
+    (if file
+        (elisp/ert/write--atomically file)
+      (princ (buffer-string)))))
+
+(defun elisp/ert/write--json-summary (file report)
+  "Write a summary of REPORT to FILE in JSON format.
+REPORT is a ‘testsuite’ XML node.  The summary contains the test
+counts and total duration, as well as the names and one-line
+messages of the tests that failed.  If some test cases have a
+‘duration-samples’ property, the summary also contains their
+names and samples."
+  (cl-check-type file string)
+  (cl-check-type report cons)
+  (cl-flet ((number (node attribute)
+                    (string-to-number (xml-get-attribute node attribute))))
+    (with-temp-buffer
+      (insert
+       (json-encode
+        `((tests . ,(number report 'tests))
+          (errors . ,(number report 'errors))
+          (failures . ,(number report 'failures))
+          (skipped . ,(number report 'skipped))
+          (time . ,(number report 'time))
+          (failed
+           . ,(cl-loop
+               for test-case in (xml-get-children report 'testcase)
+               for problem = (or (car (xml-get-children test-case 'failure))
+                                 (car (xml-get-children test-case 'error)))
+               when problem
+               vconcat
+               (list
+                `((name . ,(xml-get-attribute test-case 'name))
+                  (type . ,(symbol-name (xml-node-name problem)))
+                  (message
+                   . ,(car (split-string
+                            (xml-get-attribute problem 'message) "\n")))
+                  (time . ,(number test-case 'time))))))
+          ,@(when-let ((samples
+                        (cl-loop
+                         for test-case in (xml-get-children report 'testcase)
+                         for property
+                         = (cl-find "duration-samples"
+                                    (xml-get-children
+                                     (car (xml-get-children test-case
+                                                            'properties))
+                                     'property)
+                                    :key (lambda (property)
+                                           (xml-get-attribute property 'name))
+                                    :test #'equal)
+                         when property
+                         vconcat
+                         (list
+                          `((name . ,(xml-get-attribute test-case 'name))
+                            (durations
+                             . ,(vconcat
+                                 (mapcar #'string-to-number
+                                         (split-string
+                                          (xml-get-attribute property
+                                                             'value))))))))))
+              `((samples . ,samples))))))
+      (insert ?\n)
+      (elisp/ert/write--atomically file))))
+
+(defun elisp/ert/write--benchmarks (file report)
+  "Write the benchmark results in REPORT to FILE in JSON format.
+REPORT is a ‘testsuite’ XML node.  FILE contains a JSON object
+whose ‘benchmarks’ member is an array with one object for each
+test case that has ‘benchmark-…’ properties.  Each object
+contains the test name and the values of these properties,
+without the ‘benchmark-’ prefix."
+  (cl-check-type file string)
+  (cl-check-type report cons)
+  (let ((case-fold-search nil))
+    (with-temp-buffer
+      (insert
+       (json-encode
+        `((benchmarks
+           . ,(cl-loop
+               for test-case in (xml-get-children report 'testcase)
+               for properties
+               = (cl-loop
+                  for property in (xml-get-children
+                                   (car (xml-get-children test-case
+                                                          'properties))
+                                   'property)
+                  for name = (xml-get-attribute property 'name)
+                  when (string-prefix-p "benchmark-" name)
+                  collect (cons (intern (string-remove-prefix "benchmark-"
+                                                              name))
+                                (string-to-number
+                                 (xml-get-attribute property 'value))))
+               when properties
+               vconcat (list `((name . ,(xml-get-attribute test-case 'name))
+                               ,@properties)))))))
+      (insert ?\n)
+      (elisp/ert/write--atomically file))))
+
+(defun elisp/ert/write--coverage-per-test (file report)
+  "Write the files touched by each test in REPORT to FILE.
+REPORT is a ‘testsuite’ XML node.  FILE contains a JSON object
+that maps the name of each test case with a ‘coverage-files’
+property to the array of filenames in that property."
+  (cl-check-type file string)
+  (cl-check-type report cons)
+  ;; Use a hashtable so that ‘json-encode’ generates an object even if no
+  ;; test has run.
+  (let ((tests (make-hash-table :test #'equal)))
+    (dolist (test-case (xml-get-children report 'testcase))
+      (dolist (property (xml-get-children
+                         (car (xml-get-children test-case 'properties))
+                         'property))
+        (when (equal (xml-get-attribute property 'name) "coverage-files")
+          (puthash (xml-get-attribute test-case 'name)
+                   (vconcat (split-string
+                             (xml-get-attribute property 'value)))
+                   tests))))
+    (with-temp-buffer
+      (insert (json-encode tests) ?\n)
+      (elisp/ert/write--atomically file))))
+
+(defun elisp/ert/read--changed-files (file)
+  "Read the list of changed files from FILE.
+FILE contains one workspace-relative filename per line.  Return a
+list of filenames, ignoring empty lines."
+  (cl-check-type file string)
+  (with-temp-buffer
+    (insert-file-contents file)
+    (split-string (buffer-string) "\n" :omit-nulls (rx (+ space)))))
+
+(defun elisp/ert/read--coverage-map (file)
+  "Read the files touched by each test from the JSON file FILE.
+FILE is as written by ‘elisp/ert/write--coverage-per-test’.
+Return an alist that maps test names to lists of filenames."
+  (cl-check-type file string)
+  (let ((json-object-type 'alist)
+        (json-array-type 'list)
+        (json-key-type 'string))
+    (json-read-file file)))
+
+(defun elisp/ert/affected--tests (tests changed-files coverage-map)
+  "Return the elements of TESTS that might be affected by CHANGED-FILES.
+TESTS is a list of ERT test objects.  CHANGED-FILES is a list of
+workspace-relative filenames.  COVERAGE-MAP is an alist as
+returned by ‘elisp/ert/read--coverage-map’.  Select the tests
+that touched one of CHANGED-FILES and the tests that are defined
+in one of them.  To be on the safe side, also select the tests
+that COVERAGE-MAP doesn’t know about."
+  (cl-check-type tests list)
+  (cl-check-type changed-files list)
+  (cl-check-type coverage-map list)
+  (cl-remove-if-not
+   (lambda (test)
+     (let* ((name (ert-test-name test))
+            (entry (assoc (symbol-name name) coverage-map)))
+       (or (null entry)
+           (cl-intersection (cdr entry) changed-files :test #'string-equal)
+           (member (car (elisp/ert/test--location name)) changed-files))))
+   tests))
+
+(defun elisp/ert/check--output-file (description file)
+  "Check that the test binary will be able to write FILE.
+DESCRIPTION describes the contents of FILE for error messages.
+Create the parent directory of FILE if it doesn’t exist yet.
+Signal an error that explains the problem if FILE isn’t
+writable.  Since ‘elisp/ert/write--atomically’ replaces FILE with
+a temporary file, its directory has to be writable as well."
+  (cl-check-type description string)
+  (cl-check-type file string)
+  (let ((directory (file-name-directory (expand-file-name file))))
+    (condition-case err
+        (make-directory directory :parents)
+      (file-error
+       (error "Can’t write %s to %s: %s" description (file-name-unquote file)
+              (error-message-string err))))
+    (cond ((file-directory-p file)
+           (error "Can’t write %s to %s: file is a directory"
+                  description (file-name-unquote file)))
+          ((not (and (file-writable-p directory)
+                     (or (not (file-exists-p file)) (file-writable-p file))))
+           (error "Can’t write %s to %s: permission denied"
+                  description (file-name-unquote file))))))
+
+(defun elisp/ert/write--atomically (file)
+  "Write the current buffer to FILE atomically.
+Write the buffer contents to a temporary file in the same
+directory, flush it to disk, and then rename it to FILE.  That
+way, readers never see a partially-written FILE, even if Emacs is
+killed while writing."
+  (cl-check-type file string)
+  (let ((temp-file (make-temp-file
+                    (expand-file-name ".tmp-" (file-name-directory file))))
+        (success nil))
+    (unwind-protect
+        (let ((coding-system-for-write 'utf-8-unix)
+              (write-region-inhibit-fsync nil))
+          (write-region nil nil temp-file nil :nomessage)
+          (rename-file temp-file file :ok-if-already-exists)
+          (setq success t))
+      (unless success (delete-file temp-file)))))
+
+(defun elisp/ert/write--coverage-report (coverage-file buffers exclude)
+  "Append a coverage report to COVERAGE-FILE.
 BUFFERS is a list of buffers containing Emacs Lisp sources
-instrumented using Edebug."
-  (cl-check-type coverage-dir string)
+instrumented using Edebug.  Report all files, even if no line in
+them was hit, so that they show up as uncovered.  With sharding,
+every shard reports them; Bazel adds up the hit counts of all
+shards when merging their coverage reports, so the duplicate
+records are harmless.  EXCLUDE is a list of glob patterns, see
+‘wildcard-to-regexp’; omit records for files whose names relative
+to the current directory match one of them.  The files are still
+instrumented, so excluding them doesn’t change the behavior of
+the tests."
+  (cl-check-type coverage-file string)
   (cl-check-type buffers list)
+  (cl-check-type exclude list)
   (with-temp-buffer
-    (let ((coding-system-for-write 'utf-8-unix))
+    (let ((coding-system-for-write 'utf-8-unix)
+          (regexps (mapcar #'wildcard-to-regexp exclude))
+          (case-fold-search nil))
       (dolist (buffer buffers)
-        (elisp/ert/insert--coverage-report buffer)
+        (let ((file (file-relative-name (buffer-file-name buffer))))
+          (unless (cl-some (lambda (regexp) (string-match-p regexp file))
+                           regexps)
+            (elisp/ert/insert--coverage-report buffer)))
         (kill-buffer buffer))
-      (write-region nil nil (expand-file-name "emacs-lisp.dat" coverage-dir)
-                    :append))))
+      (write-region nil nil coverage-file :append))))
+
+(defun elisp/ert/lcov--parse (file)
+  "Parse the LCOV coverage records in FILE.
+Return an alist that maps source filenames to lists (LINES
+BRANCHES).  LINES is a hashtable that maps line numbers to hit
+counts.  BRANCHES is a hashtable that maps lists (LINE BLOCK
+BRANCH) to hit counts.  Merge records for the same source file,
+e.g. from subordinate processes, by adding up their hit counts.
+Treat branches that weren’t executed as having zero hits."
+  (cl-check-type file string)
+  (with-temp-buffer
+    (when (file-exists-p file) (insert-file-contents file))
+    (let ((files ())
+          (current nil)
+          (case-fold-search nil))
+      (while (re-search-forward
+              (rx bol (group (+ (any "A-Z"))) ":" (group (* nonl))) nil t)
+        (let ((key (match-string-no-properties 1))
+              (fields (split-string (match-string-no-properties 2) ",")))
+          (pcase key
+            ("SF"
+             (let ((name (match-string-no-properties 2)))
+               (setq current (or (cdr (assoc name files))
+                                 (let ((new (list (make-hash-table)
+                                                  (make-hash-table
+                                                   :test #'equal))))
+                                   (push (cons name new) files)
+                                   new)))))
+            ("DA"
+             (cl-incf (gethash (string-to-number (nth 0 fields))
+                               (nth 0 current) 0)
+                      (string-to-number (nth 1 fields))))
+            ("BRDA"
+             (cl-incf (gethash (mapcar #'string-to-number (butlast fields))
+                               (nth 1 current) 0)
+                      (string-to-number (nth 3 fields)))))))
+      (nreverse files))))
+
+(defun elisp/ert/write--cobertura-report (file lcov-file)
+  "Write the coverage data in LCOV-FILE to FILE in Cobertura XML format.
+LCOV-FILE contains coverage records as written by
+‘elisp/ert/write--coverage-report’.  The Cobertura report has one
+package per directory and one class per source file.  Line and
+branch rates are fractions between zero and one; they are one if
+there are no lines or branches."
+  (cl-check-type file string)
+  (cl-check-type lcov-file string)
+  (cl-flet* ((rate (covered valid)
+                   (number-to-string
+                    (if (zerop valid) 1.0 (/ covered (float valid)))))
+             (rates (counts)
+                    (pcase-let ((`(,lines-covered ,lines-valid
+                                                  ,branches-covered
+                                                  ,branches-valid)
+                                 counts))
+                      `((line-rate . ,(rate lines-covered lines-valid))
+                        (branch-rate
+                         . ,(rate branches-covered branches-valid))))))
+    (let ((packages ())
+          (total (list 0 0 0 0)))
+      (pcase-dolist (`(,name ,lines ,branches)
+                     (sort (elisp/ert/lcov--parse lcov-file)
+                           (lambda (a b) (string-lessp (car a) (car b)))))
+        (let* ((directory (directory-file-name
+                           (or (file-name-directory name) ".")))
+               (package (or (assoc directory packages)
+                            (car (push (list directory (list 0 0 0 0) ())
+                                       packages))))
+               (counts (list 0 0 0 0))
+               (elements ()))
+          (dolist (line (sort (hash-table-keys lines) #'<))
+            (let* ((hits (gethash line lines))
+                   (line-branches
+                    (cl-loop for key being the hash-keys of branches
+                             using (hash-values branch-hits)
+                             when (eql (car key) line)
+                             collect branch-hits))
+                   (covered (cl-count-if #'cl-plusp line-branches))
+                   (valid (length line-branches)))
+              (cl-incf (nth 0 counts) (min hits 1))
+              (cl-incf (nth 1 counts))
+              (cl-incf (nth 2 counts) covered)
+              (cl-incf (nth 3 counts) valid)
+              (push `(line ((number . ,(number-to-string line))
+                            (hits . ,(number-to-string hits))
+                            (branch . ,(if line-branches "true" "false"))
+                            ,@(and line-branches
+                                   `((condition-coverage
+                                      . ,(format "%d%% (%d/%d)"
+                                                 (/ (* 100 covered) valid)
+                                                 covered valid))))))
+                    elements)))
+          (cl-loop for count in counts
+                   for place on (nth 1 package)
+                   do (cl-incf (car place) count))
+          (cl-loop for count in counts
+                   for place on total
+                   do (cl-incf (car place) count))
+          (push `(class ((name . ,(file-name-nondirectory name))
+                         (filename . ,name)
+                         ,@(rates counts)
+                         (complexity . "0"))
+                        (methods ())
+                        (lines () ,@(nreverse elements)))
+                (nth 2 package))))
+      (with-temp-buffer
+        (xml-print
+         (elisp/ert/sanitize--xml
+          `((coverage
+             (,@(rates total)
+              (lines-covered . ,(number-to-string (nth 0 total)))
+              (lines-valid . ,(number-to-string (nth 1 total)))
+              (branches-covered . ,(number-to-string (nth 2 total)))
+              (branches-valid . ,(number-to-string (nth 3 total)))
+              (complexity . "0")
+              (version . ,emacs-version)
+              (timestamp . ,(format-time-string "%s")))
+             (sources () (source () "."))
+             (packages
+              ()
+              ,@(cl-loop for (name counts classes) in (nreverse packages)
+                         collect `(package ((name . ,name)
+                                            ,@(rates counts)
+                                            (complexity . "0"))
+                                           (classes
+                                            () ,@(nreverse classes)))))))))
+        (insert ?\n)
+        (elisp/ert/write--atomically file)))))
 
 (eval-when-compile
   (defmacro elisp/ert/hash--get-or-put (key table &rest body)
@@ -726,10 +3812,30 @@ TABLE."
                (puthash ,key ,(macroexp-progn body) ,table)
              ,value))))))
 
+(defun elisp/ert/coverage--hits (buffer)
+  "Return the total hit count of the forms instrumented in BUFFER.
+BUFFER must visit an Emacs Lisp source file that has been
+instrumented with Edebug."
+  (cl-check-type buffer buffer-live)
+  (with-current-buffer buffer
+    (cl-loop
+     for data in edebug-form-data
+     for name = (edebug--form-data-name data)
+     for ours = (eq (get name 'edebug-behavior) 'elisp/ert/coverage)
+     sum (cl-loop for cov across (get name (if ours 'elisp/ert/coverage
+                                            'edebug-freq-count))
+                  sum (cond ((not ours) cov)
+                            (cov (elisp/ert/coverage--data-hits cov))
+                            (t 0))))))
+
 (defun elisp/ert/insert--coverage-report (buffer)
   "Insert a coverage report into the current buffer.
 BUFFER must be a different buffer visiting an Emacs Lisp source
-file that has been instrumented with Edebug."
+file that has been instrumented with Edebug.  If
+‘elisp/ert/function--coverage’ is non-nil, fold nested
+definitions such as local functions into the top-level
+definitions that contain them, so that the function records list
+each top-level definition once."
   (cl-check-type buffer buffer-live)
   (let ((file-name (elisp/ert/sanitize--string
                     (file-relative-name (buffer-file-name buffer))))
@@ -758,10 +3864,17 @@ file that has been instrumented with Edebug."
                             thereis (and (not (eql hits 0)) hits)
                             finally return 0)
        for (begin _ offsets) = (get name 'edebug)
+       ;; TOPLEVEL is the beginning of the top-level form that contains the
+       ;; definition.  The buffer isn’t in Emacs Lisp mode, so we have to
+       ;; use the right syntax table to skip over comments and strings.
+       for toplevel = (and elisp/ert/function--coverage
+                           (with-syntax-table emacs-lisp-mode-syntax-table
+                             (or (car (nth 9 (parse-partial-sexp (point-min)
+                                                                 begin)))
+                                 (marker-position begin))))
        do
        (unless (eq (marker-buffer begin) buffer)
          (error "Function %s got redefined in some other file" name))
-       (cl-incf functions-hit (min calls 1))
        (cl-assert (eql (length coverage) (length offsets)) :show-args)
        (cl-loop
         for offset across offsets
@@ -810,8 +3923,21 @@ file that has been instrumented with Edebug."
                              do (cl-callf max n f)))))))))
        (push (list (line-number-at-pos begin)
                    (elisp/ert/sanitize--string (symbol-name name))
-                   calls)
+                   calls toplevel (marker-position begin))
              functions)))
+    (when elisp/ert/function--coverage
+      ;; Drop the nested definitions within top-level definitions.  Their
+      ;; lines still count for line coverage.  If the top-level form isn’t a
+      ;; definition, e.g. a ‘progn’ form, keep the definitions within it.
+      (let ((definitions (cl-loop for (_ _ _ toplevel begin) in functions
+                                  when (eql toplevel begin)
+                                  collect toplevel)))
+        (cl-callf2 cl-remove-if
+            (pcase-lambda (`(,_ ,_ ,_ ,toplevel ,begin))
+              (and (not (eql toplevel begin)) (memql toplevel definitions)))
+            functions)))
+    (setq functions-hit (cl-count-if (lambda (func) (> (caddr func) 0))
+                                     functions))
     (cl-callf sort functions #'car-less-than-car)
     ;; The expected format is described to some extend in the
     ;; geninfo(1) man page.
@@ -873,6 +3999,134 @@ file that has been instrumented with Edebug."
       (insert (format "LH:%d\nLF:%d\nend_of_record\n"
                       lines-hit (length vector))))))
 
+(defun elisp/ert/test--class-name (test)
+  "Return the JUnit class name for TEST.
+TEST should be an ERT test symbol.  The class name is derived
+from the file that defines TEST, see ‘elisp/ert/file--class-name’."
+  (cl-check-type test symbol)
+  ;; Yuck!  ‘ert--test’ is an implementation detail.
+  (elisp/ert/file--class-name (symbol-file test 'ert--test)))
+
+(defun elisp/ert/file--class-name (file)
+  "Return the JUnit class name for tests defined in FILE.
+FILE is either nil or the name of a test file.  The class name
+is the workspace-relative name of FILE, without extension and
+with dots instead of slashes, e.g. “tests.test” for
+tests/test.el.  If FILE is nil or not within a workspace, return
+“ERT”."
+  (cl-check-type file (or null string))
+  (let ((case-fold-search nil)
+        (relative (and file (elisp/ert/workspace--relative-name file))))
+    (if relative
+        (replace-regexp-in-string
+         "/" "."
+         (replace-regexp-in-string (rx (or ".el" ".elc" ".eln") (? ".gz") eos)
+                                   "" relative :fixedcase :literal)
+         :fixedcase :literal)
+      "ERT")))
+
+(defun elisp/ert/suite--function (file kind)
+  "Return the suite KIND function for the test file FILE.
+KIND is either ‘setup’ or ‘teardown’.  The suite functions of a
+test file foo-test.el are named ‘foo-test--setup-suite’ and
+‘foo-test--teardown-suite’.  Return nil if there’s no such
+function."
+  (cl-check-type file string)
+  (cl-check-type kind (member setup teardown))
+  (let* ((case-fold-search nil)
+         (base (file-name-nondirectory
+                (replace-regexp-in-string
+                 (rx (or ".el" ".elc" ".eln") (? ".gz") eos) "" file
+                 :fixedcase :literal)))
+         (symbol (intern-soft (format "%s--%s-suite" base kind))))
+    (and symbol (fboundp symbol) symbol)))
+
+(defun elisp/ert/suite--error (file kind err)
+  "Return a test case that reports a failed suite function.
+FILE is the test file, KIND is either ‘setup’ or ‘teardown’, and
+ERR is the error that the suite function signaled.  See
+‘elisp/ert/suite--function’."
+  (cl-check-type file string)
+  (cl-check-type kind (member setup teardown))
+  (cl-check-type err cons)
+  `(testcase ((name . ,(format "%s-suite" kind))
+              (classname . ,(elisp/ert/file--class-name file))
+              (time . "0"))
+             (error ((message . ,(error-message-string err))
+                     (type . ,(format "suite-%s-error" kind)))
+                    ,(format-message
+                      (if (eq kind 'setup)
+                          "Setting up the suite of %s failed, so none of its \
+tests ran:\n\n%S\n"
+                        "Tearing down the suite of %s failed:\n\n%S\n")
+                      (file-name-unquote file) err))))
+
+(defun elisp/ert/workspace--relative-name (file)
+  "Return the name of FILE relative to its workspace.
+FILE should be a filename in the execution root or the runfiles
+tree.  If FILE isn’t within a workspace, return nil."
+  (cl-check-type file string)
+  (let* ((case-fold-search nil)
+         (source-dir (getenv "TEST_SRCDIR"))
+         (file (file-name-unquote file))
+         (runfile (and (not (member source-dir '(nil "")))
+                       (file-in-directory-p file source-dir)
+                       (file-relative-name file source-dir))))
+    (cond
+     ;; See ‘elisp/ert/log--error’ for the execution root layout.
+     ((string-match (rx "/execroot/"
+                        (+ (not (any ?/))) ?/ ; workspace
+                        (+ (not (any ?/))) ?/ ; bazel-out
+                        (+ (not (any ?/))) ?/ ; configuration
+                        "bin/"
+                        (group (+ nonl)) eos)
+                    file)
+      (match-string-no-properties 1 file))
+     ;; Filenames in the runfiles tree start with the workspace name, which we
+     ;; remove.
+     ((and runfile
+           (string-match (rx bos (+ (not (any ?/))) ?/
+                             (group (+ nonl)) eos)
+                         runfile))
+      (match-string-no-properties 1 runfile)))))
+
+(defun elisp/ert/test--location (test)
+  "Return the source location of the definition of TEST.
+TEST should be an ERT test symbol.  Return a pair (FILE . LINE),
+where FILE is the workspace-relative name of the source file and
+LINE is the line number of the ‘ert-deftest’ form.  If the
+definition can’t be found, return nil."
+  (cl-check-type test symbol)
+  ;; Yuck!  ‘ert--test’ is an implementation detail.
+  (elisp/ert/definition--location test 'ert--test))
+
+(defun elisp/ert/definition--location (symbol type)
+  "Return the source location of the definition of SYMBOL.
+TYPE is as for ‘find-function-search-for-symbol’, e.g. nil for a
+function definition.  Return a pair (FILE . LINE), where FILE is
+the workspace-relative name of the source file and LINE is the
+line number of the definition.  If the definition can’t be found,
+return nil."
+  (cl-check-type symbol symbol)
+  (cl-check-type type symbol)
+  (when-let ((library (symbol-file symbol (or type 'defun))))
+    (condition-case nil
+        (let* ((buffers (buffer-list))
+               (location (find-function-search-for-symbol
+                          symbol type (file-name-unquote library)))
+               (buffer (car location))
+               (file (buffer-file-name buffer))
+               (relative (and file (elisp/ert/workspace--relative-name file)))
+               (line (and (cdr location)
+                          (with-current-buffer buffer
+                            (save-restriction
+                              (widen)
+                              (line-number-at-pos (cdr location)))))))
+          ;; Don’t leave behind buffers visiting the source files.
+          (unless (memq buffer buffers) (kill-buffer buffer))
+          (and relative line (cons relative line)))
+      (error nil))))
+
 (defun elisp/ert/log--error (test message)
   "Log an error for TEST.
 TEST should be an ERT test symbol.  MESSAGE is the error message.
@@ -924,6 +4178,53 @@ GNU Coding Standards; see Info node ‘(standards) Errors’."
               ;; kill it.
               (unless (memq buffer buffers) (kill-buffer)))))))))
 
+(defvar elisp/ert/report-functions nil
+  "Functions to post-process the test report.
+The file in ELISP_TEST_REPORT_HOOK should add functions to this
+hook.  The test runner calls each function with the report as
+argument, a ‘testsuite’ node in the format of ‘xml-parse-region’.
+The function should return the new report, e.g. with additional
+properties.")
+
+(defun elisp/ert/run--report-hook (file report)
+  "Load FILE and return REPORT as modified by the report functions.
+REPORT is a ‘testsuite’ XML node.  FILE should add functions to
+‘elisp/ert/report-functions’.  Call each of them in turn with
+the report, and use its return value as the new report."
+  (cl-check-type file string)
+  (cl-check-type report cons)
+  (let ((elisp/ert/report-functions elisp/ert/report-functions))
+    (load file nil :nomessage :nosuffix)
+    (dolist (function elisp/ert/report-functions)
+      (setq report (funcall function report))
+      (unless (eq (car-safe report) 'testsuite)
+        (error "Report function %S didn’t return a testsuite node"
+               function)))
+    report))
+
+(defun elisp/ert/add--error-case (report test-case)
+  "Return a copy of REPORT with TEST-CASE added.
+REPORT is a ‘testsuite’ XML node, and TEST-CASE is a ‘testcase’
+node that represents an error.  Increment the ‘tests’ and
+‘errors’ attributes of the report accordingly."
+  (cl-check-type report cons)
+  (cl-check-type test-case cons)
+  (pcase-let* ((`(testsuite ,attributes . ,children) report)
+               ;; The JUnit schema requires the test cases to come before
+               ;; the ‘system-out’ and ‘system-err’ elements.
+               (tail (cl-member 'system-out children :key #'car-safe)))
+    `(testsuite
+      ,(mapcar (lambda (attribute)
+                 (if (memq (car attribute) '(tests errors))
+                     (cons (car attribute)
+                           (number-to-string
+                            (1+ (string-to-number (cdr attribute)))))
+                   attribute))
+               attributes)
+      ,@(butlast children (length tail))
+      ,test-case
+      ,@tail)))
+
 (defun elisp/ert/sanitize--string (string)
   "Return a sanitized version of STRING for the coverage file."
   (cl-check-type string string)
@@ -973,18 +4274,56 @@ Return SYMBOL."
       (error "Invalid XML symbol %s" symbol)))
   symbol)
 
+(defconst elisp/ert/xml--characters
+  (string ?\t ?\n ?\r ?\s ?- #xD7FF #xE000 ?- #xFFFD #x10000 ?- #x10FFFF)
+  "Valid XML characters in the format of ‘skip-chars-forward’.
+See https://www.w3.org/TR/xml/#charsets.")
+
 (defun elisp/ert/sanitize--xml-string (string)
-  "Return a sanitized variant of STRING containing only valid XML characters."
+  "Return a sanitized variant of STRING containing only valid XML characters.
+Decode unibyte strings such as raw process output as UTF-8.
+Replace each run of bytes that doesn’t form valid UTF-8 with
+‘[base64:…]’, where … is the Base64 encoding of the bytes, so that
+they remain recoverable.  Replace other invalid characters with
+‘\\uXXXX’ or ‘\\UXXXXXXXX’ escape sequences."
   (cl-check-type string string)
-  (let ((case-fold-search nil))
-    (replace-regexp-in-string
-     ;; https://www.w3.org/TR/xml/#charsets
-     (rx (not (any #x9 #xA #xD (#x20 . #xD7FF) (#xE000 . #xFFFD)
-                   (#x10000 . #x10FFFF))))
-     (lambda (s)
-       (let ((c (string-to-char s)))
-         (format (if (< c #x10000) "\\u%04X" "\\U%08X") c)))
-     string :fixedcase :literal)))
+  (if (let ((case-fold-search nil))
+        ;; Fast path for the common case of printable ASCII text.
+        (string-match-p (rx bos (* (any #x9 #xA #xD (#x20 . #x7E))) eos)
+                        string))
+      string
+    (elisp/ert/sanitize--non-ascii string)))
+
+(defun elisp/ert/sanitize--non-ascii (string)
+  "Return a sanitized variant of STRING, see ‘elisp/ert/sanitize--xml-string’."
+  (cl-check-type string string)
+  (with-temp-buffer
+    ;; A unibyte string would end up as raw bytes in the report file, which
+    ;; then isn’t valid UTF-8.  Decoding turns invalid byte sequences into
+    ;; raw-byte characters, which the loop below handles.
+    (insert (if (multibyte-string-p string) string
+              (decode-coding-string string 'utf-8-unix :nocopy)))
+    (goto-char (point-min))
+    (while (progn (skip-chars-forward elisp/ert/xml--characters)
+                  (not (eobp)))
+      (let ((start (point)))
+        (if (eq (char-charset (char-after)) 'eight-bit)
+            (let ((bytes
+                   (progn
+                     (while (and (not (eobp))
+                                 (eq (char-charset (char-after)) 'eight-bit))
+                       (forward-char))
+                     (encode-coding-string
+                      (buffer-substring-no-properties start (point))
+                      'binary))))
+              (delete-region start (point))
+              (insert "[base64:" (base64-encode-string bytes :no-line-break)
+                      "]"))
+          (let ((char (char-after)))
+            (delete-char 1)
+            (insert (format (if (< char #x10000) "\\u%04X" "\\U%08X")
+                            char))))))
+    (buffer-substring-no-properties (point-min) (point-max))))
 
 (defun elisp/ert/edebug--unique (_cursor spec)
   "Handle the ‘:unique’ Edebug specification.
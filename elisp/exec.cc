@@ -14,12 +14,18 @@
 
 #include "elisp/exec.h"
 
+#include <algorithm>
 #include <cassert>
+#include <cerrno>
+#include <csignal>
+#include <cstdint>
 #include <cstdlib>
 #include <cstring>
+#include <fstream>
 #include <iostream>
 #include <iterator>
 #include <limits>
+#include <map>
 #include <memory>
 #include <regex>
 #include <string>
@@ -27,7 +33,13 @@
 #include <utility>
 #include <vector>
 
+#include <fcntl.h>
+#include <poll.h>
+#include <signal.h>
 #include <spawn.h>
+#include <sys/ioctl.h>
+#include <sys/resource.h>
+#include <sys/stat.h>
 #include <sys/types.h>
 #include <sys/wait.h>
 #include <unistd.h>
@@ -38,14 +50,15 @@
 #pragma GCC diagnostic ignored "-Wsign-conversion"
 #pragma GCC diagnostic ignored "-Woverflow"
 #include "absl/algorithm/container.h"
-#include "absl/base/casts.h"
 #include "absl/container/flat_hash_map.h"
 #include "absl/container/flat_hash_set.h"
 #include "absl/random/random.h"
 #include "absl/status/status.h"
 #include "absl/status/statusor.h"
+#include "absl/strings/numbers.h"
 #include "absl/strings/str_cat.h"
 #include "absl/strings/str_join.h"
+#include "absl/strings/str_split.h"
 #include "absl/strings/string_view.h"
 #include "absl/strings/strip.h"
 #include "absl/types/optional.h"
@@ -55,6 +68,7 @@
 #pragma GCC diagnostic pop
 
 #include "elisp/file.h"
+#include "elisp/report.h"
 #include "elisp/status.h"
 #include "elisp/str.h"
 
@@ -115,6 +129,130 @@ static Environment CopyEnv() {
   return map;
 }
 
+// Process ID of the child process that Executor::Run is waiting for, or zero
+// if there is none.
+static volatile std::sig_atomic_t child_pid = 0;
+
+static void ForwardSignal(const int signal) {
+  const pid_t pid = child_pid;
+  if (pid > 0) kill(pid, signal);
+}
+
+namespace {
+
+// While in scope, forwards SIGTERM to the child process whose ID is passed to
+// Start.  Bazel sends SIGTERM if a test times out; forwarding it gives the test
+// runner a chance to write a partial report.  SIGTERM is blocked until Start
+// is called so that it can’t get lost in between.
+class SignalForwarder {
+ public:
+  SignalForwarder() {
+    sigset_t set;
+    sigemptyset(&set);
+    sigaddset(&set, SIGTERM);
+    sigprocmask(SIG_BLOCK, &set, &old_mask_);
+    struct sigaction action = {};
+    action.sa_handler = ForwardSignal;
+    sigemptyset(&action.sa_mask);
+    action.sa_flags = SA_RESTART;
+    sigaction(SIGTERM, &action, &old_action_);
+  }
+
+  SignalForwarder(const SignalForwarder&) = delete;
+  SignalForwarder& operator=(const SignalForwarder&) = delete;
+
+  ~SignalForwarder() {
+    child_pid = 0;
+    sigaction(SIGTERM, &old_action_, nullptr);
+    sigprocmask(SIG_SETMASK, &old_mask_, nullptr);
+  }
+
+  // The signal mask that child processes should start with.
+  const sigset_t& old_mask() const { return old_mask_; }
+
+  // Starts forwarding SIGTERM to the given process, including a pending one.
+  void Start(const pid_t pid) {
+    child_pid = pid;
+    sigprocmask(SIG_SETMASK, &old_mask_, nullptr);
+  }
+
+ private:
+  sigset_t old_mask_;
+  struct sigaction old_action_;
+};
+
+// Owns the primary side of a new pseudo-terminal.  Child processes open the
+// secondary side by name.
+class PseudoTerminal {
+ public:
+  static absl::StatusOr<PseudoTerminal> Create() {
+    const int fd = posix_openpt(O_RDWR | O_NOCTTY);
+    if (fd < 0) return ErrnoStatus("posix_openpt");
+    PseudoTerminal result(fd);
+    if (grantpt(fd) != 0) return ErrnoStatus("grantpt", fd);
+    if (unlockpt(fd) != 0) return ErrnoStatus("unlockpt", fd);
+    const char* const name = ptsname(fd);
+    if (name == nullptr) return ErrnoStatus("ptsname", fd);
+    result.secondary_ = name;
+    // Emacs uses the terminal size for the initial frame.
+    struct winsize size = {};
+    size.ws_row = 24;
+    size.ws_col = 80;
+    if (ioctl(fd, TIOCSWINSZ, &size) != 0) {
+      return ErrnoStatus("ioctl", fd, "TIOCSWINSZ");
+    }
+    return std::move(result);
+  }
+
+  PseudoTerminal(const PseudoTerminal&) = delete;
+  PseudoTerminal(PseudoTerminal&& other)
+      : fd_(absl::exchange(other.fd_, -1)),
+        secondary_(std::move(other.secondary_)) {}
+  PseudoTerminal& operator=(const PseudoTerminal&) = delete;
+  PseudoTerminal& operator=(PseudoTerminal&&) = delete;
+
+  ~PseudoTerminal() noexcept {
+    if (fd_ >= 0) close(fd_);
+  }
+
+  int fd() const noexcept { return fd_; }
+  const std::string& secondary() const noexcept { return secondary_; }
+
+  // Reads and discards output until the given child process has exited, so
+  // that the child never blocks on a full terminal buffer.  Returns the wait
+  // status of the child.
+  absl::StatusOr<int> Wait(const pid_t pid) const {
+    int options = WNOHANG;
+    while (true) {
+      int wstatus;
+      const pid_t status = waitpid(pid, &wstatus, options);
+      if (status == pid) return wstatus;
+      if (status != 0) return ErrnoStatus("waitpid", pid);
+      struct pollfd poll_fd = {fd_, POLLIN, 0};
+      if (poll(&poll_fd, 1, 100) <= 0) continue;
+      if ((poll_fd.revents & POLLIN) != 0) {
+        char buffer[4096];
+        const ssize_t count = read(fd_, buffer, sizeof buffer);
+        // Linux returns EIO once the child has closed the secondary side.
+        if (count < 0 && errno != EIO && errno != EINTR) {
+          return ErrnoStatus("read", fd_);
+        }
+      } else if ((poll_fd.revents & POLLHUP) != 0) {
+        // Nothing left to read, so wait for the child to exit.
+        options = 0;
+      }
+    }
+  }
+
+ private:
+  explicit PseudoTerminal(const int fd) : fd_(fd) {}
+
+  int fd_;
+  std::string secondary_;
+};
+
+}  // namespace
+
 static absl::StatusOr<std::unique_ptr<Runfiles>> CreateRunfiles(
     const std::string& argv0) {
   std::string error;
@@ -196,15 +334,103 @@ static absl::StatusOr<std::string> FindDumpFile(const std::string& libexec) {
   return *files.begin();
 }
 
-static absl::StatusOr<absl::optional<TempFile>> AddManifest(
-    const Mode mode, std::vector<std::string>& args, absl::BitGen& random) {
-  using Type = absl::optional<TempFile>;
-  if (mode == Mode::kDirect) return absl::implicit_cast<Type>(absl::nullopt);
+// Returns the header of the given portable dump file.  The header starts with
+// a 16-byte magic number followed by the 32-byte fingerprint of the Emacs
+// binary that created the dump, see struct dump_header in Emacs’s pdumper.c.
+static absl::StatusOr<std::string> DumpHeader(const std::string& file) {
+  constexpr std::streamsize size = 48;
+  std::ifstream stream(file, std::ios::binary);
+  if (!stream) return ErrnoStatus("std::ifstream", file);
+  std::string header(size, '\0');
+  stream.read(&header.front(), size);
+  if (stream.gcount() != size) {
+    return absl::InvalidArgumentError(
+        absl::StrCat("file ", file, " is too short to be a dump file"));
+  }
+  return header;
+}
+
+// Checks that the portable dump file was created by the same Emacs binary as
+// the given reference dump file.  Emacs refuses to start with incompatible
+// dump files.
+static absl::Status CheckDumpFile(const std::string& file,
+                                  const std::string& reference) {
+  ASSIGN_OR_RETURN(const auto header, DumpHeader(file));
+  ASSIGN_OR_RETURN(const auto expected, DumpHeader(reference));
+  if (header != expected) {
+    return absl::FailedPreconditionError(
+        absl::StrCat("dump file ", file, " doesn’t match Emacs binary"));
+  }
+  return absl::OkStatus();
+}
+
+// Creates the manifest file.  We always create it so that Emacs Lisp programs
+// can find out about their declared input and output files using the
+// ELISP_MANIFEST environmental variable.  Only wrappers receive the manifest
+// on the command line.
+static absl::StatusOr<TempFile> AddManifest(const Mode mode,
+                                            std::vector<std::string>& args,
+                                            absl::BitGen& random) {
   ASSIGN_OR_RETURN(auto stream,
                    TempFile::Create(TempDir(), "manifest-*.json", random));
-  args.push_back(absl::StrCat("--manifest=", stream.path()));
-  args.push_back("--");
-  return absl::implicit_cast<Type>(std::move(stream));
+  if (mode == Mode::kWrap) {
+    args.push_back(absl::StrCat("--manifest=", stream.path()));
+    args.push_back("--");
+  }
+  return std::move(stream);
+}
+
+// Returns an Emacs Lisp string literal for the given string.
+static std::string LispString(const absl::string_view string) {
+  std::string result = "\"";
+  for (const char c : string) {
+    if (c == '"' || c == '\\') result += '\\';
+    result += c;
+  }
+  result += '"';
+  return result;
+}
+
+// Returns the exit code for the given wait status.  As in shells, processes
+// killed by a signal get an exit code of 128 plus the signal number, so that
+// they are distinguishable from processes that failed normally.
+static int ExitCode(const int wstatus) {
+  if (WIFEXITED(wstatus)) return WEXITSTATUS(wstatus);
+  if (WIFSIGNALED(wstatus)) return 128 + WTERMSIG(wstatus);
+  return 0xFF;
+}
+
+// Returns the number of the signal that killed the process with the given wait
+// status, or zero if the process wasn’t killed by a signal.  Process chains
+// that go through the Emacs launcher of the toolchain report signals as exit
+// codes, see ExitCode.  Emacs itself exits with status 255 after an uncaught
+// error in batch mode, so only exit codes that correspond to an actual signal
+// number count.
+static int TermSignal(const int wstatus) {
+  if (WIFSIGNALED(wstatus)) return WTERMSIG(wstatus);
+  if (WIFEXITED(wstatus)) {
+    const int signal = WEXITSTATUS(wstatus) - 128;
+    if (signal > 0 && signal < NSIG) return signal;
+  }
+  return 0;
+}
+
+// Limits the address space of the current process and its future child
+// processes to the given number of bytes.
+static absl::Status SetMemoryLimit(const std::string& bytes) {
+  struct rlimit limit;
+  if (::getrlimit(RLIMIT_AS, &limit) != 0) return ErrnoStatus("getrlimit");
+  std::uint64_t value;
+  if (!absl::SimpleAtoi(bytes, &value) || value == 0 ||
+      (limit.rlim_max != RLIM_INFINITY && value > limit.rlim_max)) {
+    return absl::InvalidArgumentError(
+        absl::StrCat("invalid memory limit ", bytes));
+  }
+  limit.rlim_cur = value;
+  if (::setrlimit(RLIMIT_AS, &limit) != 0) {
+    return ErrnoStatus("setrlimit", value);
+  }
+  return absl::OkStatus();
 }
 
 static void CheckRelative(const std::vector<std::string>& files) {
@@ -259,17 +485,41 @@ class Executor {
 
   absl::StatusOr<std::string> Runfile(const std::string& rel) const;
   std::string RunfilesDir() const;
+  // Replaces “$(rlocation …)” placeholders in the given element of the
+  // “test_args” attribute with absolute filenames, and “$$” with a literal
+  // dollar sign.  See “_expand_test_arg” in //elisp:defs.bzl.
+  absl::StatusOr<std::string> ExpandTestArg(absl::string_view arg) const;
   std::string EnvVar(const std::string& name) const noexcept;
 
+  // Returns the Emacs binary to run.  If the environment variable ELISP_EMACS
+  // names an executable file, returns that file; otherwise returns the given
+  // runfile from the toolchain.
+  absl::StatusOr<std::string> Emacs(const std::string& toolchain) const;
+
   absl::Status AddLoadPath(std::vector<std::string>& args,
                            const std::vector<std::string>& load_path) const;
 
+  // If the toolchain supports native compilation, adds the given directories
+  // with natively-compiled files to ‘native-comp-eln-load-path’.
+  absl::Status AddNativeCompilation(const CommonOptions& opts,
+                                    std::vector<std::string>& args) const;
+
+  // If the environment variable ELISP_ELN_CACHE names a writable directory,
+  // adds it to the front of ‘native-comp-eln-load-path’, so that Emacs writes
+  // natively-compiled files there and finds them again in later runs.
+  absl::Status AddElnCache(std::vector<std::string>& args) const;
+
+  // Runs the given binary and returns its wait status.  If terminal is true,
+  // the binary runs in a new session with a fresh pseudo-terminal as
+  // controlling terminal, standard input, and standard output.
   absl::StatusOr<int> Run(const std::string& binary,
                           const std::vector<std::string>& args,
-                          const Environment& env);
+                          const Environment& env, bool terminal = false);
 
   std::vector<std::string> BuildArgs(
-      const std::vector<std::string>& prefix) const;
+      const std::vector<std::string>& args) const;
+
+  void AddUserArgs(std::vector<std::string>& args) const;
 
   std::vector<std::string> BuildEnv(const Environment& other) const;
 
@@ -306,11 +556,27 @@ absl::StatusOr<int> Executor::RunEmacs(const EmacsOptions& opts) {
   std::vector<std::string> args;
   switch (opts.dump_mode) {
     case DumpMode::kPortable: {
-      ASSIGN_OR_RETURN(const auto dump, FindDumpFile(libexec));
+      ASSIGN_OR_RETURN(auto dump, FindDumpFile(libexec));
+      // ELISP_DUMP_FILE can name a dump file with additional preloaded
+      // libraries to speed up startup.
+      const auto custom = this->EnvVar("ELISP_DUMP_FILE");
+      if (!custom.empty()) {
+        const auto status = CheckDumpFile(custom, dump);
+        if (status.ok()) {
+          ASSIGN_OR_RETURN(dump, MakeAbsolute(custom));
+        } else {
+          std::clog << "Ignoring ELISP_DUMP_FILE: " << status << std::endl;
+        }
+      }
       args.push_back("--dump-file=" + dump);
       break;
     }
     case DumpMode::kUnexec:
+      if (!this->EnvVar("ELISP_DUMP_FILE").empty()) {
+        std::clog << "Ignoring ELISP_DUMP_FILE because Emacs doesn’t use "
+                     "portable dump files"
+                  << std::endl;
+      }
       break;
   }
   Environment map;
@@ -318,52 +584,117 @@ absl::StatusOr<int> Executor::RunEmacs(const EmacsOptions& opts) {
   map.emplace("EMACSDOC", etc);
   map.emplace("EMACSLOADPATH", JoinPath(shared, "lisp"));
   map.emplace("EMACSPATH", libexec);
-  return this->Run(emacs, args, map);
+  this->AddUserArgs(args);
+  ASSIGN_OR_RETURN(const auto wstatus, this->Run(emacs, args, map));
+  return ExitCode(wstatus);
 }
 
 absl::StatusOr<int> Executor::RunBinary(const BinaryOptions& opts) {
-  ASSIGN_OR_RETURN(const auto emacs, this->Runfile(opts.wrapper));
+  ASSIGN_OR_RETURN(const auto emacs, this->Emacs(opts.wrapper));
   std::vector<std::string> args;
   ASSIGN_OR_RETURN(auto manifest, AddManifest(opts.mode, args, random_));
   args.push_back("--quick");
   args.push_back("--batch");
+  RETURN_IF_ERROR(this->AddNativeCompilation(opts, args));
+  RETURN_IF_ERROR(this->AddElnCache(args));
   RETURN_IF_ERROR(this->AddLoadPath(args, opts.load_path));
+  // If there’s a “--” separator, the arguments before it are additional Emacs
+  // startup options, and the arguments after it end up in
+  // ‘command-line-args-left’.  Otherwise, all arguments end up there.
+  const auto begin = std::next(orig_args_.begin());
+  auto rest = std::find(begin, orig_args_.end(), "--");
+  if (rest == orig_args_.end()) {
+    rest = begin;
+  } else {
+    args.insert(args.end(), begin, rest);
+    ++rest;
+  }
+  // Replace the error message of ‘require’ with one that names the feature.
+  for (const auto& feature : opts.preload) {
+    args.push_back(absl::StrCat(
+        "--eval=(let ((feature (intern ", LispString(feature),
+        "))) (condition-case err (require feature) (error (error \"Failed to "
+        "preload feature %s: %s\" feature (error-message-string err)))))"));
+  }
   for (const auto& file : opts.load_files) {
     ASSIGN_OR_RETURN(const auto abs, this->Runfile(file));
     args.push_back(absl::StrCat("--load=", abs));
   }
-  if (manifest) {
-    const auto runfiles = this->RunfilesDir();
-    ASSIGN_OR_RETURN(auto input_files,
-                     this->ArgFiles(runfiles, opts.input_args));
-    ASSIGN_OR_RETURN(auto output_files,
-                     this->ArgFiles(runfiles, opts.output_args));
-    RETURN_IF_ERROR(WriteManifest(opts, std::move(input_files),
-                                  std::move(output_files), manifest.value()));
-  }
-  ASSIGN_OR_RETURN(const auto code, this->Run(emacs, args, {}));
-  if (manifest) RETURN_IF_ERROR(manifest->Close());
-  return code;
+  args.insert(args.end(), rest, orig_args_.end());
+  const auto runfiles = this->RunfilesDir();
+  ASSIGN_OR_RETURN(auto input_files, this->ArgFiles(runfiles, opts.input_args));
+  ASSIGN_OR_RETURN(auto output_files,
+                   this->ArgFiles(runfiles, opts.output_args));
+  RETURN_IF_ERROR(WriteManifest(opts, std::move(input_files),
+                                std::move(output_files), manifest));
+  ASSIGN_OR_RETURN(
+      const auto wstatus,
+      this->Run(emacs, args, {{"ELISP_MANIFEST", manifest.path()}}));
+  RETURN_IF_ERROR(manifest.Close());
+  return ExitCode(wstatus);
 }
 
 absl::StatusOr<int> Executor::RunTest(const TestOptions& opts) {
-  ASSIGN_OR_RETURN(const auto emacs, this->Runfile(opts.wrapper));
+  // Check the required environment variables before doing anything else, so
+  // that tests don’t fail later with an obscure error.
+  std::vector<std::string> missing_env;
+  for (const auto& name : opts.required_env) {
+    if (!orig_env_.contains(name)) missing_env.push_back(name);
+  }
+  if (!missing_env.empty()) {
+    return absl::FailedPreconditionError(absl::StrCat(
+        "test requires environment variables that aren’t set: ",
+        absl::StrJoin(missing_env, ", "),
+        "; set them using e.g. bazel test --test_env=NAME=VALUE"));
+  }
+  ASSIGN_OR_RETURN(const auto emacs, this->Emacs(opts.wrapper));
   std::vector<std::string> args;
   ASSIGN_OR_RETURN(auto manifest, AddManifest(opts.mode, args, random_));
-  args.push_back("--quick");
-  args.push_back("--batch");
-  args.push_back("--module-assertions");
+  // By default, don’t load any site-wide initialization files, so that the
+  // local Emacs installation can’t affect the tests.  The user init file is
+  // never loaded; it would come from the temporary home directory anyway.
+  if (opts.site_init) {
+    args.push_back("--no-init-file");
+    args.push_back("--no-splash");
+  } else {
+    args.push_back("--quick");
+  }
+  // In terminal mode, Emacs runs interactively on a pseudo-terminal instead
+  // of in batch mode, so that tests can exercise terminal frames.
+  args.push_back(opts.terminal ? "--no-window-system" : "--batch");
+  if (opts.module_assertions) args.push_back("--module-assertions");
+  RETURN_IF_ERROR(this->AddNativeCompilation(opts, args));
+  RETURN_IF_ERROR(this->AddElnCache(args));
   RETURN_IF_ERROR(this->AddLoadPath(args, opts.load_path));
   ASSIGN_OR_RETURN(const auto runner,
                    this->Runfile("phst_rules_elisp/elisp/ert/runner.elc"));
   args.push_back(absl::StrCat("--load=", runner));
-  // Note that using equals signs for "--test-source, --skip-test, and
-  // --skip-tag doesn’t work.
+  if (opts.isolate_srcs) args.push_back("--isolate-test-sources");
+  // Note that using equals signs for "--test-source, --skip-test, --skip-tag,
+  // and the other test runner options doesn’t work.
+  for (const auto& file : opts.pre_test_load) {
+    ASSIGN_OR_RETURN(const auto abs, this->Runfile(file));
+    args.push_back("--pre-test-load");
+    args.push_back(absl::StrCat("/:", abs));
+  }
+  for (const auto& form : opts.pre_test_eval) {
+    args.push_back("--pre-test-eval");
+    args.push_back(form);
+  }
+  for (const auto& feature : opts.preload) {
+    args.push_back("--preload-feature");
+    args.push_back(feature);
+  }
   for (const auto& file : opts.load_files) {
     ASSIGN_OR_RETURN(const auto abs, this->Runfile(file));
     args.push_back("--test-source");
     args.push_back(absl::StrCat("/:", abs));
   }
+  for (const auto& file : opts.erts_files) {
+    ASSIGN_OR_RETURN(const auto abs, this->Runfile(file));
+    args.push_back("--erts-file");
+    args.push_back(absl::StrCat("/:", abs));
+  }
   for (const auto& test : Sort(opts.skip_tests)) {
     args.push_back("--skip-test");
     args.push_back(test);
@@ -372,29 +703,126 @@ absl::StatusOr<int> Executor::RunTest(const TestOptions& opts) {
     args.push_back("--skip-tag");
     args.push_back(tag);
   }
-  args.push_back("--funcall=elisp/ert/run-batch-and-exit");
-  if (manifest) {
-    std::vector<std::string> inputs, outputs;
-    const auto report_file = this->EnvVar("XML_OUTPUT_FILE");
-    if (!report_file.empty()) {
-      outputs.push_back(report_file);
+  for (const auto& arg : opts.test_args) {
+    ASSIGN_OR_RETURN(auto expanded, this->ExpandTestArg(arg));
+    args.push_back("--test-arg");
+    args.push_back(std::move(expanded));
+  }
+  args.push_back(opts.terminal ? "--funcall=elisp/ert/run-terminal-and-exit"
+                               : "--funcall=elisp/ert/run-batch-and-exit");
+  this->AddUserArgs(args);
+  std::vector<std::string> inputs(opts.pre_test_load.begin(),
+                                  opts.pre_test_load.end());
+  std::vector<std::string> outputs;
+  const auto report_file = this->EnvVar("XML_OUTPUT_FILE");
+  if (!report_file.empty()) {
+    outputs.push_back(report_file);
+  }
+  if (this->EnvVar("COVERAGE") == "1") {
+    std::string coverage_manifest = this->EnvVar("COVERAGE_MANIFEST");
+    if (!coverage_manifest.empty()) {
+      inputs.push_back(std::move(coverage_manifest));
+    }
+    const auto coverage_dir = this->EnvVar("COVERAGE_DIR");
+    if (!coverage_dir.empty()) {
+      outputs.push_back(JoinPath(coverage_dir, "emacs-lisp.dat"));
+    } else {
+      std::string coverage_file = this->EnvVar("COVERAGE_OUTPUT_FILE");
+      if (!coverage_file.empty()) {
+        outputs.push_back(std::move(coverage_file));
+      }
+    }
+  }
+  RETURN_IF_ERROR(WriteManifest(opts, std::move(inputs), outputs, manifest));
+  // The limit also applies to the launcher itself, which needs little memory.
+  const auto memory_limit = this->EnvVar("ELISP_TEST_MEMORY_LIMIT");
+  if (!memory_limit.empty()) RETURN_IF_ERROR(SetMemoryLimit(memory_limit));
+  // Point HOME at a fresh directory so that tests can’t read or write the
+  // user’s Emacs profile, even when running outside of a sandbox.  Emacs
+  // derives ‘user-emacs-directory’ from HOME or XDG_CONFIG_HOME.
+  ASSIGN_OR_RETURN(auto temp_home,
+                   TempDirectory::Create(TempDir(), "home-*", random_));
+  auto home = this->EnvVar("ELISP_TEST_HOME");
+  if (home.empty()) home = temp_home.path();
+  Environment env = {{"ELISP_MANIFEST", manifest.path()},
+                     {"HOME", home},
+                     {"XDG_CONFIG_HOME", JoinPath(home, ".config")}};
+  // The terminal type has to be one that Emacs supports and that is likely
+  // present in the terminfo database.
+  if (opts.terminal) env.emplace("TERM", "xterm");
+  // In matrix mode, run the tests once with each of the given Emacs binaries,
+  // giving each run its own report file.  Failures in one run don’t prevent
+  // the other runs.
+  const auto matrix = this->EnvVar("ELISP_TEST_EMACS_MATRIX");
+  std::vector<std::string> binaries =
+      absl::StrSplit(matrix, ':', absl::SkipEmpty());
+  const bool in_matrix = !binaries.empty();
+  if (in_matrix) {
+    env.emplace("ELISP_TEST_MATRIX", "1");
+  } else {
+    binaries.push_back(emacs);
+  }
+  // Use the same suite name as the test runner so that reports we synthesize
+  // for crashed runs look like the reports that the runner writes.
+  std::string suite_name = this->EnvVar("ELISP_TEST_SUITE_NAME");
+  if (suite_name.empty()) suite_name = this->EnvVar("TEST_TARGET");
+  if (suite_name.empty()) suite_name = "ERT";
+  ASSIGN_OR_RETURN(auto temp_reports,
+                   TempDirectory::Create(TempDir(), "reports-*", random_));
+  std::vector<std::string> run_reports;
+  std::vector<std::string> run_suite_names;
+  int exit_code = 0;
+  for (std::size_t i = 0; i < binaries.size(); ++i) {
+    const auto& binary = binaries[i];
+    std::string run_report = report_file;
+    Environment run_env = env;
+    std::string run_suite_name = suite_name;
+    if (in_matrix) {
+      // The runner tags its suite name with the Emacs version, which we
+      // don’t know, so use the binary instead.
+      absl::StrAppend(&run_suite_name, " (", binary, ")");
+      std::clog << "Running tests with Emacs binary " << binary << std::endl;
+      if (!report_file.empty()) {
+        run_report = JoinPath(temp_reports.path(), absl::StrCat(i, ".xml"));
+        run_env["XML_OUTPUT_FILE"] = run_report;
+        run_reports.push_back(run_report);
+        run_suite_names.push_back(run_suite_name);
+      }
     }
-    if (this->EnvVar("COVERAGE") == "1") {
-      std::string coverage_manifest = this->EnvVar("COVERAGE_MANIFEST");
-      if (!coverage_manifest.empty()) {
-        inputs.push_back(std::move(coverage_manifest));
+    ASSIGN_OR_RETURN(const auto wstatus,
+                     this->Run(binary, args, run_env, opts.terminal));
+    // The test runner exits with status 1 if some tests failed.  If Emacs was
+    // killed by a signal instead, e.g. because it crashed or ran out of
+    // memory, record that in the report so that such infrastructure failures
+    // are distinguishable from test failures.
+    const int signal = TermSignal(wstatus);
+    if (signal != 0) {
+      auto message = absl::StrCat("Emacs was killed by signal ", signal, " (",
+                                  strsignal(signal), ")");
+      // With a memory limit, Emacs typically crashes when a memory allocation
+      // fails outside of Lisp code.
+      if (!memory_limit.empty()) {
+        absl::StrAppend(&message, ", probably because it exceeded the memory ",
+                        "limit of ", memory_limit, " bytes");
       }
-      const auto coverage_dir = this->EnvVar("COVERAGE_DIR");
-      if (!coverage_dir.empty()) {
-        outputs.push_back(JoinPath(coverage_dir, "emacs-lisp.dat"));
+      std::clog << message << std::endl;
+      if (!run_report.empty()) {
+        RETURN_IF_ERROR(AddSuiteError(
+            run_report, run_suite_name, message,
+            memory_limit.empty() ? "signal" : "memory", random_));
       }
     }
+    // Report the most severe outcome: signals have exit codes above 128.
+    exit_code = std::max(exit_code, ExitCode(wstatus));
+  }
+  if (!run_reports.empty()) {
     RETURN_IF_ERROR(
-        WriteManifest(opts, std::move(inputs), outputs, manifest.value()));
+        CombineReports(run_reports, run_suite_names, report_file, random_));
   }
-  ASSIGN_OR_RETURN(const auto code, this->Run(emacs, args, {}));
-  if (manifest) RETURN_IF_ERROR(manifest->Close());
-  return code;
+  RETURN_IF_ERROR(temp_reports.Close());
+  RETURN_IF_ERROR(manifest.Close());
+  RETURN_IF_ERROR(temp_home.Close());
+  return exit_code;
 }
 
 absl::StatusOr<std::string> Executor::Runfile(const std::string& rel) const {
@@ -407,6 +835,35 @@ absl::StatusOr<std::string> Executor::Runfile(const std::string& rel) const {
   return MakeAbsolute(str);
 }
 
+absl::StatusOr<std::string> Executor::ExpandTestArg(
+    const absl::string_view arg) const {
+  std::string result;
+  absl::string_view rest = arg;
+  while (true) {
+    const auto index = rest.find('$');
+    absl::StrAppend(&result, rest.substr(0, index));
+    if (index == rest.npos) return result;
+    rest.remove_prefix(index);
+    if (absl::ConsumePrefix(&rest, "$$")) {
+      result += '$';
+      continue;
+    }
+    if (!absl::ConsumePrefix(&rest, "$(rlocation ")) {
+      return absl::InvalidArgumentError(
+          absl::StrCat("invalid test argument ", arg));
+    }
+    const auto end = rest.find(')');
+    if (end == rest.npos) {
+      return absl::InvalidArgumentError(
+          absl::StrCat("unterminated placeholder in test argument ", arg));
+    }
+    ASSIGN_OR_RETURN(const auto file,
+                     this->Runfile(std::string(rest.substr(0, end))));
+    absl::StrAppend(&result, file);
+    rest.remove_prefix(end + 1);
+  }
+}
+
 std::string Executor::RunfilesDir() const {
   const std::string vars[] = {"RUNFILES_DIR", "TEST_SRCDIR"};
   for (const auto& var : vars) {
@@ -421,63 +878,231 @@ std::string Executor::EnvVar(const std::string& name) const noexcept {
   return it == orig_env_.end() ? std::string() : it->second;
 }
 
+absl::StatusOr<std::string> Executor::Emacs(
+    const std::string& toolchain) const {
+  const auto emacs = this->EnvVar("ELISP_EMACS");
+  if (!emacs.empty()) {
+    struct stat info;
+    if (::stat(Pointer(emacs), &info) == 0 && S_ISREG(info.st_mode) &&
+        ::access(Pointer(emacs), X_OK) == 0) {
+      return MakeAbsolute(emacs);
+    }
+    std::clog << "ELISP_EMACS (" << emacs
+              << ") isn’t an executable file, using Emacs from the toolchain"
+              << std::endl;
+  }
+  return this->Runfile(toolchain);
+}
+
+absl::Status Executor::AddNativeCompilation(
+    const CommonOptions& opts, std::vector<std::string>& args) const {
+  if (!opts.native_compile) return absl::OkStatus();
+  // Emacs looks up the natively-compiled file for a byte-compiled file in
+  // ‘native-comp-eln-load-path’ using a hash of the true name of the source
+  // file next to the byte-compiled file.  The runfiles resolve to the same
+  // source file that the compilation action has seen, so the hashes agree.
+  // Emacs can’t load natively-compiled files through file name handlers, so
+  // skip directories that aren’t available as ordinary directories; Emacs then
+  // falls back to the byte-compiled files.
+  std::vector<std::string> directories;
+  for (const auto& dir : opts.eln_load_path) {
+    const auto status_or_dir = this->Runfile(dir);
+    if (absl::IsNotFound(status_or_dir.status())) continue;
+    RETURN_IF_ERROR(status_or_dir.status());
+    directories.push_back(LispString(status_or_dir.value()));
+  }
+  if (directories.empty()) return absl::OkStatus();
+  // Emacs versions without native compilation don’t define the variable.
+  args.push_back(absl::StrCat(
+      "--eval=(when (boundp 'native-comp-eln-load-path) "
+      "(setq native-comp-eln-load-path (append '(",
+      absl::StrJoin(directories, " "), ") native-comp-eln-load-path)))"));
+  return absl::OkStatus();
+}
+
+absl::Status Executor::AddElnCache(std::vector<std::string>& args) const {
+  const auto dir = this->EnvVar("ELISP_ELN_CACHE");
+  if (dir.empty()) return absl::OkStatus();
+  struct stat info;
+  if (::stat(Pointer(dir), &info) != 0 || !S_ISDIR(info.st_mode) ||
+      ::access(Pointer(dir), W_OK | X_OK) != 0) {
+    std::clog << "Ignoring ELISP_ELN_CACHE (" << dir
+              << ") because it isn’t a writable directory" << std::endl;
+    return absl::OkStatus();
+  }
+  ASSIGN_OR_RETURN(const auto abs, MakeAbsolute(dir));
+  // Emacs writes natively-compiled files into the first writable directory
+  // in ‘native-comp-eln-load-path’ and searches the directories in order, so
+  // the cache has to come first.  Emacs versions without native compilation
+  // don’t define the variable.
+  args.push_back(absl::StrCat(
+      "--eval=(when (boundp 'native-comp-eln-load-path) "
+      "(push (file-name-as-directory ",
+      LispString(abs), ") native-comp-eln-load-path))"));
+  return absl::OkStatus();
+}
+
 absl::Status Executor::AddLoadPath(
     std::vector<std::string>& args,
     const std::vector<std::string>& load_path) const {
   constexpr const char* const runfiles_elc =
       "phst_rules_elisp/elisp/runfiles/runfiles.elc";
+  bool runfiles_loaded = false;
   bool runfile_handler_installed = false;
+  // Load directories grouped by the repository that they belong to.  The
+  // first component of a runfile name is always the repository name.
+  std::map<std::string, std::vector<std::string>> repositories;
   for (const auto& dir : load_path) {
     const auto status_or_dir = this->Runfile(dir);
+    std::string directory;
     if (status_or_dir.ok()) {
-      args.push_back(absl::StrCat("--directory=", status_or_dir.value()));
+      directory = status_or_dir.value();
     } else if (absl::IsNotFound(status_or_dir.status())) {
-      if (!absl::exchange(runfile_handler_installed, true)) {
+      if (!absl::exchange(runfiles_loaded, true)) {
         ASSIGN_OR_RETURN(const auto file, this->Runfile(runfiles_elc));
         args.push_back(absl::StrCat("--load=", file));
+      }
+      if (!absl::exchange(runfile_handler_installed, true)) {
         args.push_back("--funcall=elisp/runfiles/install-handler");
       }
-      args.push_back(absl::StrCat("--directory=/bazel-runfile:", dir));
+      directory = absl::StrCat("/bazel-runfile:", dir);
     } else {
       return status_or_dir.status();
     }
+    args.push_back(absl::StrCat("--directory=", directory));
+    const std::string repository = dir.substr(0, dir.find('/'));
+    repositories[repository].push_back(std::move(directory));
+  }
+  // If the load path spans several repositories, features with the same name
+  // might exist in more than one of them.  Make ‘require’ look in the
+  // repository of the requiring file first, so that each library gets the
+  // file from its own repository.
+  if (repositories.size() > 1) {
+    if (!absl::exchange(runfiles_loaded, true)) {
+      ASSIGN_OR_RETURN(const auto file, this->Runfile(runfiles_elc));
+      args.push_back(absl::StrCat("--load=", file));
+    }
+    std::string alist;
+    for (const auto& entry : repositories) {
+      absl::StrAppend(&alist, "(", LispString(entry.first));
+      for (const auto& directory : entry.second) {
+        absl::StrAppend(&alist, " ", LispString(directory));
+      }
+      absl::StrAppend(&alist, ")");
+    }
+    args.push_back(absl::StrCat(
+        "--eval=(elisp/runfiles/install-repository-load-path '(", alist,
+        "))"));
   }
   return absl::OkStatus();
 }
 
 absl::StatusOr<int> Executor::Run(const std::string& binary,
                                   const std::vector<std::string>& args,
-                                  const Environment& env) {
+                                  const Environment& env, const bool terminal) {
   auto final_args = this->BuildArgs(args);
+  // If ELISP_WRAPPER is set, run the binary under the given wrapper program,
+  // e.g., a debugger or profiler.  The wrapper receives its own arguments
+  // followed by the filename of the binary and the binary’s arguments.  The
+  // variable is a plain whitespace-separated list without quoting or
+  // escaping, so none of the words can contain whitespace.
+  const std::vector<std::string> wrapper =
+      absl::StrSplit(this->EnvVar("ELISP_WRAPPER"), absl::ByAnyChar(" \t\n"),
+                     absl::SkipWhitespace());
+  if (!wrapper.empty()) {
+    final_args.at(0) = binary;
+    final_args.insert(final_args.begin(), wrapper.begin(), wrapper.end());
+  }
+  const std::string& program = wrapper.empty() ? binary : wrapper.front();
   const auto argv = Pointers(final_args);
   auto final_env = this->BuildEnv(env);
   const auto envp = Pointers(final_env);
+  absl::optional<PseudoTerminal> pty;
+  int flags = POSIX_SPAWN_SETSIGMASK;
+  if (terminal) {
+#ifdef POSIX_SPAWN_SETSID
+    ASSIGN_OR_RETURN(auto created, PseudoTerminal::Create());
+    pty.emplace(std::move(created));
+    // A session leader without controlling terminal acquires the first
+    // terminal that it opens without O_NOCTTY.
+    flags |= POSIX_SPAWN_SETSID;
+#else
+    return absl::UnimplementedError(
+        "running in a terminal requires POSIX_SPAWN_SETSID");
+#endif
+  }
+  SignalForwarder forwarder;
+  posix_spawnattr_t attr;
+  int error = posix_spawnattr_init(&attr);
+  if (error != 0) {
+    return ErrorStatus(std::error_code(error, std::system_category()),
+                       "posix_spawnattr_init");
+  }
+  posix_spawn_file_actions_t actions;
+  error = posix_spawn_file_actions_init(&actions);
+  if (error != 0) {
+    posix_spawnattr_destroy(&attr);
+    return ErrorStatus(std::error_code(error, std::system_category()),
+                       "posix_spawn_file_actions_init");
+  }
+  error = posix_spawnattr_setsigmask(&attr, &forwarder.old_mask());
+  if (error == 0) {
+    error = posix_spawnattr_setflags(&attr, static_cast<short>(flags));
+  }
+  // Standard error stays connected to the launcher’s standard error, so that
+  // messages still end up in the test log.
+  if (error == 0 && pty) {
+    error = posix_spawn_file_actions_addopen(
+        &actions, STDIN_FILENO, Pointer(pty->secondary()), O_RDWR, 0);
+  }
+  if (error == 0 && pty) {
+    error =
+        posix_spawn_file_actions_adddup2(&actions, STDIN_FILENO, STDOUT_FILENO);
+  }
+  if (error == 0 && pty) {
+    error = posix_spawn_file_actions_addclose(&actions, pty->fd());
+  }
   pid_t pid;
-  const int error = posix_spawn(&pid, Pointer(binary), nullptr, nullptr,
-                                argv.data(), envp.data());
+  // Look up wrapper programs in PATH, so that e.g. ELISP_WRAPPER=gdb works.
+  if (error == 0) {
+    error = wrapper.empty() ? posix_spawn(&pid, Pointer(program), &actions,
+                                          &attr, argv.data(), envp.data())
+                            : posix_spawnp(&pid, Pointer(program), &actions,
+                                           &attr, argv.data(), envp.data());
+  }
+  posix_spawn_file_actions_destroy(&actions);
+  posix_spawnattr_destroy(&attr);
   if (error != 0) {
     return ErrorStatus(std::error_code(error, std::system_category()),
-                       "posix_spawn", binary);
+                       wrapper.empty() ? "posix_spawn" : "posix_spawnp",
+                       program);
   }
+  forwarder.Start(pid);
+  if (pty) return pty->Wait(pid);
   int wstatus;
   const pid_t status = waitpid(pid, &wstatus, 0);
   if (status != pid) return ErrnoStatus("waitpid", pid);
-  return WIFEXITED(wstatus) ? WEXITSTATUS(wstatus) : 0xFF;
+  return wstatus;
 }
 
 std::vector<std::string> Executor::BuildArgs(
-    const std::vector<std::string>& prefix) const {
+    const std::vector<std::string>& args) const {
   std::vector<std::string> vec{orig_args_.at(0)};
-  vec.insert(vec.end(), prefix.begin(), prefix.end());
-  vec.insert(vec.end(), std::next(orig_args_.begin()), orig_args_.end());
+  vec.insert(vec.end(), args.begin(), args.end());
   return vec;
 }
 
+void Executor::AddUserArgs(std::vector<std::string>& args) const {
+  args.insert(args.end(), std::next(orig_args_.begin()), orig_args_.end());
+}
+
 std::vector<std::string> Executor::BuildEnv(const Environment& other) const {
   const auto& pairs = runfiles_->EnvVars();
   Environment map(pairs.begin(), pairs.end());
   map.insert(other.begin(), other.end());
   map.insert(orig_env_.begin(), orig_env_.end());
+  // Only the outermost launcher should apply the wrapper, see Run.
+  map.erase("ELISP_WRAPPER");
   std::vector<std::string> vec;
   for (const auto& p : map) {
     vec.push_back(absl::StrCat(p.first, "=", p.second));
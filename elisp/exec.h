@@ -43,8 +43,10 @@ ABSL_MUST_USE_RESULT int RunEmacs(const EmacsOptions& opts);
 struct CommonOptions {
   std::string wrapper;
   Mode mode;
+  bool native_compile;
   absl::flat_hash_set<std::string> rule_tags;
-  std::vector<std::string> load_path, load_files;
+  std::vector<std::string> load_path, load_files, preload;
+  std::vector<std::string> eln_load_path;
   absl::flat_hash_set<std::string> data_files;
   std::vector<std::string> argv;
 };
@@ -56,6 +58,14 @@ struct BinaryOptions : CommonOptions {
 ABSL_MUST_USE_RESULT int RunBinary(const BinaryOptions& opts);
 
 struct TestOptions : CommonOptions {
+  bool module_assertions;
+  bool isolate_srcs;
+  bool terminal;
+  bool site_init;
+  std::vector<std::string> erts_files;
+  std::vector<std::string> test_args;
+  std::vector<std::string> pre_test_load, pre_test_eval;
+  std::vector<std::string> required_env;
   absl::flat_hash_set<std::string> skip_tests, skip_tags;
 };
 
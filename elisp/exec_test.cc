@@ -14,6 +14,11 @@
 
 #include "elisp/exec.h"
 
+#include <cstdlib>
+#include <fstream>
+#include <string>
+#include <utility>
+
 #include "gmock/gmock.h"
 #include "gtest/gtest.h"
 
@@ -21,11 +26,44 @@ namespace phst_rules_elisp {
 namespace {
 
 using ::testing::Eq;
+using ::testing::NotNull;
+
+// Sets an environment variable for the lifetime of the object and restores
+// the previous value afterwards.  An empty value unsets the variable.
+class ScopedEnv {
+ public:
+  ScopedEnv(std::string name, const std::string& value)
+      : name_(std::move(name)) {
+    const char* const old = std::getenv(name_.c_str());
+    if (old != nullptr) old_ = old;
+    had_value_ = old != nullptr;
+    Set(value);
+  }
+
+  ~ScopedEnv() { Set(had_value_ ? old_ : std::string()); }
+
+  ScopedEnv(const ScopedEnv&) = delete;
+  ScopedEnv& operator=(const ScopedEnv&) = delete;
+
+ private:
+  void Set(const std::string& value) const {
+    if (value.empty()) {
+      ::unsetenv(name_.c_str());
+    } else {
+      ::setenv(name_.c_str(), value.c_str(), 1);
+    }
+  }
+
+  std::string name_;
+  std::string old_;
+  bool had_value_;
+};
 
 TEST(Executor, RunBinaryWrap) {
   BinaryOptions opts;
   opts.wrapper = "phst_rules_elisp/tests/wrap/wrap";
   opts.mode = Mode::kWrap;
+  opts.native_compile = false;
   opts.rule_tags = {"local", "mytag"};
   opts.load_path = {"phst_rules_elisp"};
   opts.data_files = {"phst_rules_elisp/elisp/exec.h"};
@@ -35,5 +73,36 @@ TEST(Executor, RunBinaryWrap) {
   EXPECT_THAT(RunBinary(opts), Eq(0));
 }
 
+TEST(Executor, RunBinaryWrapRunfileHandler) {
+  // Use a copy of the runfiles manifest without a runfiles directory.
+  // Directories aren’t listed in the manifest, so the launcher has to use the
+  // runfile handler for the load path, but it still finds runfiles.elc and
+  // the wrapper in the manifest.  The load path spans two repositories, so
+  // the launcher also installs the repository-specific load path.
+  const char* const srcdir = std::getenv("TEST_SRCDIR");
+  ASSERT_THAT(srcdir, NotNull());
+  const char* const tmpdir = std::getenv("TEST_TMPDIR");
+  ASSERT_THAT(tmpdir, NotNull());
+  const std::string manifest = std::string(tmpdir) + "/runfiles.txt";
+  {
+    std::ifstream in(std::string(srcdir) + "/MANIFEST");
+    ASSERT_TRUE(in.is_open());
+    std::ofstream out(manifest);
+    out << in.rdbuf();
+    ASSERT_TRUE(out.good());
+  }
+  const ScopedEnv manifest_file("RUNFILES_MANIFEST_FILE", manifest);
+  const ScopedEnv runfiles_dir("RUNFILES_DIR", "");
+  const ScopedEnv test_srcdir("TEST_SRCDIR", "");
+  BinaryOptions opts;
+  opts.wrapper = "phst_rules_elisp/tests/wrap/wrap";
+  opts.mode = Mode::kWrap;
+  opts.native_compile = false;
+  opts.rule_tags = {"local", "mytag"};
+  opts.load_path = {"phst_rules_elisp", "other_repository/lisp"};
+  opts.argv = {"unused", "--runfile-handler"};
+  EXPECT_THAT(RunBinary(opts), Eq(0));
+}
+
 }  // namespace
 }  // namespace phst_rules_elisp
@@ -18,12 +18,14 @@
 #include <sys/stat.h>
 #include <dirent.h>
 #include <fcntl.h>
+#include <ftw.h>
 #include <unistd.h>
 
 #include <array>
 #include <cassert>
 #include <cerrno>
 #include <cstdint>
+#include <cstdio>
 #include <cstdlib>
 #include <initializer_list>
 #include <iostream>
@@ -154,6 +156,54 @@ absl::Status TempFile::Fail(const absl::string_view function) const {
                       absl::StrCat("file ", path_, ": ", status.message()));
 }
 
+absl::StatusOr<TempDirectory> TempDirectory::Create(
+    const std::string& directory, const absl::string_view tmpl,
+    absl::BitGen& random) {
+  for (int i = 0; i < 10; i++) {
+    auto name = TempName(directory, tmpl, random);
+    if (::mkdir(Pointer(name), S_IRWXU) == 0) {
+      return TempDirectory(std::move(name));
+    }
+    if (errno != EEXIST) return ErrnoStatus("mkdir", name);
+  }
+  return absl::UnavailableError(
+      absl::StrCat("can’t create temporary directory in directory ", directory,
+                   " with template ", tmpl));
+}
+
+TempDirectory& TempDirectory::operator=(TempDirectory&& other) {
+  const auto status = this->Close();
+  if (!status.ok()) std::clog << status << std::endl;
+  path_ = absl::exchange(other.path_, std::string());
+  return *this;
+}
+
+TempDirectory::~TempDirectory() noexcept {
+  const auto path = this->path();
+  const auto status = this->Close();
+  if (!status.ok() && !absl::IsNotFound(status)) {
+    std::clog << "error removing temporary directory " << path << ": "
+              << status << std::endl;
+  }
+}
+
+static int RemoveEntry(const char* const name, const struct stat*, int,
+                       struct FTW*) noexcept {
+  // On POSIX systems, std::remove also removes empty directories.
+  return std::remove(name);
+}
+
+absl::Status TempDirectory::Close() {
+  if (path_.empty()) return absl::OkStatus();
+  const auto path = absl::exchange(path_, std::string());
+  // Visit the directory contents before the directories themselves, and
+  // don’t follow symbolic links out of the directory.
+  if (::nftw(Pointer(path), RemoveEntry, 16, FTW_DEPTH | FTW_PHYS) != 0) {
+    return ErrnoStatus("nftw", path);
+  }
+  return absl::OkStatus();
+}
+
 std::string JoinPathImpl(const std::initializer_list<absl::string_view> pieces) {
   assert(pieces.begin() < pieces.end());
   const auto format = [](std::string* const out, absl::string_view name) {
@@ -199,6 +249,26 @@ absl::Status RemoveFile(const std::string& name) noexcept {
                                       : ErrnoStatus("unlink", name);
 }
 
+absl::Status WriteFileAtomically(const std::string& name,
+                                 const absl::string_view contents,
+                                 absl::BitGen& random) {
+  const auto pos = name.rfind('/');
+  std::string directory = ".";
+  if (pos == 0) {
+    directory = "/";
+  } else if (pos != name.npos) {
+    directory = name.substr(0, pos);
+  }
+  ASSIGN_OR_RETURN(auto file, TempFile::Create(directory, ".tmp-*", random));
+  RETURN_IF_ERROR(file.Write(contents));
+  if (::rename(Pointer(file.path()), Pointer(name)) != 0) {
+    return ErrnoStatus("rename", file.path(), name);
+  }
+  // The temporary file is gone now, so closing it can’t remove it.
+  const auto status = file.Close();
+  return absl::IsNotFound(status) ? absl::OkStatus() : status;
+}
+
 ABSL_MUST_USE_RESULT std::string TempDir() {
   const std::array<const char*, 2> vars = {"TEST_TMPDIR", "TMPDIR"};
   for (const auto var : vars) {
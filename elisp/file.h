@@ -65,6 +65,29 @@ class TempFile {
   std::string path_;
 };
 
+// A temporary directory that is removed together with its contents when the
+// object is destroyed.
+class TempDirectory {
+ public:
+  static absl::StatusOr<TempDirectory> Create(const std::string& directory,
+                                              absl::string_view tmpl,
+                                              absl::BitGen& random);
+
+  ~TempDirectory() noexcept;
+  TempDirectory(const TempDirectory&) = delete;
+  TempDirectory(TempDirectory&& other)
+      : path_(absl::exchange(other.path_, std::string())) {}
+  TempDirectory& operator=(const TempDirectory&) = delete;
+  TempDirectory& operator=(TempDirectory&& other);
+  const std::string& path() const noexcept { return path_; }
+  absl::Status Close();
+
+ private:
+  explicit TempDirectory(std::string path) : path_(std::move(path)) {}
+
+  std::string path_;
+};
+
 constexpr bool IsAbsolute(absl::string_view name) noexcept {
   return !name.empty() && name.front() == '/';
 }
@@ -83,6 +106,14 @@ absl::StatusOr<std::string> MakeRelative(absl::string_view name,
 
 ABSL_MUST_USE_RESULT bool FileExists(const std::string& name) noexcept;
 absl::Status RemoveFile(const std::string& name) noexcept;
+
+// Writes contents to the file with the given name.  The contents first go to a
+// temporary file in the same directory, which then replaces the file, so that
+// readers never see a partially-written file.
+absl::Status WriteFileAtomically(const std::string& name,
+                                 absl::string_view contents,
+                                 absl::BitGen& random);
+
 ABSL_MUST_USE_RESULT std::string TempDir();
 ABSL_MUST_USE_RESULT std::string TempName(absl::string_view dir,
                                           absl::string_view tmpl,
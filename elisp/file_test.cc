@@ -14,10 +14,13 @@
 
 #include "elisp/file.h"
 
+#include <sys/stat.h>
+
 #include <fstream>
 #include <iterator>
 #include <string>
 #include <utility>
+#include <vector>
 
 #pragma GCC diagnostic push
 #pragma GCC diagnostic ignored "-Wpedantic"
@@ -43,6 +46,7 @@ using ::testing::StrNe;
 using ::testing::StartsWith;
 using ::testing::EndsWith;
 using ::testing::IsEmpty;
+using ::testing::ElementsAre;
 
 static absl::string_view FileName(absl::string_view name) noexcept {
   const auto pos = name.rfind('/');
@@ -141,6 +145,38 @@ TEST(TempFile, Write) {
   EXPECT_THAT(FileExists(path), IsFalse());
 }
 
+TEST(TempDirectory, Create) {
+  absl::BitGen rnd;
+  auto status_or_dir = TempDirectory::Create(TempDir(), "dir-*", rnd);
+  ASSERT_THAT(status_or_dir, IsOK());
+  auto& dir = status_or_dir.value();
+  const auto path = dir.path();
+  EXPECT_THAT(Parent(path), Eq(RemoveSlash(TempDir())));
+  EXPECT_THAT(std::string(FileName(path)), StartsWith("dir-"));
+  EXPECT_THAT(FileExists(path), IsTrue());
+  // Closing the directory should also remove its contents.
+  const auto subdir = JoinPath(path, "subdir");
+  ASSERT_EQ(::mkdir(subdir.c_str(), S_IRWXU), 0);
+  std::ofstream(JoinPath(subdir, "file")) << "contents";
+  EXPECT_THAT(dir.Close(), IsOK());
+  EXPECT_THAT(dir.path(), IsEmpty());
+  EXPECT_THAT(FileExists(path), IsFalse());
+}
+
+TEST(TempDirectory, Move) {
+  absl::BitGen rnd;
+  auto status_or_dir = TempDirectory::Create(TempDir(), "dir-*", rnd);
+  ASSERT_THAT(status_or_dir, IsOK());
+  auto a = std::move(status_or_dir).value();
+  const auto path = a.path();
+  auto b = std::move(a);
+  EXPECT_THAT(a.path(), IsEmpty());
+  EXPECT_THAT(b.path(), Eq(path));
+  EXPECT_THAT(FileExists(path), IsTrue());
+  EXPECT_THAT(b.Close(), IsOK());
+  EXPECT_THAT(FileExists(path), IsFalse());
+}
+
 TEST(JoinPath, Relative) {
   EXPECT_THAT(JoinPath("foo/", "/bar/", "baz/qux/"), StrEq("foo/bar/baz/qux/"));
 }
@@ -173,5 +209,28 @@ TEST(TempName, Create) {
   EXPECT_THAT(b, StrNe(a));
 }
 
+TEST(WriteFileAtomically, Replace) {
+  absl::BitGen rnd;
+  const auto dir = TempName(TempDir(), "dir-*", rnd);
+  ASSERT_EQ(::mkdir(dir.c_str(), S_IRWXU), 0);
+  const auto file = JoinPath(dir, "file.txt");
+  EXPECT_THAT(WriteFileAtomically(file, "old", rnd), IsOK());
+  EXPECT_THAT(ReadFile(file), StrEq("old"));
+  EXPECT_THAT(WriteFileAtomically(file, "new", rnd), IsOK());
+  EXPECT_THAT(ReadFile(file), StrEq("new"));
+  // No temporary files should remain.
+  auto status_or_directory = Directory::Open(dir);
+  ASSERT_THAT(status_or_directory, IsOK());
+  auto& directory = status_or_directory.value();
+  std::vector<std::string> entries;
+  while (true) {
+    auto entry = directory.Read();
+    ASSERT_THAT(entry, IsOK());
+    if (entry->empty()) break;
+    if (*entry != "." && *entry != "..") entries.push_back(*entry);
+  }
+  EXPECT_THAT(entries, ElementsAre("file.txt"));
+}
+
 }  // namespace
 }  // namespace phst_rules_elisp
@@ -0,0 +1,186 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "elisp/report.h"
+
+#include <cstddef>
+#include <cstdint>
+#include <fstream>
+#include <regex>
+#include <sstream>
+#include <string>
+#include <vector>
+
+#pragma GCC diagnostic push
+#pragma GCC diagnostic ignored "-Wpedantic"
+#pragma GCC diagnostic ignored "-Wconversion"
+#pragma GCC diagnostic ignored "-Wsign-conversion"
+#include "absl/random/random.h"
+#include "absl/status/status.h"
+#include "absl/strings/ascii.h"
+#include "absl/strings/match.h"
+#include "absl/strings/numbers.h"
+#include "absl/strings/str_cat.h"
+#include "absl/strings/string_view.h"
+#pragma GCC diagnostic pop
+
+#include "elisp/file.h"
+#include "elisp/status.h"
+
+namespace phst_rules_elisp {
+
+static std::string EscapeXml(const absl::string_view string) {
+  std::string result;
+  for (const char c : string) {
+    switch (c) {
+      case '&': result += "&amp;"; break;
+      case '<': result += "&lt;"; break;
+      case '>': result += "&gt;"; break;
+      case '"': result += "&quot;"; break;
+      default: result += c; break;
+    }
+  }
+  return result;
+}
+
+// Returns the position of the start tag of the first <testsuite> element in
+// the given XML document, or npos if there’s no such element.
+static std::size_t FindTestSuite(const absl::string_view xml) {
+  constexpr absl::string_view prefix = "<testsuite";
+  for (auto pos = xml.find(prefix); pos != xml.npos;
+       pos = xml.find(prefix, pos + 1)) {
+    const auto next = pos + prefix.size();
+    if (next < xml.size() &&
+        (absl::ascii_isspace(static_cast<unsigned char>(xml[next])) ||
+         xml[next] == '>' || xml[next] == '/')) {
+      return pos;
+    }
+  }
+  return xml.npos;
+}
+
+// Returns the position just after the end of the tag that starts at the given
+// position, or npos if the tag doesn’t end.  Attribute values can contain
+// unescaped “>” characters, so skip over them.
+static std::size_t FindTagEnd(const absl::string_view xml, std::size_t pos) {
+  char quote = '\0';
+  for (; pos < xml.size(); ++pos) {
+    const char c = xml[pos];
+    if (quote != '\0') {
+      if (c == quote) quote = '\0';
+    } else if (c == '"' || c == '\'') {
+      quote = c;
+    } else if (c == '>') {
+      return pos + 1;
+    }
+  }
+  return xml.npos;
+}
+
+// Returns the given start tag with its “errors” attribute incremented.  If the
+// tag doesn’t have an “errors” attribute, add one.  The attribute can appear
+// anywhere in the tag and use either kind of quotes.
+static std::string IncrementErrors(const std::string& tag) {
+  const std::regex attribute(R"re((\serrors\s*=\s*)(["'])(\d+)\2)re");
+  std::smatch match;
+  std::uint64_t errors;
+  if (std::regex_search(tag, match, attribute) &&
+      absl::SimpleAtoi(match.str(3), &errors)) {
+    return absl::StrCat(match.prefix().str(), match.str(1), match.str(2),
+                        errors + 1, match.str(2), match.suffix().str());
+  }
+  const auto end = absl::EndsWith(tag, "/>") ? tag.size() - 2 : tag.size() - 1;
+  return absl::StrCat(tag.substr(0, end), " errors=\"1\"", tag.substr(end));
+}
+
+absl::Status AddSuiteError(const std::string& report_file,
+                           const absl::string_view suite_name,
+                           const absl::string_view message,
+                           const absl::string_view type,
+                           absl::BitGen& random) {
+  const auto error = absl::StrCat("<error message=\"", EscapeXml(message),
+                                  "\" type=\"", EscapeXml(type), "\"/>");
+  std::string report;
+  if (FileExists(report_file)) {
+    std::ifstream stream(report_file);
+    std::ostringstream buffer;
+    buffer << stream.rdbuf();
+    if (!stream) return ErrnoStatus("std::ifstream", report_file);
+    report = buffer.str();
+  }
+  constexpr absl::string_view end_tag = "</testsuite>";
+  const auto begin = FindTestSuite(report);
+  const auto end =
+      begin == report.npos ? report.npos : FindTagEnd(report, begin);
+  const auto close = report.rfind(std::string(end_tag));
+  if (end == report.npos) {
+    report = absl::StrCat(
+        "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n",
+        "<testsuite name=\"", EscapeXml(suite_name),
+        "\" hostname=\"localhost\" tests=\"0\" errors=\"1\" failures=\"0\" ",
+        "skipped=\"0\">", error, end_tag, "\n");
+  } else {
+    std::string tag = IncrementErrors(report.substr(begin, end - begin));
+    if (absl::EndsWith(tag, "/>")) {
+      // An empty report such as <testsuite …/> has no end tag yet.
+      tag.erase(tag.size() - 2);
+      absl::StrAppend(&tag, ">", error, end_tag);
+      report.replace(begin, end - begin, tag);
+    } else if (close != report.npos && close >= end) {
+      report.insert(close, error);
+      report.replace(begin, end - begin, tag);
+    } else {
+      return absl::InvalidArgumentError(
+          absl::StrCat("report file ", report_file, " has no end tag"));
+    }
+  }
+  return WriteFileAtomically(report_file, report, random);
+}
+
+absl::Status CombineReports(const std::vector<std::string>& reports,
+                            const std::vector<std::string>& suite_names,
+                            const std::string& report_file,
+                            absl::BitGen& random) {
+  if (suite_names.size() != reports.size()) {
+    return absl::InvalidArgumentError(
+        absl::StrCat("got ", reports.size(), " reports, but ",
+                     suite_names.size(), " suite names"));
+  }
+  std::string combined =
+      "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<testsuites>\n";
+  for (std::size_t i = 0; i < reports.size(); ++i) {
+    const auto& report = reports[i];
+    if (!FileExists(report)) {
+      RETURN_IF_ERROR(AddSuiteError(report, suite_names[i],
+                                    "Emacs didn’t write a report", "missing",
+                                    random));
+    }
+    std::ifstream stream(report);
+    std::ostringstream buffer;
+    buffer << stream.rdbuf();
+    if (!stream) return ErrnoStatus("std::ifstream", report);
+    const std::string string = buffer.str();
+    absl::string_view contents = string;
+    // Remove the XML declaration, which may only appear at the very start.
+    if (absl::StartsWith(contents, "<?xml")) {
+      const auto end = contents.find("?>");
+      if (end != contents.npos) contents.remove_prefix(end + 2);
+    }
+    absl::StrAppend(&combined, absl::StripAsciiWhitespace(contents), "\n");
+  }
+  absl::StrAppend(&combined, "</testsuites>\n");
+  return WriteFileAtomically(report_file, combined, random);
+}
+
+}  // namespace phst_rules_elisp
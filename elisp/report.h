@@ -0,0 +1,55 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#ifndef PHST_RULES_ELISP_ELISP_REPORT_H
+#define PHST_RULES_ELISP_ELISP_REPORT_H
+
+#include <string>
+#include <vector>
+
+#pragma GCC diagnostic push
+#pragma GCC diagnostic ignored "-Wpedantic"
+#pragma GCC diagnostic ignored "-Wconversion"
+#pragma GCC diagnostic ignored "-Wsign-conversion"
+#include "absl/random/random.h"
+#include "absl/status/status.h"
+#include "absl/strings/string_view.h"
+#pragma GCC diagnostic pop
+
+namespace phst_rules_elisp {
+
+// Records a suite-level error with the given message and type in the JUnit
+// report file.  The test runner writes its report atomically, so the file
+// either contains a complete report or doesn’t exist.  In the first case, add
+// an error element to the root <testsuite> element of the existing report and
+// increment its error count; otherwise, write a new report with the given
+// suite name that only contains the error.  Like the test runner, replace the
+// report file atomically.
+absl::Status AddSuiteError(const std::string& report_file,
+                           absl::string_view suite_name,
+                           absl::string_view message, absl::string_view type,
+                           absl::BitGen& random);
+
+// Combines the JUnit reports in the given files into a single report with a
+// <testsuites> root element.  Runs that didn’t write a report contribute an
+// error, see AddSuiteError.  The suite names of those runs are the elements of
+// suite_names, which must have the same length as reports.
+absl::Status CombineReports(const std::vector<std::string>& reports,
+                            const std::vector<std::string>& suite_names,
+                            const std::string& report_file,
+                            absl::BitGen& random);
+
+}  // namespace phst_rules_elisp
+
+#endif
@@ -0,0 +1,160 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "elisp/report.h"
+
+#include <fstream>
+#include <iterator>
+#include <string>
+
+#pragma GCC diagnostic push
+#pragma GCC diagnostic ignored "-Wpedantic"
+#pragma GCC diagnostic ignored "-Wconversion"
+#pragma GCC diagnostic ignored "-Wsign-conversion"
+#include "absl/random/random.h"
+#include "absl/status/status.h"
+#include "absl/strings/string_view.h"
+#include "gmock/gmock.h"
+#include "gtest/gtest.h"
+#pragma GCC diagnostic pop
+
+#include "elisp/file.h"
+
+namespace phst_rules_elisp {
+namespace {
+
+using ::testing::TempDir;
+using ::testing::IsTrue;
+using ::testing::StrEq;
+
+static std::string ReadFile(const std::string& path) {
+  std::ifstream stream(path);
+  stream.exceptions(stream.badbit | stream.failbit | stream.eofbit);
+  using iterator = std::istreambuf_iterator<char>;
+  return std::string(iterator(stream), iterator());
+}
+
+static void WriteFile(const std::string& path,
+                      const absl::string_view contents) {
+  std::ofstream stream(path, std::ios::trunc);
+  stream.exceptions(stream.badbit | stream.failbit);
+  stream << contents;
+}
+
+MATCHER(IsOK, "OK") {
+  if (arg.ok()) return true;
+  *result_listener << "status is " << arg;
+  return false;
+}
+
+static constexpr absl::string_view kDeclaration =
+    "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n";
+
+static constexpr absl::string_view kMessage =
+    "Emacs was killed by signal 9 (Killed)";
+
+static constexpr absl::string_view kError =
+    "<error message=\"Emacs was killed by signal 9 (Killed)\" "
+    "type=\"signal\"/>";
+
+TEST(AddSuiteError, NewReport) {
+  absl::BitGen rnd;
+  const auto file = JoinPath(TempDir(), "new.xml");
+  EXPECT_THAT(AddSuiteError(file, "//pkg:a&b", kMessage, "signal", rnd),
+              IsOK());
+  EXPECT_THAT(ReadFile(file),
+              StrEq(std::string(kDeclaration) +
+                    "<testsuite name=\"//pkg:a&amp;b\" hostname=\"localhost\" "
+                    "tests=\"0\" errors=\"1\" failures=\"0\" skipped=\"0\">" +
+                    std::string(kError) + "</testsuite>\n"));
+}
+
+TEST(AddSuiteError, ExistingReport) {
+  absl::BitGen rnd;
+  const auto file = JoinPath(TempDir(), "existing.xml");
+  WriteFile(file, std::string(kDeclaration) +
+                      "<testsuite name=\"ERT\" tests=\"1\" errors=\"2\" "
+                      "failures=\"0\"><testcase name=\"foo\"/></testsuite>\n");
+  EXPECT_THAT(AddSuiteError(file, "unused", kMessage, "signal", rnd), IsOK());
+  EXPECT_THAT(ReadFile(file),
+              StrEq(std::string(kDeclaration) +
+                    "<testsuite name=\"ERT\" tests=\"1\" errors=\"3\" "
+                    "failures=\"0\"><testcase name=\"foo\"/>" +
+                    std::string(kError) + "</testsuite>\n"));
+}
+
+TEST(AddSuiteError, AttributeOrder) {
+  absl::BitGen rnd;
+  // Another writer might order attributes differently, use single quotes, or
+  // put “>” characters into attribute values.
+  const auto file = JoinPath(TempDir(), "order.xml");
+  WriteFile(file,
+            "<testsuite\n  errors = '0' failures=\"1\"\n  name='a > b'\n"
+            "  tests=\"1\"><testcase name=\"foo\"><failure/></testcase>"
+            "</testsuite>");
+  EXPECT_THAT(AddSuiteError(file, "unused", kMessage, "signal", rnd), IsOK());
+  EXPECT_THAT(ReadFile(file),
+              StrEq("<testsuite\n  errors = '1' failures=\"1\"\n  "
+                    "name='a > b'\n  tests=\"1\"><testcase name=\"foo\">"
+                    "<failure/></testcase>" +
+                    std::string(kError) + "</testsuite>"));
+}
+
+TEST(AddSuiteError, MissingErrorCount) {
+  absl::BitGen rnd;
+  const auto file = JoinPath(TempDir(), "missing-count.xml");
+  WriteFile(file, "<testsuite tests=\"0\" name=\"ERT\"></testsuite>");
+  EXPECT_THAT(AddSuiteError(file, "unused", kMessage, "signal", rnd), IsOK());
+  EXPECT_THAT(ReadFile(file),
+              StrEq("<testsuite tests=\"0\" name=\"ERT\" errors=\"1\">" +
+                    std::string(kError) + "</testsuite>"));
+}
+
+TEST(AddSuiteError, EmptyElement) {
+  absl::BitGen rnd;
+  const auto file = JoinPath(TempDir(), "empty.xml");
+  WriteFile(file, "<testsuite tests=\"0\" name=\"ERT\" errors=\"0\"/>\n");
+  EXPECT_THAT(AddSuiteError(file, "unused", kMessage, "signal", rnd), IsOK());
+  EXPECT_THAT(ReadFile(file),
+              StrEq("<testsuite tests=\"0\" name=\"ERT\" errors=\"1\">" +
+                    std::string(kError) + "</testsuite>\n"));
+}
+
+TEST(CombineReports, MissingReport) {
+  absl::BitGen rnd;
+  const auto present = JoinPath(TempDir(), "present.xml");
+  const auto missing = JoinPath(TempDir(), "missing.xml");
+  const auto combined = JoinPath(TempDir(), "combined.xml");
+  WriteFile(present, std::string(kDeclaration) +
+                         "<testsuite name=\"//pkg:test (Emacs 28.1)\" "
+                         "errors=\"0\"></testsuite>\n");
+  EXPECT_THAT(CombineReports({present, missing},
+                             {"//pkg:test (emacs-28)", "//pkg:test (emacs-29)"},
+                             combined, rnd),
+              IsOK());
+  EXPECT_THAT(FileExists(missing), IsTrue());
+  EXPECT_THAT(
+      ReadFile(combined),
+      StrEq(std::string(kDeclaration) + "<testsuites>\n" +
+            "<testsuite name=\"//pkg:test (Emacs 28.1)\" errors=\"0\">"
+            "</testsuite>\n"
+            "<testsuite name=\"//pkg:test (emacs-29)\" hostname=\"localhost\" "
+            "tests=\"0\" errors=\"1\" failures=\"0\" skipped=\"0\">"
+            "<error message=\"Emacs didn’t write a report\" "
+            "type=\"missing\"/></testsuite>\n"
+            "</testsuites>\n"));
+}
+
+}  // namespace
+}  // namespace phst_rules_elisp
@@ -36,4 +36,17 @@
     (should (> (file-attribute-size (file-attributes filename)) 0))
     (should (or (getenv "RUNFILES_DIR") (getenv "RUNFILES_MANIFEST_FILE")))))
 
+(ert-deftest elisp/runfiles/check-declared ()
+  ;; The launcher always writes a manifest.
+  (should (getenv "ELISP_MANIFEST"))
+  (elisp/runfiles/check-declared "phst_rules_elisp/elisp/runfiles/test.txt")
+  (let* ((filename "phst_rules_elisp/elisp/runfiles/undeclared.txt")
+         (err (should-error (elisp/runfiles/check-declared filename)
+                            :type 'elisp/runfiles/undeclared)))
+    ;; The error message should name the undeclared file.
+    (should (string-match-p (regexp-quote filename)
+                            (error-message-string err)))
+    ;; Without a manifest, don’t check anything.
+    (elisp/runfiles/check-declared filename nil)))
+
 ;;; runfiles-test.el ends here
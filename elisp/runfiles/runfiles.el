@@ -26,11 +26,16 @@
 ;;
 ;; This library also provides a file name handler for runfiles,
 ;; ‘elisp/runfiles/file-handler’.  It uses the prefix "/bazel-runfile:".
+;;
+;; Use the function ‘elisp/runfiles/check-declared’ to verify that a runfile is
+;; a declared input file of the current program.  This helps to detect missing
+;; data dependencies early, with a clear error message.
 
 ;;; Code:
 
 (require 'cl-lib)
 (require 'eieio)
+(require 'json)
 (require 'pcase)
 (require 'rx)
 
@@ -97,6 +102,23 @@ to a global instance."
   (cl-check-type runfiles elisp/runfiles/runfiles)
   (elisp/runfiles/env-vars--internal runfiles))
 
+(cl-defun elisp/runfiles/check-declared
+    (filename &optional (manifest (getenv "ELISP_MANIFEST")))
+  "Signal an error if the runfile FILENAME isn’t a declared input file.
+MANIFEST is the filename of the JSON manifest that the launcher
+of the current ‘elisp_binary’ or ‘elisp_test’ program writes; it
+defaults to the value of the environmental variable
+ELISP_MANIFEST.  If FILENAME isn’t listed as input file in the
+manifest, signal an error of type ‘elisp/runfiles/undeclared’.
+If MANIFEST is nil or empty, do nothing."
+  (cl-check-type filename elisp/runfiles/filename)
+  (cl-check-type manifest (or null string))
+  (when (and manifest (not (string-equal manifest "")))
+    (unless (member filename (elisp/runfiles/declared--inputs manifest))
+      (signal 'elisp/runfiles/undeclared
+              (list "Runfile not declared as input file, add it to the data \
+attribute" filename)))))
+
 (defun elisp/runfiles/filename-p (string)
   "Return whether STRING is a possible argument for ‘elisp/runfiles/rlocation’."
   (let ((case-fold-search nil))
@@ -123,6 +145,7 @@ to a global instance."
 (define-error 'elisp/runfiles/not-found "Runfiles not found" 'file-missing)
 (define-error 'elisp/runfiles/read-only "Runfiles are read-only" 'file-error)
 (define-error 'elisp/runfiles/syntax-error "Syntax error in runfiles manifest")
+(define-error 'elisp/runfiles/undeclared "Runfile not declared" 'file-error)
 
 
 ;;;; File name handler:
@@ -438,5 +461,87 @@ RUNFILES is a runfiles object."
           ;; can pick up RUNFILES_DIR.
           (concat "JAVA_RUNFILES=" directory))))
 
+;;;; Repository-local load path:
+
+(defvar elisp/runfiles/repository--load-path nil
+  "Load directories of each repository.
+This is an alist that maps repository names to lists of load
+directories; see ‘elisp/runfiles/install-repository-load-path’.")
+
+(defun elisp/runfiles/install-repository-load-path (repositories)
+  "Make ‘require’ prefer files from the repository of the requiring file.
+REPOSITORIES is an alist that maps the names of Bazel
+repositories to lists of load directories within these
+repositories.  Once installed, a ‘require’ form without FILENAME
+argument in a file within one of these directories first looks
+for the feature in the load directories of the same repository,
+and only then in ‘load-path’.  That way a library can’t
+accidentally load a file with the same name from another
+repository that happens to come first in ‘load-path’.  The
+launchers of ‘elisp_binary’ and ‘elisp_test’ rules call this
+function if their load path spans more than one repository."
+  (cl-check-type repositories list)
+  (setq elisp/runfiles/repository--load-path
+        (cl-loop for (repository . directories) in repositories
+                 collect (cons repository
+                               (mapcar #'elisp/runfiles/load--directory
+                                       directories))))
+  (advice-add #'require :around #'elisp/runfiles/require--from-repository))
+
+(defun elisp/runfiles/require--from-repository
+    (require feature &optional filename noerror)
+  "Around advice for ‘require’ that prefers the current repository.
+REQUIRE is the original ‘require’ function, and FEATURE,
+FILENAME, and NOERROR are its arguments.  See
+‘elisp/runfiles/install-repository-load-path’."
+  (unless (or filename (featurep feature) (null load-file-name))
+    (let ((directories
+           (elisp/runfiles/repository--directories load-file-name)))
+      (when directories
+        (setq filename (locate-file (symbol-name feature) directories
+                                    (get-load-suffixes))))))
+  (funcall require feature filename noerror))
+
+(defun elisp/runfiles/repository--directories (file)
+  "Return the load directories of the repository that contains FILE.
+Return nil if FILE isn’t within any of the directories in
+‘elisp/runfiles/repository--load-path’."
+  (cl-check-type file string)
+  (let ((file (file-name-unquote file))
+        (result nil)
+        (longest 0))
+    ;; A repository whose directory is a longer prefix of FILE wins, in case
+    ;; one repository is nested within another one.
+    (pcase-dolist (`(,_ . ,directories) elisp/runfiles/repository--load-path)
+      (dolist (directory directories)
+        (when (and (string-prefix-p directory file)
+                   (> (length directory) longest))
+          (setq result directories
+                longest (length directory)))))
+    result))
+
+(defun elisp/runfiles/load--directory (directory)
+  "Return DIRECTORY in the form that ‘load-file-name’ uses.
+The result is unquoted and ends in a slash, so that it’s a
+prefix of the names of the files within DIRECTORY."
+  (cl-check-type directory string)
+  (file-name-as-directory (file-name-unquote (expand-file-name directory))))
+
+;;;; Manifest of declared input and output files:
+
+(defun elisp/runfiles/declared--inputs (manifest)
+  "Return the list of declared input files in MANIFEST.
+MANIFEST is the filename of a JSON manifest file as written by
+the launcher.  Return a list of strings."
+  (cl-check-type manifest string)
+  (with-temp-buffer
+    (insert-file-contents (concat "/:" manifest))
+    (let* ((json-array-type 'list)
+           (json-object-type 'alist)
+           (json-key-type 'string)
+           (inputs (cdr (assoc "inputFiles" (json-read)))))
+      (cl-check-type inputs list)
+      inputs)))
+
 (provide 'elisp/runfiles/runfiles)
 ;;; runfiles.el ends here
@@ -21,6 +21,8 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"strings"
+	"testing"
 
 	"github.com/phst/runfiles"
 )
@@ -65,6 +67,94 @@ func Example() {
 	// hi from data dependency
 }
 
+func TestArgs(t *testing.T) {
+	bin, err := runfiles.Path("phst_rules_elisp/examples/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Arguments before “--” are Emacs startup options, arguments after it
+	// are passed to the program.
+	cmd := exec.Command(bin, `--eval=(message "hi from startup")`, "--", "foo", "bar")
+	cmd.Dir = "/"
+	cmd.Env = append(env, "EMACS="+os.Getenv("EMACS"), "PATH="+os.Getenv("PATH"), "GCOV_PREFIX="+os.TempDir())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running %s: %s\n%s", bin, err, out)
+	}
+	lines := strings.Split(string(out), "\n")
+	for _, want := range []string{"hi from startup", `hi from bin, ("foo" "bar")`} {
+		if !contains(lines, want) {
+			t.Errorf("output doesn’t contain line %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWrapper(t *testing.T) {
+	bin, err := runfiles.Path("phst_rules_elisp/examples/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The env program acts as a trivial wrapper that sets an
+	// environmental variable before running Emacs.
+	cmd := exec.Command(bin, `--eval=(message "wrapped: %s" (getenv "WRAPPED"))`, "--")
+	cmd.Dir = "/"
+	cmd.Env = append(env, "ELISP_WRAPPER=env WRAPPED=yes", "EMACS="+os.Getenv("EMACS"), "PATH="+os.Getenv("PATH"), "GCOV_PREFIX="+os.TempDir())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running %s: %s\n%s", bin, err, out)
+	}
+	lines := strings.Split(string(out), "\n")
+	for _, want := range []string{"wrapped: yes", "hi from bin, nil"} {
+		if !contains(lines, want) {
+			t.Errorf("output doesn’t contain line %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWrapperArguments(t *testing.T) {
+	bin, err := runfiles.Path("phst_rules_elisp/examples/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The wrapper gets several arguments, separated by different kinds of
+	// whitespace.  The wrapper sets FIRST twice, so the last value only
+	// wins if the argument order is preserved.
+	cmd := exec.Command(bin, `--eval=(message "wrapped: %s %s %s" (getenv "FIRST") (getenv "SECOND") (getenv "UNSET"))`, "--")
+	cmd.Dir = "/"
+	cmd.Env = append(env, "ELISP_WRAPPER= env -u UNSET\tFIRST=1  SECOND=2\nFIRST=3 ", "UNSET=yes", "EMACS="+os.Getenv("EMACS"), "PATH="+os.Getenv("PATH"), "GCOV_PREFIX="+os.TempDir())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running %s: %s\n%s", bin, err, out)
+	}
+	lines := strings.Split(string(out), "\n")
+	for _, want := range []string{"wrapped: 3 2 nil", "hi from bin, nil"} {
+		if !contains(lines, want) {
+			t.Errorf("output doesn’t contain line %q:\n%s", want, out)
+		}
+	}
+}
+
+func contains(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
+
 func filter(r io.Reader, w io.Writer) {
 	s := bufio.NewScanner(r)
 	for s.Scan() {
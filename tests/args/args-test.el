@@ -0,0 +1,39 @@
+;;; args-test.el --- test for test arguments        -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Checks that tests can retrieve the arguments from the ‘test_args’ attribute
+;; using ‘elisp/ert/test-args’.
+
+;;; Code:
+
+(require 'ert)
+
+(declare-function elisp/ert/test-args "elisp/ert/runner" ())
+
+(ert-deftest tests/args/location ()
+  (let ((file (car (elisp/ert/test-args))))
+    (should (file-name-absolute-p file))
+    (with-temp-buffer
+      (insert-file-contents file)
+      (should (equal (buffer-string) "Generated file\n")))))
+
+(ert-deftest tests/args/literal ()
+  (should (equal (cdr (elisp/ert/test-args)) '("--price=$5"))))
+
+;;; args-test.el ends here
@@ -0,0 +1,45 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A deliberately misbehaving Emacs module.  It stores the environment passed
+// to the initialization function and uses it after it’s no longer live.  With
+// module assertions enabled, Emacs detects this and aborts.
+
+#include <stddef.h>
+
+#include "emacs-module.h"
+
+static emacs_env* stale_env = NULL;
+
+static emacs_value misbehave(emacs_env* env, ptrdiff_t nargs,
+                             emacs_value* args, void* data) {
+  return stale_env->intern(stale_env, "nil");
+}
+
+int emacs_module_init(struct emacs_runtime* rt) {
+  if (rt->size < sizeof *rt) return 1;
+  emacs_env* env = rt->get_environment(rt);
+  if (env->size < sizeof(struct emacs_env_26)) return 2;
+  stale_env = env;
+  emacs_value args[] = {
+      env->intern(env, "tests/bad-module-misbehave"),
+      env->make_function(env, 0, 0, misbehave, NULL, NULL),
+  };
+  env->funcall(env, env->intern(env, "defalias"), 2, args);
+  emacs_value feature = env->intern(env, "tests/bad-module");
+  env->funcall(env, env->intern(env, "provide"), 1, &feature);
+  return 0;
+}
+
+int plugin_is_GPL_compatible = 1;
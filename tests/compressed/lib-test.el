@@ -0,0 +1,31 @@
+;;; lib-test.el --- test for compressed libraries  -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Tests that libraries can be compiled from gzip-compressed source files.
+
+;;; Code:
+
+(require 'tests/compressed/lib)
+
+(require 'ert)
+
+(ert-deftest tests/compressed/function ()
+  (should (eql (tests/compressed/function 1) 2)))
+
+;;; lib-test.el ends here
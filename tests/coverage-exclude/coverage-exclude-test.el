@@ -0,0 +1,38 @@
+;;; coverage-exclude-test.el --- exclusion test     -*- lexical-binding: t; -*-
+
+
+;; Copyright 2021 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+;;; Commentary:
+
+;; Tests that exercise both libraries, so that both would normally show up in
+;; the coverage report.  Only one of the tests calls into generated-pb.el, so
+;; that per-test coverage can distinguish them.
+
+;;; Code:
+
+(require 'ert)
+(require 'tests/coverage-exclude/generated-pb)
+(require 'tests/coverage-exclude/normal)
+
+(ert-deftest tests/coverage-exclude/call-functions ()
+  (should (eq (tests/coverage-exclude/normal-function 'normal) 'normal))
+  (should (eq (tests/coverage-exclude/generated-function 'generated)
+              'generated)))
+
+(ert-deftest tests/coverage-exclude/call-normal ()
+  (should (eq (tests/coverage-exclude/normal-function 'normal) 'normal)))
+
+;;; coverage-exclude-test.el ends here
@@ -0,0 +1,29 @@
+;;; normal.el --- library with coverage             -*- lexical-binding: t; -*-
+
+
+;; Copyright 2021 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+;;; Commentary:
+
+;; A library whose coverage should show up in the coverage report.
+
+;;; Code:
+
+(defun tests/coverage-exclude/normal-function (arg)
+  "Return ARG."
+  arg)
+
+(provide 'tests/coverage-exclude/normal)
+;;; normal.el ends here
@@ -0,0 +1,44 @@
+;;; data-test.el --- test for data files            -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Checks that tests can find their data files using ‘elisp/ert/data-file’.
+
+;;; Code:
+
+(require 'ert)
+
+(declare-function elisp/ert/data-file "elisp/ert/runner"
+                  (filename &optional workspace))
+
+(ert-deftest tests/data/file ()
+  (let ((file (elisp/ert/data-file "tests/data/data.txt")))
+    (should (file-exists-p file))
+    (with-temp-buffer
+      (insert-file-contents file)
+      (should (equal (buffer-string) "Data file\n")))))
+
+(ert-deftest tests/data/undeclared ()
+  (let* ((filename "tests/data/undeclared.txt")
+         (err (should-error (elisp/ert/data-file filename)
+                            :type 'elisp/runfiles/undeclared)))
+    ;; The error message should name the undeclared file.
+    (should (string-match-p (regexp-quote filename)
+                            (error-message-string err)))))
+
+;;; data-test.el ends here
@@ -0,0 +1,31 @@
+;;; b-test.el --- test for duplicate test names     -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Together with a-test.el, checks that the test runner reports tests that are
+;; defined in more than one test source file.
+
+;;; Code:
+
+(require 'ert)
+
+(ert-deftest tests/duplicate/foo-test ()
+  "This definition replaces the one in a-test.el."
+  (should t))
+
+;;; b-test.el ends here
@@ -15,14 +15,20 @@
 package runner_test
 
 import (
+	"bufio"
+	"encoding/json"
 	"encoding/xml"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -42,18 +48,7 @@ func Test(t *testing.T) {
 		t.Fatal(err)
 	}
 	tempDir := os.Getenv("TEST_TMPDIR")
-	reportFile, err := ioutil.TempFile(tempDir, "report-*.xml")
-	if err != nil {
-		t.Fatal(err)
-	}
-	reportName := reportFile.Name()
-	// The test recreates the file in exclusive mode, so delete it now.
-	if err := os.Remove(reportName); err != nil {
-		t.Error(err)
-	}
-	if err := reportFile.Close(); err != nil {
-		t.Error(err)
-	}
+	reportName := filepath.Join(t.TempDir(), "report.xml")
 	coverageManifest, err := ioutil.TempFile(tempDir, "coverage-manifest-*.txt")
 	if err != nil {
 		t.Fatal(err)
@@ -74,10 +69,12 @@ func Test(t *testing.T) {
 	// https://docs.bazel.build/versions/3.1.0/test-encyclopedia.html#initial-conditions.
 	cmd.Env = append(os.Environ(), append(runfilesEnv,
 		"XML_OUTPUT_FILE="+reportName,
+		"TEST_TARGET=//tests:test_test",
 		"TESTBRIDGE_TEST_ONLY=(not (tag skip))",
 		"COVERAGE=1",
 		"COVERAGE_MANIFEST="+coverageManifest.Name(),
-		"COVERAGE_DIR="+coverageDir)...)
+		"COVERAGE_DIR="+coverageDir,
+		"ELISP_TEST_BRANCH_COVERAGE=1")...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = workspace
@@ -124,12 +121,17 @@ func Test(t *testing.T) {
 		Properties []property `xml:"property"`
 	}
 	type testCase struct {
-		Name      string    `xml:"name,attr"`
-		ClassName string    `xml:"classname,attr"`
-		Time      float64   `xml:"time,attr"`
-		Skipped   *struct{} `xml:"skipped"`
-		Error     message   `xml:"error"`
-		Failure   message   `xml:"failure"`
+		Name       string   `xml:"name,attr"`
+		ClassName  string   `xml:"classname,attr"`
+		File       string   `xml:"file,attr"`
+		Line       int      `xml:"line,attr"`
+		Time       float64  `xml:"time,attr"`
+		Assertions int      `xml:"assertions,attr"`
+		Skipped    *message `xml:"skipped"`
+		Error      message  `xml:"error"`
+		Failure    message  `xml:"failure"`
+		SystemOut  string   `xml:"system-out"`
+		SystemErr  string   `xml:"system-err"`
 	}
 	type report struct {
 		XMLName    xml.Name
@@ -138,6 +140,7 @@ func Test(t *testing.T) {
 		Errors     int        `xml:"errors,attr"`
 		Failures   int        `xml:"failures,attr"`
 		Skipped    int        `xml:"skipped,attr"`
+		Warnings   int        `xml:"warnings,attr"`
 		Time       float64    `xml:"time,attr"`
 		Timestamp  timestamp  `xml:"timestamp,attr"`
 		Properties properties `xml:"properties"`
@@ -147,16 +150,43 @@ func Test(t *testing.T) {
 	if err := xml.Unmarshal(b, &gotReport); err != nil {
 		t.Error(err)
 	}
-	var emacsVersion string
+	gotProperties := make(map[string]string)
 	for _, prop := range gotReport.Properties.Properties {
-		if prop.Name == "emacs-version" {
-			emacsVersion = prop.Value
-			break
-		}
+		gotProperties[prop.Name] = prop.Value
 	}
+	emacsVersion := gotProperties["emacs-version"]
 	if !regexp.MustCompile(`^\d+\.\d+`).MatchString(emacsVersion) {
 		t.Errorf("invalid Emacs version %q", emacsVersion)
 	}
+	gcCount := gotProperties["gc-count"]
+	if !regexp.MustCompile(`^\d+$`).MatchString(gcCount) {
+		t.Errorf("invalid GC count %q", gcCount)
+	}
+	gcTime := gotProperties["gc-time"]
+	if !regexp.MustCompile(`^\d+\.\d+$`).MatchString(gcTime) {
+		t.Errorf("invalid GC time %q", gcTime)
+	}
+	loadPathLength := gotProperties["load-path-length"]
+	if !regexp.MustCompile(`^[1-9]\d*$`).MatchString(loadPathLength) {
+		t.Errorf("invalid load path length %q", loadPathLength)
+	}
+	systemConfiguration := gotProperties["system-configuration"]
+	if systemConfiguration == "" {
+		t.Error("empty system configuration")
+	}
+	orderingSeed := gotProperties["ordering-seed"]
+	if !regexp.MustCompile(`^\d+$`).MatchString(orderingSeed) {
+		t.Errorf("invalid ordering seed %q", orderingSeed)
+	}
+	setupTime := gotProperties["setup-time"]
+	if !regexp.MustCompile(`^\d+\.\d+$`).MatchString(setupTime) {
+		t.Errorf("invalid setup time %q", setupTime)
+	}
+	systemType := gotProperties["system-type"]
+	if systemType == "" {
+		t.Error("empty system type")
+	}
+	lines := deftestLines(t, filepath.Join(workspace, "tests/test.el"))
 	// Margin for time comparisons.  One hour is excessive, but we only
 	// care about catching obvious bugs here.
 	const margin = time.Hour
@@ -164,47 +194,66 @@ func Test(t *testing.T) {
 	// time is nonnegative and below the margin.
 	wantElapsed := margin.Seconds() / 2
 	wantReport := report{
-		XMLName:    xml.Name{"", "testsuite"},
-		Name:       "ERT",
-		Tests:      12,
-		Errors:     0,
-		Failures:   7,
-		Skipped:    1,
-		Time:       wantElapsed,
-		Timestamp:  timestamp(time.Now()),
-		Properties: properties{[]property{{"emacs-version", emacsVersion}}},
+		XMLName:   xml.Name{"", "testsuite"},
+		Name:      "//tests:test_test",
+		Tests:     13,
+		Errors:    0,
+		Failures:  7,
+		Skipped:   1,
+		Time:      wantElapsed,
+		Timestamp: timestamp(time.Now()),
+		Properties: properties{[]property{
+			{"emacs-version", emacsVersion},
+			{"gc-count", gcCount},
+			{"gc-time", gcTime},
+			{"load-path-length", loadPathLength},
+			{"ordering-seed", orderingSeed},
+			{"setup-time", setupTime},
+			{"system-configuration", systemConfiguration},
+			{"system-type", systemType},
+		}},
 		TestCases: []testCase{
 			{
-				Name: "abort", ClassName: "ERT", Time: wantElapsed,
+				Name: "abort", ClassName: "tests.test", File: "tests/test.el", Line: lines["abort"], Time: wantElapsed,
 				Failure: message{Message: `peculiar error: "Boo"`, Type: `undefined-error-symbol`, Description: "something"},
 			},
-			{Name: "command-line", ClassName: "ERT", Time: wantElapsed},
-			{Name: "coverage", ClassName: "ERT", Time: wantElapsed},
+			{Name: "command-line", ClassName: "tests.test", File: "tests/test.el", Line: lines["command-line"], Time: wantElapsed, Assertions: 1},
 			{
-				Name: "error", ClassName: "ERT", Time: wantElapsed,
+				Name: "coverage", ClassName: "tests.test", File: "tests/test.el", Line: lines["coverage"], Time: wantElapsed,
+				SystemErr: "Bar\nBar\n1\n2\nnil\n(nil . q) (a . #0) [nil q]\n",
+			},
+			{
+				Name: "error", ClassName: "tests.test", File: "tests/test.el", Line: lines["error"], Time: wantElapsed,
 				Failure: message{Message: `Boo`, Type: `error`, Description: "something"},
 			},
 			{
-				Name: "ert-fail", ClassName: "ERT", Time: wantElapsed,
+				Name: "ert-fail", ClassName: "tests.test", File: "tests/test.el", Line: lines["ert-fail"], Time: wantElapsed, Assertions: 1,
 				Failure: message{Message: `Test failed: "Fail!"`, Type: `ert-test-failed`, Description: "something"},
 			},
-			{Name: "expect-failure", ClassName: "ERT", Time: wantElapsed},
+			{Name: "expect-failure", ClassName: "tests.test", File: "tests/test.el", Line: lines["expect-failure"], Time: wantElapsed, Assertions: 1},
 			{
-				Name: "expect-failure-but-pass", ClassName: "ERT", Time: wantElapsed,
+				Name: "expect-failure-but-pass", ClassName: "tests.test", File: "tests/test.el", Line: lines["expect-failure-but-pass"], Time: wantElapsed, Assertions: 1,
 				Failure: message{Message: `Test passed unexpectedly`, Type: `error`},
 			},
 			{
-				Name: "fail", ClassName: "ERT", Time: wantElapsed,
+				Name: "fail", ClassName: "tests.test", File: "tests/test.el", Line: lines["fail"], Time: wantElapsed, Assertions: 1,
 				Failure: message{Message: `Test failed: ((should (= 0 1)) :form (= 0 1) :value nil)`, Type: `ert-test-failed`, Description: "something"},
 			},
-			{Name: "pass", ClassName: "ERT", Time: wantElapsed},
-			{Name: "skip", ClassName: "ERT", Time: wantElapsed, Skipped: new(struct{})},
 			{
-				Name: "special-chars", ClassName: "ERT", Time: wantElapsed,
-				Failure: message{Message: "Error äöü \t \n \\u0000 \uFFFD \\uFFFE \\uFFFF 𝑨 <![CDATA[ ]]> & < > \" ' <!-- -->", Type: `error`, Description: "something"},
+				Name: "output", ClassName: "tests.test", File: "tests/test.el", Line: lines["output"], Time: wantElapsed,
+				SystemOut: "Output", SystemErr: "Message\n",
+			},
+			{Name: "pass", ClassName: "tests.test", File: "tests/test.el", Line: lines["pass"], Time: wantElapsed, Assertions: 1},
+			{
+				Name: "skip", ClassName: "tests.test", File: "tests/test.el", Line: lines["skip"], Time: wantElapsed, Assertions: 1,
+				Skipped: &message{Message: `Test skipped: ((skip-unless (= 1 2)) :form (= 1 2) :value nil)`},
 			},
 			{
-				Name: "throw", ClassName: "ERT", Time: wantElapsed,
+				Name: "special-chars", ClassName: "tests.test", File: "tests/test.el", Line: lines["special-chars"], Time: wantElapsed,
+				Failure: message{Message: "Error äöü \t   \\u0000 \uFFFD \\uFFFE \\uFFFF 𝑨 <![CDATA[ ]]> & < > \" ' <!-- -->", Type: `error`, Description: "something"},
+			},
+			{
+				Name: "throw", ClassName: "tests.test", File: "tests/test.el", Line: lines["throw"], Time: wantElapsed,
 				Failure: message{Message: `No catch for tag: unknown-tag, hi`, Type: `no-catch`, Description: "something"},
 			},
 		},
@@ -238,10 +287,12 @@ func Test(t *testing.T) {
 FN:27,tests/test-function
 FN:39,foo@cl-flet@1
 FN:41,foo@cl-flet@3
+FN:57,tests/uncalled-function
 FNDA:1,tests/test-function
 FNDA:0,foo@cl-flet@1
 FNDA:0,foo@cl-flet@3
-FNF:3
+FNDA:0,tests/uncalled-function
+FNF:4
 FNH:1
 BRDA:30,0,0,0
 BRDA:30,0,1,1
@@ -290,8 +341,9 @@ DA:51,0
 DA:52,1
 DA:53,1
 DA:55,1
+DA:59,0
 LH:18
-LF:23
+LF:24
 end_of_record
 `
 	if strings.HasPrefix(emacsVersion, "26.") {
@@ -303,6 +355,2843 @@ end_of_record
 	}
 }
 
+func TestFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		want   []string
+	}{
+		{`"^pass$"`, []string{"pass"}},
+		{`(member pass skip)`, []string{"pass", "skip"}},
+		{`"^no-such-test$"`, nil},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY="+tc.filter)
+			if err != nil {
+				t.Errorf("test binary failed: %s", err)
+			}
+			if diff := cmp.Diff(report.names(), tc.want); diff != "" {
+				t.Error("test cases (-got +want):\n", diff)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	for _, tc := range []struct {
+		filter, tags string
+		want         []string
+	}{
+		{"t", "+integration", []string{"tagged-integration", "tagged-slow-integration"}},
+		{"t", "integration -slow", []string{"tagged-integration"}},
+		{"t", "+slow", []string{"tagged-slow-integration"}},
+		{"(member tagged-slow-integration)", "+integration", []string{"tagged-slow-integration"}},
+		{"t", "+no-such-tag", nil},
+	} {
+		t.Run(tc.tags, func(t *testing.T) {
+			report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY="+tc.filter, "ELISP_TEST_TAGS="+tc.tags)
+			if err != nil {
+				t.Errorf("test binary failed: %s", err)
+			}
+			if diff := cmp.Diff(report.names(), tc.want); diff != "" {
+				t.Error("selected tests (-got +want):\n", diff)
+			}
+		})
+	}
+}
+
+func TestSelector(t *testing.T) {
+	for _, tc := range []struct {
+		selector string
+		want     []string
+	}{
+		{"`(and (tag integration) (not (tag slow)))", []string{"tagged-integration"}},
+		{"(list 'tag 'slow)", []string{"tagged-slow-integration"}},
+		{`(lambda (test) (memq 'integration (ert-test-tags test)))`, []string{"tagged-integration", "tagged-slow-integration"}},
+		{"'(tag no-such-tag)", nil},
+	} {
+		t.Run(tc.selector, func(t *testing.T) {
+			report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=t", "ELISP_TEST_SELECTOR="+tc.selector)
+			if err != nil {
+				t.Errorf("test binary failed: %s", err)
+			}
+			if diff := cmp.Diff(report.names(), tc.want); diff != "" {
+				t.Error("selected tests (-got +want):\n", diff)
+			}
+		})
+	}
+	for _, selector := range []string{"(list 'tag", "'(tag integration) extra", "'(no-such-selector)"} {
+		t.Run(selector, func(t *testing.T) {
+			cmd := testCommand(t, "ELISP_TEST_SELECTOR="+selector)
+			out, err := cmd.CombinedOutput()
+			if err == nil {
+				t.Fatalf("test binary succeeded unexpectedly:\n%s", out)
+			}
+			if _, ok := err.(*exec.ExitError); !ok {
+				t.Fatal(err)
+			}
+			want := "Invalid ELISP_TEST_SELECTOR (" + selector + ")"
+			if !strings.Contains(string(out), want) {
+				t.Errorf("output doesn’t contain %q:\n%s", want, out)
+			}
+		})
+	}
+}
+
+func TestInvalidNumber(t *testing.T) {
+	for _, tc := range []struct{ name, value string }{
+		{"ELISP_TEST_RETRIES", "abc"},
+		{"ELISP_TEST_JOBS", "0"},
+		{"ELISP_TEST_TIMEOUT", "-1"},
+		{"ELISP_TEST_SLOW_COUNT", "1.5"},
+	} {
+		t.Run(tc.name+"="+tc.value, func(t *testing.T) {
+			cmd := testCommand(t, "TESTBRIDGE_TEST_ONLY=pass", tc.name+"="+tc.value)
+			out, err := cmd.CombinedOutput()
+			if err == nil {
+				t.Fatalf("test binary succeeded unexpectedly:\n%s", out)
+			}
+			if _, ok := err.(*exec.ExitError); !ok {
+				t.Fatal(err)
+			}
+			want := "Invalid " + tc.name + " (" + tc.value + ")"
+			if !strings.Contains(string(out), want) {
+				t.Errorf("output doesn’t contain %q:\n%s", want, out)
+			}
+		})
+	}
+}
+
+func TestSkipUnless(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member graphic network)"
+	for _, tc := range []struct {
+		network     string
+		wantSkipped []string
+	}{
+		{"", []string{"graphic", "network"}},
+		{"0", []string{"graphic", "network"}},
+		{"1", []string{"graphic"}},
+	} {
+		t.Run("network="+tc.network, func(t *testing.T) {
+			report, _, err := runTests(t, filter, "ELISP_TEST_NETWORK="+tc.network)
+			if err != nil {
+				t.Errorf("test binary failed: %s", err)
+			}
+			var skipped []string
+			for _, c := range report.TestCases {
+				if c.Skipped != nil {
+					skipped = append(skipped, c.Name)
+				}
+			}
+			sort.Strings(skipped)
+			if diff := cmp.Diff(skipped, tc.wantSkipped); diff != "" {
+				t.Error("skipped tests (-got +want):\n", diff)
+			}
+			if report.Tests != 2 || report.Failures != 0 || report.Errors != 0 {
+				t.Errorf("got %d tests, %d failures, %d errors; want 2, 0, 0", report.Tests, report.Failures, report.Errors)
+			}
+		})
+	}
+}
+
+func TestSetupTime(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member pass)", "TESTS_SLOW_LOAD=1")
+	if err != nil {
+		t.Errorf("test binary failed: %s", err)
+	}
+	// Loading the test file sleeps for two seconds, which should only count
+	// towards the setup time, not towards the test times.
+	setupTime, err := strconv.ParseFloat(report.property("setup-time"), 64)
+	if err != nil {
+		t.Error(err)
+	}
+	if setupTime < 2 {
+		t.Errorf("got setup time %g, want at least 2 seconds", setupTime)
+	}
+	if report.Time >= 1 {
+		t.Errorf("got suite time %g, want less than 1 second", report.Time)
+	}
+	for _, c := range report.TestCases {
+		if c.Time >= 1 {
+			t.Errorf("test %s: got time %g, want less than 1 second", c.Name, c.Time)
+		}
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	for _, env := range []string{"TEST_UNDECLARED_OUTPUTS_DIR", "ELISP_TEST_OUTPUT_DIR"} {
+		t.Run(env, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "outputs")
+			report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member artifact)",
+				"TEST_UNDECLARED_OUTPUTS_DIR=", env+"="+dir)
+			checkExitError(t, err)
+			if _, err := os.Stat(filepath.Join(dir, "artifact", "file.txt")); err != nil {
+				t.Errorf("artifact not written: %s", err)
+			}
+			if len(report.TestCases) != 1 {
+				t.Fatalf("got %d test cases, want exactly one", len(report.TestCases))
+			}
+			if got, want := report.TestCases[0].Failure.Description, "artifact/file.txt"; !strings.Contains(got, want) {
+				t.Errorf("failure description %q doesn’t mention artifact %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReportEnv(t *testing.T) {
+	for _, tc := range []struct {
+		values    string
+		wantPlain string
+	}{
+		{"", "<redacted>"},
+		{"1", "plain value"},
+	} {
+		t.Run("values="+tc.values, func(t *testing.T) {
+			report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=pass",
+				"ELISP_TEST_REPORT_ENV=TESTS_REPORT_*",
+				"ELISP_TEST_REPORT_ENV_VALUES="+tc.values,
+				"TESTS_REPORT_PLAIN=plain value",
+				"TESTS_REPORT_API_TOKEN=secret value",
+				"TESTS_REPORT_SSH_KEYS=secret value",
+				"TESTS_REPORT_APIKEY=secret value",
+				"TESTS_REPORT_GITHUBTOKEN=secret value",
+				"TESTS_REPORT_MYPASSWORD=secret value",
+				"TESTS_REPORT_DBPASSWD=secret value",
+				"TESTS_REPORT_MONKEY_PATH=plain value",
+				"TESTS_REPORT_TOKENIZER_DIR=plain value")
+			if err != nil {
+				t.Errorf("test binary failed: %s", err)
+			}
+			// Harmless words that merely contain one of the sensitive words
+			// aren’t secrets.
+			for _, name := range []string{"env:TESTS_REPORT_PLAIN", "env:TESTS_REPORT_MONKEY_PATH", "env:TESTS_REPORT_TOKENIZER_DIR"} {
+				if got := report.property(name); got != tc.wantPlain {
+					t.Errorf("property %s: got %q, want %q", name, got, tc.wantPlain)
+				}
+			}
+			// Variables that look like they contain secrets must never show
+			// up in the report, even if they match the pattern.
+			for _, p := range report.Properties {
+				if strings.Contains(p.Value, "secret") {
+					t.Errorf("report contains sensitive property %s=%q", p.Name, p.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestProfile(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "emacs.profile")
+	_, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member pass command-line)",
+		"ELISP_TEST_PROFILE=cpu", "ELISP_TEST_PROFILE_FILE="+profile)
+	if err != nil {
+		t.Errorf("test binary failed: %s", err)
+	}
+	for _, file := range []string{profile, profile + ".txt"} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.Size() == 0 {
+			t.Errorf("profile file %s is empty", file)
+		}
+	}
+}
+
+func TestSharding(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(not (tag skip))"
+	report, _, err := runTests(t, filter)
+	checkExitError(t, err)
+	want := report.names()
+	if len(want) == 0 {
+		t.Fatal("no tests found")
+	}
+	statusFile := filepath.Join(t.TempDir(), "shard-status")
+	var got []string
+	for _, index := range []string{"0", "1"} {
+		report, _, err := runTests(t, filter,
+			"TEST_TOTAL_SHARDS=2", "TEST_SHARD_INDEX="+index,
+			"TEST_SHARD_STATUS_FILE="+statusFile)
+		checkExitError(t, err)
+		got = append(got, report.names()...)
+	}
+	if _, err := os.Stat(statusFile); err != nil {
+		t.Errorf("shard status file not created: %s", err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("union of sharded test cases (-got +want):\n", diff)
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(not (tag skip))"
+	var executed [2][]string
+	for i, seed := range []string{"123", "456"} {
+		report, log, err := runTests(t, filter, "TEST_RANDOMIZE_ORDERING_SEED="+seed)
+		checkExitError(t, err)
+		cases := report.names()
+		if !strings.Contains(log, "TEST_RANDOMIZE_ORDERING_SEED="+seed) {
+			t.Errorf("seed %s not logged", seed)
+		}
+		if !sort.StringsAreSorted(cases) {
+			t.Errorf("test cases in report not sorted: %q", cases)
+		}
+		for _, m := range runningTest.FindAllStringSubmatch(log, -1) {
+			executed[i] = append(executed[i], m[1])
+		}
+	}
+	if cmp.Equal(executed[0], executed[1]) {
+		t.Errorf("different seeds resulted in the same execution order %q", executed[0])
+	}
+	sorted := func(s []string) []string {
+		r := append([]string(nil), s...)
+		sort.Strings(r)
+		return r
+	}
+	if diff := cmp.Diff(sorted(executed[0]), sorted(executed[1])); diff != "" {
+		t.Error("different seeds resulted in different sets of tests (-first +second):\n", diff)
+	}
+}
+
+var runningTest = regexp.MustCompile(`(?m)^Running test (\S+)$`)
+
+func TestExpectedFailure(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member expect-failure expect-failure-but-pass)")
+	checkExitError(t, err)
+	want := shortReport{
+		Tests:    2,
+		Failures: 1,
+		TestCases: []shortTestCase{
+			{Name: "expect-failure", Assertions: 1},
+			{Name: "expect-failure-but-pass", Assertions: 1, Failure: shortMessage{Message: "Test passed unexpectedly", Type: "error"}},
+		},
+	}
+	if diff := cmp.Diff(report, want, cmpopts.IgnoreFields(shortReport{}, "Time", "Timestamp", "Properties"), cmpopts.IgnoreFields(shortTestCase{}, "Time")); diff != "" {
+		t.Error("XML test report (-got +want):\n", diff)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	report, log, err := runTests(t,
+		"TESTBRIDGE_TEST_ONLY=(member error fail)",
+		"ELISP_TEST_FAIL_FAST=1",
+		"ELISP_TEST_RETRIES=1")
+	checkExitError(t, err)
+	// The test order is random, so find out which test ran first.
+	var executed []string
+	for _, m := range runningTest.FindAllStringSubmatch(log, -1) {
+		executed = append(executed, m[1])
+	}
+	if len(executed) != 1 {
+		t.Fatalf("got executed tests %q, want exactly one", executed)
+	}
+	if report.Tests != 2 || report.Failures != 1 || report.Skipped != 1 {
+		t.Errorf("got %d tests, %d failures, %d skipped; want 2, 1, 1", report.Tests, report.Failures, report.Skipped)
+	}
+	for _, c := range report.TestCases {
+		// The first test should be retried once before stopping.
+		ran := c.Name == executed[0]
+		if ran && (c.Skipped != nil || c.Attempts != 2) {
+			t.Errorf("test %s: got skipped %v and %d attempts, want a failure after 2 attempts", c.Name, c.Skipped, c.Attempts)
+		}
+		if !ran && c.Skipped == nil {
+			t.Errorf("test %s should have been skipped", c.Name)
+		}
+	}
+}
+
+func TestMaxFailures(t *testing.T) {
+	report, log, err := runTests(t,
+		"TESTBRIDGE_TEST_ONLY=(member max-failures-1 max-failures-2 max-failures-3)",
+		"ELISP_TEST_MAX_FAILURES=2")
+	checkExitError(t, err)
+	if err == nil {
+		t.Error("test binary succeeded, want failure")
+	}
+	var executed []string
+	for _, m := range runningTest.FindAllStringSubmatch(log, -1) {
+		executed = append(executed, m[1])
+	}
+	if len(executed) != 2 {
+		t.Fatalf("got executed tests %q, want exactly two", executed)
+	}
+	if report.Tests != 3 || report.Failures != 2 || report.Skipped != 1 {
+		t.Errorf("got %d tests, %d failures, %d skipped; want 3, 2, 1", report.Tests, report.Failures, report.Skipped)
+	}
+	for _, c := range report.TestCases {
+		ran := containsString(executed, c.Name)
+		if ran && c.Failure == (shortMessage{}) {
+			t.Errorf("test %s: got no failure", c.Name)
+		}
+		if !ran && (c.Skipped == nil || !strings.Contains(c.Skipped.Message, "after 2 unexpected results")) {
+			t.Errorf("test %s: got skipped %+v, want a message about the failure limit", c.Name, c.Skipped)
+		}
+	}
+}
+
+func TestParallel(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member parallel-1 parallel-2 serial pass fail)"
+	run := func(env ...string) (shortReport, time.Duration) {
+		start := time.Now()
+		report, _, err := runTests(t, append([]string{filter}, env...)...)
+		checkExitError(t, err)
+		return report, time.Since(start)
+	}
+	want, serialTime := run()
+	got, parallelTime := run("ELISP_TEST_JOBS=2")
+	if parallelTime >= serialTime {
+		t.Errorf("parallel execution took %s, serial execution only %s", parallelTime, serialTime)
+	}
+	if diff := cmp.Diff(got, want, cmpopts.IgnoreFields(shortReport{}, "Time", "Timestamp", "Properties"), cmpopts.IgnoreFields(shortTestCase{}, "Time")); diff != "" {
+		t.Error("XML test report (-parallel +serial):\n", diff)
+	}
+	if names := got.names(); !cmp.Equal(names, []string{"fail", "parallel-1", "parallel-2", "pass", "serial"}) {
+		t.Errorf("got test cases %q, want every test exactly once", names)
+	}
+}
+
+func TestReproduce(t *testing.T) {
+	report, log, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member pass fail)", "TEST_RANDOMIZE_ORDERING_SEED=789", "TEST_TARGET=//tests:test_test")
+	checkExitError(t, err)
+	const want = "To reproduce: bazel test --test_env=TEST_RANDOMIZE_ORDERING_SEED=789 //tests:test_test\n"
+	if !strings.Contains(log, want) {
+		t.Errorf("test log doesn’t contain reproduction line %q:\n%s", want, log)
+	}
+	if got := report.property("ordering-seed"); got != "789" {
+		t.Errorf("got ordering seed %q in report, want 789", got)
+	}
+}
+
+func TestSuiteName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{"default", []string{"TEST_TARGET="}, "ERT"},
+		{"target", []string{"TEST_TARGET=//tests:test_test"}, "//tests:test_test"},
+		{"custom", []string{"TEST_TARGET=//tests:test_test", "ELISP_TEST_SUITE_NAME=Custom suite"}, "Custom suite"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reportName := filepath.Join(t.TempDir(), "report.xml")
+			cmd := testCommand(t, append([]string{"TESTBRIDGE_TEST_ONLY=pass", "XML_OUTPUT_FILE=" + reportName}, tc.env...)...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(reportName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report struct {
+				Name string `xml:"name,attr"`
+			}
+			if err := xml.Unmarshal(b, &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Name != tc.want {
+				t.Errorf("got suite name %q, want %q", report.Name, tc.want)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	start := time.Now()
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=timeout", "ELISP_TEST_TIMEOUT=1")
+	checkExitError(t, err)
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("test binary took %s despite timeout", elapsed)
+	}
+	want := shortReport{
+		Tests:  1,
+		Errors: 1,
+		TestCases: []shortTestCase{
+			{Name: "timeout", Error: shortMessage{Message: "Test timed out: 1", Type: "timeout"}},
+		},
+	}
+	if diff := cmp.Diff(report, want, cmpopts.IgnoreFields(shortReport{}, "Time", "Timestamp", "Properties"), cmpopts.IgnoreFields(shortTestCase{}, "Time")); diff != "" {
+		t.Error("XML test report (-got +want):\n", diff)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member flaky error)", "ELISP_TEST_RETRIES=2")
+	checkExitError(t, err)
+	want := shortReport{
+		Tests:    2,
+		Failures: 1,
+		TestCases: []shortTestCase{
+			{Name: "error", Attempts: 3, Failure: shortMessage{Message: "Boo", Type: "error"}},
+			{Name: "flaky", Flaky: "true", Attempts: 2, Assertions: 1},
+		},
+	}
+	if diff := cmp.Diff(report, want, cmpopts.IgnoreFields(shortReport{}, "Time", "Timestamp", "Properties"), cmpopts.IgnoreFields(shortTestCase{}, "Time")); diff != "" {
+		t.Error("XML test report (-got +want):\n", diff)
+	}
+}
+
+func TestCoverageOutputFile(t *testing.T) {
+	coverageFile := filepath.Join(t.TempDir(), "coverage.dat")
+	_, _, err := runTests(t,
+		"TESTBRIDGE_TEST_ONLY=coverage",
+		"COVERAGE=1",
+		"COVERAGE_MANIFEST="+writeCoverageManifest(t),
+		"COVERAGE_DIR=",
+		"COVERAGE_OUTPUT_FILE="+coverageFile)
+	checkExitError(t, err)
+	b, err := ioutil.ReadFile(coverageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// See geninfo(1) for the coverage file format.
+	if !strings.HasPrefix(string(b), "SF:tests/test-lib.el\n") {
+		t.Errorf("coverage report doesn’t start with source file record:\n%s", b)
+	}
+	var covered, uncovered int
+	for _, m := range regexp.MustCompile(`(?m)^DA:\d+,(\d+)$`).FindAllStringSubmatch(string(b), -1) {
+		if m[1] == "0" {
+			uncovered++
+		} else {
+			covered++
+		}
+	}
+	if covered == 0 || uncovered == 0 {
+		t.Errorf("got %d covered and %d uncovered lines, want at least one of each:\n%s", covered, uncovered, b)
+	}
+}
+
+func TestKilled(t *testing.T) {
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := testCommand(t,
+		"XML_OUTPUT_FILE="+reportName,
+		"TESTBRIDGE_TEST_ONLY=(member pass timeout)")
+	// Put the test binary and Emacs into their own process group so that we
+	// can kill both.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Wait until the test runner has started the long-running test, then
+	// kill it in the middle of the test suite.
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		if scanner.Text() == "Running test timeout" {
+			break
+		}
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		t.Error(err)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Error("test binary succeeded unexpectedly")
+	}
+	b, err := ioutil.ReadFile(reportName)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Errorf("partial XML report file: %s\n%s", err, b)
+	}
+}
+
+func TestTerminated(t *testing.T) {
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := testCommand(t,
+		"XML_OUTPUT_FILE="+reportName,
+		"TESTBRIDGE_TEST_ONLY=(member pass timeout)")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Wait until the test runner has started the long-running test, then
+	// terminate the test binary like Bazel does when a test times out.  The
+	// test binary should forward the signal to Emacs.
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		if scanner.Text() == "Running test timeout" {
+			break
+		}
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Error(err)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Error("test binary succeeded unexpectedly")
+	}
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatalf("partial XML report file: %s\n%s", err, b)
+	}
+	if report.Tests != 2 || len(report.TestCases) != 2 {
+		t.Errorf("got %d tests and %d test cases, want 2", report.Tests, len(report.TestCases))
+	}
+	for _, c := range report.TestCases {
+		if c.Name == "timeout" && c.Error.Type != "timeout" {
+			t.Errorf("test %s: got error type %q, want timeout", c.Name, c.Error.Type)
+		}
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member temp-file-1 temp-file-2)"
+	t.Run("clean", func(t *testing.T) {
+		tempDir := t.TempDir()
+		report, _, err := runTests(t, filter, "TEST_TMPDIR="+tempDir)
+		if err != nil {
+			t.Errorf("test binary failed: %s", err)
+		}
+		if report.Tests != 2 || report.Failures != 0 || report.Errors != 0 {
+			t.Errorf("got %d tests, %d failures, and %d errors; want two passing tests",
+				report.Tests, report.Failures, report.Errors)
+		}
+		// The assertion in the helper function counts towards each test.
+		for _, c := range report.TestCases {
+			if c.Assertions != 1 {
+				t.Errorf("test %s: got %d assertions, want 1", c.Name, c.Assertions)
+			}
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(tempDir, "ert"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			t.Errorf("temporary directory %s not removed", e.Name())
+		}
+	})
+	t.Run("keep", func(t *testing.T) {
+		tempDir := t.TempDir()
+		_, _, err := runTests(t, filter, "TEST_TMPDIR="+tempDir,
+			"TESTS_FAIL_TEMP=1", "ELISP_TEST_KEEP_TEMP_DIRS=1")
+		checkExitError(t, err)
+		for _, name := range []string{"temp-file-1", "temp-file-2"} {
+			if _, err := os.Stat(filepath.Join(tempDir, "ert", name, "file.txt")); err != nil {
+				t.Errorf("temporary directory of test %s not kept: %s", name, err)
+			}
+		}
+	})
+}
+
+func TestProgress(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cmd := testCommand(t,
+		"TESTBRIDGE_TEST_ONLY=(member pass timeout)",
+		"ELISP_TEST_TIMEOUT=3",
+		// The first entry in ExtraFiles becomes file descriptor 3.
+		"ELISP_TEST_PROGRESS_FD=3")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Close our copy of the write end so that reading stops once the
+	// test binary exits.
+	w.Close()
+	type event struct {
+		Event    string  `json:"event"`
+		Test     string  `json:"test"`
+		Status   string  `json:"status"`
+		Duration float64 `json:"duration"`
+	}
+	var events []event
+	var timeoutStarted time.Time
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Errorf("invalid progress event %q: %s", scanner.Text(), err)
+			continue
+		}
+		if e.Event == "test-start" && e.Test == "timeout" {
+			timeoutStarted = time.Now()
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Error(err)
+	}
+	finished := time.Now()
+	checkExitError(t, cmd.Wait())
+	// The events have to arrive while the tests are running, not only at
+	// the end.
+	if timeoutStarted.IsZero() {
+		t.Error("no test-start event for test timeout")
+	} else if elapsed := finished.Sub(timeoutStarted); elapsed < 2*time.Second {
+		t.Errorf("test-start event for test timeout arrived only %s before the end", elapsed)
+	}
+	ended := make(map[string]string)
+	for _, e := range events {
+		if e.Event == "test-end" {
+			if _, dup := ended[e.Test]; dup {
+				t.Errorf("duplicate test-end event for test %s", e.Test)
+			}
+			ended[e.Test] = e.Status
+		}
+	}
+	if diff := cmp.Diff(ended, map[string]string{"pass": "passed", "timeout": "error"}); diff != "" {
+		t.Error("test-end events (-got +want):\n", diff)
+	}
+}
+
+func TestStreamFile(t *testing.T) {
+	streamName := filepath.Join(t.TempDir(), "stream.xml")
+	cmd := testCommand(t,
+		"TESTBRIDGE_TEST_ONLY=(member pass slow-1 slow-2)",
+		"ELISP_TEST_STREAM_FILE="+streamName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	// Poll the stream file while the tests are running.  Each version of
+	// the file has to be a complete report of the tests that have
+	// finished so far.
+	var partial []string
+	var runErr error
+loop:
+	for {
+		select {
+		case runErr = <-done:
+			break loop
+		case <-time.After(50 * time.Millisecond):
+		}
+		b, err := ioutil.ReadFile(streamName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report shortReport
+		if err := xml.Unmarshal(b, &report); err != nil {
+			t.Fatalf("invalid partial report %q: %s", b, err)
+		}
+		if report.Tests != len(report.TestCases) {
+			t.Errorf("partial report claims %d tests, but contains %d test cases", report.Tests, len(report.TestCases))
+		}
+		if n := len(report.TestCases); n > 0 && n < 3 {
+			partial = report.names()
+		}
+	}
+	checkExitError(t, runErr)
+	if len(partial) == 0 {
+		t.Error("no partial report with completed tests while the tests were running")
+	}
+	for _, name := range partial {
+		if !containsString([]string{"pass", "slow-1", "slow-2"}, name) {
+			t.Errorf("unexpected test %s in partial report", name)
+		}
+	}
+	b, err := ioutil.ReadFile(streamName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"pass", "slow-1", "slow-2"}, report.names()); diff != "" {
+		t.Error("final report (-want +got):\n", diff)
+	}
+	if report.property("ordering-seed") == "" {
+		t.Error("final report has no properties")
+	}
+}
+
+func TestCheckGlobals(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass mutate-load-path)"
+	for _, mode := range []string{"warn", "strict"} {
+		t.Run(mode, func(t *testing.T) {
+			report, _, err := runTests(t, filter, "ELISP_TEST_CHECK_GLOBALS="+mode)
+			checkExitError(t, err)
+			if len(report.TestCases) != 2 {
+				t.Fatalf("got %d test cases, want 2", len(report.TestCases))
+			}
+			for _, c := range report.TestCases {
+				warned := strings.Contains(c.SystemErr, "modified load-path")
+				failed := c.Failure.Type == "elisp/ert/global-state"
+				switch c.Name {
+				case "pass":
+					if warned || failed {
+						t.Errorf("test %s: unexpected modification reported: %+v", c.Name, c)
+					}
+				case "mutate-load-path":
+					if !warned {
+						t.Errorf("test %s: modification of load-path not reported in %q", c.Name, c.SystemErr)
+					}
+					if failed != (mode == "strict") {
+						t.Errorf("test %s: got failure %+v in %s mode", c.Name, c.Failure, mode)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFailOnMessage(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member pass fail-on-message)", "ELISP_TEST_FAIL_ON_MESSAGE=connection reset")
+	checkExitError(t, err)
+	if len(report.TestCases) != 2 {
+		t.Fatalf("got %d test cases, want 2", len(report.TestCases))
+	}
+	for _, c := range report.TestCases {
+		failed := c.Failure.Type == "elisp/ert/matching-message"
+		switch c.Name {
+		case "pass":
+			if failed {
+				t.Errorf("test %s: unexpected failure %+v", c.Name, c.Failure)
+			}
+		case "fail-on-message":
+			// The assertion passes, but the warning still fails the test.
+			if c.Assertions != 1 {
+				t.Errorf("test %s: got %d assertions, want 1", c.Name, c.Assertions)
+			}
+			if !failed || !strings.Contains(c.Failure.Message, "Warning: connection reset by peer") {
+				t.Errorf("test %s: got failure %+v, want one that mentions the warning", c.Name, c.Failure)
+			}
+		}
+	}
+}
+
+func TestStrictShouldError(t *testing.T) {
+	for _, tc := range []struct {
+		strict     string
+		wantFailed []string
+	}{
+		{"", nil},
+		{"1", []string{"should-error-broad"}},
+	} {
+		t.Run("strict="+tc.strict, func(t *testing.T) {
+			report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member should-error-typed should-error-broad)", "ELISP_TEST_STRICT_SHOULD_ERROR="+tc.strict)
+			checkExitError(t, err)
+			if len(report.TestCases) != 2 {
+				t.Fatalf("got %d test cases, want 2", len(report.TestCases))
+			}
+			var failed []string
+			for _, c := range report.TestCases {
+				if c.Failure == (shortMessage{}) {
+					continue
+				}
+				failed = append(failed, c.Name)
+				// The failure should name both conditions.
+				const want = "caught ‘wrong-type-argument’, but expected ‘error’"
+				if !strings.Contains(c.Failure.Description, want) {
+					t.Errorf("test %s: failure description %q doesn’t contain %q", c.Name, c.Failure.Description, want)
+				}
+			}
+			if diff := cmp.Diff(tc.wantFailed, failed); diff != "" {
+				t.Errorf("failed tests: -want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDurationSamples(t *testing.T) {
+	summaryName := filepath.Join(t.TempDir(), "summary.json")
+	report, _, err := runTests(t,
+		"TESTBRIDGE_TEST_ONLY=pass",
+		"ELISP_TEST_DURATION_SAMPLES=3",
+		"ELISP_TEST_SUMMARY_FILE="+summaryName)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(report.TestCases) != 1 {
+		t.Fatalf("got %d test cases, want one", len(report.TestCases))
+	}
+	// The time attribute still contains a single duration; the samples go
+	// into a property.
+	c := report.TestCases[0]
+	var samples []string
+	for _, p := range c.Properties {
+		if p.Name == "duration-samples" {
+			samples = strings.Fields(p.Value)
+		}
+	}
+	if len(samples) != 3 {
+		t.Errorf("test %s: got duration samples %q, want three", c.Name, samples)
+	}
+	for _, sample := range samples {
+		if d, err := strconv.ParseFloat(sample, 64); err != nil || d < 0 {
+			t.Errorf("test %s: invalid duration sample %q", c.Name, sample)
+		}
+	}
+	b, err := ioutil.ReadFile(summaryName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary struct {
+		Samples []struct {
+			Name      string    `json:"name"`
+			Durations []float64 `json:"durations"`
+		} `json:"samples"`
+	}
+	if err := json.Unmarshal(b, &summary); err != nil {
+		t.Fatalf("invalid JSON summary: %s\n%s", err, b)
+	}
+	if len(summary.Samples) != 1 {
+		t.Fatalf("got samples for %d tests, want one:\n%s", len(summary.Samples), b)
+	}
+	if got := summary.Samples[0]; got.Name != "pass" || len(got.Durations) != 3 {
+		t.Errorf("got samples %+v, want three samples for test pass", got)
+	}
+}
+
+func TestCleanAdvice(t *testing.T) {
+	// Try a few seeds until the leaking test runs first.
+	for _, seed := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		report, log, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member clean-advice-leak clean-advice-check)",
+			"ELISP_TEST_CLEAN_ADVICE=1", "TEST_RANDOMIZE_ORDERING_SEED="+seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Failures != 0 || report.Errors != 0 || report.Warnings != 1 {
+			t.Errorf("got %d failures, %d errors, and %d warnings; want 0, 0, 1", report.Failures, report.Errors, report.Warnings)
+		}
+		for _, c := range report.TestCases {
+			var warnings []string
+			for _, p := range c.Properties {
+				if p.Name == "warning" {
+					warnings = append(warnings, p.Value)
+				}
+			}
+			var want []string
+			if c.Name == "clean-advice-leak" {
+				want = []string{"Test left anonymous advice on function ‘tests/advised-function’"}
+			}
+			if diff := cmp.Diff(want, warnings); diff != "" {
+				t.Errorf("test %s: warnings: -want +got:\n%s", c.Name, diff)
+			}
+		}
+		var executed []string
+		for _, m := range runningTest.FindAllStringSubmatch(log, -1) {
+			executed = append(executed, m[1])
+		}
+		if len(executed) == 2 && executed[0] == "clean-advice-leak" {
+			return
+		}
+	}
+	t.Error("the leaking test never ran first")
+}
+
+func TestMemoryUsage(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member memory-small memory-large)", "ELISP_TEST_MEMORY_USAGE=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := make(map[string]int64)
+	for _, c := range report.TestCases {
+		memory[c.Name] = c.Memory
+	}
+	small, large := memory["memory-small"], memory["memory-large"]
+	if small <= 0 || large <= 0 {
+		t.Fatalf("got memory usage %d and %d, want positive values", small, large)
+	}
+	// memory-large allocates a list of 100,000 conses, which take at least
+	// 1.6 MB.
+	if large-small < 1600000 {
+		t.Errorf("memory-large used %d bytes, memory-small %d; want a difference of at least 1.6 MB", large, small)
+	}
+}
+
+func TestGCPerTest(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass garbage-collection)"
+	for _, tc := range []struct {
+		perTest string
+		want    bool
+	}{
+		{"", false},
+		{"1", true},
+	} {
+		t.Run("per-test="+tc.perTest, func(t *testing.T) {
+			report, _, err := runTests(t, filter, "ELISP_TEST_GC_PER_TEST="+tc.perTest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The suite properties are always present.
+			if n, err := strconv.Atoi(report.property("gc-count")); err != nil || n < 3 {
+				t.Errorf("got suite GC count %q, want at least 3", report.property("gc-count"))
+			}
+			for _, c := range report.TestCases {
+				var count, elapsed string
+				for _, p := range c.Properties {
+					switch p.Name {
+					case "gc-count":
+						count = p.Value
+					case "gc-time":
+						elapsed = p.Value
+					}
+				}
+				if !tc.want {
+					if count != "" || elapsed != "" {
+						t.Errorf("test %s: got GC properties without ELISP_TEST_GC_PER_TEST", c.Name)
+					}
+					continue
+				}
+				if _, err := strconv.ParseFloat(elapsed, 64); err != nil {
+					t.Errorf("test %s: invalid GC time %q", c.Name, elapsed)
+				}
+				n, err := strconv.Atoi(count)
+				if err != nil {
+					t.Errorf("test %s: invalid GC count %q", c.Name, count)
+				} else if c.Name == "garbage-collection" && n < 3 {
+					t.Errorf("test %s: got GC count %d, want at least 3", c.Name, n)
+				}
+			}
+		})
+	}
+}
+
+func TestShouldWarn(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=(member pass should-warn)")
+	if err != nil {
+		t.Error(err)
+	}
+	// The warning doesn’t count as a failure or error.
+	if report.Failures != 0 || report.Errors != 0 {
+		t.Errorf("got %d failures and %d errors, want none", report.Failures, report.Errors)
+	}
+	if report.Warnings != 1 {
+		t.Errorf("got %d warnings, want one", report.Warnings)
+	}
+	for _, c := range report.TestCases {
+		if c.Failure != (shortMessage{}) || c.Error != (shortMessage{}) {
+			t.Errorf("test %s: got failure %+v and error %+v, want none", c.Name, c.Failure, c.Error)
+		}
+		var warnings []string
+		for _, p := range c.Properties {
+			if p.Name == "warning" {
+				warnings = append(warnings, p.Value)
+			}
+		}
+		var want []string
+		if c.Name == "should-warn" {
+			want = []string{"Advisory check failed"}
+		}
+		if diff := cmp.Diff(want, warnings); diff != "" {
+			t.Errorf("test %s: warnings: -want +got:\n%s", c.Name, diff)
+		}
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	// runTests fails if the report isn’t valid XML, which includes invalid
+	// UTF-8.
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=invalid-utf-8")
+	checkExitError(t, err)
+	if len(report.TestCases) != 1 {
+		t.Fatalf("got %d test cases, want one", len(report.TestCases))
+	}
+	c := report.TestCases[0]
+	// The invalid bytes FF FE are Base64-encoded, so they aren’t lost.
+	if want := "a[base64://4=]b"; !strings.Contains(c.SystemOut, want) {
+		t.Errorf("test %s: standard output %q doesn’t contain %q", c.Name, c.SystemOut, want)
+	}
+	// Depending on the Emacs version, the failure message contains the
+	// unibyte string either with escapes or as raw bytes.  Either way, the
+	// report must be valid.
+	if c.Failure == (shortMessage{}) {
+		t.Errorf("test %s: got no failure", c.Name)
+	}
+}
+
+func TestSkipUnlessProgram(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=skip-unless-program")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(report.TestCases) != 1 {
+		t.Fatalf("got %d test cases, want one", len(report.TestCases))
+	}
+	c := report.TestCases[0]
+	if c.Skipped == nil {
+		t.Fatalf("test %s: not skipped: %+v", c.Name, c)
+	}
+	if want := "tests-nonexistent-program"; !strings.Contains(c.Skipped.Message, want) {
+		t.Errorf("test %s: skip reason %q doesn’t contain %q", c.Name, c.Skipped.Message, want)
+	}
+	if report.Skipped != 1 {
+		t.Errorf("got %d skipped tests, want one", report.Skipped)
+	}
+}
+
+func TestSiteStart(t *testing.T) {
+	dir := t.TempDir()
+	const contents = ";;; site-start.el --- fake site initialization  -*- lexical-binding: t; -*-\n(provide 'tests/site-start)\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "site-start.el"), []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The trailing path separator keeps the default load path.
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=site-start", "EMACSLOADPATH="+dir+string(filepath.ListSeparator))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(report.TestCases) != 1 {
+		t.Fatalf("got %d test cases, want one", len(report.TestCases))
+	}
+	if c := report.TestCases[0]; c.Failure != (shortMessage{}) || c.Error != (shortMessage{}) {
+		t.Errorf("test %s: Emacs loaded site-start.el despite --quick: %+v", c.Name, c)
+	}
+}
+
+func TestEmacsMatrix(t *testing.T) {
+	dir := t.TempDir()
+	// The stubs stand in for different Emacs versions.  They ignore their
+	// arguments and write a minimal report like the test runner would with
+	// ELISP_TEST_MATRIX=1.  The newer version has a failing test.
+	var binaries []string
+	for _, stub := range []struct {
+		version string
+		exit    int
+	}{{"27.1", 0}, {"28.2", 1}} {
+		file := filepath.Join(dir, "emacs-"+stub.version)
+		contents := `#!/bin/sh
+test "$ELISP_TEST_MATRIX" = 1 || exit 2
+cat > "$XML_OUTPUT_FILE" <<'EOF'
+<?xml version="1.0" encoding="utf-8"?>
+<testsuite name="ERT (Emacs ` + stub.version + `)" tests="1" errors="0" failures="` + strconv.Itoa(stub.exit) + `" skipped="0"><testcase name="pass" classname="ERT"/></testsuite>
+EOF
+exit ` + strconv.Itoa(stub.exit) + "\n"
+		if err := ioutil.WriteFile(file, []byte(contents), 0700); err != nil {
+			t.Fatal(err)
+		}
+		binaries = append(binaries, file)
+	}
+	// Two more stubs crash.  The first one has already written a report whose
+	// attributes are in a different order, the second one hasn’t written any
+	// report.
+	crashed := filepath.Join(dir, "emacs-crashed")
+	if err := ioutil.WriteFile(crashed, []byte(`#!/bin/sh
+cat > "$XML_OUTPUT_FILE" <<'EOF'
+<testsuite errors='2' skipped="0" failures="0" tests="1"
+           name="matrix (Emacs 29.1)"><testcase name="pass" classname="ERT"/></testsuite>
+EOF
+kill -KILL $$
+`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "emacs-missing")
+	if err := ioutil.WriteFile(missing, []byte("#!/bin/sh\nkill -KILL $$\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	binaries = append(binaries, crashed, missing)
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := testCommand(t, "ELISP_TEST_EMACS_MATRIX="+strings.Join(binaries, ":"), "XML_OUTPUT_FILE="+reportName, "ELISP_TEST_SUITE_NAME=matrix")
+	out, err := cmd.CombinedOutput()
+	t.Logf("%s", out)
+	checkExitError(t, err)
+	if err == nil {
+		t.Error("test binary succeeded, want failure from the second run")
+	}
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		XMLName xml.Name `xml:"testsuites"`
+		Suites  []struct {
+			Name     string `xml:"name,attr"`
+			Errors   int    `xml:"errors,attr"`
+			Failures int    `xml:"failures,attr"`
+			Error    []struct {
+				Type string `xml:"type,attr"`
+			} `xml:"error"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatalf("can’t unmarshal combined report: %s\n%s", err, b)
+	}
+	var got []string
+	for _, s := range report.Suites {
+		line := s.Name + " errors=" + strconv.Itoa(s.Errors) + " failures=" + strconv.Itoa(s.Failures)
+		for _, e := range s.Error {
+			line += " " + e.Type
+		}
+		got = append(got, line)
+	}
+	want := []string{
+		"ERT (Emacs 27.1) errors=0 failures=0",
+		"ERT (Emacs 28.2) errors=0 failures=1",
+		"matrix (Emacs 29.1) errors=3 failures=0 signal",
+		"matrix (" + missing + ") errors=1 failures=0 signal",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("test suites: -want +got:\n%s", diff)
+	}
+}
+
+func TestReportHook(t *testing.T) {
+	for _, tc := range []struct {
+		name, contents string
+		wantErr        bool
+	}{
+		{
+			name: "property",
+			contents: `;;; hook.el --- report hook  -*- lexical-binding: t; -*-
+(add-hook 'elisp/ert/report-functions
+          (lambda (report)
+            (let ((properties (assq 'properties (cddr report))))
+              (setcdr (cdr properties)
+                      (cons '(property ((name . "commit") (value . "abc123")))
+                            (cddr properties))))
+            report))
+`,
+		},
+		{
+			name:     "error",
+			contents: ";;; hook.el --- report hook  -*- lexical-binding: t; -*-\n(error \"Broken hook\")\n",
+			wantErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hook := filepath.Join(t.TempDir(), "hook.el")
+			if err := ioutil.WriteFile(hook, []byte(tc.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=pass", "ELISP_TEST_REPORT_HOOK="+hook)
+			if tc.wantErr {
+				checkExitError(t, err)
+				if err == nil {
+					t.Error("test binary succeeded despite the broken report hook")
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+			// The results of the tests should survive a broken hook.
+			var want []string
+			if tc.wantErr {
+				want = []string{"pass", "report-hook"}
+			} else {
+				want = []string{"pass"}
+				if got := report.property("commit"); got != "abc123" {
+					t.Errorf("got commit property %q, want abc123", got)
+				}
+			}
+			if diff := cmp.Diff(want, report.names()); diff != "" {
+				t.Error("test cases (-want +got):\n", diff)
+			}
+		})
+	}
+}
+
+func TestPrintLimits(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=print-limits", "ELISP_TEST_PRINT_LEVEL=6", "ELISP_TEST_PRINT_LENGTH=10")
+	checkExitError(t, err)
+	if len(report.TestCases) != 1 {
+		t.Fatalf("got %d test cases, want one", len(report.TestCases))
+	}
+	description := report.TestCases[0].Failure.Description
+	const marker = "Test print-limits condition:"
+	i := strings.Index(description, marker)
+	if i < 0 {
+		t.Fatalf("failure description doesn’t contain %q:\n%s", marker, description)
+	}
+	// The values are nested three levels deep within the condition, so only
+	// three levels of the nested list and ten elements of the long list
+	// remain.
+	condition := description[i+len(marker):]
+	for _, want := range []string{"(c ...)", "(1 2 3 4 5 6 7 8 9 10 ...)"} {
+		if !strings.Contains(condition, want) {
+			t.Errorf("condition doesn’t contain %q:\n%s", want, condition)
+		}
+	}
+	for _, unwanted := range []string{"(d", " 11"} {
+		if strings.Contains(condition, unwanted) {
+			t.Errorf("condition contains %q despite print limits:\n%s", unwanted, condition)
+		}
+	}
+}
+
+func TestUncaughtSignal(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass uncaught-signal)"
+	report, _, err := runTests(t, filter)
+	checkExitError(t, err)
+	if report.Tests != 2 || report.Errors != 1 || report.Failures != 0 {
+		t.Errorf("got %d tests, %d errors, %d failures; want 2 tests, 1 error, 0 failures", report.Tests, report.Errors, report.Failures)
+	}
+	for _, c := range report.TestCases {
+		switch c.Name {
+		case "pass":
+			if c.Error.Type != "" || c.Failure.Type != "" {
+				t.Errorf("test %s: got unexpected result %+v", c.Name, c)
+			}
+		case "uncaught-signal":
+			if c.Error.Type != "tests/arbitrary-signal" {
+				t.Errorf("test %s: got error type %q, want tests/arbitrary-signal", c.Name, c.Error.Type)
+			}
+		default:
+			t.Errorf("unexpected test %s", c.Name)
+		}
+	}
+}
+
+func TestEmacsOverride(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	emacs := filepath.Join(dir, "emacs")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > '" + argsFile + "'\n"
+	if err := ioutil.WriteFile(emacs, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := testCommand(t, "ELISP_EMACS="+emacs)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("overriding Emacs binary wasn’t run: %s", err)
+	}
+	// The load path and test runner options should be the same as for the
+	// Emacs binary from the toolchain.
+	args := strings.Split(string(b), "\n")
+	for _, want := range []string{"--quick", "--batch", "--funcall=elisp/ert/run-batch-and-exit"} {
+		if !containsString(args, want) {
+			t.Errorf("Emacs arguments %q don’t contain %q", args, want)
+		}
+	}
+}
+
+func TestEmacsOverrideFallback(t *testing.T) {
+	report, log, err := runTests(t, "TESTBRIDGE_TEST_ONLY=pass", "ELISP_EMACS=/nonexistent/emacs")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(report.TestCases) != 1 {
+		t.Errorf("got %d test cases, want 1", len(report.TestCases))
+	}
+	if !strings.Contains(log, "using Emacs from the toolchain") {
+		t.Errorf("no warning about invalid ELISP_EMACS in log %q", log)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, elt := range list {
+		if elt == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSlowTests(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass slow-1 slow-2)"
+	for _, tc := range []struct {
+		count string
+		want  []string
+	}{
+		{"", []string{"slow-2", "slow-1"}},
+		{"1", []string{"slow-2"}},
+	} {
+		t.Run("count="+tc.count, func(t *testing.T) {
+			report, log, err := runTests(t, filter, "ELISP_TEST_SLOW_THRESHOLD=0.25", "ELISP_TEST_SLOW_COUNT="+tc.count)
+			checkExitError(t, err)
+			var value *string
+			for _, p := range report.Properties {
+				if p.Name == "slow-tests" {
+					value = &p.Value
+				}
+			}
+			if value == nil {
+				t.Fatalf("report properties %v don’t contain slow-tests", report.Properties)
+			}
+			var got []string
+			for _, field := range strings.Fields(*value) {
+				name, seconds := splitSlowTest(t, field)
+				if seconds <= 0.25 {
+					t.Errorf("test %s took %g seconds, which isn’t above the threshold", name, seconds)
+				}
+				got = append(got, name)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+			if !strings.Contains(log, "Slowest tests") {
+				t.Errorf("log %q doesn’t list the slowest tests", log)
+			}
+		})
+	}
+}
+
+func splitSlowTest(t *testing.T, field string) (string, float64) {
+	t.Helper()
+	i := strings.LastIndexByte(field, '=')
+	if i < 0 {
+		t.Fatalf("invalid slow test entry %q", field)
+	}
+	seconds, err := strconv.ParseFloat(field[i+1:], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return field[:i], seconds
+}
+
+func TestDumpFile(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var defaultDump string
+	err = filepath.Walk(workspace, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "emacs.pdmp" {
+			defaultDump = path
+			return io.EOF
+		}
+		return err
+	})
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if defaultDump == "" {
+		t.Skip("Emacs doesn’t use portable dump files")
+	}
+	dir := t.TempDir()
+	// A copy of the default dump file is compatible with the Emacs binary.
+	compatible := filepath.Join(dir, "compatible.pdmp")
+	b, err := ioutil.ReadFile(defaultDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(compatible, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	incompatible := filepath.Join(dir, "incompatible.pdmp")
+	if err := ioutil.WriteFile(incompatible, []byte(strings.Repeat("garbage\n", 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass fail skip)"
+	want, _, err := runTests(t, filter)
+	checkExitError(t, err)
+	for _, tc := range []struct {
+		file    string
+		ignored bool
+	}{
+		{compatible, false},
+		{incompatible, true},
+	} {
+		t.Run(filepath.Base(tc.file), func(t *testing.T) {
+			got, log, err := runTests(t, filter, "ELISP_DUMP_FILE="+tc.file)
+			checkExitError(t, err)
+			if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(shortReport{}, "Time", "Timestamp", "Properties"), cmpopts.IgnoreFields(shortTestCase{}, "Time")); diff != "" {
+				t.Errorf("-want +got:\n%s", diff)
+			}
+			if ignored := strings.Contains(log, "Ignoring ELISP_DUMP_FILE"); ignored != tc.ignored {
+				t.Errorf("dump file ignored: got %t, want %t", ignored, tc.ignored)
+			}
+		})
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass allocate)"
+	report, _, err := runTests(t, filter, "ELISP_TEST_MEMORY_LIMIT="+strconv.Itoa(1<<30))
+	checkExitError(t, err)
+	if report.Error != nil {
+		t.Errorf("got suite-level error %+v", report.Error)
+	}
+	for _, c := range report.TestCases {
+		switch c.Name {
+		case "pass":
+			if c.Error.Type != "" || c.Failure.Type != "" {
+				t.Errorf("test %s: got unexpected result %+v", c.Name, c)
+			}
+		case "allocate":
+			if c.Error.Type != "memory" {
+				t.Errorf("test %s: got error type %q, want memory", c.Name, c.Error.Type)
+			}
+		default:
+			t.Errorf("unexpected test %s", c.Name)
+		}
+	}
+}
+
+func TestWarningsFile(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warningsName := filepath.Join(t.TempDir(), "warnings.json")
+	if _, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=warning", "TEST_WARNINGS_OUTPUT_FILE="+warningsName); err != nil {
+		t.Error(err)
+	}
+	b, err := ioutil.ReadFile(warningsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type record struct {
+		File     string `json:"file"`
+		Line     int    `json:"line"`
+		Category string `json:"category"`
+		Message  string `json:"message"`
+	}
+	var got []record
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Errorf("invalid warning record %q: %s", line, err)
+			continue
+		}
+		got = append(got, r)
+	}
+	lines := deftestLines(t, filepath.Join(workspace, "tests/test.el"))
+	want := []record{{File: "tests/test.el", Line: lines["warning"], Category: "tests", Message: "Test warning"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("warning records (-want +got):\n", diff)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	benchmarkName := filepath.Join(t.TempDir(), "benchmark.json")
+	report, log, err := runTests(t, "TESTBRIDGE_TEST_ONLY=benchmark", "ELISP_TEST_BENCHMARK_ITERATIONS=5", "ELISP_TEST_BENCHMARK_WARMUP=2", "ELISP_TEST_BENCHMARK_FILE="+benchmarkName)
+	if err != nil {
+		t.Error(err)
+	}
+	// The test runs once as usual, then twice for warmup, then five times
+	// for measuring.
+	if !strings.Contains(log, "Benchmark run 8\n") || strings.Contains(log, "Benchmark run 9\n") {
+		t.Errorf("benchmark test didn’t run exactly eight times:\n%s", log)
+	}
+	if len(report.TestCases) != 1 {
+		t.Fatalf("got %d test cases, want one", len(report.TestCases))
+	}
+	got := make(map[string]string)
+	for _, p := range report.TestCases[0].Properties {
+		got[p.Name] = p.Value
+	}
+	if got["benchmark-iterations"] != "5" || got["benchmark-warmup"] != "2" {
+		t.Errorf("got benchmark properties %q, want five iterations after two warmup runs", got)
+	}
+	b, err := ioutil.ReadFile(benchmarkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type record struct {
+		Name       string  `json:"name"`
+		Iterations int     `json:"iterations"`
+		Warmup     int     `json:"warmup"`
+		Min        float64 `json:"min"`
+		Median     float64 `json:"median"`
+		Mean       float64 `json:"mean"`
+		Stddev     float64 `json:"stddev"`
+	}
+	var results struct {
+		Benchmarks []record `json:"benchmarks"`
+	}
+	if err := json.Unmarshal(b, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Benchmarks) != 1 {
+		t.Fatalf("got benchmark results %+v, want exactly one", results.Benchmarks)
+	}
+	r := results.Benchmarks[0]
+	if r.Name != "benchmark" || r.Iterations != 5 || r.Warmup != 2 {
+		t.Errorf("got benchmark result %+v, want five iterations of test benchmark after two warmup runs", r)
+	}
+	if r.Min < 0 || r.Median < r.Min || r.Mean < r.Min || r.Stddev < 0 {
+		t.Errorf("inconsistent benchmark statistics %+v", r)
+	}
+}
+
+func TestDoctests(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass doctest/tests/doctest-function/1 doctest/tests/doctest-function/2)"
+	report, _, err := runTests(t, filter, "ELISP_TEST_DOCTESTS=1")
+	checkExitError(t, err)
+	if diff := cmp.Diff([]string{"doctest/tests/doctest-function/1", "doctest/tests/doctest-function/2", "pass"}, report.names()); diff != "" {
+		t.Error("test cases (-want +got):\n", diff)
+	}
+	line := findLine(t, filepath.Join(workspace, "tests/test.el"), "(defun tests/doctest-function ")
+	for _, c := range report.TestCases {
+		switch c.Name {
+		case "pass", "doctest/tests/doctest-function/1":
+			if c.Error.Type != "" || c.Failure.Type != "" {
+				t.Errorf("test %s: got unexpected result %+v", c.Name, c)
+			}
+		case "doctest/tests/doctest-function/2":
+			if c.Failure.Type != "elisp/ert/doctest-mismatch" {
+				t.Errorf("test %s: got failure type %q, want elisp/ert/doctest-mismatch", c.Name, c.Failure.Type)
+			}
+			for _, want := range []string{
+				"tests/test.el:" + strconv.Itoa(line) + ": (tests/doctest-function 2)",
+				"expected: 4",
+				"actual:   3",
+			} {
+				if !strings.Contains(c.Failure.Description, want) {
+					t.Errorf("test %s: failure message %q doesn’t contain %q", c.Name, c.Failure.Description, want)
+				}
+			}
+		}
+	}
+}
+
+// findLine returns the number of the first line in the given file that
+// starts with prefix.
+func findLine(t *testing.T, file, prefix string) int {
+	t.Helper()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return i + 1
+		}
+	}
+	t.Fatalf("no line in %s starts with %q", file, prefix)
+	return 0
+}
+
+func TestHome(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=user-emacs-directory"
+	t.Run("default", func(t *testing.T) {
+		home := t.TempDir()
+		if _, _, err := runTests(t, filter, "HOME="+home); err != nil {
+			t.Error(err)
+		}
+		entries, err := ioutil.ReadDir(home)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			t.Errorf("test wrote %s into home directory", e.Name())
+		}
+	})
+	t.Run("override", func(t *testing.T) {
+		home := t.TempDir()
+		if _, _, err := runTests(t, filter, "ELISP_TEST_HOME="+home); err != nil {
+			t.Error(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(home, ".emacs.d", "test-file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "contents\n"; got != want {
+			t.Errorf("test file: got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestElnCache(t *testing.T) {
+	cache := t.TempDir()
+	source := filepath.Join(t.TempDir(), "tests-eln-cache.el")
+	const contents = ";;; tests-eln-cache.el --- test -*- lexical-binding: t; -*-\n(defun tests/eln-cache-function () 'native)\n"
+	if err := ioutil.WriteFile(source, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The second run should find the natively-compiled file that the first
+	// run has written into the cache.
+	for i, want := range []bool{false, true} {
+		report, log, err := runTests(t, "TESTBRIDGE_TEST_ONLY=eln-cache", "ELISP_ELN_CACHE="+cache, "TESTS_ELN_SOURCE="+source)
+		if err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if len(report.TestCases) == 1 && report.TestCases[0].Skipped != nil {
+			t.Skip("Emacs doesn’t support native compilation")
+		}
+		if got := strings.Contains(log, "Reusing natively-compiled file "+cache); got != want {
+			t.Errorf("run %d: reused cached file: got %t, want %t", i, got, want)
+		}
+	}
+}
+
+func TestCrash(t *testing.T) {
+	report, _, err := runTests(t, "TESTBRIDGE_TEST_ONLY=crash")
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 128+int(syscall.SIGKILL) {
+		t.Errorf("got error %v, want exit code %d", err, 128+int(syscall.SIGKILL))
+	}
+	if report.Error == nil {
+		t.Fatal("report contains no suite-level error")
+	}
+	if report.Error.Type != "signal" {
+		t.Errorf("got error type %q, want signal", report.Error.Type)
+	}
+	if want := "signal " + strconv.Itoa(int(syscall.SIGKILL)); !strings.Contains(report.Error.Message, want) {
+		t.Errorf("got error message %q, want it to contain %q", report.Error.Message, want)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=pass"
+	for _, format := range []string{"legacy", "rfc3339"} {
+		t.Run(format, func(t *testing.T) {
+			start := time.Now().Truncate(time.Second)
+			report, _, err := runTests(t, filter, "ELISP_TEST_TIMESTAMP_FORMAT="+format)
+			checkExitError(t, err)
+			var got time.Time
+			switch format {
+			case "legacy":
+				var ts timestamp
+				err = ts.UnmarshalText([]byte(report.Timestamp))
+				got = toTime(ts)
+			case "rfc3339":
+				err = got.UnmarshalText([]byte(report.Timestamp))
+			}
+			if err != nil {
+				t.Fatalf("invalid timestamp %q: %s", report.Timestamp, err)
+			}
+			if format == "rfc3339" && got.Before(start) {
+				t.Errorf("timestamp %s is before start time %s", got, start)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(member pass skip timeout)"
+	t.Run("names", func(t *testing.T) {
+		reportName := filepath.Join(t.TempDir(), "report.xml")
+		cmd := testCommand(t, filter, "XML_OUTPUT_FILE="+reportName, "ELISP_TEST_LIST=names")
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(out), "pass\nskip\ntimeout\n"); diff != "" {
+			t.Error("test list (-got +want):\n", diff)
+		}
+		if _, err := os.Stat(reportName); !os.IsNotExist(err) {
+			t.Errorf("XML report %s written despite ELISP_TEST_LIST: %v", reportName, err)
+		}
+	})
+	t.Run("json", func(t *testing.T) {
+		cmd := testCommand(t, filter, "ELISP_TEST_LIST=json")
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		type test struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		var got []test
+		if err := json.Unmarshal(out, &got); err != nil {
+			t.Fatalf("invalid JSON output %q: %s", out, err)
+		}
+		want := []test{
+			{Name: "pass", Tags: []string{}},
+			{Name: "skip", Tags: []string{}},
+			{Name: "timeout", Tags: []string{"skip"}},
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Error("test list (-got +want):\n", diff)
+		}
+	})
+	t.Run("sharded", func(t *testing.T) {
+		var got []string
+		for _, index := range []string{"0", "1"} {
+			cmd := testCommand(t, filter, "ELISP_TEST_LIST=names",
+				"TEST_TOTAL_SHARDS=2", "TEST_SHARD_INDEX="+index)
+			cmd.Stderr = os.Stderr
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, strings.Fields(string(out))...)
+		}
+		sort.Strings(got)
+		if diff := cmp.Diff(got, []string{"pass", "skip", "timeout"}); diff != "" {
+			t.Error("union of sharded test lists (-got +want):\n", diff)
+		}
+	})
+}
+
+func TestDryRunReport(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=(not (tag skip))"
+	cmd := testCommand(t, filter, "ELISP_TEST_LIST=names")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Fields(string(out))
+	if len(want) == 0 {
+		t.Fatal("no tests selected")
+	}
+	report, log, err := runTests(t, filter, "ELISP_TEST_DRY_RUN_REPORT=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := runningTest.FindString(log); m != "" {
+		t.Errorf("test binary ran a test in dry-run mode: %s", m)
+	}
+	var got []string
+	for _, c := range report.TestCases {
+		got = append(got, c.Name)
+		if c.Skipped == nil || c.Skipped.Message != "Test not run in dry-run mode" {
+			t.Errorf("test %s: got skipped %+v, want dry-run marker", c.Name, c.Skipped)
+		}
+		if c.Time != 0 || c.Failure != (shortMessage{}) || c.Error != (shortMessage{}) {
+			t.Errorf("test %s: got time %g, failure %+v, and error %+v; want zero time and no result", c.Name, c.Time, c.Failure, c.Error)
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("test cases in dry-run report (-want +got):\n", diff)
+	}
+	if report.Tests != len(want) || report.Skipped != len(want) {
+		t.Errorf("got %d tests and %d skipped, want %d of each", report.Tests, report.Skipped, len(want))
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	coverageMap := filepath.Join(dir, "coverage-map.json")
+	if err := ioutil.WriteFile(coverageMap, []byte(`{"pass": ["tests/test-lib.el"], "fail": ["tests/other.el"], "skip": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		changed string
+		want    string
+	}{
+		// “timeout” doesn’t appear in the coverage map, so it always runs.
+		{"library", "tests/test-lib.el\n", "pass\ntimeout\n"},
+		{"none", "\n", "timeout\n"},
+		// All tests are defined in test.el.
+		{"test file", "tests/unrelated.el\ntests/test.el\n", "fail\npass\nskip\ntimeout\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			changedFiles := filepath.Join(t.TempDir(), "changed.txt")
+			if err := ioutil.WriteFile(changedFiles, []byte(tc.changed), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cmd := testCommand(t, "TESTBRIDGE_TEST_ONLY=(member pass fail skip timeout)", "ELISP_TEST_LIST=names",
+				"ELISP_TEST_CHANGED_FILES="+changedFiles, "ELISP_TEST_COVERAGE_MAP="+coverageMap)
+			cmd.Stderr = os.Stderr
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, string(out)); diff != "" {
+				t.Error("selected tests (-want +got):\n", diff)
+			}
+		})
+	}
+}
+
+func TestUnwritableReport(t *testing.T) {
+	dir := t.TempDir()
+	// A regular file can’t contain other files, even for the superuser.
+	blocker := filepath.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	reportName := filepath.Join(blocker, "report.xml")
+	var stderr strings.Builder
+	cmd := testCommand(t, "TESTBRIDGE_TEST_ONLY=pass", "XML_OUTPUT_FILE="+reportName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := cmd.Run(); err == nil {
+		t.Fatal("test binary succeeded despite unwritable report file")
+	}
+	wantMessage := "Can’t write XML report to " + reportName + ":"
+	if !strings.Contains(stderr.String(), wantMessage) {
+		t.Errorf("standard error doesn’t contain %q:\n%s", wantMessage, stderr.String())
+	}
+	// The test binary should fail before running any test.
+	if m := runningTest.FindString(stderr.String()); m != "" {
+		t.Errorf("test binary ran tests despite unwritable report file: %s", m)
+	}
+
+	// Missing parent directories are fine.
+	reportName = filepath.Join(dir, "new", "dir", "report.xml")
+	cmd = testCommand(t, "TESTBRIDGE_TEST_ONLY=pass", "XML_OUTPUT_FILE="+reportName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(reportName); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReportStdout(t *testing.T) {
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := testCommand(t,
+		"TESTBRIDGE_TEST_ONLY=(member fail pass)",
+		"ELISP_TEST_REPORT_STDOUT=1",
+		"XML_OUTPUT_FILE="+reportName)
+	var stdout strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	checkExitError(t, cmd.Run())
+	// The report comes last, after any output that escaped the tests.
+	out := stdout.String()
+	i := strings.Index(out, "<testsuite")
+	if i < 0 {
+		t.Fatalf("no report in standard output:\n%s", out)
+	}
+	printed := strings.TrimSpace(out[i:])
+	var report shortReport
+	if err := xml.Unmarshal([]byte(printed), &report); err != nil {
+		t.Fatalf("can’t unmarshal report from standard output: %s\n%s", err, printed)
+	}
+	if diff := cmp.Diff([]string{"fail", "pass"}, report.names()); diff != "" {
+		t.Errorf("tests in printed report: -want +got:\n%s", diff)
+	}
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := strings.TrimSpace(string(b)); printed != file {
+		t.Errorf("printed report differs from report file:\n%s\n\nreport file:\n%s", printed, file)
+	}
+}
+
+func TestTAP(t *testing.T) {
+	reportName := filepath.Join(t.TempDir(), "report.tap")
+	cmd := testCommand(t,
+		"TESTBRIDGE_TEST_ONLY=(member fail pass skip)",
+		"ELISP_TEST_REPORT_FORMAT=tap",
+		"ELISP_TEST_REPORT_FILE="+reportName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	checkExitError(t, cmd.Run())
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(b), "\n")
+	if len(lines) < 2 || lines[0] != "TAP version 13" {
+		t.Fatalf("invalid TAP header:\n%s", b)
+	}
+	plan := regexp.MustCompile(`^1\.\.(\d+)$`).FindStringSubmatch(lines[1])
+	if plan == nil {
+		t.Fatalf("invalid TAP plan %q", lines[1])
+	}
+	var results []string
+	for _, line := range lines[2:] {
+		if strings.HasPrefix(line, "ok ") || strings.HasPrefix(line, "not ok ") {
+			results = append(results, line)
+		}
+	}
+	if plan[1] != strconv.Itoa(len(results)) {
+		t.Errorf("TAP plan %s doesn’t match %d test results", lines[1], len(results))
+	}
+	want := []string{
+		"not ok 1 - fail",
+		"ok 2 - pass",
+		"ok 3 - skip # SKIP Test skipped: ((skip-unless (= 1 2)) :form (= 1 2) :value nil)",
+	}
+	if diff := cmp.Diff(results, want); diff != "" {
+		t.Error("TAP results (-got +want):\n", diff)
+	}
+	const wantDiagnostics = `
+  ---
+  message: "Test failed: \"Fail!\""
+  type: "ert-test-failed"
+`
+	if !strings.Contains(string(b), wantDiagnostics) {
+		t.Errorf("TAP report doesn’t contain diagnostics for failed test:\n%s", b)
+	}
+}
+
+func TestJSONSummary(t *testing.T) {
+	summaryName := filepath.Join(t.TempDir(), "summary.json")
+	report, _, err := runTests(t,
+		"TESTBRIDGE_TEST_ONLY=(not (tag skip))",
+		"ELISP_TEST_SUMMARY_FILE="+summaryName)
+	checkExitError(t, err)
+	b, err := ioutil.ReadFile(summaryName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary struct {
+		Tests    int     `json:"tests"`
+		Errors   int     `json:"errors"`
+		Failures int     `json:"failures"`
+		Skipped  int     `json:"skipped"`
+		Time     float64 `json:"time"`
+		Failed   []struct {
+			Name    string  `json:"name"`
+			Type    string  `json:"type"`
+			Message string  `json:"message"`
+			Time    float64 `json:"time"`
+		} `json:"failed"`
+	}
+	if err := json.Unmarshal(b, &summary); err != nil {
+		t.Fatalf("invalid JSON summary: %s\n%s", err, b)
+	}
+	// The summary and the XML report must never disagree.
+	if summary.Failures != report.Failures {
+		t.Errorf("JSON summary has %d failures, XML report has %d", summary.Failures, report.Failures)
+	}
+	if summary.Tests != report.Tests || summary.Errors != report.Errors || summary.Skipped != report.Skipped {
+		t.Errorf("JSON summary counts (%d tests, %d errors, %d skipped) don’t match XML report (%d tests, %d errors, %d skipped)",
+			summary.Tests, summary.Errors, summary.Skipped, report.Tests, report.Errors, report.Skipped)
+	}
+	var wantFailed, gotFailed []string
+	for _, tc := range report.TestCases {
+		if tc.Failure.Type != "" || tc.Error.Type != "" {
+			wantFailed = append(wantFailed, tc.Name)
+		}
+	}
+	for _, f := range summary.Failed {
+		gotFailed = append(gotFailed, f.Name)
+		if f.Message == "" || strings.Contains(f.Message, "\n") {
+			t.Errorf("test %s: message %q should be a single non-empty line", f.Name, f.Message)
+		}
+	}
+	if diff := cmp.Diff(gotFailed, wantFailed); diff != "" {
+		t.Error("failed tests (-got +want):\n", diff)
+	}
+}
+
+func TestModuleAssertions(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(workspace, "tests/module_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, "COVERAGE=")...)
+	cmd.Dir = workspace
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("test binary succeeded unexpectedly:\n%s", out)
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatal(err)
+	}
+	// Emacs should abort with a message explaining the misbehavior.
+	const want = "Emacs module assertion: "
+	if !strings.Contains(string(out), want) {
+		t.Errorf("output doesn’t contain %q:\n%s", want, out)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := exec.Command(filepath.Join(workspace, "tests/load_error_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, "COVERAGE=", "XML_OUTPUT_FILE="+reportName)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = workspace
+	checkExitError(t, cmd.Run())
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	// The test defined before the load error should still run, and the
+	// load error should show up as an error.
+	want := []shortTestCase{
+		{Name: "load", Error: shortMessage{Message: "Error while loading test file", Type: "load-error"}},
+		{Name: "tests/load-error/defined", Assertions: 1},
+	}
+	if diff := cmp.Diff(report.TestCases, want, cmpopts.IgnoreFields(shortTestCase{}, "Time"), cmpopts.IgnoreFields(shortMessage{}, "Description")); diff != "" {
+		t.Error("test cases (-got +want):\n", diff)
+	}
+	if report.Errors != 1 {
+		t.Errorf("got %d errors, want 1", report.Errors)
+	}
+}
+
+func TestMissingDependency(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := exec.Command(filepath.Join(workspace, "tests/missing_dependency_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, "COVERAGE=", "XML_OUTPUT_FILE="+reportName)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = workspace
+	checkExitError(t, cmd.Run())
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	var load *shortTestCase
+	for i, c := range report.TestCases {
+		if c.Name == "load" {
+			load = &report.TestCases[i]
+		}
+	}
+	if load == nil {
+		t.Fatalf("report %+v doesn’t contain the load error", report)
+	}
+	if load.Error.Type != "missing-feature" {
+		t.Errorf("got error type %q, want missing-feature", load.Error.Type)
+	}
+	// The message should name the missing feature, the file that requires
+	// it, the filenames that Emacs tried, and the load path.
+	for _, want := range []string{
+		"Cannot find feature ‘tests/missing-dependency’ required by tests/missing-dependency-test.elc",
+		"tests/missing-dependency.elc",
+		"load path directories:",
+		"phst_rules_elisp",
+	} {
+		if !strings.Contains(load.Error.Message, want) {
+			t.Errorf("error message %q doesn’t contain %q", load.Error.Message, want)
+		}
+	}
+}
+
+func TestDuplicateTest(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := exec.Command(filepath.Join(workspace, "tests/duplicate/duplicate_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, "COVERAGE=", "XML_OUTPUT_FILE="+reportName)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = workspace
+	checkExitError(t, cmd.Run())
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.TestCases) != 2 {
+		t.Fatalf("got %d test cases, want 2", len(report.TestCases))
+	}
+	// The collision should show up as an error that names both files.  The
+	// second definition replaces the first one.
+	for _, c := range report.TestCases {
+		switch c.Name {
+		case "duplicate":
+			if c.Error.Type != "duplicate-test" {
+				t.Errorf("test %s: got error %+v, want one of type duplicate-test", c.Name, c.Error)
+			}
+			for _, file := range []string{"tests/duplicate/a-test", "tests/duplicate/b-test"} {
+				if !strings.Contains(c.Error.Message, file) {
+					t.Errorf("test %s: error message %q doesn’t mention %s", c.Name, c.Error.Message, file)
+				}
+			}
+		case "tests/duplicate/foo-test":
+			if c.Error != (shortMessage{}) || c.Failure != (shortMessage{}) {
+				t.Errorf("test %s: got unexpected result %+v", c.Name, c)
+			}
+		default:
+			t.Errorf("unexpected test case %s", c.Name)
+		}
+	}
+	if report.Errors != 1 {
+		t.Errorf("got %d errors, want 1", report.Errors)
+	}
+}
+
+func TestErts(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := exec.Command(filepath.Join(workspace, "tests/erts/erts_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, "COVERAGE=", "XML_OUTPUT_FILE="+reportName)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = workspace
+	checkExitError(t, cmd.Run())
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	// Each case in the erts file should result in a separate test case.
+	const prefix = "erts/tests/erts/upcase/"
+	if diff := cmp.Diff([]string{prefix + "fail", prefix + "pass"}, report.names()); diff != "" {
+		t.Fatal("test cases (-want +got):\n", diff)
+	}
+	if report.TestCases[0].Skipped != nil {
+		t.Skip("this Emacs version doesn’t support erts files")
+	}
+	if c := report.TestCases[0]; c.Failure.Type != "ert-test-failed" {
+		t.Errorf("test %s: got failure %+v, want one of type ert-test-failed", c.Name, c.Failure)
+	}
+	if c := report.TestCases[1]; c.Failure != (shortMessage{}) || c.Error != (shortMessage{}) {
+		t.Errorf("test %s: got unexpected result %+v", c.Name, c)
+	}
+}
+
+func TestRequiredEnv(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(env ...string) (string, error) {
+		reportName := filepath.Join(t.TempDir(), "report.xml")
+		cmd := exec.Command(filepath.Join(workspace, "tests/required_env_test"))
+		cmd.Env = append(os.Environ(), append(runfilesEnv, append([]string{"COVERAGE=", "XML_OUTPUT_FILE=" + reportName}, env...)...)...)
+		var stderr strings.Builder
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		cmd.Dir = workspace
+		err := cmd.Run()
+		return stderr.String(), err
+	}
+	stderr, err := run("PHST_RULES_ELISP_REQUIRED_1=")
+	if err == nil {
+		t.Fatal("test binary succeeded despite missing environment variable")
+	}
+	const wantMessage = "test requires environment variables that aren’t set: PHST_RULES_ELISP_REQUIRED_2;"
+	if !strings.Contains(stderr, wantMessage) {
+		t.Errorf("standard error doesn’t contain %q:\n%s", wantMessage, stderr)
+	}
+	// The launcher should fail before starting Emacs.
+	if m := runningTest.FindString(stderr); m != "" {
+		t.Errorf("test binary ran tests despite missing environment variable: %s", m)
+	}
+	if _, err := run("PHST_RULES_ELISP_REQUIRED_1=foo", "PHST_RULES_ELISP_REQUIRED_2=bar"); err != nil {
+		t.Errorf("test binary failed with all environment variables set: %s", err)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := exec.Command(filepath.Join(workspace, "tests/terminal_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, "COVERAGE=", "XML_OUTPUT_FILE="+reportName)...)
+	var stderr strings.Builder
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	cmd.Dir = workspace
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	want := []shortTestCase{
+		{Name: "tests/terminal/interactive", Assertions: 4},
+		{Name: "tests/terminal/message", Assertions: 1},
+	}
+	if diff := cmp.Diff(report.TestCases, want, cmpopts.IgnoreFields(shortTestCase{}, "Time")); diff != "" {
+		t.Error("test cases (-got +want):\n", diff)
+	}
+	// Emacs doesn’t run in batch mode, but the messages should still show
+	// up in the test log.
+	const wantMessage = "Message from terminal test\n"
+	if !strings.Contains(stderr.String(), wantMessage) {
+		t.Errorf("standard error doesn’t contain %q:\n%s", wantMessage, stderr.String())
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(t *testing.T, env ...string) (string, error) {
+		reportName := filepath.Join(t.TempDir(), "report.xml")
+		cmd := exec.Command(filepath.Join(workspace, "tests/keep-going/keep_going_test"))
+		cmd.Env = append(os.Environ(), append(runfilesEnv, append([]string{"COVERAGE=", "XML_OUTPUT_FILE=" + reportName}, env...)...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Dir = workspace
+		return reportName, cmd.Run()
+	}
+	t.Run("default", func(t *testing.T) {
+		// Without keep-going mode, the preload error is fatal.
+		reportName, err := run(t)
+		if err == nil {
+			t.Error("test binary succeeded unexpectedly")
+		}
+		if _, err := os.Stat(reportName); !os.IsNotExist(err) {
+			t.Errorf("test binary wrote report %s despite the fatal error", reportName)
+		}
+	})
+	t.Run("keep-going", func(t *testing.T) {
+		reportName, err := run(t, "ELISP_TEST_KEEP_GOING=1")
+		checkExitError(t, err)
+		b, err := ioutil.ReadFile(reportName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report shortReport
+		if err := xml.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		// The tests of the good library should all have run, and the preload
+		// error should show up as an error.
+		want := []shortTestCase{
+			{Name: "setup", Error: shortMessage{Type: "setup-error"}},
+			{Name: "tests/keep-going/call-function", Assertions: 1},
+			{Name: "tests/keep-going/preloaded", Assertions: 1},
+		}
+		if diff := cmp.Diff(want, report.TestCases, cmpopts.IgnoreFields(shortTestCase{}, "Time"), cmpopts.IgnoreFields(shortMessage{}, "Message", "Description")); diff != "" {
+			t.Error("test cases (-want +got):\n", diff)
+		}
+		if len(report.TestCases) > 0 {
+			if c := report.TestCases[0]; !strings.Contains(c.Error.Message, "Error while loading library") {
+				t.Errorf("error message %q doesn’t mention the preload error", c.Error.Message)
+			}
+		}
+		if report.Errors != 1 {
+			t.Errorf("got %d errors, want 1", report.Errors)
+		}
+	})
+}
+
+func TestSuiteFixtures(t *testing.T) {
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := exec.Command(filepath.Join(workspace, "tests/suite/suite_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, "COVERAGE=", "XML_OUTPUT_FILE="+reportName)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = workspace
+	checkExitError(t, cmd.Run())
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	// The tests of the file with the failing suite setup shouldn’t have run.
+	// The other file’s setup should have run only once, and its failing
+	// teardown should show up as another suite error.
+	notRun := &shortMessage{Message: "Test not run because suite setup failed"}
+	want := []shortTestCase{
+		{Name: "setup-suite", Error: shortMessage{Message: "Suite setup failed on purpose", Type: "suite-setup-error"}},
+		{Name: "teardown-suite", Error: shortMessage{Message: "Suite teardown failed on purpose", Type: "suite-teardown-error"}},
+		{Name: "tests/suite/first", Skipped: notRun},
+		{Name: "tests/suite/one", Assertions: 1},
+		{Name: "tests/suite/second", Skipped: notRun},
+		{Name: "tests/suite/two", Assertions: 1},
+	}
+	if diff := cmp.Diff(want, report.TestCases, cmpopts.IgnoreFields(shortTestCase{}, "Time", "SystemErr"), cmpopts.IgnoreFields(shortMessage{}, "Description")); diff != "" {
+		t.Error("test cases (-want +got):\n", diff)
+	}
+	if report.Errors != 2 {
+		t.Errorf("got %d errors, want 2", report.Errors)
+	}
+	if report.Skipped != 2 {
+		t.Errorf("got %d skipped tests, want 2", report.Skipped)
+	}
+}
+
+func TestCoverageExclude(t *testing.T) {
+	dir := t.TempDir()
+	runCoverageExclude(t, dir, "ELISP_TEST_COVERAGE_EXCLUDE=*-pb.el")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "emacs-lisp.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, record := range strings.Split(string(b), "\n") {
+		if f := strings.TrimPrefix(record, "SF:"); f != record {
+			files = append(files, f)
+		}
+	}
+	// Only the file that doesn’t match the pattern should show up.
+	if diff := cmp.Diff([]string{"tests/coverage-exclude/normal.el"}, files); diff != "" {
+		t.Error("files in coverage report (-want +got):\n", diff)
+	}
+}
+
+func TestCoveragePerTest(t *testing.T) {
+	dir := t.TempDir()
+	perTestName := filepath.Join(dir, "coverage-per-test.json")
+	runCoverageExclude(t, dir, "ELISP_TEST_COVERAGE_PER_TEST_FILE="+perTestName)
+	b, err := ioutil.ReadFile(perTestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string][]string
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"tests/coverage-exclude/call-functions": {"tests/coverage-exclude/generated-pb.el", "tests/coverage-exclude/normal.el"},
+		"tests/coverage-exclude/call-normal":    {"tests/coverage-exclude/normal.el"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("files touched by tests (-want +got):\n", diff)
+	}
+}
+
+// runCoverageExclude runs //tests/coverage-exclude:coverage_exclude_test with
+// coverage enabled for both of its libraries.  The test binary writes its
+// reports into the given directory.
+func runCoverageExclude(t *testing.T, dir string, env ...string) {
+	t.Helper()
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "coverage-manifest.txt")
+	if err := ioutil.WriteFile(manifest, []byte("tests/coverage-exclude/generated-pb.el\ntests/coverage-exclude/normal.el\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(workspace, "tests/coverage-exclude/coverage_exclude_test"))
+	cmd.Env = append(os.Environ(), append(runfilesEnv, append([]string{
+		"XML_OUTPUT_FILE=" + filepath.Join(dir, "report.xml"),
+		"COVERAGE=1",
+		"COVERAGE_MANIFEST=" + manifest,
+		"COVERAGE_DIR=" + dir,
+		"COVERAGE_OUTPUT_FILE=",
+	}, env...)...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = workspace
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedCoverage(t *testing.T) {
+	// Both tests exercise the same file, so the hit counts of the two
+	// shards need to add up to the hit counts of an unsharded run.
+	const filter = "TESTBRIDGE_TEST_ONLY=(member coverage coverage-again)"
+	want := runCoverage(t, filter)
+	if len(want) == 0 {
+		t.Fatal("no coverage data found")
+	}
+	got := make(map[lcovLine]int)
+	for _, index := range []string{"0", "1"} {
+		for line, hits := range runCoverage(t, filter, "TEST_TOTAL_SHARDS=2", "TEST_SHARD_INDEX="+index) {
+			got[line] += hits
+		}
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("merged line coverage (-got +want):\n", diff)
+	}
+}
+
+func TestShardedCoverageUnusedFile(t *testing.T) {
+	// The second shard doesn’t exercise the instrumented library, but
+	// still has to report it so that the library shows up as uncovered
+	// even if no shard reaches it.
+	_, report := coverageReport(t, "TESTBRIDGE_TEST_ONLY=pass", "TEST_TOTAL_SHARDS=2", "TEST_SHARD_INDEX=1")
+	if !strings.HasPrefix(report, "SF:tests/test-lib.el\n") {
+		t.Fatalf("coverage report doesn’t contain the unused file:\n%s", report)
+	}
+	for _, record := range strings.Split(report, "\n") {
+		if m := lcovData.FindStringSubmatch(record); m != nil && m[2] != "0" {
+			t.Errorf("got hit count %s for line %s, want 0", m[2], m[1])
+		}
+	}
+}
+
+func TestBranchCoverage(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=coverage"
+	testReport, report := coverageReport(t, filter)
+	if strings.Contains(report, "BRDA:") {
+		t.Errorf("got branch coverage without ELISP_TEST_BRANCH_COVERAGE:\n%s", report)
+	}
+	if strings.HasPrefix(testReport.property("emacs-version"), "26.") {
+		t.Skip("no branch coverage under Emacs 26")
+	}
+	_, report = coverageReport(t, filter, "ELISP_TEST_BRANCH_COVERAGE=1")
+	// Line 30 of test-lib.el contains an ‘if’ form with two branches.
+	branches := make(map[string]bool)
+	for _, m := range regexp.MustCompile(`(?m)^BRDA:30,(\d+,\d+),`).FindAllStringSubmatch(report, -1) {
+		branches[m[1]] = true
+	}
+	if len(branches) != 2 {
+		t.Errorf("got %d distinct branches for line 30, want 2:\n%s", len(branches), report)
+	}
+}
+
+func TestFunctionCoverage(t *testing.T) {
+	const filter = "TESTBRIDGE_TEST_ONLY=coverage"
+	_, report := coverageReport(t, filter, "ELISP_TEST_FUNCTION_COVERAGE=1")
+	// The local functions within ‘tests/test-function’ are folded into it,
+	// and the line coverage is still present.
+	for _, want := range []string{
+		"FN:27,tests/test-function\nFN:57,tests/uncalled-function\n",
+		"FNDA:0,tests/uncalled-function\n",
+		"FNF:2\nFNH:1\n",
+		"DA:40,1\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("coverage report doesn’t contain %q:\n%s", want, report)
+		}
+	}
+	if m := regexp.MustCompile(`(?m)^FNDA:(\d+),tests/test-function$`).FindStringSubmatch(report); m == nil || m[1] == "0" {
+		t.Errorf("got no positive function hit count for tests/test-function:\n%s", report)
+	}
+	if strings.Contains(report, "@cl-flet") {
+		t.Errorf("coverage report contains nested functions:\n%s", report)
+	}
+}
+
+func TestCoberturaCoverage(t *testing.T) {
+	coberturaFile := filepath.Join(t.TempDir(), "coverage.xml")
+	_, report := coverageReport(t, "TESTBRIDGE_TEST_ONLY=(member coverage coverage-again)",
+		"ELISP_TEST_COVERAGE_FORMAT=cobertura", "ELISP_TEST_COBERTURA_FILE="+coberturaFile)
+	want := make(map[lcovLine]int)
+	var file string
+	for _, record := range strings.Split(report, "\n") {
+		if f := strings.TrimPrefix(record, "SF:"); f != record {
+			file = f
+		}
+		if m := lcovData.FindStringSubmatch(record); m != nil {
+			line, err := strconv.Atoi(m[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			hits, err := strconv.Atoi(m[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[lcovLine{file, line}] += hits
+		}
+	}
+	if len(want) == 0 {
+		t.Fatal("no coverage data found")
+	}
+	b, err := ioutil.ReadFile(coberturaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cobertura struct {
+		LinesCovered int     `xml:"lines-covered,attr"`
+		LinesValid   int     `xml:"lines-valid,attr"`
+		LineRate     float64 `xml:"line-rate,attr"`
+		Packages     []struct {
+			Name    string `xml:"name,attr"`
+			Classes []struct {
+				Filename string `xml:"filename,attr"`
+				Lines    []struct {
+					Number int `xml:"number,attr"`
+					Hits   int `xml:"hits,attr"`
+				} `xml:"lines>line"`
+			} `xml:"classes>class"`
+		} `xml:"packages>package"`
+	}
+	if err := xml.Unmarshal(b, &cobertura); err != nil {
+		t.Fatalf("can’t parse Cobertura report: %s\n%s", err, b)
+	}
+	got := make(map[lcovLine]int)
+	for _, p := range cobertura.Packages {
+		for _, c := range p.Classes {
+			if dir := filepath.Dir(c.Filename); dir != p.Name {
+				t.Errorf("file %s is in package %s, want %s", c.Filename, p.Name, dir)
+			}
+			for _, l := range c.Lines {
+				got[lcovLine{c.Filename, l.Number}] += l.Hits
+			}
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("Cobertura line coverage (-want +got):\n", diff)
+	}
+	covered := 0
+	for _, hits := range want {
+		if hits > 0 {
+			covered++
+		}
+	}
+	if cobertura.LinesCovered != covered || cobertura.LinesValid != len(want) {
+		t.Errorf("got %d of %d lines covered, want %d of %d", cobertura.LinesCovered, cobertura.LinesValid, covered, len(want))
+	}
+	if rate := float64(covered) / float64(len(want)); math.Abs(cobertura.LineRate-rate) > 1e-6 {
+		t.Errorf("got line rate %g, want %g", cobertura.LineRate, rate)
+	}
+}
+
+// lcovLine identifies a source line in an LCOV coverage report.
+type lcovLine struct {
+	File string
+	Line int
+}
+
+// runCoverage runs the test binary with coverage enabled and returns the
+// line hit counts from the coverage report.
+func runCoverage(t *testing.T, env ...string) map[lcovLine]int {
+	t.Helper()
+	lines := make(map[lcovLine]int)
+	var file string
+	_, report := coverageReport(t, env...)
+	for _, record := range strings.Split(report, "\n") {
+		if f := strings.TrimPrefix(record, "SF:"); f != record {
+			file = f
+		}
+		if m := lcovData.FindStringSubmatch(record); m != nil {
+			line, err := strconv.Atoi(m[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			hits, err := strconv.Atoi(m[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[lcovLine{file, line}] += hits
+		}
+	}
+	return lines
+}
+
+var lcovData = regexp.MustCompile(`^DA:(\d+),(\d+)$`)
+
+// coverageReport runs the test binary with coverage enabled and returns the
+// XML test report and the coverage report.
+func coverageReport(t *testing.T, env ...string) (shortReport, string) {
+	t.Helper()
+	dir := t.TempDir()
+	testReport, _, err := runTests(t, append([]string{
+		"COVERAGE=1",
+		"COVERAGE_MANIFEST=" + writeCoverageManifest(t),
+		"COVERAGE_DIR=" + dir,
+		"COVERAGE_OUTPUT_FILE=",
+	}, env...)...)
+	checkExitError(t, err)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "emacs-lisp.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testReport, string(b)
+}
+
+// writeCoverageManifest writes a coverage manifest file listing the
+// instrumented test library and returns its name.
+func writeCoverageManifest(t *testing.T) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "coverage-manifest.txt")
+	if err := ioutil.WriteFile(name, []byte("tests/test-lib.el\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// shortReport is a subset of the XML report for tests that don’t need to
+// check the entire report.
+type shortReport struct {
+	Tests      int             `xml:"tests,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Warnings   int             `xml:"warnings,attr"`
+	Time       float64         `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []shortProperty `xml:"properties>property"`
+	TestCases  []shortTestCase `xml:"testcase"`
+	Error      *shortMessage   `xml:"error"`
+}
+
+type shortProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type shortTestCase struct {
+	Name       string          `xml:"name,attr"`
+	Flaky      string          `xml:"flaky,attr"`
+	Attempts   int             `xml:"attempts,attr"`
+	Time       float64         `xml:"time,attr"`
+	Assertions int             `xml:"assertions,attr"`
+	Memory     int64           `xml:"memory,attr"`
+	Skipped    *shortMessage   `xml:"skipped"`
+	Failure    shortMessage    `xml:"failure"`
+	Error      shortMessage    `xml:"error"`
+	SystemOut  string          `xml:"system-out"`
+	SystemErr  string          `xml:"system-err"`
+	Properties []shortProperty `xml:"properties>property"`
+}
+
+type shortMessage struct {
+	Message     string `xml:"message,attr"`
+	Type        string `xml:"type,attr"`
+	Description string `xml:",chardata"`
+}
+
+// property returns the value of the property with the given name, or the
+// empty string if there’s no such property.
+func (r shortReport) property(name string) string {
+	for _, p := range r.Properties {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+func (r shortReport) names() []string {
+	var names []string
+	for _, c := range r.TestCases {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// runTests runs the test binary with the given additional environment
+// variables.  It returns a subset of the XML report, the standard error output
+// of the test binary, and the error returned by exec.Cmd.Run.
+func runTests(t *testing.T, env ...string) (shortReport, string, error) {
+	t.Helper()
+	reportName := filepath.Join(t.TempDir(), "report.xml")
+	cmd := testCommand(t, append([]string{"XML_OUTPUT_FILE=" + reportName}, env...)...)
+	var log strings.Builder
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &log)
+	runErr := cmd.Run()
+	b, err := ioutil.ReadFile(reportName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shortReport
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Tests != len(report.TestCases) {
+		t.Errorf("report claims %d tests, but contains %d test cases", report.Tests, len(report.TestCases))
+	}
+	return report, log.String(), runErr
+}
+
+// testCommand returns a command that runs the test binary with the given
+// additional environment variables.  Coverage is disabled unless the
+// environment variables enable it.
+func testCommand(t *testing.T, env ...string) *exec.Cmd {
+	t.Helper()
+	workspace, err := runfiles.Path("phst_rules_elisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runfilesEnv, err := runfiles.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(workspace, "tests/test_test"), "arg 1", "arg\n2")
+	cmd.Env = append(os.Environ(), append(runfilesEnv,
+		append([]string{"COVERAGE="}, env...)...)...)
+	cmd.Dir = workspace
+	return cmd
+}
+
+// deftestLines returns the line numbers of the ert-deftest forms in the
+// given file, keyed by test name.
+func deftestLines(t *testing.T, file string) map[string]int {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	re := regexp.MustCompile(`^\(ert-deftest (\S+) `)
+	lines := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if m := re.FindStringSubmatch(scanner.Text()); m != nil {
+			lines[m[1]] = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// checkExitError checks that err signals that some tests failed.
+func checkExitError(t *testing.T, err error) {
+	t.Helper()
+	switch err := err.(type) {
+	case nil:
+	case *exec.ExitError:
+		if err.ExitCode() != 1 {
+			t.Errorf("test binary: got exit code %d, want 1", err.ExitCode())
+		}
+	default:
+		t.Error(err)
+	}
+}
+
 type timestamp time.Time
 
 func (t *timestamp) UnmarshalText(b []byte) error {
@@ -0,0 +1,87 @@
+;;; golden-test.el --- test for golden files        -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Checks that ‘elisp/ert/assert-golden’ compares against golden files, and
+;; that ‘elisp/ert/assert-approx’ compares numbers with a tolerance.
+
+;;; Code:
+
+(require 'ert)
+
+(declare-function elisp/ert/assert-golden "elisp/ert/runner"
+                  (actual filename &optional workspace))
+(declare-function elisp/ert/assert-approx "elisp/ert/runner"
+                  (expected actual &key margin fraction))
+
+(ert-deftest tests/golden/match ()
+  (elisp/ert/assert-golden "Golden\ncontents\n" "tests/golden/golden.txt")
+  (with-temp-buffer
+    (insert "Golden\ncontents\n")
+    (elisp/ert/assert-golden (current-buffer) "tests/golden/golden.txt")))
+
+(ert-deftest tests/golden/mismatch ()
+  (let ((result (ert-run-test
+                 (make-ert-test
+                  :name 'tests/golden/mismatch-inner
+                  :body (lambda ()
+                          (elisp/ert/assert-golden
+                           "Golden\nwrong\n" "tests/golden/golden.txt"))))))
+    (should (ert-test-failed-p result))
+    (should (equal (ert-test-result-with-condition-condition result)
+                   '(elisp/ert/golden-mismatch "tests/golden/golden.txt")))
+    ;; The failure message should contain the differences.
+    (let ((diff (mapconcat #'cdr (ert-test-result-with-condition-infos result)
+                           "\n")))
+      (should (string-match-p (rx bol "    -contents" eol) diff))
+      (should (string-match-p (rx bol "    +wrong" eol) diff)))))
+
+(ert-deftest tests/golden/approx ()
+  (elisp/ert/assert-approx 1 1)
+  (elisp/ert/assert-approx 1.0 1.05 :margin 0.1)
+  (elisp/ert/assert-approx 100.0 101.0 :fraction 0.02)
+  (elisp/ert/assert-approx -2.0 -2.1 :margin 0.01 :fraction 0.1)
+  (elisp/ert/assert-approx 1.0e+INF 1.0e+INF))
+
+(ert-deftest tests/golden/approx-mismatch ()
+  (pcase-dolist (`(,expected ,actual . ,tolerance)
+                 '((1.0 1.2 :margin 0.1)
+                   (100.0 103.0 :fraction 0.02)
+                   (0.0 1.0e-10)
+                   (0.0e+NaN 0.0e+NaN :margin 1.0)))
+    (ert-info ((format "expected %S, actual %S, tolerance %S"
+                       expected actual tolerance))
+      (let ((result (ert-run-test
+                     (make-ert-test
+                      :name 'tests/golden/approx-mismatch-inner
+                      :body (lambda ()
+                              (apply #'elisp/ert/assert-approx
+                                     expected actual tolerance))))))
+        (should (ert-test-failed-p result))
+        (should (eq (car (ert-test-result-with-condition-condition result))
+                    'elisp/ert/approx-mismatch))
+        ;; The failure message should show the expected and actual values
+        ;; and the tolerance.
+        (let ((message (mapconcat
+                        #'cdr (ert-test-result-with-condition-infos result)
+                        "\n")))
+          (should (string-match-p (rx "expected " (+ nonl) ", actual "
+                                      (+ nonl) ", tolerance ")
+                                  message)))))))
+
+;;; golden-test.el ends here
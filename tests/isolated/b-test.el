@@ -0,0 +1,38 @@
+;;; b-test.el --- test for isolated source files    -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Together with a-test.el, checks that the ‘isolate_srcs’ attribute of
+;; ‘elisp_test’ loads each test source file into a separate Emacs process.
+
+;;; Code:
+
+(require 'ert)
+
+(defvar tests/isolated/source "b"
+  "Name of the test source file that defined this variable.")
+
+(defun tests/isolated/b-function ()
+  "Function that only b-test.el defines.")
+
+(ert-deftest tests/isolated/b ()
+  (should (equal tests/isolated/source "b"))
+  (should (fboundp 'tests/isolated/b-function))
+  (should-not (fboundp 'tests/isolated/a-function)))
+
+;;; b-test.el ends here
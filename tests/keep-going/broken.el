@@ -0,0 +1,29 @@
+;;; broken.el --- library that fails to load        -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; A library that signals an error while loading.  ert_test.go checks that
+;; the test runner still runs the tests in good-test.el if
+;; ELISP_TEST_KEEP_GOING is set.
+
+;;; Code:
+
+(error "Error while loading library")
+
+(provide 'tests/keep-going/broken)
+;;; broken.el ends here
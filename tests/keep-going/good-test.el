@@ -0,0 +1,35 @@
+;;; good-test.el --- tests for good.el              -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Checks that the test binary preloads good.el even though preloading
+;; broken.el fails.
+
+;;; Code:
+
+(require 'ert)
+
+(declare-function tests/keep-going/function "tests/keep-going/good" ())
+
+(ert-deftest tests/keep-going/preloaded ()
+  (should (featurep 'tests/keep-going/good)))
+
+(ert-deftest tests/keep-going/call-function ()
+  (should (eq (tests/keep-going/function) 'good)))
+
+;;; good-test.el ends here
@@ -0,0 +1,30 @@
+;;; good.el --- library that loads fine             -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; A library that good-test.el uses.  The test binary preloads it after
+;; broken.el.
+
+;;; Code:
+
+(defun tests/keep-going/function ()
+  "Return a fixed value."
+  'good)
+
+(provide 'tests/keep-going/good)
+;;; good.el ends here
@@ -0,0 +1,36 @@
+;;; load-error-test.el --- test file with load error-*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; A test file that signals an error while loading.  ert_test.go checks that
+;; the test runner reports the error instead of silently dropping the tests
+;; after it.
+
+;;; Code:
+
+(require 'ert)
+
+(ert-deftest tests/load-error/defined ()
+  (should t))
+
+(error "Error while loading test file")
+
+(ert-deftest tests/load-error/undefined ()
+  (should t))
+
+;;; load-error-test.el ends here
@@ -0,0 +1,33 @@
+;;; dependent-test.el --- test for load order       -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+;;; Commentary:
+
+;; Checks that the test binary loads library-test.el only once, even though
+;; it comes after this file in the list of test source files.
+
+;;; Code:
+
+(require 'ert)
+(require 'tests/load-order/library-test)
+
+(push "dependent-test" tests/load-order/loads)
+
+(ert-deftest tests/load-order/dependent ()
+  ;; The library has to be loaded once, before this file.
+  (should (equal tests/load-order/loads '("dependent-test" "library-test"))))
+
+;;; dependent-test.el ends here
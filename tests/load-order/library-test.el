@@ -0,0 +1,39 @@
+;;; library-test.el --- library for load order test -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+;;; Commentary:
+
+;; Together with dependent-test.el, checks that the test binary loads test
+;; source files only once, even if one of them requires another one.
+
+;;; Code:
+
+(require 'cl-lib)
+(require 'ert)
+
+(defvar tests/load-order/loads ()
+  "List of names of the loaded test source files, most recent first.")
+
+;; Every load of this file adds an entry.
+(push "library-test" tests/load-order/loads)
+
+(ert-deftest tests/load-order/library ()
+  (should (equal (cl-count "library-test" tests/load-order/loads
+                           :test #'equal)
+                 1)))
+
+(provide 'tests/load-order/library-test)
+;;; library-test.el ends here
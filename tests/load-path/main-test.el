@@ -0,0 +1,31 @@
+;;; main-test.el --- repository-local requires      -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; The copy of ‘load-path-common’ in @load_path_other comes first in the load
+;; path, but this file should still load the copy from its own repository.
+
+;;; Code:
+
+(require 'ert)
+(require 'load-path-common)
+
+(ert-deftest tests/load-path/main ()
+  (should (equal load-path-common-repository "phst_rules_elisp")))
+
+;;; main-test.el ends here
@@ -0,0 +1,32 @@
+;;; other-test.el --- repository-local requires     -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; The copy of ‘load-path-common’ in this repository comes first in the load
+;; path, but ‘load-path-user’ should still load the copy from
+;; @load_path_other.
+
+;;; Code:
+
+(require 'ert)
+(require 'load-path-user)
+
+(ert-deftest tests/load-path/other ()
+  (should (equal load-path-user-repository "load_path_other")))
+
+;;; other-test.el ends here
@@ -0,0 +1,30 @@
+;;; load-path-common.el --- other copy              -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Provides the same feature as the library of the same name in the main
+;; repository.
+
+;;; Code:
+
+(defconst load-path-common-repository "load_path_other"
+  "Repository that contains this copy of the library.")
+
+(provide 'load-path-common)
+
+;;; load-path-common.el ends here
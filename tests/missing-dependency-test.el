@@ -0,0 +1,34 @@
+;;; missing-dependency-test.el --- missing feature -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; A test file that requires a feature that doesn’t exist.  ert_test.go
+;; checks that the test runner explains which feature is missing.
+
+;;; Code:
+
+(require 'ert)
+
+(ert-deftest tests/missing-dependency/defined ()
+  (should t))
+
+;; Compute the feature name at runtime so that the byte compiler doesn’t
+;; try to load the feature.
+(require (intern "tests/missing-dependency"))
+
+;;; missing-dependency-test.el ends here
@@ -0,0 +1,32 @@
+;;; module-test.el --- misbehaving module test  -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; A test that calls a misbehaving dynamic module.  //tests:go_default_test
+;; runs this test to check that module assertions catch the misbehavior.
+
+;;; Code:
+
+(require 'tests/bad-module)
+
+(require 'ert)
+
+(ert-deftest bad-module ()
+  (tests/bad-module-misbehave))
+
+;;; module-test.el ends here
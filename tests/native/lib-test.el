@@ -0,0 +1,46 @@
+;;; lib-test.el --- test for native compilation     -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Tests that natively-compiled libraries are loaded if the toolchain supports
+;; native compilation.
+
+;;; Code:
+
+(require 'tests/native/lib)
+
+(require 'cl-lib)
+(require 'ert)
+
+(defvar native-comp-eln-load-path)
+
+(declare-function subr-native-elisp-p "data.c" (object))
+
+(ert-deftest tests/native/function ()
+  (should (eql (tests/native/function 1) 2))
+  ;; The launcher adds the directory with the natively-compiled files only if
+  ;; the toolchain supports native compilation.
+  (skip-unless (and (boundp 'native-comp-eln-load-path)
+                    (cl-some (lambda (dir)
+                               (equal (file-name-nondirectory
+                                       (directory-file-name dir))
+                                      "lib.eln.d"))
+                             native-comp-eln-load-path)))
+  (should (subr-native-elisp-p (symbol-function 'tests/native/function))))
+
+;;; lib-test.el ends here
@@ -0,0 +1,29 @@
+;;; lib.el --- natively-compiled library       -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; A library that gets compiled to native code if the toolchain supports it.
+
+;;; Code:
+
+(defun tests/native/function (arg)
+  "Return ARG plus one."
+  (1+ arg))
+
+(provide 'tests/native/lib)
+;;; lib.el ends here
@@ -0,0 +1,41 @@
+;;; precompiled-test.el --- compiled-only libraries -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Tests that libraries consisting only of byte-compiled files load and run.
+
+;;; Code:
+
+(require 'ert)
+(require 'tests/precompiled/precompiled)
+(require 'tests/precompiled/user)
+
+(ert-deftest tests/precompiled/require ()
+  (should (featurep 'tests/precompiled/precompiled))
+  (let ((file (locate-library "tests/precompiled/precompiled")))
+    (should (string-suffix-p ".elc" file))
+    ;; There’s no source file that could be newer than the compiled file.
+    (should-not (file-exists-p (concat (file-name-sans-extension file)
+                                       ".el")))))
+
+(ert-deftest tests/precompiled/call ()
+  (should (equal (tests/precompiled/greeting) "Hello from a compiled file"))
+  (should (equal (tests/precompiled/user-greeting)
+                 "Hello from a compiled file")))
+
+;;; precompiled-test.el ends here
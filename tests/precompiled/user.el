@@ -0,0 +1,32 @@
+;;; user.el --- use a compiled-only library         -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Requires a library that has no source file at compile time.
+
+;;; Code:
+
+(require 'tests/precompiled/precompiled)
+
+(defun tests/precompiled/user-greeting ()
+  "Return the greeting from the compiled-only library."
+  (tests/precompiled/greeting))
+
+(provide 'tests/precompiled/user)
+
+;;; user.el ends here
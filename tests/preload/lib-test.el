@@ -0,0 +1,33 @@
+;;; lib-test.el --- test for preloaded features     -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Checks that the ‘preload’ attribute of ‘elisp_test’ requires features
+;; before loading the test source files.
+
+;;; Code:
+
+(require 'ert)
+
+(declare-function tests/preload/lib-function "tests/preload/lib" ())
+
+(ert-deftest tests/preload/lib ()
+  (should (featurep 'tests/preload/lib))
+  (should (eq (tests/preload/lib-function) 'preloaded)))
+
+;;; lib-test.el ends here
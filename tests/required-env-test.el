@@ -0,0 +1,31 @@
+;;; required-env-test.el --- required variables     -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; A test that needs environment variables.  ert_test.go checks that the
+;; test binary fails early if they are missing.
+
+;;; Code:
+
+(require 'ert)
+
+(ert-deftest tests/required-env/set ()
+  (should (getenv "PHST_RULES_ELISP_REQUIRED_1"))
+  (should (getenv "PHST_RULES_ELISP_REQUIRED_2")))
+
+;;; required-env-test.el ends here
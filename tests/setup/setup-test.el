@@ -0,0 +1,46 @@
+;;; setup-test.el --- test for setup actions        -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; Checks that the ‘pre_test_load’ and ‘pre_test_eval’ attributes of
+;; ‘elisp_test’ run before loading the test source files.
+
+;;; Code:
+
+(require 'ert)
+
+(defgroup tests/setup nil
+  "Options for setup-test.el."
+  :group 'lisp)
+
+(defcustom tests/setup/option 'default
+  "Option that the setup form customizes."
+  :type 'symbol
+  :group 'tests/setup)
+
+(defvar tests/setup/loaded)
+
+(ert-deftest tests/setup/load ()
+  (should (bound-and-true-p tests/setup/loaded)))
+
+(ert-deftest tests/setup/eval ()
+  ;; The setup form runs before the ‘defcustom’ above, so the option has
+  ;; the customized value instead of the default.
+  (should (eq tests/setup/option 'configured)))
+
+;;; setup-test.el ends here
@@ -0,0 +1,36 @@
+;;; setup-test.el --- failing suite setup           -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; The suite setup function of this file fails, so the runner should report
+;; a suite error and not run any of the tests.
+
+;;; Code:
+
+(require 'ert)
+
+(defun setup-test--setup-suite ()
+  (error "Suite setup failed on purpose"))
+
+(ert-deftest tests/suite/first ()
+  (ert-fail "Test ran despite failing suite setup"))
+
+(ert-deftest tests/suite/second ()
+  (ert-fail "Test ran despite failing suite setup"))
+
+;;; setup-test.el ends here
@@ -0,0 +1,44 @@
+;;; teardown-test.el --- suite setup and teardown   -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+
+;;; Commentary:
+
+;; The suite setup function of this file succeeds, and the runner should
+;; call it only once.  The teardown function fails, which the runner should
+;; report as a suite error.
+
+;;; Code:
+
+(require 'cl-lib)
+(require 'ert)
+
+(defvar tests/suite/setups 0
+  "Number of times that the suite setup function has run.")
+
+(defun teardown-test--setup-suite ()
+  (cl-incf tests/suite/setups))
+
+(defun teardown-test--teardown-suite ()
+  (error "Suite teardown failed on purpose"))
+
+(ert-deftest tests/suite/one ()
+  (should (eql tests/suite/setups 1)))
+
+(ert-deftest tests/suite/two ()
+  (should (eql tests/suite/setups 1)))
+
+;;; teardown-test.el ends here
@@ -0,0 +1,36 @@
+;;; terminal-test.el --- tests for terminal mode    -*- lexical-binding: t; -*-
+
+;; Copyright 2020 Google LLC
+;;
+;; Licensed under the Apache License, Version 2.0 (the "License");
+;; you may not use this file except in compliance with the License.
+;; You may obtain a copy of the License at
+;;
+;;     https://www.apache.org/licenses/LICENSE-2.0
+;;
+;; Unless required by applicable law or agreed to in writing, software
+;; distributed under the License is distributed on an "AS IS" BASIS,
+;; WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+;; See the License for the specific language governing permissions and
+;; limitations under the License.
+
+;;; Commentary:
+
+;; Tests for the terminal mode of the ‘elisp_test’ rule.  ert_test.go runs
+;; them and checks that messages still end up in the test log.
+
+;;; Code:
+
+(require 'ert)
+
+(ert-deftest tests/terminal/interactive ()
+  (should-not noninteractive)
+  (should-not (display-graphic-p))
+  (should (tty-type))
+  (should (equal (getenv "TERM") "xterm")))
+
+(ert-deftest tests/terminal/message ()
+  (message "Message from terminal test")
+  (should (equal (current-message) "Message from terminal test")))
+
+;;; terminal-test.el ends here
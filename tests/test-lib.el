@@ -54,5 +54,9 @@
   ;; Improper lists and vectors should also work.
   (message "%S %S %S" `(,arg . q) #1='(a . #1#) `[,arg q]))
 
+(defun tests/uncalled-function ()
+  "Not called by any test, for function coverage testing."
+  (message "Uncalled"))
+
 (provide 'tests/test-lib)
 ;;; test-lib.el ends here
@@ -24,11 +24,21 @@
 (require 'ert)
 (require 'tests/test-lib)
 
+(defvar elisp/ert/output-directory)
+(declare-function elisp/ert/should-warn "elisp/ert/runner"
+                  (value &optional message))
+(declare-function elisp/ert/skip-unless-program "elisp/ert/runner" (program))
+
 ;; Ensure that command-line arguments are passed on correctly.
 (cl-assert (equal-including-properties command-line-args-left
                                        '("arg 1" "arg\n2"))
            :show-args)
 
+;; Simulate a slow library so that ert_test.go can check that loading the
+;; test file doesn’t count towards the test times.
+(when (equal (getenv "TESTS_SLOW_LOAD") "1")
+  (sleep-for 2))
+
 (ert-deftest pass ()
   (should (= 0 0)))
 
@@ -58,6 +68,297 @@
   :tags '(skip-from-attribute)
   (should (= 0 1)))
 
+(ert-deftest timeout ()
+  "This test validates the per-test timeout.
+ert_test.go runs it separately with a short timeout."
+  :tags '(skip)
+  (sleep-for 60))
+
+(defvar tests/flaky-attempts 0
+  "Number of times the test ‘flaky’ has been run.")
+
+(ert-deftest flaky ()
+  "This test fails on its first attempt and passes afterwards.
+ert_test.go runs it separately with retries enabled."
+  :tags '(skip)
+  (should (> (cl-incf tests/flaky-attempts) 1)))
+
+(ert-deftest parallel-1 ()
+  "This test validates parallel test execution.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (sleep-for 3))
+
+(ert-deftest parallel-2 ()
+  "This test validates parallel test execution.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (sleep-for 3))
+
+(ert-deftest serial ()
+  "This test validates that serial tests don’t run in parallel.
+ert_test.go runs it separately."
+  :tags '(skip :serial)
+  ;; Subordinate processes always run with ELISP_TEST_JOBS=1.
+  (should-not (equal (getenv "ELISP_TEST_JOBS") "1")))
+
+(ert-deftest tagged-integration ()
+  "This test validates selection by tag.
+ert_test.go runs it separately."
+  :tags '(skip integration))
+
+(ert-deftest tagged-slow-integration ()
+  "This test validates selection by tag.
+ert_test.go runs it separately."
+  :tags '(skip integration slow))
+
+(ert-deftest graphic ()
+  "This test validates that graphical displays are unavailable.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (skip-unless (display-graphic-p))
+  (ert-fail "Test ran under a graphical display"))
+
+(ert-deftest network ()
+  "This test validates the ‘elisp/ert/network’ feature.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (skip-unless (featurep 'elisp/ert/network))
+  (should (equal (getenv "ELISP_TEST_NETWORK") "1")))
+
+(ert-deftest artifact ()
+  "This test validates the artifact directory.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should elisp/ert/output-directory)
+  (let ((directory (expand-file-name "artifact" elisp/ert/output-directory)))
+    (make-directory directory)
+    (write-region "Artifact" nil (expand-file-name "file.txt" directory)))
+  (ert-fail "Artifact written"))
+
+(defun tests/write-temp-file ()
+  "Write a file with a fixed name to ‘temporary-file-directory’.
+If the environment variable TESTS_FAIL_TEMP is 1, fail afterwards."
+  (let ((file (expand-file-name "file.txt" temporary-file-directory)))
+    (should-not (file-exists-p file))
+    (write-region "Temporary" nil file))
+  (when (equal (getenv "TESTS_FAIL_TEMP") "1")
+    (ert-fail "Temporary file written")))
+
+(ert-deftest temp-file-1 ()
+  "This test validates the per-test temporary directory.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (tests/write-temp-file))
+
+(ert-deftest temp-file-2 ()
+  "This test validates the per-test temporary directory.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (tests/write-temp-file))
+
+(ert-deftest mutate-load-path ()
+  "This test validates the detection of modified global state.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (push "/nonexistent" load-path))
+
+(ert-deftest uncaught-signal ()
+  "This test validates that signals escaping ERT don’t abort the suite.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (let ((debug-on-error nil))
+    (signal 'tests/arbitrary-signal '("Boo"))))
+
+(ert-deftest slow-1 ()
+  "This test validates the list of slow tests.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (sleep-for 0.5))
+
+(ert-deftest slow-2 ()
+  "This test validates the list of slow tests.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (sleep-for 1))
+
+(ert-deftest allocate ()
+  "This test validates the memory limit.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (make-string (* 4 1024 1024 1024) ?x))
+
+(ert-deftest warning ()
+  "This test validates that the test binary records warnings.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (display-warning 'tests "Test warning"))
+
+(ert-deftest user-emacs-directory ()
+  "This test validates that tests don’t write to the user’s home directory.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (make-directory user-emacs-directory :parents)
+  (write-region "contents\n" nil
+                (expand-file-name "test-file" user-emacs-directory)))
+
+(ert-deftest eln-cache ()
+  "This test validates that natively-compiled files end up in the
+directory given by ELISP_ELN_CACHE.  ert_test.go runs it
+separately."
+  :tags '(skip)
+  (skip-unless (and (fboundp 'native-comp-available-p)
+                    (native-comp-available-p)))
+  ;; Emacs versions without native compilation don’t define these functions.
+  (with-no-warnings
+    (let* ((source (getenv "TESTS_ELN_SOURCE"))
+           (eln (comp-el-to-eln-filename source)))
+      (should (file-in-directory-p eln (getenv "ELISP_ELN_CACHE")))
+      (if (file-exists-p eln)
+          (message "Reusing natively-compiled file %s" eln)
+        (native-compile source))
+      (should (file-exists-p eln))
+      (load eln nil :nomessage :nosuffix)
+      (should (eq (funcall (intern "tests/eln-cache-function")) 'native)))))
+
+(ert-deftest fail-on-message ()
+  "This test logs a warning despite passing.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (message "Warning: connection reset by peer")
+  (should t))
+
+(ert-deftest site-start ()
+  "This test checks that Emacs doesn’t load site-start.el.
+ert_test.go runs it separately with a fake site-start.el
+file in the load path."
+  :tags '(skip)
+  (should (locate-library "site-start"))
+  (should-not (featurep 'tests/site-start)))
+
+(ert-deftest print-limits ()
+  "This test fails with a deeply nested and a long value.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should (equal '(a (b (c (d (e (f)))))) (number-sequence 1 20))))
+
+(ert-deftest should-error-typed ()
+  "This test expects exactly the error that it signals.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should-error (car 1) :type 'wrong-type-argument))
+
+(ert-deftest should-error-broad ()
+  "This test expects a broader error than the one that it signals.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should-error (car 1) :type 'error))
+
+(ert-deftest should-warn ()
+  "This test records an advisory warning, but passes.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should (elisp/ert/should-warn t "This isn’t recorded"))
+  (should-not (elisp/ert/should-warn nil "Advisory check failed")))
+
+(ert-deftest invalid-utf-8 ()
+  "This test prints and fails with bytes that aren’t valid UTF-8.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (princ (unibyte-string ?a #xFF #xFE ?b))
+  (should (equal (unibyte-string #xC3) "x")))
+
+(ert-deftest skip-unless-program ()
+  "This test requires a program that doesn’t exist.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (elisp/ert/skip-unless-program "tests-nonexistent-program")
+  (ert-fail "Test didn’t skip"))
+
+(ert-deftest max-failures-1 ()
+  "This test always fails.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (ert-fail "First failure"))
+
+(ert-deftest max-failures-2 ()
+  "This test always fails.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (ert-fail "Second failure"))
+
+(ert-deftest max-failures-3 ()
+  "This test always fails.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (ert-fail "Third failure"))
+
+(ert-deftest memory-small ()
+  "This test allocates little memory.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should (eql (+ 1 2) 3)))
+
+(ert-deftest memory-large ()
+  "This test allocates a long list.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should (eql (length (make-list 100000 nil)) 100000)))
+
+(ert-deftest garbage-collection ()
+  "This test forces several garbage collections.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (let ((before gcs-done))
+    (dotimes (_ 3) (garbage-collect))
+    (should (>= (- gcs-done before) 3))))
+
+(defun tests/advised-function ()
+  "Return the symbol ‘original’.
+The clean-advice tests advise this function."
+  'original)
+
+(ert-deftest clean-advice-leak ()
+  "This test advises a function without removing the advice.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (advice-add #'tests/advised-function :override (lambda () 'advised))
+  (should (eq (tests/advised-function) 'advised)))
+
+(ert-deftest clean-advice-check ()
+  "This test checks that no advice has leaked into it.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (should (eq (tests/advised-function) 'original)))
+
+(defvar tests/benchmark-runs 0
+  "Number of times that the ‘benchmark’ test has run.")
+
+(ert-deftest benchmark ()
+  "This test validates benchmark mode.  ert_test.go runs it separately."
+  :tags '(skip :benchmark)
+  (message "Benchmark run %d" (cl-incf tests/benchmark-runs))
+  (should (equal (number-sequence 1 3) '(1 2 3))))
+
+(defun tests/doctest-function (number)
+  "Return NUMBER plus one.
+The test binary validates these examples only if ert_test.go
+enables doctests.  The first example passes, the second one fails:
+
+  (tests/doctest-function 1)
+    ⇒ 2
+
+  (tests/doctest-function 2)
+    ⇒ 4"
+  (1+ number))
+
+(ert-deftest crash ()
+  "This test validates that the test binary reports crashes.
+ert_test.go runs it separately."
+  :tags '(skip)
+  (signal-process (emacs-pid) 'KILL)
+  (sleep-for 60))
+
 (ert-deftest error ()
   (error "Boo"))
 
@@ -74,6 +375,13 @@
 (ert-deftest coverage ()
   (tests/test-function nil))
 
+(ert-deftest coverage-again ()
+  "This test exercises the same code as the test ‘coverage’.
+ert_test.go uses it to check that coverage reports from multiple
+shards add up."
+  :tags '(skip)
+  (tests/test-function nil))
+
 (ert-deftest command-line ()
   (should (equal-including-properties command-line-args-left
                                       '("arg 1" "arg\n2"))))
@@ -82,6 +390,10 @@
   :tags '(:nocover)
   (should (= 0 1)))
 
+(ert-deftest output ()
+  (princ "Output")
+  (message "Message"))
+
 (ert-deftest ert-fail ()
   "This test validates a workaround for an ERT bug."
   (should (integerp (ert-fail "Fail!"))))
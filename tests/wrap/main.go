@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -51,7 +52,54 @@ func main() {
 		"inputFiles":  []interface{}{"phst_rules_elisp/elisp/exec.cc", "phst_rules_elisp/elisp/exec.h"},
 		"outputFiles": []interface{}{"/tmp/output.dat"},
 	}
+	args := flag.Args()
+	handler := args[len(args)-1] == "--runfile-handler"
+	if handler {
+		want["loadPath"] = []interface{}{"phst_rules_elisp", "other_repository/lisp"}
+		want["inputFiles"] = []interface{}{}
+		want["outputFiles"] = []interface{}{}
+	}
 	if diff := cmp.Diff(got, want); diff != "" {
 		log.Fatalf("manifest: -got +want:\n%s", diff)
 	}
+	if handler {
+		checkRunfileHandler(args)
+	}
+}
+
+// checkRunfileHandler checks that the launcher has loaded the runfiles
+// library and installed the runfile handler exactly once, before adding any
+// load directory that needs the handler.
+func checkRunfileHandler(args []string) {
+	var loads, handlers, repositories []int
+	for i, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--load=") && strings.HasSuffix(arg, "/elisp/runfiles/runfiles.elc"):
+			loads = append(loads, i)
+		case arg == "--funcall=elisp/runfiles/install-handler":
+			handlers = append(handlers, i)
+		case strings.HasPrefix(arg, "--eval=(elisp/runfiles/install-repository-load-path "):
+			repositories = append(repositories, i)
+		}
+	}
+	if len(loads) != 1 || len(handlers) != 1 || len(repositories) != 1 {
+		log.Fatalf("got %d loads of runfiles.elc, %d handler installations, and %d repository load paths; want one each", len(loads), len(handlers), len(repositories))
+	}
+	if loads[0] > handlers[0] {
+		log.Fatal("runfile handler installed before loading runfiles.elc")
+	}
+	for _, dir := range []string{"phst_rules_elisp", "other_repository/lisp"} {
+		found := false
+		for i, arg := range args {
+			if arg == "--directory=/bazel-runfile:"+dir {
+				found = true
+				if i < handlers[0] {
+					log.Fatalf("load directory %s added before installing the runfile handler", dir)
+				}
+			}
+		}
+		if !found {
+			log.Fatalf("load directory %s missing from arguments %q", dir, args)
+		}
+	}
 }